@@ -2,25 +2,34 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
+	stdlog "log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
+	"sort"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
 	"github.com/prometheus/common/expfmt"
 	"github.com/spf13/cobra"
 
 	"github.com/openshift/telemeter/pkg/forwarder"
 	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/logging"
 	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/tracing"
 )
 
 func main() {
@@ -29,6 +38,20 @@ func main() {
 		LimitBytes: 200 * 1024,
 		Rules:      []string{`{__name__="up"}`},
 		Interval:   4*time.Minute + 30*time.Second,
+
+		BufferMaxAge:   23 * time.Hour,
+		BufferMaxBytes: 64 * 1024 * 1024,
+
+		MinBackoff: 30 * time.Second,
+
+		DeltaFullEvery: 10,
+
+		ScrubPlaceholder: metricfamily.DefaultScrubPlaceholder,
+
+		LogLevel:  "info",
+		LogFormat: logging.FormatLogfmt,
+
+		TracingSampleRatio: 1,
 	}
 	cmd := &cobra.Command{
 		Short: "Federate Prometheus via push",
@@ -50,20 +73,44 @@ func main() {
 	cmd.Flags().StringVar(&opt.ToAuthorize, "to-auth", opt.ToAuthorize, "A telemeter server endpoint to exchange the bearer token for an access token. Will be defaulted for standard servers.")
 	cmd.Flags().StringVar(&opt.ToToken, "to-token", opt.ToToken, "A bearer token to use when authenticating to the destination telemeter server.")
 	cmd.Flags().StringVar(&opt.ToTokenFile, "to-token-file", opt.ToTokenFile, "A file containing a bearer token to use when authenticating to the destination telemeter server.")
+	cmd.Flags().StringVar(&opt.DestinationsFile, "destinations-file", opt.DestinationsFile, "A JSON file containing a list of additional telemeter servers to send metrics to, each with its own name, to, toUpload, toAuth, toToken, toTokenFile, labels and rename fields.")
+	cmd.Flags().StringVar(&opt.BufferDir, "buffer-dir", opt.BufferDir, "A directory in which to buffer metrics that could not be sent, so they can be sent once the server is reachable again. Buffering is disabled if empty.")
+	cmd.Flags().DurationVar(&opt.BufferMaxAge, "buffer-max-age", opt.BufferMaxAge, "The maximum age of buffered metrics. Cannot be more than the 24 hours accepted by the server.")
+	cmd.Flags().Int64Var(&opt.BufferMaxBytes, "buffer-max-bytes", opt.BufferMaxBytes, "The maximum size of the buffered metrics of each destination in bytes. The oldest metrics are dropped first.")
+	cmd.Flags().DurationVar(&opt.MinBackoff, "min-backoff", opt.MinBackoff, "The delay before the first retry after a failed scrape or upload. The delay doubles with every consecutive failure, and a Retry-After header sent by the server is honoured.")
+	cmd.Flags().DurationVar(&opt.MaxBackoff, "max-backoff", opt.MaxBackoff, "The maximum delay between retries after failed scrapes or uploads. Defaults to the interval.")
+	cmd.Flags().IntVar(&opt.MaxAttempts, "max-attempts", opt.MaxAttempts, "The number of times a failed scrape or upload is retried with backoff, not counting the first try, before the client waits for the regular interval. Zero means no limit.")
+	cmd.Flags().BoolVar(&opt.DeltaUploads, "delta-uploads", opt.DeltaUploads, "Only send the series that changed since the last upload a destination accepted, along with a sequence number. If the destination did not store the last upload, all series are sent.")
+	cmd.Flags().IntVar(&opt.DeltaFullEvery, "delta-full-every", opt.DeltaFullEvery, "With --delta-uploads, the number of uploads of changed series after which all series are sent again.")
 	cmd.Flags().DurationVar(&opt.Interval, "interval", opt.Interval, "The interval between scrapes. Prometheus returns the last 5 minutes of metrics when invoking the federation endpoint.")
 
 	// TODO: more complex input definition, such as a JSON struct
 	cmd.Flags().StringArrayVar(&opt.Rules, "match", opt.Rules, "Match rules to federate.")
 	cmd.Flags().StringVar(&opt.RulesFile, "match-file", opt.RulesFile, "A file containing match rules to federate, one rule per line.")
+	cmd.Flags().StringArrayVar(&opt.QueryFlag, "query", opt.QueryFlag, "A PromQL expression to evaluate via the query API of the Prometheus server instead of federating, in NAME=EXPR form. The result is sent as the metric NAME. If given, the match rules are not used.")
+	cmd.Flags().StringVar(&opt.SourcesFile, "sources-file", opt.SourcesFile, "A JSON file containing a list of additional Prometheus servers to federate from, each with its own name, from, fromToken, fromTokenFile, fromCAFile, match, matchFile and queries fields. Each query has a record and an expr field.")
 
 	cmd.Flags().StringSliceVar(&opt.LabelFlag, "label", opt.LabelFlag, "Labels to add to each outgoing metric, in key=value form.")
+	cmd.Flags().StringArrayVar(&opt.AggregateFlag, "aggregate", opt.AggregateFlag, "Aggregate the series of a metric before sending them, in NAME=EXPR form where EXPR is a PromQL-like 'sum|count|max|min [by|without (label, ...)]' aggregation, for example 'kube_pod_info=count by (namespace)'. NAME is the name after renaming. May be repeated.")
 	cmd.Flags().StringSliceVar(&opt.RenameFlag, "rename", opt.RenameFlag, "Rename metrics before sending by specifying OLD=NEW name pairs. Defaults to renaming ALERTS to alerts. Defaults to ALERTS=alerts.")
 
 	cmd.Flags().StringSliceVar(&opt.AnonymizeLabels, "anonymize-labels", opt.AnonymizeLabels, "Anonymize the values of the provided values before sending them on.")
 	cmd.Flags().StringVar(&opt.AnonymizeSalt, "anonymize-salt", opt.AnonymizeSalt, "A secret and unguessable value used to anonymize the input data.")
 	cmd.Flags().StringVar(&opt.AnonymizeSaltFile, "anonymize-salt-file", opt.AnonymizeSaltFile, "A file containing a secret and unguessable value used to anonymize the input data.")
+	cmd.Flags().StringArrayVar(&opt.AnonymizeMetricsLabelFlag, "anonymize-metric-labels", opt.AnonymizeMetricsLabelFlag, "Anonymize the values of the provided labels of a single metric only, in metric=label1,label2 form.")
+	cmd.Flags().BoolVar(&opt.AnonymizeHMAC, "anonymize-hmac", opt.AnonymizeHMAC, "Anonymize with an HMAC keyed by the salt instead of a salted SHA-256, which also allows rotating the salt with --anonymize-previous-salt.")
+	cmd.Flags().IntVar(&opt.AnonymizeHashLength, "anonymize-hash-length", opt.AnonymizeHashLength, "The number of bytes of the HMAC kept in anonymized values, between 6 and 32.")
+	cmd.Flags().StringArrayVar(&opt.ScrubRedactFlag, "scrub-redact", opt.ScrubRedactFlag, "Replace the parts of the values of a label that match a regular expression with the placeholder before sending them on, in label=regex form. May be repeated.")
+	cmd.Flags().StringArrayVar(&opt.ScrubAllowFlag, "scrub-allow", opt.ScrubAllowFlag, "Allow a value of a label, in label=value form. Once a label has allowed values, any other value is replaced with the placeholder after redaction. Series left with the same labels as another series are dropped. May be repeated.")
+	cmd.Flags().StringVar(&opt.ScrubPlaceholder, "scrub-placeholder", opt.ScrubPlaceholder, "The value replacing redacted parts of label values and values that are not allowed.")
+	cmd.Flags().StringArrayVar(&opt.AnonymizePreviousSaltFlag, "anonymize-previous-salt", opt.AnonymizePreviousSaltFlag, "A salt that is being rotated out, in version=salt form. Values hashed with it are added as labels suffixed by _<version> to correlate them with values hashed with the current salt.")
 
 	cmd.Flags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Show verbose output.")
+	cmd.Flags().StringVar(&opt.LogLevel, "log-level", opt.LogLevel, "The minimum level of log entries to write: 'debug', 'info', 'warn' or 'error'.")
+	cmd.Flags().StringVar(&opt.LogFormat, "log-format", opt.LogFormat, "The format of log entries: 'logfmt' or 'json'.")
+	cmd.Flags().StringVar(&opt.TracingEndpoint, "tracing-endpoint", opt.TracingEndpoint, "The URL of an OpenTelemetry collector to export traces to over OTLP/HTTP, such as http://localhost:4318. The path defaults to /v1/traces. Traces are not exported if empty.")
+	cmd.Flags().Float64Var(&opt.TracingSampleRatio, "tracing-sample-ratio", opt.TracingSampleRatio, "The ratio of traces exported to the --tracing-endpoint, between 0 and 1.")
+	cmd.Flags().BoolVar(&opt.DryRun, "dry-run", opt.DryRun, "Scrape once, print which series would be sent or dropped and why, and exit without contacting the destination.")
 
 	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
@@ -74,6 +121,13 @@ type Options struct {
 	Listen     string
 	LimitBytes int64
 	Verbose    bool
+	DryRun     bool
+
+	LogLevel  string
+	LogFormat string
+
+	TracingEndpoint    string
+	TracingSampleRatio float64
 
 	From          string
 	To            string
@@ -86,24 +140,136 @@ type Options struct {
 	ToTokenFile   string
 	Identifier    string
 
+	DestinationsFile string
+
+	BufferDir      string
+	BufferMaxAge   time.Duration
+	BufferMaxBytes int64
+
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+
+	DeltaUploads   bool
+	DeltaFullEvery int
+
 	RenameFlag []string
 	Renames    map[string]string
 
-	AnonymizeLabels   []string
-	AnonymizeSalt     string
-	AnonymizeSaltFile string
+	AggregateFlag []string
+	Aggregations  map[string]metricfamily.Aggregation
+
+	AnonymizeLabels           []string
+	AnonymizeSalt             string
+	AnonymizeSaltFile         string
+	AnonymizeMetricsLabelFlag []string
+	AnonymizeMetricsLabels    map[string][]string
+	AnonymizeHMAC             bool
+	AnonymizeHashLength       int
+	AnonymizePreviousSaltFlag []string
+	AnonymizePreviousSalts    []metricfamily.Salt
+
+	ScrubRedactFlag  []string
+	ScrubAllowFlag   []string
+	ScrubPlaceholder string
+	ScrubLabels      map[string]metricfamily.ScrubRule
 
 	Rules     []string
 	RulesFile string
 
+	QueryFlag []string
+	Queries   []forwarder.Query
+
+	SourcesFile string
+
 	LabelFlag []string
 	Labels    map[string]string
 
 	Interval time.Duration
 }
 
+// SourceFile is the format of an entry in the file given by --sources-file.
+type SourceFile struct {
+	Name          string      `json:"name"`
+	From          string      `json:"from"`
+	FromToken     string      `json:"fromToken"`
+	FromTokenFile string      `json:"fromTokenFile"`
+	FromCAFile    string      `json:"fromCAFile"`
+	Rules         []string    `json:"match"`
+	RulesFile     string      `json:"matchFile"`
+	Queries       []QueryFile `json:"queries"`
+}
+
+// QueryFile is the format of a query of an entry in the file given by --sources-file.
+type QueryFile struct {
+	Record string `json:"record"`
+	Expr   string `json:"expr"`
+}
+
+// DestinationFile is the format of an entry in the file given by --destinations-file.
+type DestinationFile struct {
+	Name        string            `json:"name"`
+	To          string            `json:"to"`
+	ToUpload    string            `json:"toUpload"`
+	ToAuthorize string            `json:"toAuth"`
+	ToToken     string            `json:"toToken"`
+	ToTokenFile string            `json:"toTokenFile"`
+	Labels      map[string]string `json:"labels"`
+	Renames     map[string]string `json:"rename"`
+}
+
 func (o *Options) Run() error {
-	if len(o.From) == 0 {
+	logger, err := logging.New(os.Stderr, o.LogFormat, o.LogLevel)
+	if err != nil {
+		return err
+	}
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.NewStdlibAdapter(level.Info(logger)))
+
+	if len(o.TracingEndpoint) > 0 {
+		closer, err := tracing.Register(logger, "telemeter-client", o.TracingEndpoint, o.TracingSampleRatio)
+		if err != nil {
+			return fmt.Errorf("--tracing-endpoint: %v", err)
+		}
+		defer closer.Close()
+	}
+
+	var sources []forwarder.Source
+	if len(o.SourcesFile) > 0 {
+		data, err := ioutil.ReadFile(o.SourcesFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --sources-file: %v", err)
+		}
+		var files []SourceFile
+		if err := json.Unmarshal(data, &files); err != nil {
+			return fmt.Errorf("unable to parse --sources-file: %v", err)
+		}
+		for i, f := range files {
+			if len(f.Name) == 0 {
+				return fmt.Errorf("--sources-file entry %d must have a name", i)
+			}
+			from, err := parseFrom(f.From)
+			if err != nil {
+				return fmt.Errorf("--sources-file entry %q: from is not a valid URL: %v", f.Name, err)
+			}
+			var queries []forwarder.Query
+			for _, q := range f.Queries {
+				queries = append(queries, forwarder.Query{Record: q.Record, Expr: q.Expr})
+			}
+			sources = append(sources, forwarder.Source{
+				Name:      f.Name,
+				From:      from,
+				Token:     f.FromToken,
+				TokenFile: f.FromTokenFile,
+				CAFile:    f.FromCAFile,
+				Rules:     f.Rules,
+				RulesFile: f.RulesFile,
+				Queries:   queries,
+			})
+		}
+	}
+
+	if len(o.From) == 0 && len(sources) == 0 {
 		return fmt.Errorf("you must specify a Prometheus server to federate from (e.g. http://localhost:9090)")
 	}
 
@@ -118,6 +284,74 @@ func (o *Options) Run() error {
 		o.Labels[values[0]] = values[1]
 	}
 
+	for _, flag := range o.AnonymizeMetricsLabelFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[1]) == 0 {
+			return fmt.Errorf("--anonymize-metric-labels must be of the form metric=label1,label2: %s", flag)
+		}
+		if o.AnonymizeMetricsLabels == nil {
+			o.AnonymizeMetricsLabels = make(map[string][]string)
+		}
+		o.AnonymizeMetricsLabels[values[0]] = append(o.AnonymizeMetricsLabels[values[0]], strings.Split(values[1], ",")...)
+	}
+
+	for _, flag := range o.ScrubRedactFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[1]) == 0 {
+			return fmt.Errorf("--scrub-redact must be of the form label=regex: %s", flag)
+		}
+		if o.ScrubLabels == nil {
+			o.ScrubLabels = make(map[string]metricfamily.ScrubRule)
+		}
+		rule := o.ScrubLabels[values[0]]
+		rule.Redact = append(rule.Redact, values[1])
+		o.ScrubLabels[values[0]] = rule
+	}
+
+	for _, flag := range o.ScrubAllowFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--scrub-allow must be of the form label=value: %s", flag)
+		}
+		if o.ScrubLabels == nil {
+			o.ScrubLabels = make(map[string]metricfamily.ScrubRule)
+		}
+		rule := o.ScrubLabels[values[0]]
+		rule.Allow = append(rule.Allow, values[1])
+		o.ScrubLabels[values[0]] = rule
+	}
+
+	for _, flag := range o.AnonymizePreviousSaltFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--anonymize-previous-salt must be of the form version=salt")
+		}
+		o.AnonymizePreviousSalts = append(o.AnonymizePreviousSalts, metricfamily.Salt{Version: values[0], Secret: values[1]})
+	}
+
+	for _, flag := range o.QueryFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--query must be of the form NAME=EXPR: %s", flag)
+		}
+		o.Queries = append(o.Queries, forwarder.Query{Record: values[0], Expr: values[1]})
+	}
+
+	for _, flag := range o.AggregateFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 || len(values[0]) == 0 {
+			return fmt.Errorf("--aggregate must be of the form NAME=EXPR: %s", flag)
+		}
+		aggregation, err := metricfamily.ParseAggregation(values[1])
+		if err != nil {
+			return fmt.Errorf("--aggregate for metric %s: %v", values[0], err)
+		}
+		if o.Aggregations == nil {
+			o.Aggregations = make(map[string]metricfamily.Aggregation)
+		}
+		o.Aggregations[values[0]] = aggregation
+	}
+
 	if len(o.RenameFlag) == 0 {
 		o.RenameFlag = []string{"ALERTS=alerts"}
 	}
@@ -135,54 +369,65 @@ func (o *Options) Run() error {
 		o.Renames[values[0]] = values[1]
 	}
 
-	from, err := url.Parse(o.From)
-	if err != nil {
-		return fmt.Errorf("--from is not a valid URL: %v", err)
-	}
-	from.Path = strings.TrimRight(from.Path, "/")
-	if len(from.Path) == 0 {
-		from.Path = "/federate"
-	}
-
-	var to, toUpload, toAuthorize *url.URL
-	if len(o.ToUpload) > 0 {
-		to, err = url.Parse(o.ToUpload)
+	var from *url.URL
+	if len(o.From) > 0 {
+		u, err := parseFrom(o.From)
 		if err != nil {
-			return fmt.Errorf("--to-upload is not a valid URL: %v", err)
+			return fmt.Errorf("--from is not a valid URL: %v", err)
 		}
+		from = u
 	}
-	if len(o.ToAuthorize) > 0 {
-		toAuthorize, err = url.Parse(o.ToAuthorize)
-		if err != nil {
-			return fmt.Errorf("--to-auth is not a valid URL: %v", err)
-		}
+
+	toUpload, toAuthorize, err := destinationURLs(o.To, o.ToUpload, o.ToAuthorize, o.Identifier)
+	if err != nil {
+		return err
 	}
-	if len(o.To) > 0 {
-		to, err = url.Parse(o.To)
+
+	var destinations []forwarder.Destination
+	if len(o.DestinationsFile) > 0 {
+		data, err := ioutil.ReadFile(o.DestinationsFile)
 		if err != nil {
-			return fmt.Errorf("--to is not a valid URL: %v", err)
+			return fmt.Errorf("unable to read --destinations-file: %v", err)
 		}
-		if len(to.Path) == 0 {
-			to.Path = "/"
+		var files []DestinationFile
+		if err := json.Unmarshal(data, &files); err != nil {
+			return fmt.Errorf("unable to parse --destinations-file: %v", err)
 		}
-		if toAuthorize == nil {
-			u := *to
-			u.Path = path.Join(to.Path, "authorize")
-			if len(o.Identifier) > 0 {
-				q := to.Query()
-				q.Add("id", o.Identifier)
-				u.RawQuery = q.Encode()
+		for i, f := range files {
+			if len(f.Name) == 0 {
+				return fmt.Errorf("--destinations-file entry %d must have a name", i)
 			}
-			toAuthorize = &u
-		}
-		if toUpload == nil {
-			u := *to
-			u.Path = path.Join(to.Path, "upload")
-			toUpload = &u
+			upload, authorize, err := destinationURLs(f.To, f.ToUpload, f.ToAuthorize, o.Identifier)
+			if err != nil {
+				return fmt.Errorf("--destinations-file entry %q: %v", f.Name, err)
+			}
+			if upload == nil {
+				return fmt.Errorf("--destinations-file entry %q: either to or toUpload must be specified", f.Name)
+			}
+			var t metricfamily.MultiTransformer
+			if len(f.Labels) > 0 {
+				labels := f.Labels
+				t.WithFunc(func() metricfamily.Transformer {
+					return metricfamily.NewLabel(labels, nil)
+				})
+			}
+			if len(f.Renames) > 0 {
+				t.With(metricfamily.RenameMetrics{Names: f.Renames})
+			}
+			destinations = append(destinations, forwarder.Destination{
+				Name:        f.Name,
+				ToAuthorize: authorize,
+				ToUpload:    upload,
+				ToToken:     f.ToToken,
+				ToTokenFile: f.ToTokenFile,
+				Transformer: t,
+			})
 		}
 	}
 
-	if toUpload == nil || toAuthorize == nil {
+	// The primary destination may only be omitted if additional destinations are given.
+	primary := toUpload != nil || toAuthorize != nil || len(destinations) == 0
+	if primary && (toUpload == nil || toAuthorize == nil) && !o.DryRun {
 		return fmt.Errorf("either --to or --to-auth and --to-upload must be specified")
 	}
 
@@ -204,10 +449,19 @@ func (o *Options) Run() error {
 		return metricfamily.NewDropInvalidFederateSamples(time.Now().Add(-24 * time.Hour))
 	})
 
+	if len(o.Aggregations) > 0 {
+		aggregate, err := metricfamily.NewAggregate(logger, o.Aggregations)
+		if err != nil {
+			return err
+		}
+		transformer.With(aggregate)
+	}
+
 	transformer.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
 	transformer.With(metricfamily.TransformerFunc(metricfamily.SortMetrics))
 
 	cfg := forwarder.Config{
+		Logger:        logger,
 		From:          from,
 		ToAuthorize:   toAuthorize,
 		ToUpload:      toUpload,
@@ -217,15 +471,35 @@ func (o *Options) Run() error {
 		ToTokenFile:   o.ToTokenFile,
 		FromCAFile:    o.FromCAFile,
 
-		AnonymizeLabels:   o.AnonymizeLabels,
-		AnonymizeSalt:     o.AnonymizeSalt,
-		AnonymizeSaltFile: o.AnonymizeSaltFile,
-		Debug:             o.Verbose,
-		Interval:          o.Interval,
-		LimitBytes:        o.LimitBytes,
-		Rules:             o.Rules,
-		RulesFile:         o.RulesFile,
-		Transformer:       transformer,
+		AnonymizeLabels:        o.AnonymizeLabels,
+		AnonymizeSalt:          o.AnonymizeSalt,
+		AnonymizeSaltFile:      o.AnonymizeSaltFile,
+		AnonymizeMetricsLabels: o.AnonymizeMetricsLabels,
+		AnonymizeHMAC:          o.AnonymizeHMAC,
+		AnonymizeHashLength:    o.AnonymizeHashLength,
+		AnonymizePreviousSalts: o.AnonymizePreviousSalts,
+		ScrubLabels:            o.ScrubLabels,
+		ScrubPlaceholder:       o.ScrubPlaceholder,
+		Debug:                  o.Verbose,
+		Interval:               o.Interval,
+		LimitBytes:             o.LimitBytes,
+		Rules:                  o.Rules,
+		RulesFile:              o.RulesFile,
+		Queries:                o.Queries,
+		Sources:                sources,
+		Destinations:           destinations,
+		Transformer:            transformer,
+
+		BufferDir:      o.BufferDir,
+		BufferMaxAge:   o.BufferMaxAge,
+		BufferMaxBytes: o.BufferMaxBytes,
+
+		MinBackoff:  o.MinBackoff,
+		MaxBackoff:  o.MaxBackoff,
+		MaxAttempts: o.MaxAttempts,
+
+		DeltaUploads:   o.DeltaUploads,
+		DeltaFullEvery: o.DeltaFullEvery,
 	}
 
 	worker, err := forwarder.New(cfg)
@@ -233,7 +507,15 @@ func (o *Options) Run() error {
 		return fmt.Errorf("failed to configure Telemeter client: %v", err)
 	}
 
-	log.Printf("Starting telemeter-client reading from %s and sending to %s (listen=%s)", o.From, o.To, o.Listen)
+	if o.DryRun {
+		e, size, err := worker.DryRun(context.Background())
+		if err != nil {
+			return fmt.Errorf("dry run failed: %v", err)
+		}
+		return printExplanation(os.Stdout, e, size)
+	}
+
+	level.Info(logger).Log("msg", "starting telemeter-client", "from", o.From, "to", o.To, "listen", o.Listen)
 
 	var g run.Group
 	{
@@ -257,7 +539,7 @@ func (o *Options) Run() error {
 				select {
 				case <-hup:
 					if err := worker.Reconfigure(cfg); err != nil {
-						log.Printf("error: failed to reload config: %v", err)
+						level.Error(logger).Log("msg", "failed to reload config", "err", err)
 						return err
 					}
 				case <-cancel:
@@ -277,7 +559,7 @@ func (o *Options) Run() error {
 		telemeterhttp.ReloadRoutes(handlers, func() error {
 			return worker.Reconfigure(cfg)
 		})
-		handlers.Handle("/federate", serveLastMetrics(worker))
+		handlers.Handle("/federate", serveLastMetrics(logger, worker))
 		l, err := net.Listen("tcp", o.Listen)
 		if err != nil {
 			return fmt.Errorf("failed to listen: %v", err)
@@ -286,8 +568,8 @@ func (o *Options) Run() error {
 		{
 			// Run the HTTP server.
 			g.Add(func() error {
-				if err := http.Serve(l, handlers); err != nil && err != http.ErrServerClosed {
-					log.Printf("error: server exited unexpectedly: %v", err)
+				if err := http.Serve(l, logging.RequestHandler(handlers)); err != nil && err != http.ErrServerClosed {
+					level.Error(logger).Log("msg", "server exited unexpectedly", "err", err)
 					return err
 				}
 				return nil
@@ -300,8 +582,106 @@ func (o *Options) Run() error {
 	return g.Run()
 }
 
+// destinationURLs returns the upload and authorize endpoints of a telemeter server.
+// Endpoints that are not given explicitly are defaulted from the base URL to.
+func destinationURLs(to, toUpload, toAuthorize, id string) (*url.URL, *url.URL, error) {
+	var upload, authorize *url.URL
+	if len(toUpload) > 0 {
+		u, err := url.Parse(toUpload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--to-upload is not a valid URL: %v", err)
+		}
+		upload = u
+	}
+	if len(toAuthorize) > 0 {
+		u, err := url.Parse(toAuthorize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--to-auth is not a valid URL: %v", err)
+		}
+		authorize = u
+	}
+	if len(to) > 0 {
+		base, err := url.Parse(to)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--to is not a valid URL: %v", err)
+		}
+		if len(base.Path) == 0 {
+			base.Path = "/"
+		}
+		if authorize == nil {
+			u := *base
+			u.Path = path.Join(base.Path, "authorize")
+			if len(id) > 0 {
+				q := base.Query()
+				q.Add("id", id)
+				u.RawQuery = q.Encode()
+			}
+			authorize = &u
+		}
+		if upload == nil {
+			u := *base
+			u.Path = path.Join(base.Path, "upload")
+			upload = &u
+		}
+	}
+	return upload, authorize, nil
+}
+
+// printExplanation writes a table describing what happens to each scraped family.
+func printExplanation(out io.Writer, e *metricfamily.Explanation, size int) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FAMILY\tSERIES\tKEPT\tDROPPED\tRENAMED\tANONYMIZED\tSCRUBBED\tLABELLED")
+	var series, kept, families int
+	for _, f := range e.Families {
+		series += f.Series
+		kept += f.Kept
+		if f.Kept > 0 {
+			families++
+		}
+		var dropped []string
+		for reason, n := range f.Dropped {
+			if n > 0 {
+				dropped = append(dropped, fmt.Sprintf("%s=%d", reason, n))
+			}
+		}
+		sort.Strings(dropped)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			f.Name, f.Series, f.Kept,
+			orNone(strings.Join(dropped, ",")), orNone(f.Renamed),
+			orNone(strings.Join(f.Anonymized, ",")), orNone(strings.Join(f.Scrubbed, ",")),
+			orNone(strings.Join(f.Labelled, ",")),
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\n%d of %d series would be sent in %d families, payload size %d bytes (snappy compressed)\n", kept, series, families, size)
+	return err
+}
+
+func orNone(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// parseFrom parses the URL of a Prometheus server to federate from,
+// defaulting the path to /federate.
+func parseFrom(s string) (*url.URL, error) {
+	from, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	from.Path = strings.TrimRight(from.Path, "/")
+	if len(from.Path) == 0 {
+		from.Path = "/federate"
+	}
+	return from, nil
+}
+
 // serveLastMetrics retrieves the last set of metrics served
-func serveLastMetrics(worker *forwarder.Worker) http.Handler {
+func serveLastMetrics(logger log.Logger, worker *forwarder.Worker) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "GET" {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -315,7 +695,7 @@ func serveLastMetrics(worker *forwarder.Worker) http.Handler {
 				continue
 			}
 			if err := encoder.Encode(family); err != nil {
-				log.Printf("error: unable to write metrics for family: %v", err)
+				level.Error(logging.FromContext(req.Context(), logger)).Log("msg", "unable to write metrics for family", "err", err)
 				break
 			}
 		}
@@ -12,8 +12,9 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	stdlog "log"
 	mathrand "math/rand"
 	"net"
 	"net/http"
@@ -24,10 +25,14 @@ import (
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"golang.org/x/oauth2"
 
+	"github.com/openshift/telemeter/pkg/audit"
 	"github.com/openshift/telemeter/pkg/authorize"
 	"github.com/openshift/telemeter/pkg/authorize/jwt"
 	"github.com/openshift/telemeter/pkg/authorize/stub"
@@ -35,11 +40,17 @@ import (
 	"github.com/openshift/telemeter/pkg/cluster"
 	telemeter_http "github.com/openshift/telemeter/pkg/http"
 	httpserver "github.com/openshift/telemeter/pkg/http/server"
+	"github.com/openshift/telemeter/pkg/ingest"
+	"github.com/openshift/telemeter/pkg/logging"
+	"github.com/openshift/telemeter/pkg/metadata"
 	"github.com/openshift/telemeter/pkg/metricfamily"
 	telemeter_oauth2 "github.com/openshift/telemeter/pkg/oauth2"
 	"github.com/openshift/telemeter/pkg/store"
 	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/quota"
 	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/store/staleness"
+	"github.com/openshift/telemeter/pkg/tracing"
 	"github.com/openshift/telemeter/pkg/validate"
 )
 
@@ -80,6 +91,16 @@ func main() {
 		PartitionKey:       "_id",
 		Ratelimit:          4*time.Minute + 30*time.Second,
 		TTL:                10 * time.Minute,
+		EvictionPolicy:     string(memstore.EvictNone),
+		MetadataMismatch:   string(metadata.Coerce),
+		QuotaWindow:        24 * time.Hour,
+		AuditLogSample:     1,
+		AuditLogMaxBytes:   100 * 1024 * 1024,
+		AuditLogMaxFiles:   5,
+		IngestStatsTTL:     24 * time.Hour,
+		LogLevel:           "info",
+		LogFormat:          logging.FormatLogfmt,
+		TracingSampleRatio: 1,
 	}
 	cmd := &cobra.Command{
 		Short:        "Aggregate federated metrics pushes",
@@ -118,13 +139,40 @@ func main() {
 
 	cmd.Flags().DurationVar(&opt.Ratelimit, "ratelimit", opt.Ratelimit, "The rate limit of metric uploads per cluster ID. Uploads happening more often than this limit will be rejected.")
 	cmd.Flags().DurationVar(&opt.TTL, "ttl", opt.TTL, "The TTL for metrics to be held in memory.")
+	cmd.Flags().Int64Var(&opt.StoreLimits.Partitions, "max-partitions", opt.StoreLimits.Partitions, "The maximum number of cluster IDs to hold in memory. Zero means no limit.")
+	cmd.Flags().Int64Var(&opt.StoreLimits.Series, "max-series", opt.StoreLimits.Series, "The maximum number of series to hold in memory. Zero means no limit.")
+	cmd.Flags().Int64Var(&opt.StoreLimits.Bytes, "max-bytes", opt.StoreLimits.Bytes, "The maximum size of the metrics held in memory in bytes. Zero means no limit.")
+	cmd.Flags().StringVar(&opt.EvictionPolicy, "eviction-policy", opt.EvictionPolicy, "What to do when an upload exceeds --max-partitions, --max-series or --max-bytes: 'none' rejects the upload, 'oldest' evicts the cluster IDs with the oldest metrics and 'lru' evicts the least recently uploaded cluster IDs.")
+
+	cmd.Flags().DurationVar(&opt.QuotaWindow, "quota-window", opt.QuotaWindow, "The sliding window over which upload quotas are enforced.")
+	cmd.Flags().Int64Var(&opt.QuotaAccount.Samples, "quota-account-samples", opt.QuotaAccount.Samples, "The maximum number of samples uploaded per account within the quota window. Zero means no limit.")
+	cmd.Flags().Int64Var(&opt.QuotaAccount.Bytes, "quota-account-bytes", opt.QuotaAccount.Bytes, "The maximum number of bytes uploaded per account within the quota window. Zero means no limit.")
+	cmd.Flags().Int64Var(&opt.QuotaPartition.Samples, "quota-partition-samples", opt.QuotaPartition.Samples, "The maximum number of samples uploaded per cluster ID within the quota window. Zero means no limit.")
+	cmd.Flags().Int64Var(&opt.QuotaPartition.Bytes, "quota-partition-bytes", opt.QuotaPartition.Bytes, "The maximum number of bytes uploaded per cluster ID within the quota window. Zero means no limit.")
+	cmd.Flags().StringVar(&opt.QuotaStateFile, "quota-state-file", opt.QuotaStateFile, "A file in which to persist quota usage across restarts. Usage is only kept in memory if empty.")
+
+	cmd.Flags().StringVar(&opt.AuditLog, "audit-log", opt.AuditLog, "A file to write a JSON line for every upload and authorize request to, or '-' for standard output. Disabled if empty.")
+	cmd.Flags().Float64Var(&opt.AuditLogSample, "audit-log-sample", opt.AuditLogSample, "The fraction of successful requests to write to the audit log. Failed requests are always written.")
+	cmd.Flags().Int64Var(&opt.AuditLogMaxBytes, "audit-log-max-bytes", opt.AuditLogMaxBytes, "The size in bytes at which the audit log file is rotated. Zero means it is never rotated.")
+	cmd.Flags().IntVar(&opt.AuditLogMaxFiles, "audit-log-max-files", opt.AuditLogMaxFiles, "The number of rotated audit log files to keep.")
+
+	cmd.Flags().IntVar(&opt.Staleness.MissedIntervals, "silent-after-intervals", opt.Staleness.MissedIntervals, "The number of usual upload intervals a cluster ID may miss before it is served as silent on /federate, until its metrics expire. Zero disables detection.")
+	cmd.Flags().StringSliceVar(&opt.StalenessAccountFlag, "silent-after-intervals-account", opt.StalenessAccountFlag, "Overrides --silent-after-intervals for the cluster IDs of an account, in account=intervals form.")
+
+	cmd.Flags().DurationVar(&opt.IngestStatsTTL, "ingest-stats-ttl", opt.IngestStatsTTL, "How long to keep the upload statistics of a cluster ID that stopped uploading, served on /ingestion.")
 
 	cmd.Flags().BoolVarP(&opt.Verbose, "verbose", "v", opt.Verbose, "Show verbose output.")
+	cmd.Flags().StringVar(&opt.LogLevel, "log-level", opt.LogLevel, "The minimum level of log entries to write: 'debug', 'info', 'warn' or 'error'.")
+	cmd.Flags().StringVar(&opt.LogFormat, "log-format", opt.LogFormat, "The format of log entries: 'logfmt' or 'json'.")
+	cmd.Flags().StringVar(&opt.TracingEndpoint, "tracing-endpoint", opt.TracingEndpoint, "The URL of an OpenTelemetry collector to export traces to over OTLP/HTTP, such as http://localhost:4318. The path defaults to /v1/traces. Traces are not exported if empty.")
+	cmd.Flags().Float64Var(&opt.TracingSampleRatio, "tracing-sample-ratio", opt.TracingSampleRatio, "The ratio of traces exported to the --tracing-endpoint, between 0 and 1.")
 
 	cmd.Flags().StringSliceVar(&opt.RequiredLabelFlag, "required-label", opt.RequiredLabelFlag, "Labels that must be present on each incoming metric, in key=value form.")
 	cmd.Flags().StringArrayVar(&opt.Whitelist, "whitelist", opt.Whitelist, "Allowed rules for incoming metrics. If one of these rules is not matched, the metric is dropped.")
 	cmd.Flags().StringVar(&opt.WhitelistFile, "whitelist-file", opt.WhitelistFile, "A file of allowed rules for incoming metrics. If one of these rules is not matched, the metric is dropped; one label key per line.")
 	cmd.Flags().StringArrayVar(&opt.ElideLabels, "elide-label", opt.ElideLabels, "A list of labels to be elided from incoming metrics.")
+	cmd.Flags().StringVar(&opt.MetadataFile, "metadata-file", opt.MetadataFile, "A JSON file mapping metric names to their canonical type, help and unit. Otherwise the first type uploaded for a metric name is canonical.")
+	cmd.Flags().StringVar(&opt.MetadataMismatch, "metadata-mismatch", opt.MetadataMismatch, "What to do with incoming metrics whose type does not match the canonical type: 'reject' rejects the upload, 'coerce' converts between counters, gauges and untyped metrics and drops others, 'drop' drops them.")
 
 	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
@@ -164,11 +212,35 @@ type Options struct {
 	Whitelist         []string
 	ElideLabels       []string
 	WhitelistFile     string
+	MetadataFile      string
+	MetadataMismatch  string
+
+	TTL            time.Duration
+	Ratelimit      time.Duration
+	StoreLimits    memstore.Limits
+	EvictionPolicy string
 
-	TTL       time.Duration
-	Ratelimit time.Duration
+	QuotaWindow    time.Duration
+	QuotaAccount   quota.Limits
+	QuotaPartition quota.Limits
+	QuotaStateFile string
 
-	Verbose bool
+	AuditLog         string
+	AuditLogSample   float64
+	AuditLogMaxBytes int64
+	AuditLogMaxFiles int
+
+	IngestStatsTTL time.Duration
+
+	Staleness            staleness.Config
+	StalenessAccountFlag []string
+
+	Verbose   bool
+	LogLevel  string
+	LogFormat string
+
+	TracingEndpoint    string
+	TracingSampleRatio float64
 }
 
 type Paths struct {
@@ -176,6 +248,21 @@ type Paths struct {
 }
 
 func (o *Options) Run() error {
+	logger, err := logging.New(os.Stderr, o.LogFormat, o.LogLevel)
+	if err != nil {
+		return err
+	}
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.NewStdlibAdapter(level.Info(logger)))
+
+	if len(o.TracingEndpoint) > 0 {
+		closer, err := tracing.Register(logger, "telemeter-server", o.TracingEndpoint, o.TracingSampleRatio)
+		if err != nil {
+			return fmt.Errorf("--tracing-endpoint: %v", err)
+		}
+		defer closer.Close()
+	}
+
 	for _, flag := range o.LabelFlag {
 		values := strings.SplitN(flag, "=", 2)
 		if len(values) != 2 {
@@ -187,6 +274,21 @@ func (o *Options) Run() error {
 		o.Labels[values[0]] = values[1]
 	}
 
+	for _, flag := range o.StalenessAccountFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--silent-after-intervals-account must be of the form account=intervals: %s", flag)
+		}
+		n, err := strconv.Atoi(values[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("--silent-after-intervals-account must have a non-negative number of intervals: %s", flag)
+		}
+		if o.Staleness.AccountMissedIntervals == nil {
+			o.Staleness.AccountMissedIntervals = make(map[string]int)
+		}
+		o.Staleness.AccountMissedIntervals[values[0]] = n
+	}
+
 	for _, flag := range o.RequiredLabelFlag {
 		values := strings.SplitN(flag, "=", 2)
 		if len(values) != 2 {
@@ -306,7 +408,7 @@ func (o *Options) Run() error {
 			return fmt.Errorf("--shared-key must be specified when specifying a cluster to join")
 		}
 
-		log.Printf("warning: Using a generated shared-key")
+		level.Warn(logger).Log("msg", "using a generated shared-key")
 
 		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		if err != nil {
@@ -343,13 +445,28 @@ func (o *Options) Run() error {
 		return err
 	}
 
+	// Configure the metadata catalog.
+	mode, err := metadata.ParseMode(o.MetadataMismatch)
+	if err != nil {
+		return fmt.Errorf("--metadata-mismatch: %v", err)
+	}
+	catalog := metadata.New(logger, mode)
+	if err := catalog.SeedWhitelist(o.Whitelist); err != nil {
+		return err
+	}
+	if len(o.MetadataFile) > 0 {
+		if err := catalog.SeedFile(o.MetadataFile); err != nil {
+			return fmt.Errorf("unable to read --metadata-file: %v", err)
+		}
+	}
+
 	issuer := "telemeter.selfsigned"
 	audience := "federate"
 
 	jwtAuthorizer := jwt.NewClientAuthorizer(
 		issuer,
 		[]crypto.PublicKey{publicKey},
-		jwt.NewValidator([]string{audience}),
+		jwt.NewValidator(logger, []string{audience}),
 	)
 	signer := jwt.NewSigner(issuer, privateKey)
 
@@ -365,37 +482,108 @@ func (o *Options) Run() error {
 	internal := http.NewServeMux()
 	internalProtected := http.NewServeMux()
 
-	internalPaths := []string{"/", "/federate", "/metrics", "/debug/pprof", "/healthz", "/healthz/ready"}
+	internalPaths := []string{"/", "/federate", "/api/v1/metadata", "/partitions", "/ingestion", "/metrics", "/debug/pprof", "/healthz", "/healthz/ready"}
 
 	// configure the authenticator and incoming data validator
-	var clusterAuth authorize.ClusterAuthorizer = authorize.ClusterAuthorizerFunc(stub.Authorize)
+	var clusterAuth authorize.ClusterAuthorizer = stub.NewAuthorizer(logger)
 	if authorizeURL != nil {
-		clusterAuth = tollbooth.NewAuthorizer(authorizeClient, authorizeURL)
+		clusterAuth = tollbooth.NewAuthorizer(logger, authorizeClient, authorizeURL)
 	}
 
-	auth := jwt.NewAuthorizeClusterHandler(o.PartitionKey, o.TokenExpireSeconds, signer, o.RequiredLabels, clusterAuth)
+	var auditLogger *audit.Logger
+	if len(o.AuditLog) > 0 {
+		if o.AuditLogSample <= 0 || o.AuditLogSample > 1 {
+			return fmt.Errorf("--audit-log-sample must be greater than 0 and at most 1")
+		}
+		var w io.Writer = os.Stdout
+		if o.AuditLog != "-" {
+			f, err := audit.OpenRotatingFile(o.AuditLog, o.AuditLogMaxBytes, o.AuditLogMaxFiles)
+			if err != nil {
+				return fmt.Errorf("unable to open --audit-log: %v", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		auditLogger = audit.New(logger, w, o.AuditLogSample)
+	}
+
+	auth := jwt.NewAuthorizeClusterHandler(logger, o.PartitionKey, o.TokenExpireSeconds, signer, o.RequiredLabels, clusterAuth)
+	auth.SetAuditLogger(auditLogger)
 	validator := validate.New(o.PartitionKey, o.LimitBytes, 24*time.Hour)
 
-	ms := memstore.New(o.TTL)
+	policy, err := memstore.ParseEvictionPolicy(o.EvictionPolicy)
+	if err != nil {
+		return fmt.Errorf("--eviction-policy: %v", err)
+	}
+	ms := memstore.NewLimited(logger, o.TTL, o.StoreLimits, policy)
 	ms.StartCleaner(ctx, time.Minute)
 
-	// Create a rate-limited store with a memory-store as its backend.
-	var store store.Store = ratelimited.New(o.Ratelimit, ms)
+	// Create a rate-limited store with a memory-store as its backend. The
+	// cadence of the writes is learned on the member storing a partition.
+	var store store.Store = ms
+	if o.Staleness.MissedIntervals > 0 || len(o.Staleness.AccountMissedIntervals) > 0 {
+		o.Staleness.TTL = o.TTL
+		store = staleness.New(o.PartitionKey, o.Staleness, store)
+	}
+	store = ratelimited.New(o.Ratelimit, store)
 
+	var c *cluster.DynamicCluster
 	if len(o.ListenCluster) > 0 {
-		c := cluster.NewDynamic(o.Name, store)
-		ml, err := cluster.NewMemberlist(o.Name, o.ListenCluster, secret, o.Verbose, c)
+		c = cluster.NewDynamic(logger, o.Name, store)
+
+		// Wrap the cluster store within a rate-limited store.
+		// This guarantees an upper-bound on the total inter-node requests that
+		// hit the target node of `l*n`, where l is the rate limit and n is
+		// the cluster size. Without this, if a DOS attack with IDs that hash
+		// to node A's bucket enter the cluster on different node, node B,
+		// then node B will dutifully pass along the requests to the node A
+		// and can DOS the target and congest the internal network.
+		// Accepted writes are gossiped between the nodes, so that the rate limit
+		// applies cluster-wide regardless of the node an upload enters on.
+		store = c
+		if o.Ratelimit != 0 {
+			rl := ratelimited.New(o.Ratelimit, c)
+			c.ObserveWrites(rl)
+			store = rl
+		}
+		internalPaths = append(internalPaths, "/debug/cluster")
+		internalProtected.Handle("/debug/cluster", c)
+	}
+
+	// Enforce the upload quotas on the node receiving the upload, where the
+	// authorized client is known. The usage of accepted uploads is gossiped
+	// between the nodes, so that the quotas apply cluster-wide.
+	if o.QuotaAccount != (quota.Limits{}) || o.QuotaPartition != (quota.Limits{}) {
+		if o.QuotaWindow <= 0 {
+			return fmt.Errorf("--quota-window must be positive")
+		}
+		qs, err := quota.New(logger, o.QuotaWindow, o.QuotaAccount, o.QuotaPartition, o.QuotaStateFile, store)
 		if err != nil {
-			return fmt.Errorf("unable to configure cluster: %v", err)
+			return err
+		}
+		qs.StartPersister(ctx, time.Minute)
+		if c != nil {
+			qs.GossipUsage(c)
+			c.ObserveUsage(qs)
 		}
+		internalPaths = append(internalPaths, "/quota")
+		internalProtected.Handle("/quota", qs)
+		store = qs
+	}
 
+	// Join the cluster once the observers of gossiped writes and usage are set.
+	if c != nil {
+		ml, err := cluster.NewMemberlist(logger, o.Name, o.ListenCluster, secret, o.Verbose, c)
+		if err != nil {
+			return fmt.Errorf("unable to configure cluster: %v", err)
+		}
 		c.Start(ml, context.Background())
 
 		if len(o.Members) > 0 {
 			go func() {
 				for {
 					if err := c.Join(o.Members); err != nil {
-						log.Printf("error: Could not join any of %v: %v", o.Members, err)
+						level.Error(logger).Log("msg", "could not join any members", "members", strings.Join(o.Members, ","), "err", err)
 						time.Sleep(5 * time.Second)
 						continue
 					}
@@ -403,29 +591,23 @@ func (o *Options) Run() error {
 				}
 			}()
 		}
-		internalPaths = append(internalPaths, "/debug/cluster")
-		internalProtected.Handle("/debug/cluster", c)
-		store = c
-		// Wrap the cluster store within a rate-limited store.
-		// This guarantees an upper-bound on the total inter-node requests that
-		// hit the target node of `l*n`, where l is the rate limit and n is
-		// the cluster size. Without this, if a DOS attack with IDs that hash
-		// to node A's bucket enter the cluster on different node, node B,
-		// then node B will dutifully pass along the requests to the node A
-		// and can DOS the target and congest the internal network.
-		if o.Ratelimit != 0 {
-			store = ratelimited.New(o.Ratelimit, store)
-		}
 	}
 
 	transforms := metricfamily.MultiTransformer{}
 	transforms.With(whitelister)
+	transforms.With(catalog)
 	if len(o.Labels) > 0 {
 		transforms.With(metricfamily.NewLabel(o.Labels, nil))
 	}
 	transforms.With(metricfamily.NewElide(o.ElideLabels...))
 
-	server := httpserver.New(store, validator, transforms, o.TTL)
+	server := httpserver.New(logger, store, validator, transforms, o.TTL)
+	server.SetAuditLogger(auditLogger)
+
+	stats := ingest.New(logger, o.IngestStatsTTL)
+	stats.StartCleaner(ctx, time.Minute)
+	prometheus.MustRegister(stats)
+	server.SetIngestStats(stats)
 
 	internalPathJSON, _ := json.MarshalIndent(Paths{Paths: internalPaths}, "", "  ")
 	externalPathJSON, _ := json.MarshalIndent(Paths{Paths: []string{"/", "/authorize", "/upload", "/healthz", "/healthz/ready"}}, "", "  ")
@@ -433,12 +615,16 @@ func (o *Options) Run() error {
 	// TODO: add internal authorization
 	telemeter_http.DebugRoutes(internalProtected)
 	internalProtected.Handle("/federate", http.HandlerFunc(server.Get))
+	internalProtected.Handle("/api/v1/metadata", catalog)
+	internalProtected.Handle("/partitions", http.HandlerFunc(server.Partitions))
+	internalProtected.Handle("/partitions/", http.HandlerFunc(server.Partitions))
+	internalProtected.Handle("/ingestion", stats)
 
 	internal.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/" && req.Method == "GET" {
 			w.Header().Add("Content-Type", "application/json")
 			if _, err := w.Write(internalPathJSON); err != nil {
-				log.Printf("error writing internal paths: %v", err)
+				level.Error(logger).Log("msg", "error writing internal paths", "err", err)
 			}
 			return
 		}
@@ -447,23 +633,23 @@ func (o *Options) Run() error {
 	telemeter_http.MetricRoutes(internal)
 	telemeter_http.HealthRoutes(internal)
 
-	externalProtected.Handle("/upload", telemeter_http.NewInstrumentedHandler("upload", http.HandlerFunc(server.Post)))
+	externalProtected.Handle("/upload", telemeter_http.NewInstrumentedHandler("upload", tracing.Handler("upload", http.HandlerFunc(server.Post))))
 	externalProtectedHandler := authorize.NewAuthorizeClientHandler(jwtAuthorizer, externalProtected)
 
 	external.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if req.URL.Path == "/" && req.Method == "GET" {
 			w.Header().Add("Content-Type", "application/json")
 			if _, err := w.Write(externalPathJSON); err != nil {
-				log.Printf("error writing external paths: %v", err)
+				level.Error(logger).Log("msg", "error writing external paths", "err", err)
 			}
 			return
 		}
 		externalProtectedHandler.ServeHTTP(w, req)
 	}))
 	telemeter_http.HealthRoutes(external)
-	external.Handle("/authorize", telemeter_http.NewInstrumentedHandler("authorize", auth))
+	external.Handle("/authorize", telemeter_http.NewInstrumentedHandler("authorize", tracing.Handler("authorize", auth)))
 
-	log.Printf("Starting telemeter-server %s on %s (internal=%s, cluster=%s)", o.Name, o.Listen, o.ListenInternal, o.ListenCluster)
+	level.Info(logger).Log("msg", "starting telemeter-server", "name", o.Name, "listen", o.Listen, "internal", o.ListenInternal, "cluster", o.ListenCluster)
 
 	internalListener, err := net.Listen("tcp", o.ListenInternal)
 	if err != nil {
@@ -479,16 +665,16 @@ func (o *Options) Run() error {
 		// Run the internal server.
 		g.Add(func() error {
 			s := &http.Server{
-				Handler: internal,
+				Handler: logging.RequestHandler(internal),
 			}
 			if useInternalTLS {
 				if err := s.ServeTLS(internalListener, o.InternalTLSCertificatePath, o.InternalTLSKeyPath); err != nil && err != http.ErrServerClosed {
-					log.Printf("error: internal HTTPS server exited: %v", err)
+					level.Error(logger).Log("msg", "internal HTTPS server exited", "err", err)
 					return err
 				}
 			} else {
 				if err := s.Serve(internalListener); err != nil && err != http.ErrServerClosed {
-					log.Printf("error: internal HTTP server exited: %v", err)
+					level.Error(logger).Log("msg", "internal HTTP server exited", "err", err)
 					return err
 				}
 			}
@@ -502,16 +688,16 @@ func (o *Options) Run() error {
 		// Run the external server.
 		g.Add(func() error {
 			s := &http.Server{
-				Handler: external,
+				Handler: logging.RequestHandler(external),
 			}
 			if useTLS {
 				if err := s.ServeTLS(externalListener, o.TLSCertificatePath, o.TLSKeyPath); err != nil && err != http.ErrServerClosed {
-					log.Printf("error: external HTTPS server exited: %v", err)
+					level.Error(logger).Log("msg", "external HTTPS server exited", "err", err)
 					return err
 				}
 			} else {
 				if err := s.Serve(externalListener); err != nil && err != http.ErrServerClosed {
-					log.Printf("error: external HTTP server exited: %v", err)
+					level.Error(logger).Log("msg", "external HTTP server exited", "err", err)
 					return err
 				}
 			}
@@ -46,7 +46,7 @@ func TestPostError(t *testing.T) {
 	validator := validate.New("cluster", 4096, 0)
 	ttl := 10 * time.Minute
 	store := memstore.New(ttl)
-	server := server.New(store, validator, nil, ttl)
+	server := server.New(nil, store, validator, nil, ttl)
 	labels := map[string]string{"cluster": "test"}
 
 	s := httptest.NewServer(fakeAuthorizeHandler(http.HandlerFunc(server.Post), &authorize.Client{ID: "test", Labels: labels}))
@@ -83,7 +83,7 @@ func testPost(t *testing.T, validator validate.Validator, send, expect []*client
 
 	ttl := 10 * time.Minute
 	memStore := memstore.New(ttl)
-	server := server.New(memStore, validator, nil, ttl)
+	server := server.New(nil, memStore, validator, nil, ttl)
 
 	s := httptest.NewServer(fakeAuthorizeHandler(http.HandlerFunc(server.Post), &authorize.Client{ID: "test", Labels: map[string]string{"cluster": "test"}}))
 	defer s.Close()
@@ -111,7 +111,7 @@ func TestGet(t *testing.T) {
 	ttl := 10 * time.Minute
 	memStore := memstore.New(ttl)
 	validator := validate.New("cluster", 0, 0)
-	server := server.NewNonExpiring(memStore, validator, nil, ttl)
+	server := server.NewNonExpiring(nil, memStore, validator, nil, ttl)
 	srv := httptest.NewServer(http.HandlerFunc(server.Get))
 	defer srv.Close()
 
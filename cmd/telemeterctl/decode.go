@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func newDecodeCmd() *cobra.Command {
+	var (
+		format string
+		output string
+		out    string
+	)
+	cmd := &cobra.Command{
+		Use:   "decode [FILE]",
+		Short: "Decode an upload payload into the text exposition format or JSON",
+		Long:  "Decode a snappy compressed, delimited protobuf upload payload read from FILE, or from stdin if FILE is omitted or -.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var name string
+			if len(args) > 0 {
+				name = args[0]
+			}
+			data, err := readInput(name)
+			if err != nil {
+				return err
+			}
+			families, err := readFamilies(data, format)
+			if err != nil {
+				return err
+			}
+			return writeOutput(out, func(w io.Writer) error {
+				switch output {
+				case "text":
+					return writeText(w, families)
+				case "json":
+					return writeJSON(w, families)
+				default:
+					return fmt.Errorf("unrecognized output %q, must be one of text or json", output)
+				}
+			})
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", formatPayload, "The format of the input, one of auto, payload or text.")
+	cmd.Flags().StringVarP(&output, "output", "o", "text", "The output format, one of text or json.")
+	cmd.Flags().StringVar(&out, "output-file", "", "A file to write the output to instead of stdout.")
+	return cmd
+}
+
+func writeText(w io.Writer, families []*clientmodel.MetricFamily) error {
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(w, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonFamily is the JSON representation of a metric family. Sample values are
+// formatted as strings, like in the Prometheus HTTP API, so that special float
+// values can be represented.
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Help    string       `json:"help,omitempty"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+type jsonMetric struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Value       string            `json:"value,omitempty"`
+	Count       string            `json:"count,omitempty"`
+	Sum         string            `json:"sum,omitempty"`
+	Buckets     map[string]string `json:"buckets,omitempty"`
+	Quantiles   map[string]string `json:"quantiles,omitempty"`
+	TimestampMs *int64            `json:"timestamp_ms,omitempty"`
+}
+
+func writeJSON(w io.Writer, families []*clientmodel.MetricFamily) error {
+	result := make([]jsonFamily, 0, len(families))
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		result = append(result, toJSONFamily(family))
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+func toJSONFamily(family *clientmodel.MetricFamily) jsonFamily {
+	f := jsonFamily{
+		Name:    family.GetName(),
+		Help:    family.GetHelp(),
+		Type:    family.GetType().String(),
+		Metrics: make([]jsonMetric, 0, len(family.Metric)),
+	}
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		jm := jsonMetric{TimestampMs: m.TimestampMs}
+		if len(m.Label) > 0 {
+			jm.Labels = make(map[string]string, len(m.Label))
+			for _, label := range m.Label {
+				jm.Labels[label.GetName()] = label.GetValue()
+			}
+		}
+		switch {
+		case m.Counter != nil:
+			jm.Value = formatFloat(m.Counter.GetValue())
+		case m.Gauge != nil:
+			jm.Value = formatFloat(m.Gauge.GetValue())
+		case m.Untyped != nil:
+			jm.Value = formatFloat(m.Untyped.GetValue())
+		case m.Histogram != nil:
+			jm.Count = strconv.FormatUint(m.Histogram.GetSampleCount(), 10)
+			jm.Sum = formatFloat(m.Histogram.GetSampleSum())
+			jm.Buckets = make(map[string]string, len(m.Histogram.Bucket))
+			for _, b := range m.Histogram.Bucket {
+				jm.Buckets[formatFloat(b.GetUpperBound())] = strconv.FormatUint(b.GetCumulativeCount(), 10)
+			}
+		case m.Summary != nil:
+			jm.Count = strconv.FormatUint(m.Summary.GetSampleCount(), 10)
+			jm.Sum = formatFloat(m.Summary.GetSampleSum())
+			jm.Quantiles = make(map[string]string, len(m.Summary.Quantile))
+			for _, q := range m.Summary.Quantile {
+				jm.Quantiles[formatFloat(q.GetQuantile())] = formatFloat(q.GetValue())
+			}
+		}
+		f.Metrics = append(f.Metrics, jm)
+	}
+	return f
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+}
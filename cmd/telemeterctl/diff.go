@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/cobra"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func newDiffCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "diff OLD NEW",
+		Short: "Compare the series of two payloads",
+		Long: `Compare the series of two payloads. Lines start with - for series only in OLD,
++ for series only in NEW and ~ for series whose type, value or timestamp changed.
+Exits with a non-zero status if the payloads differ.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var sides [2][]*clientmodel.MetricFamily
+			for i, name := range args {
+				data, err := readInput(name)
+				if err != nil {
+					return err
+				}
+				if sides[i], err = readFamilies(data, format); err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			if diff := diffFamilies(sides[0], sides[1]); len(diff) > 0 {
+				writeLines(os.Stdout, diff)
+				return errSilent
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", formatAuto, "The format of the inputs, one of auto, payload or text.")
+	return cmd
+}
+
+// series is a single series of a family, identified by its name and labels.
+type series struct {
+	typ    clientmodel.MetricType
+	metric *clientmodel.Metric
+}
+
+// indexSeries returns the series of the given families by identity. When a
+// series occurs more than once, the sample with the latest timestamp wins.
+func indexSeries(families []*clientmodel.MetricFamily) map[string]series {
+	index := make(map[string]series)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			id := seriesID(family.GetName(), m)
+			if existing, ok := index[id]; ok && existing.metric.GetTimestampMs() > m.GetTimestampMs() {
+				continue
+			}
+			index[id] = series{typ: family.GetType(), metric: m}
+		}
+	}
+	return index
+}
+
+// seriesID formats the name and sorted labels of a series like a selector.
+func seriesID(name string, m *clientmodel.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, label := range m.Label {
+		if label == nil {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sampleOf describes the value and timestamp of a series.
+func sampleOf(s series) string {
+	var sample string
+	switch m := s.metric; {
+	case m.Counter != nil:
+		sample = formatFloat(m.Counter.GetValue())
+	case m.Gauge != nil:
+		sample = formatFloat(m.Gauge.GetValue())
+	case m.Untyped != nil:
+		sample = formatFloat(m.Untyped.GetValue())
+	default:
+		value := *m
+		value.Label = nil
+		value.TimestampMs = nil
+		sample = strings.TrimSpace(proto.CompactTextString(&value))
+	}
+	if s.metric.TimestampMs != nil {
+		sample += fmt.Sprintf(" @%d", s.metric.GetTimestampMs())
+	}
+	return sample
+}
+
+// diffFamilies returns a line for every series that differs between a and b,
+// sorted by series.
+func diffFamilies(a, b []*clientmodel.MetricFamily) []string {
+	before, after := indexSeries(a), indexSeries(b)
+
+	ids := make([]string, 0, len(before)+len(after))
+	for id := range before {
+		ids = append(ids, id)
+	}
+	for id := range after {
+		if _, ok := before[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var lines []string
+	for _, id := range ids {
+		old, inBefore := before[id]
+		updated, inAfter := after[id]
+		switch {
+		case !inAfter:
+			lines = append(lines, fmt.Sprintf("- %s %s", id, sampleOf(old)))
+		case !inBefore:
+			lines = append(lines, fmt.Sprintf("+ %s %s", id, sampleOf(updated)))
+		default:
+			from, to := sampleOf(old), sampleOf(updated)
+			if old.typ != updated.typ {
+				from = strings.ToLower(old.typ.String()) + " " + from
+				to = strings.ToLower(updated.typ.String()) + " " + to
+			}
+			if from != to {
+				lines = append(lines, fmt.Sprintf("~ %s %s -> %s", id, from, to))
+			}
+		}
+	}
+	return lines
+}
+
+func writeLines(w io.Writer, lines []string) {
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
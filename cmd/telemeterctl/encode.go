@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func newEncodeCmd() *cobra.Command {
+	var (
+		format        string
+		out           string
+		addTimestamps bool
+	)
+	cmd := &cobra.Command{
+		Use:   "encode [FILE]",
+		Short: "Encode metrics in the text exposition format into an upload payload",
+		Long:  "Encode metrics read from FILE, or from stdin if FILE is omitted or -, into a snappy compressed, delimited protobuf upload payload.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var name string
+			if len(args) > 0 {
+				name = args[0]
+			}
+			data, err := readInput(name)
+			if err != nil {
+				return err
+			}
+			families, err := readFamilies(data, format)
+			if err != nil {
+				return err
+			}
+			if addTimestamps {
+				setMissingTimestamps(families, time.Now())
+			}
+			// The server requires the samples of a family to be sorted by timestamp.
+			if err := metricfamily.Filter(families, metricfamily.TransformerFunc(metricfamily.SortMetrics)); err != nil {
+				return err
+			}
+			return writeOutput(out, func(w io.Writer) error {
+				return metricsclient.Write(w, families)
+			})
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", formatText, "The format of the input, one of auto, payload or text.")
+	cmd.Flags().StringVar(&out, "output-file", "", "A file to write the payload to instead of stdout.")
+	cmd.Flags().BoolVar(&addTimestamps, "add-timestamps", false, "Set the timestamp of samples without one to the current time. The server rejects samples without timestamps.")
+	return cmd
+}
+
+// setMissingTimestamps sets the timestamp of every metric without one to now.
+func setMissingTimestamps(families []*clientmodel.MetricFamily, now time.Time) {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m == nil || m.TimestampMs != nil {
+				continue
+			}
+			m.TimestampMs = &ts
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// Supported input formats.
+const (
+	formatAuto    = "auto"
+	formatPayload = "payload"
+	formatText    = "text"
+)
+
+// snappyMagic is the stream identifier that starts every snappy framed stream,
+// and therefore every upload payload.
+var snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// errSilent is returned by commands that already reported why they failed
+// and only need to exit with a non-zero status.
+var errSilent = fmt.Errorf("")
+
+func main() {
+	cmd := &cobra.Command{
+		Use:   "telemeterctl",
+		Short: "Inspect and prepare Telemeter upload payloads",
+
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+
+	cmd.AddCommand(newDecodeCmd())
+	cmd.AddCommand(newEncodeCmd())
+	cmd.AddCommand(newValidateCmd())
+	cmd.AddCommand(newDiffCmd())
+
+	if err := cmd.Execute(); err != nil {
+		if err != errSilent {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// readInput returns the contents of the named file, or of stdin if the name is
+// empty or "-".
+func readInput(name string) ([]byte, error) {
+	if len(name) == 0 || name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// isPayload returns whether data should be treated as an upload payload
+// rather than as the Prometheus text exposition format.
+func isPayload(data []byte, format string) (bool, error) {
+	switch format {
+	case formatPayload:
+		return true, nil
+	case formatText:
+		return false, nil
+	case formatAuto, "":
+		return bytes.HasPrefix(data, snappyMagic), nil
+	default:
+		return false, fmt.Errorf("unrecognized format %q, must be one of %s, %s or %s", format, formatAuto, formatPayload, formatText)
+	}
+}
+
+// readFamilies parses data either as an upload payload or as the Prometheus
+// text exposition format.
+func readFamilies(data []byte, format string) ([]*clientmodel.MetricFamily, error) {
+	payload, err := isPayload(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if payload {
+		families, err := metricsclient.Read(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode payload: %v", err)
+		}
+		return families, nil
+	}
+	return parseText(bytes.NewReader(data))
+}
+
+// parseText parses the Prometheus text exposition format. The families are
+// returned sorted by name.
+func parseText(r io.Reader) ([]*clientmodel.MetricFamily, error) {
+	var parser expfmt.TextParser
+	byName, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse text format: %v", err)
+	}
+	families := make([]*clientmodel.MetricFamily, 0, len(byName))
+	for _, family := range byName {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, nil
+}
+
+// writeOutput writes data to the named file, or to stdout if the name is empty or "-".
+func writeOutput(name string, fn func(w io.Writer) error) error {
+	if len(name) == 0 || name == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := fn(w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %v", name, err)
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
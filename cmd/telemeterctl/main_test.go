@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func mustParseText(t *testing.T, text string) []*clientmodel.MetricFamily {
+	families, err := parseText(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+func TestReadFamilies(t *testing.T) {
+	families := mustParseText(t, "# TYPE b gauge\nb 1 1000\n# TYPE a counter\na 2 1000\n")
+	buf := &bytes.Buffer{}
+	if err := metricsclient.Write(buf, families); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{formatAuto, formatPayload} {
+		got, err := readFamilies(buf.Bytes(), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(got) != len(families) || !proto.Equal(got[0], families[0]) || !proto.Equal(got[1], families[1]) {
+			t.Errorf("%s: expected payload to round trip, got %v", format, got)
+		}
+	}
+	if _, err := readFamilies(buf.Bytes(), formatText); err == nil {
+		t.Errorf("expected an error reading a payload as text")
+	}
+}
+
+func TestDiffFamilies(t *testing.T) {
+	old := mustParseText(t, `
+up{job="a"} 1 1000
+up{job="b"} 1 1000
+# TYPE requests counter
+requests{code="200",job="a"} 10 1000
+`)
+	updated := mustParseText(t, `
+up{job="a"} 1 1000
+up{job="c"} 1 2000
+# TYPE requests counter
+requests{job="a",code="200"} 12 2000
+`)
+
+	want := []string{
+		`~ requests{code="200",job="a"} 10 @1000 -> 12 @2000`,
+		`- up{job="b"} 1 @1000`,
+		`+ up{job="c"} 1 @2000`,
+	}
+	if got := diffFamilies(old, updated); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected diff:\n%s", strings.Join(got, "\n"))
+	}
+	if got := diffFamilies(old, old); len(got) != 0 {
+		t.Errorf("expected no differences, got %v", got)
+	}
+
+	retyped := mustParseText(t, "requests{code=\"200\",job=\"a\"} 10 1000\n")
+	want = []string{`~ requests{code="200",job="a"} counter 10 @1000 -> untyped 10 @1000`}
+	if got := diffFamilies(old[:1], retyped); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected diff:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix()*1000, 10)
+
+	testCases := []struct {
+		name     string
+		opt      validateOptions
+		input    string
+		wantErr  bool
+		contains []string
+	}{
+		{
+			name:  "accepted",
+			opt:   validateOptions{PartitionKey: "_id", LabelFlag: []string{"_id=test"}},
+			input: `up{_id="test",job="a"} 1 TS` + "\n" + `up{_id="test",job="b"} 1 TS`,
+			contains: []string{
+				"partition: test",
+				"result: upload would be accepted, storing 2 series in 1 families",
+			},
+		},
+		{
+			name: "whitelisted",
+			opt: validateOptions{
+				PartitionKey: "_id",
+				LabelFlag:    []string{"_id=test"},
+				Whitelist:    []string{`{__name__="up",job="a"}`},
+				ElideLabels:  []string{"job"},
+			},
+			input: `up{_id="test",job="a"} 1 TS` + "\n" + `up{_id="test",job="b"} 1 TS`,
+			contains: []string{
+				"dropped: up: 1 of 2 series (not_matched)",
+				"changed: up: labels job",
+				"result: upload would be accepted, storing 1 series in 1 families",
+			},
+		},
+		{
+			name: "rejected",
+			opt:  validateOptions{PartitionKey: "_id", LabelFlag: []string{"_id=test"}, MaxAge: time.Hour},
+			input: `up{_id="test"} 1 TS` + "\n" + `missing 1 TS` + "\n" + `old{_id="test"} 1 1000` + "\n" +
+				`other{_id="other"} 1 TS`,
+			wantErr: true,
+			contains: []string{
+				"rejected: missing: a required label is missing from the metric",
+				"rejected: old: metrics in provided family have a timestamp that is too old",
+				"rejected: other: expected label _id to have value test instead of other",
+				"result: upload would be rejected, 3 families failed validation",
+			},
+		},
+		{
+			name:     "too large",
+			opt:      validateOptions{PartitionKey: "_id", LabelFlag: []string{"_id=test"}, LimitBytes: 10},
+			input:    `up{_id="test"} 1 TS`,
+			wantErr:  true,
+			contains: []string{"rejected: unable to read upload"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			input := strings.Replace(tc.input, "TS", now, -1)
+			err := tc.opt.Run(out, []byte(input+"\n"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v, output:\n%s", err, out)
+			}
+			for _, s := range tc.contains {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("expected output to contain %q, got:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/validate"
+)
+
+type validateOptions struct {
+	Format        string
+	PartitionKey  string
+	LabelFlag     []string
+	LimitBytes    int64
+	MaxAge        time.Duration
+	Whitelist     []string
+	WhitelistFile string
+	ElideLabels   []string
+}
+
+func newValidateCmd() *cobra.Command {
+	opt := validateOptions{
+		Format:       formatAuto,
+		PartitionKey: "_id",
+		LimitBytes:   500 * 1024,
+		MaxAge:       24 * time.Hour,
+	}
+	cmd := &cobra.Command{
+		Use:   "validate [FILE]",
+		Short: "Check which metrics the server would reject or drop",
+		Long: `Run metrics read from FILE, or from stdin if FILE is omitted or -, through the
+same validation and whitelist as the server and report the metrics that would be
+rejected or dropped. Exits with a non-zero status if the upload would be rejected.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var name string
+			if len(args) > 0 {
+				name = args[0]
+			}
+			data, err := readInput(name)
+			if err != nil {
+				return err
+			}
+			return opt.Run(os.Stdout, data)
+		},
+	}
+	cmd.Flags().StringVar(&opt.Format, "format", opt.Format, "The format of the input, one of auto, payload or text.")
+	cmd.Flags().StringVar(&opt.PartitionKey, "partition-label", opt.PartitionKey, "The label the server separates incoming data on.")
+	cmd.Flags().StringArrayVar(&opt.LabelFlag, "label", opt.LabelFlag, "Labels the server associates with the uploading cluster, of the form key=value. Every metric must carry these labels. Must include the partition label.")
+	cmd.Flags().Int64Var(&opt.LimitBytes, "limit-bytes", opt.LimitBytes, "The maximum acceptable size of an upload, as configured on the server.")
+	cmd.Flags().DurationVar(&opt.MaxAge, "max-age", opt.MaxAge, "The maximum age of samples accepted by the server.")
+	cmd.Flags().StringArrayVar(&opt.Whitelist, "whitelist", opt.Whitelist, "Allowed rules for incoming metrics, as configured on the server. If no rules are given, the whitelist is not checked.")
+	cmd.Flags().StringVar(&opt.WhitelistFile, "whitelist-file", opt.WhitelistFile, "A file of allowed rules for incoming metrics, as configured on the server.")
+	cmd.Flags().StringArrayVar(&opt.ElideLabels, "elide-label", opt.ElideLabels, "A list of labels the server elides from incoming metrics.")
+	return cmd
+}
+
+// Run validates the upload in data and writes a report to w.
+func (o *validateOptions) Run(w io.Writer, data []byte) error {
+	labels := make(map[string]string)
+	for _, flag := range o.LabelFlag {
+		values := strings.SplitN(flag, "=", 2)
+		if len(values) != 2 {
+			return fmt.Errorf("--label must be of the form key=value: %s", flag)
+		}
+		labels[values[0]] = values[1]
+	}
+
+	if len(o.WhitelistFile) > 0 {
+		data, err := ioutil.ReadFile(o.WhitelistFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --whitelist-file: %v", err)
+		}
+		o.Whitelist = append(o.Whitelist, strings.Split(string(data), "\n")...)
+	}
+	var rules []string
+	for _, rule := range o.Whitelist {
+		if rule = strings.TrimSpace(rule); len(rule) > 0 {
+			rules = append(rules, rule)
+		}
+	}
+
+	var transforms metricfamily.MultiTransformer
+	if len(rules) > 0 {
+		whitelister, err := metricfamily.NewWhitelist(rules)
+		if err != nil {
+			return err
+		}
+		transforms.With(whitelister)
+	}
+	if len(o.ElideLabels) > 0 {
+		transforms.With(metricfamily.NewElide(o.ElideLabels...))
+	}
+
+	// The server limits the size of the payload as sent, so text input
+	// is encoded first.
+	payload, err := isPayload(data, o.Format)
+	if err != nil {
+		return err
+	}
+	if !payload {
+		families, err := parseText(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		if err := metricsclient.Write(buf, families); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	req, err := http.NewRequest("POST", "/upload", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	ctx := authorize.WithClient(context.Background(), &authorize.Client{ID: "telemeterctl", Labels: labels})
+	partitionKey, validation, err := validate.New(o.PartitionKey, o.LimitBytes, o.MaxAge).Validate(ctx, req)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "partition: %s\n", partitionKey)
+
+	families, err := metricsclient.Read(req.Body)
+	if err != nil {
+		fmt.Fprintf(w, "rejected: unable to read upload: %v\n", err)
+		return errSilent
+	}
+
+	r, err := validateFamilies(families, validation, transforms)
+	if err != nil {
+		return err
+	}
+	r.write(w)
+	if len(r.Rejected) > 0 {
+		return errSilent
+	}
+	return nil
+}
+
+// validationReport describes what the server would do with an upload.
+type validationReport struct {
+	// Rejected maps the name of each family that fails validation to the reason.
+	// The server rejects the entire upload if any family fails validation.
+	Rejected map[string]string
+	// Explanation describes the series dropped or changed by the server.
+	Explanation *metricfamily.Explanation
+	// Families and Series count the families and series that would be stored.
+	Families int
+	Series   int
+}
+
+// validateFamilies runs each family through the validation separately, so that
+// all violations are reported rather than only the first, and explains what the
+// server transforms do to the valid families.
+func validateFamilies(families []*clientmodel.MetricFamily, validation, transforms metricfamily.Transformer) (*validationReport, error) {
+	r := &validationReport{Rejected: make(map[string]string)}
+	for i, family := range families {
+		if family == nil {
+			continue
+		}
+		ok, err := validation.Transform(family)
+		if err != nil {
+			r.Rejected[family.GetName()] = err.Error()
+		}
+		if !ok || err != nil {
+			families[i] = nil
+		}
+	}
+
+	e, err := metricfamily.Explain(families, transforms)
+	if err != nil {
+		return nil, err
+	}
+	r.Explanation = e
+	for _, fe := range e.Families {
+		if fe.Kept > 0 {
+			r.Families++
+			r.Series += fe.Kept
+		}
+	}
+	return r, nil
+}
+
+func (r *validationReport) write(w io.Writer) {
+	names := make([]string, 0, len(r.Rejected))
+	for name := range r.Rejected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "rejected: %s: %s\n", name, r.Rejected[name])
+	}
+
+	for _, fe := range r.Explanation.Families {
+		reasons := make([]string, 0, len(fe.Dropped))
+		for reason := range fe.Dropped {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "dropped: %s: %d of %d series (%s)\n", fe.Name, fe.Dropped[reason], fe.Series, reason)
+		}
+		if len(fe.Labelled) > 0 {
+			fmt.Fprintf(w, "changed: %s: labels %s\n", fe.Name, strings.Join(fe.Labelled, ", "))
+		}
+	}
+
+	if len(r.Rejected) > 0 {
+		fmt.Fprintf(w, "result: upload would be rejected, %d families failed validation\n", len(r.Rejected))
+		return
+	}
+	fmt.Fprintf(w, "result: upload would be accepted, storing %d series in %d families\n", r.Series, r.Families)
+}
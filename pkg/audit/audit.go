@@ -0,0 +1,121 @@
+// Package audit writes a structured log of the requests to the server, one
+// JSON object per line, to answer when and from where a client uploaded.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/logging"
+)
+
+var (
+	recordsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_audit_records_total",
+		Help: "Tracks the number of audit records, by whether they were written, sampled out or failed.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(recordsTotal)
+}
+
+// Record describes a single request.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Handler string    `json:"handler"`
+	// ClientID is the cluster ID the client identifies as.
+	ClientID string `json:"clientID,omitempty"`
+	// Subject is the account the client is authorized as.
+	Subject      string `json:"subject,omitempty"`
+	PartitionKey string `json:"partitionKey,omitempty"`
+	RemoteAddr   string `json:"remoteAddr"`
+	// Bytes is the size of the request body as received, before decompression.
+	Bytes int64 `json:"bytes"`
+	// SeriesIn and SeriesOut are the number of series uploaded and the number
+	// left after filtering.
+	SeriesIn        int     `json:"seriesIn,omitempty"`
+	SeriesOut       int     `json:"seriesOut,omitempty"`
+	Status          int     `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// NewRecord returns a record of the given request to the given handler that
+// started at the given time.
+func NewRecord(handler string, req *http.Request, start time.Time) *Record {
+	return &Record{
+		Time:       start,
+		Handler:    handler,
+		RemoteAddr: req.RemoteAddr,
+		Status:     http.StatusOK,
+	}
+}
+
+// Fail records that the request failed with the given status code and error.
+func (r *Record) Fail(status int, err error) {
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Logger writes records to a writer. A nil logger writes nothing.
+type Logger struct {
+	logger log.Logger
+	sample float64
+
+	mu   sync.Mutex // protects fields below
+	w    io.Writer
+	rand *rand.Rand
+}
+
+// New returns a logger writing records to w. Only the given fraction of
+// successful requests is written, while failed requests are always written.
+// Records that cannot be written are reported to logger.
+func New(logger log.Logger, w io.Writer, sample float64) *Logger {
+	return &Logger{
+		logger: log.With(logging.OrNop(logger), "component", "audit"),
+		sample: sample,
+		w:      w,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Log sets the duration of the record, ending now, and writes it unless it is
+// sampled out.
+func (l *Logger) Log(r *Record) {
+	if l == nil {
+		return
+	}
+	r.DurationSeconds = time.Since(r.Time).Seconds()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		level.Error(l.logger).Log("msg", "unable to encode audit record", "err", err)
+		recordsTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r.Status < http.StatusBadRequest && l.sample < 1 && l.rand.Float64() >= l.sample {
+		recordsTotal.WithLabelValues("sampled").Inc()
+		return
+	}
+	if _, err := l.w.Write(data); err != nil {
+		level.Error(l.logger).Log("msg", "unable to write audit record", "err", err)
+		recordsTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	recordsTotal.WithLabelValues("written").Inc()
+}
@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		sample float64
+		fail   bool
+		want   bool
+	}{
+		{name: "success", sample: 1, want: true},
+		{name: "sampled out success", sample: 0, want: false},
+		{name: "failure is never sampled out", sample: 0, fail: true, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			req := httptest.NewRequest("POST", "/upload", nil)
+			rec := NewRecord("upload", req, time.Now())
+			rec.PartitionKey = "cluster"
+			if tc.fail {
+				rec.Fail(http.StatusTooManyRequests, errors.New("write limit reached"))
+			}
+			New(nil, buf, tc.sample).Log(rec)
+			if !tc.want {
+				if buf.Len() > 0 {
+					t.Errorf("expected no record, got %s", buf)
+				}
+				return
+			}
+
+			var got Record
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("unable to parse %q: %v", buf, err)
+			}
+			if got.PartitionKey != "cluster" || got.RemoteAddr != req.RemoteAddr || got.Handler != "upload" {
+				t.Errorf("unexpected record %s", buf)
+			}
+			if tc.fail && (got.Status != http.StatusTooManyRequests || got.Error != "write limit reached") {
+				t.Errorf("expected failure to be recorded, got %s", buf)
+			}
+		})
+	}
+
+	// A nil logger must not panic.
+	var l *Logger
+	l.Log(&Record{})
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"audit.log":   "dddddd\n",
+		"audit.log.1": "cccccc\n",
+		"audit.log.2": "bbbbbb\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 rotated files, got %v", err)
+	}
+
+	// Reopening appends to the existing file.
+	f, err = OpenRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(strings.Repeat("e", 20))); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); !strings.HasPrefix(string(data), "dddddd\n") {
+		t.Errorf("expected the file to be appended to, got %q", data)
+	}
+}
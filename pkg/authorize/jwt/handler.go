@@ -2,21 +2,32 @@ package jwt
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/openshift/telemeter/pkg/audit"
 	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/logging"
+	"github.com/openshift/telemeter/pkg/reader"
+	"github.com/openshift/telemeter/pkg/tracing"
 )
 
 type authorizeClusterHandler struct {
+	logger          log.Logger
 	partitionKey    string
 	labels          map[string]string
 	expireInSeconds int64
 	signer          *Signer
 	clusterAuth     authorize.ClusterAuthorizer
+	audit           *audit.Logger
 }
 
 // NewAuthorizerHandler creates an authorizer HTTP endpoint that will authorize the cluster
@@ -26,8 +37,9 @@ type authorizeClusterHandler struct {
 // in a generated signed JWT which is returned to the client, along with any labels.
 //
 // A single partition key parameter must be passed to uniquely identify the caller's data.
-func NewAuthorizeClusterHandler(partitionKey string, expireInSeconds int64, signer *Signer, labels map[string]string, ca authorize.ClusterAuthorizer) *authorizeClusterHandler {
+func NewAuthorizeClusterHandler(logger log.Logger, partitionKey string, expireInSeconds int64, signer *Signer, labels map[string]string, ca authorize.ClusterAuthorizer) *authorizeClusterHandler {
 	return &authorizeClusterHandler{
+		logger:          log.With(logging.OrNop(logger), "component", "authorize"),
 		partitionKey:    partitionKey,
 		expireInSeconds: expireInSeconds,
 		signer:          signer,
@@ -36,39 +48,59 @@ func NewAuthorizeClusterHandler(partitionKey string, expireInSeconds int64, sign
 	}
 }
 
+// SetAuditLogger records every authorize request to the given logger.
+func (a *authorizeClusterHandler) SetAuditLogger(l *audit.Logger) {
+	a.audit = l
+}
+
 func (a *authorizeClusterHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		http.Error(w, "Only POST is allowed to this endpoint", http.StatusMethodNotAllowed)
 		return
 	}
 
-	req.Body = http.MaxBytesReader(w, req.Body, 4*1024)
+	logger := logging.FromContext(req.Context(), a.logger)
+	rec := audit.NewRecord("authorize", req, time.Now())
+	defer a.audit.Log(rec)
+	body := &reader.CountingReader{R: req.Body}
+	req.Body = http.MaxBytesReader(w, ioutil.NopCloser(body), 4*1024)
 	defer req.Body.Close()
+	fail := func(status int, err error) {
+		rec.Fail(status, err)
+		rec.Bytes = body.Count()
+		http.Error(w, err.Error(), status)
+	}
 
 	if err := req.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		fail(http.StatusBadRequest, err)
 		return
 	}
+	rec.Bytes = body.Count()
 
 	uniqueIDKey := "id"
 	cluster := req.Form.Get(uniqueIDKey)
 	if len(cluster) == 0 {
-		http.Error(w, fmt.Sprintf("The '%s' parameter must be specified via URL or url-encoded form body", uniqueIDKey), http.StatusBadRequest)
+		fail(http.StatusBadRequest, fmt.Errorf("The '%s' parameter must be specified via URL or url-encoded form body", uniqueIDKey))
 		return
 	}
+	rec.ClientID, rec.PartitionKey = cluster, cluster
+	logger = log.With(logger, "partition", cluster)
 
 	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
 	if strings.ToLower(auth[0]) != "bearer" {
-		http.Error(w, "Only bearer authorization allowed", http.StatusUnauthorized)
+		fail(http.StatusUnauthorized, errors.New("Only bearer authorization allowed"))
 		return
 	}
 	if len(auth) != 2 || len(strings.TrimSpace(auth[1])) == 0 {
-		http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
+		fail(http.StatusUnauthorized, errors.New("Invalid Authorization header"))
 		return
 	}
 	clientToken := auth[1]
 
+	span, _ := tracing.StartSpan(req.Context(), "authorize.authorizeCluster")
 	subject, err := a.clusterAuth.AuthorizeCluster(clientToken, cluster)
+	tracing.Finish(span, err)
+	rec.Subject = subject
 
 	if err != nil {
 		type statusCodeErr interface {
@@ -78,19 +110,20 @@ func (a *authorizeClusterHandler) ServeHTTP(w http.ResponseWriter, req *http.Req
 
 		if scerr, ok := err.(statusCodeErr); ok {
 			if scerr.HTTPStatusCode() >= http.StatusInternalServerError {
-				log.Printf("error: unable to authorize request: %v", scerr)
+				level.Error(logger).Log("msg", "unable to authorize request", "err", scerr)
 			}
 			if scerr.HTTPStatusCode() == http.StatusTooManyRequests {
 				w.Header().Set("Retry-After", "300")
 			}
-			http.Error(w, scerr.Error(), scerr.HTTPStatusCode())
+			fail(scerr.HTTPStatusCode(), scerr)
 			return
 		}
 
 		// always hide errors from the upstream service from the client
 		uid := rand.Int63()
-		log.Printf("error: unable to authorize request %d: %v", uid, err)
+		level.Error(logger).Log("msg", "unable to authorize request", "uid", uid, "err", err)
 		http.Error(w, fmt.Sprintf("Internal server error, requestid=%d", uid), http.StatusInternalServerError)
+		rec.Fail(http.StatusInternalServerError, err)
 		return
 	}
 
@@ -104,8 +137,8 @@ func (a *authorizeClusterHandler) ServeHTTP(w http.ResponseWriter, req *http.Req
 	// create a token that asserts the client and the labels
 	authToken, err := a.signer.GenerateToken(Claims(subject, labels, a.expireInSeconds, []string{"federate"}))
 	if err != nil {
-		log.Printf("error: unable to generate token: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		level.Error(logger).Log("msg", "unable to generate token", "err", err)
+		fail(http.StatusInternalServerError, err)
 		return
 	}
 
@@ -118,12 +151,12 @@ func (a *authorizeClusterHandler) ServeHTTP(w http.ResponseWriter, req *http.Req
 	})
 
 	if err != nil {
-		log.Printf("error: unable to marshal token: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		level.Error(logger).Log("msg", "unable to marshal token", "err", err)
+		fail(http.StatusInternalServerError, err)
 		return
 	}
 
 	if _, err := w.Write(data); err != nil {
-		log.Printf("writing auth token failed: %v", err)
+		level.Error(logger).Log("msg", "writing auth token failed", "err", err)
 	}
 }
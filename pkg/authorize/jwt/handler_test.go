@@ -191,7 +191,7 @@ func TestAuthorizeClusterHandler(t *testing.T) {
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			h := NewAuthorizeClusterHandler(partitionKey, 2, tc.signer, labels, tc.clusterAuth)
+			h := NewAuthorizeClusterHandler(nil, partitionKey, 2, tc.signer, labels, tc.clusterAuth)
 			rec := httptest.NewRecorder()
 			h.ServeHTTP(rec, tc.req)
 			if err := tc.check(rec); err != nil {
@@ -2,9 +2,13 @@ package jwt
 
 import (
 	"errors"
-	"log"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 
 	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/logging"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
@@ -23,14 +27,16 @@ type Validator interface {
 	NewPrivateClaims() interface{}
 }
 
-func NewValidator(audiences []string) Validator {
+func NewValidator(logger log.Logger, audiences []string) Validator {
 	return &validator{
-		auds: audiences,
+		logger: log.With(logging.OrNop(logger), "component", "authorize/jwt"),
+		auds:   audiences,
 	}
 }
 
 type validator struct {
-	auds []string
+	logger log.Logger
+	auds   []string
 }
 
 var _ = Validator(&validator{})
@@ -38,7 +44,7 @@ var _ = Validator(&validator{})
 func (v *validator) Validate(_ string, public *jwt.Claims, privateObj interface{}) (*authorize.Client, error) {
 	private, ok := privateObj.(*privateClaims)
 	if !ok {
-		log.Printf("jwt validator expected private claim of type *privateClaims but got: %T", privateObj)
+		level.Error(v.logger).Log("msg", "jwt validator expected private claim of type *privateClaims", "type", fmt.Sprintf("%T", privateObj))
 		return nil, errors.New("token could not be validated")
 	}
 	err := public.Validate(jwt.Expected{
@@ -49,7 +55,7 @@ func (v *validator) Validate(_ string, public *jwt.Claims, privateObj interface{
 	case err == jwt.ErrExpired:
 		return nil, errors.New("token has expired")
 	default:
-		log.Printf("unexpected validation error: %T", err)
+		level.Warn(v.logger).Log("msg", "unexpected validation error", "type", fmt.Sprintf("%T", err), "err", err)
 		return nil, errors.New("token could not be validated")
 	}
 
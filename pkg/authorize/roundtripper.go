@@ -39,6 +39,14 @@ func (rt *ServerRotatingRoundTripper) RoundTrip(req *http.Request) (*http.Respon
 func (rt *ServerRotatingRoundTripper) Labels() (map[string]string, error) {
 	_, err := rt.tokenStore.Load(rt.endpoint, rt.initialToken, rt.wrapper)
 	if err != nil {
+		// Preserve the status code and requested retry delay of the server for the caller.
+		if terr, ok := err.(*tokenError); ok {
+			return nil, &tokenError{
+				statusCode: terr.statusCode,
+				retryAfter: terr.retryAfter,
+				msg:        fmt.Sprintf("unable to authorize to server: %v", terr.msg),
+			}
+		}
 		return nil, fmt.Errorf("unable to authorize to server: %v", err)
 	}
 	labels, ok := rt.tokenStore.Labels()
@@ -2,16 +2,29 @@ package stub
 
 import (
 	"fmt"
-	"log"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 
 	"github.com/openshift/telemeter/pkg/fnv"
+	"github.com/openshift/telemeter/pkg/logging"
 )
 
-func Authorize(token, cluster string) (string, error) {
+type authorizer struct {
+	logger log.Logger
+}
+
+// NewAuthorizer returns a cluster authorizer that accepts every token, using
+// its hash as the subject.
+func NewAuthorizer(logger log.Logger) *authorizer {
+	return &authorizer{logger: log.With(logging.OrNop(logger), "component", "authorize/stub")}
+}
+
+func (a *authorizer) AuthorizeCluster(token, cluster string) (string, error) {
 	subject, err := fnv.Hash(token)
 	if err != nil {
 		return "", fmt.Errorf("hashing token failed: %v", err)
 	}
-	log.Printf("warning: Performing no-op authentication, subject will be %s with cluster %s", subject, cluster)
+	level.Warn(a.logger).Log("msg", "performing no-op authentication", "subject", subject, "cluster", cluster)
 	return subject, nil
 }
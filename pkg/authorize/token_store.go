@@ -9,6 +9,8 @@ import (
 	"net/url"
 	"sync"
 	"time"
+
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
 )
 
 type TokenResponse struct {
@@ -20,6 +22,21 @@ type TokenResponse struct {
 	Labels map[string]string `json:"labels"`
 }
 
+// tokenError is returned when the authorize endpoint rejects the token exchange.
+type tokenError struct {
+	statusCode int
+	retryAfter time.Duration
+	msg        string
+}
+
+func (e *tokenError) Error() string { return e.msg }
+
+// HTTPStatusCode returns the status code of the authorize response.
+func (e *tokenError) HTTPStatusCode() int { return e.statusCode }
+
+// RetryAfterDuration returns the delay requested by the authorize endpoint.
+func (e *tokenError) RetryAfterDuration() time.Duration { return e.retryAfter }
+
 type tokenStore struct {
 	lock    sync.Mutex
 	value   string
@@ -49,10 +66,14 @@ func (t *tokenStore) Load(endpoint *url.URL, initialToken string, rt http.RoundT
 	switch resp.StatusCode {
 	case http.StatusOK, http.StatusCreated:
 	case http.StatusUnauthorized:
-		return "", fmt.Errorf("initial authentication token is expired or invalid")
+		return "", &tokenError{statusCode: resp.StatusCode, msg: "initial authentication token is expired or invalid"}
 	default:
 		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024))
-		return "", fmt.Errorf("unable to exchange initial token for a long lived token: %d:\n%s", resp.StatusCode, string(body))
+		return "", &tokenError{
+			statusCode: resp.StatusCode,
+			retryAfter: telemeterhttp.RetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			msg:        fmt.Sprintf("unable to exchange initial token for a long lived token: %d:\n%s", resp.StatusCode, string(body)),
+		}
 	}
 
 	response, parseErr := parseTokenFromBody(resp.Body, 16*1024)
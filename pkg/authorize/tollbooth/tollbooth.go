@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime"
 	"net/http"
 	"net/url"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/openshift/telemeter/pkg/logging"
 )
 
 type clusterRegistration struct {
@@ -24,12 +28,14 @@ type registrationError struct {
 }
 
 type authorizer struct {
+	logger log.Logger
 	to     *url.URL
 	client *http.Client
 }
 
-func NewAuthorizer(c *http.Client, to *url.URL) *authorizer {
+func NewAuthorizer(logger log.Logger, c *http.Client, to *url.URL) *authorizer {
 	return &authorizer{
+		logger: log.With(logging.OrNop(logger), "component", "authorize/tollbooth", "upstream", to),
 		to:     to,
 		client: c,
 	}
@@ -60,7 +66,7 @@ func (a *authorizer) AuthorizeCluster(token, cluster string) (string, error) {
 		// read the body to keep the upstream connection open
 		if resp.Body != nil {
 			if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
-				log.Printf("error copying body: %v", err)
+				level.Error(a.logger).Log("msg", "error copying body", "err", err)
 			}
 			resp.Body.Close()
 		}
@@ -77,24 +83,25 @@ func (a *authorizer) AuthorizeCluster(token, cluster string) (string, error) {
 	case http.StatusOK, http.StatusCreated:
 		// allowed
 	default:
-		tryLogBody(resp.Body, 4*1024, fmt.Sprintf("warning: Upstream server rejected request for cluster %q with body:\n%%s", cluster))
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024))
+		level.Warn(a.logger).Log("msg", "upstream server rejected request", "cluster", cluster, "code", resp.StatusCode, "body", string(body))
 		return "", errWithCode{error: fmt.Errorf("upstream rejected request with code %d", resp.StatusCode), code: http.StatusInternalServerError}
 	}
 	contentType := resp.Header.Get("Content-Type")
 	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil || mediaType != "application/json" {
-		log.Printf("warning: Upstream server %s responded with an unknown content type %q", a.to, contentType)
+		level.Warn(a.logger).Log("msg", "upstream server responded with an unknown content type", "content_type", contentType)
 		return "", fmt.Errorf("unrecognized token response content-type %q", contentType)
 	}
 
 	regResponse, err := tryReadResponse(resp.Body, 32*1024)
 	if err != nil {
-		log.Printf("warning: Upstream server %s response could not be parsed", a.to)
+		level.Warn(a.logger).Log("msg", "upstream server response could not be parsed", "err", err)
 		return "", fmt.Errorf("unable to parse response body: %v", err)
 	}
 
 	if len(regResponse.AccountID) == 0 {
-		log.Printf("warning: Upstream server %s responded with an empty user string", a.to)
+		level.Warn(a.logger).Log("msg", "upstream server responded with an empty user string")
 		return "", fmt.Errorf("server responded with an empty user string")
 	}
 
@@ -121,8 +128,3 @@ type errWithCode struct {
 func (e errWithCode) HTTPStatusCode() int {
 	return e.code
 }
-
-func tryLogBody(r io.Reader, limitBytes int64, format string) {
-	body, _ := ioutil.ReadAll(io.LimitReader(r, limitBytes))
-	log.Printf(format, string(body))
-}
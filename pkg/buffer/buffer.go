@@ -0,0 +1,253 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/logging"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+var (
+	droppedPayloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_buffer_dropped_payloads_total",
+		Help: "Tracks the number of buffered payloads that were dropped before they could be sent.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(droppedPayloads)
+}
+
+// payloadSuffix is the file name suffix of buffered payloads.
+const payloadSuffix = ".payload"
+
+type entry struct {
+	name    string
+	size    int64
+	created time.Time
+}
+
+// Buffer is a bounded, persistent queue of outbound metric payloads.
+// Each payload is stored as a file in a directory, using the same snappy
+// compressed delimited protobuf format that is sent to the server, so the
+// contents of the buffer survive restarts of the client.
+// Buffers are thread safe.
+type Buffer struct {
+	logger   log.Logger
+	dir      string
+	maxAge   time.Duration
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries []entry
+	size    int64
+}
+
+// Batch is a set of consecutive buffered payloads, oldest first.
+type Batch struct {
+	Families []*clientmodel.MetricFamily
+	names    []string
+}
+
+// New returns a buffer storing payloads in dir, creating the directory if needed.
+// Payloads already present in dir are loaded. Payloads older than maxAge are dropped,
+// and the oldest payloads are dropped when the total size exceeds maxBytes.
+func New(logger log.Logger, dir string, maxAge time.Duration, maxBytes int64) (*Buffer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create buffer directory: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read buffer directory: %v", err)
+	}
+
+	b := &Buffer{
+		logger:   log.With(logging.OrNop(logger), "component", "buffer"),
+		dir:      dir,
+		maxAge:   maxAge,
+		maxBytes: maxBytes,
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, payloadSuffix) {
+			continue
+		}
+		ns, err := strconv.ParseInt(strings.TrimSuffix(name, payloadSuffix), 10, 64)
+		if err != nil {
+			level.Warn(b.logger).Log("msg", "ignoring unrecognized file in buffer directory", "file", name)
+			continue
+		}
+		b.entries = append(b.entries, entry{name: name, size: f.Size(), created: time.Unix(0, ns)})
+		b.size += f.Size()
+	}
+	sort.Slice(b.entries, func(i, j int) bool { return b.entries[i].created.Before(b.entries[j].created) })
+
+	return b, nil
+}
+
+// Len returns the number of buffered payloads.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// Size returns the total size in bytes of the buffered payloads.
+func (b *Buffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Push appends the given families to the end of the buffer.
+func (b *Buffer) Push(families []*clientmodel.MetricFamily, now time.Time) error {
+	buf := &bytes.Buffer{}
+	if err := metricsclient.Write(buf, families); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Ensure that names are unique and sort in insertion order.
+	created := now
+	if n := len(b.entries); n > 0 && !created.After(b.entries[n-1].created) {
+		created = b.entries[n-1].created.Add(time.Nanosecond)
+	}
+	e := entry{
+		name:    fmt.Sprintf("%020d%s", created.UnixNano(), payloadSuffix),
+		size:    int64(buf.Len()),
+		created: created,
+	}
+
+	tmp := filepath.Join(b.dir, e.name+".tmp")
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("unable to write buffered payload: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(b.dir, e.name)); err != nil {
+		return fmt.Errorf("unable to write buffered payload: %v", err)
+	}
+	b.entries = append(b.entries, e)
+	b.size += e.size
+
+	b.expire(now)
+	for b.maxBytes > 0 && b.size > b.maxBytes && len(b.entries) > 0 {
+		b.drop(0, "size")
+	}
+	return nil
+}
+
+// Next returns the oldest buffered payloads, combined into one batch whose
+// encoded size does not exceed limitBytes. The oldest payload is always returned,
+// regardless of its size. Next returns nil if the buffer is empty.
+// The returned payloads remain in the buffer until they are committed.
+func (b *Buffer) Next(limitBytes int64, now time.Time) (*Batch, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire(now)
+
+	var (
+		batch Batch
+		size  int64
+	)
+	for i := 0; i < len(b.entries); {
+		e := b.entries[i]
+		if len(batch.names) > 0 && limitBytes > 0 && size+e.size > limitBytes {
+			break
+		}
+		f, err := os.Open(filepath.Join(b.dir, e.name))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read buffered payload: %v", err)
+		}
+		families, err := metricsclient.Read(f)
+		f.Close()
+		if err != nil {
+			level.Error(b.logger).Log("msg", "dropping unreadable buffered payload", "file", e.name, "err", err)
+			b.drop(i, "corrupt")
+			continue
+		}
+		batch.Families = append(batch.Families, families...)
+		batch.names = append(batch.names, e.name)
+		size += e.size
+		i++
+	}
+
+	if len(batch.names) == 0 {
+		return nil, nil
+	}
+	return &batch, nil
+}
+
+// Commit removes the payloads of the given batch from the buffer.
+func (b *Buffer) Commit(batch *Batch) error {
+	if batch == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	committed := make(map[string]struct{}, len(batch.names))
+	for _, name := range batch.names {
+		committed[name] = struct{}{}
+	}
+	var firstErr error
+	for i := 0; i < len(b.entries); {
+		if _, ok := committed[b.entries[i].name]; !ok {
+			i++
+			continue
+		}
+		if err := b.remove(i); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// expire drops all payloads older than the maximum age.
+// The caller must hold the lock.
+func (b *Buffer) expire(now time.Time) {
+	if b.maxAge <= 0 {
+		return
+	}
+	min := now.Add(-b.maxAge)
+	for len(b.entries) > 0 && b.entries[0].created.Before(min) {
+		b.drop(0, "expired")
+	}
+}
+
+// drop removes the payload at position i and records the reason.
+// The caller must hold the lock.
+func (b *Buffer) drop(i int, reason string) {
+	droppedPayloads.WithLabelValues(reason).Inc()
+	if err := b.remove(i); err != nil {
+		level.Error(b.logger).Log("msg", "unable to remove buffered payload", "err", err)
+	}
+}
+
+// remove deletes the payload at position i from disk and from the index.
+// The caller must hold the lock.
+func (b *Buffer) remove(i int) error {
+	e := b.entries[i]
+	b.entries = append(b.entries[:i], b.entries[i+1:]...)
+	b.size -= e.size
+	if err := os.Remove(filepath.Join(b.dir, e.name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package buffer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func family(name string, timestamp int64) []*clientmodel.MetricFamily {
+	value := float64(1)
+	return []*clientmodel.MetricFamily{{
+		Name: &name,
+		Type: clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{
+			{Gauge: &clientmodel.Gauge{Value: &value}, TimestampMs: &timestamp},
+		},
+	}}
+}
+
+func names(families []*clientmodel.MetricFamily) []string {
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	return names
+}
+
+func TestBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1000, 0)
+	b, err := New(nil, dir, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := b.Push(family(name, 1000), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Len() != 3 {
+		t.Fatalf("expected 3 buffered payloads, got %d", b.Len())
+	}
+
+	// A new buffer on the same directory loads the existing payloads in order.
+	b, err = New(nil, dir, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 3 {
+		t.Fatalf("expected 3 buffered payloads after reload, got %d", b.Len())
+	}
+
+	// A limit smaller than one payload still returns the oldest payload.
+	batch, err := b.Next(1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(batch.Families); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("expected batch [a], got %v", got)
+	}
+	if err := b.Commit(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err = b.Next(0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(batch.Families); len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Fatalf("expected batch [b c], got %v", got)
+	}
+	if err := b.Commit(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if batch, err := b.Next(0, now); err != nil || batch != nil {
+		t.Fatalf("expected empty buffer, got %v, %v", batch, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected no files in buffer directory, got %d", len(files))
+	}
+}
+
+func TestBufferLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1000, 0)
+	b, err := New(nil, dir, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Push(family("a", 1000), now); err != nil {
+		t.Fatal(err)
+	}
+	size := b.Size()
+
+	// Only two payloads fit, so the oldest is dropped.
+	b.maxBytes = 2 * size
+	for _, name := range []string{"b", "c"} {
+		if err := b.Push(family(name, 1000), now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Len() != 2 {
+		t.Fatalf("expected 2 buffered payloads, got %d", b.Len())
+	}
+
+	// All payloads expire after the maximum age.
+	batch, err := b.Next(0, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch != nil || b.Len() != 0 || b.Size() != 0 {
+		t.Fatalf("expected all payloads to expire, got %d", b.Len())
+	}
+}
@@ -5,19 +5,29 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/hashicorp/go-msgpack/codec"
 	"github.com/hashicorp/memberlist"
 	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/serialx/hashring"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/logging"
 	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/metricsclient"
 	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/quota"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/tracing"
 )
 
 var (
@@ -48,17 +58,177 @@ const (
 	protocolVersion = 1
 
 	// metricMessage carries a pre-validated metric bundle for a given partition key.
+	// Numbered bundles are requests, which the member answers with a responseMessage
+	// once they are stored.
 	// Format is:
 	//   0:      <type(byte)>
 	//   1-??:   <header(metricMessageHeader)>
 	//   remain: <snappy-compressed(protobuf-delimited-metrics)>
 	metricMessage messageType = 1
+
+	// writeMessage announces that a write for a given partition key was accepted
+	// by a member. It is gossiped to all members rather than sent to one.
+	// Format is:
+	//   0:      <type(byte)>
+	//   1-??:   <header(writeMessageHeader)>
+	writeMessage messageType = 2
+
+	// deleteMessage requests the deletion of a partition key from the store of a member.
+	// Format is:
+	//   0:      <type(byte)>
+	//   1-??:   <header(deleteMessageHeader)>
+	deleteMessage messageType = 3
+
+	// usageMessage announces the total number of samples and bytes of the writes
+	// a member accepted for a partition key since the given time. It is gossiped to
+	// all members rather than sent to one.
+	// Format is:
+	//   0:      <type(byte)>
+	//   1-??:   <header(usageMessageHeader)>
+	usageMessage messageType = 4
+
+	// partitionRequestMessage asks a member for the metrics of a partition key
+	// in its store. The member answers with a responseMessage.
+	// Format is:
+	//   0:      <type(byte)>
+	//   1-??:   <header(partitionRequestHeader)>
+	partitionRequestMessage messageType = 5
+
+	// responseMessage answers a request of another member.
+	// Format is:
+	//   0:      <type(byte)>
+	//   1-??:   <header(responseMessageHeader)>
+	//   remain: <snappy-compressed(protobuf-delimited-metrics)>
+	responseMessage messageType = 6
+)
+
+// defaultRequestTimeout is the time to wait for the response to a request
+// sent to another member. It is shorter than the 5 second timeout of an
+// upload, so that a forwarded write that is not answered can still fall back
+// to the local store.
+const defaultRequestTimeout = 3 * time.Second
+
+// Reasons for which the owner of a partition rejects a forwarded write, so
+// that the forwarding member returns the same error to the client.
+const (
+	rejectedRateLimited = "rate_limited"
+	rejectedStoreFull   = "store_full"
+	rejectedQuota       = "quota"
 )
 
 type metricMessageHeader struct {
 	PartitionKey string
+	// Account is the ID of the client authorized for the write, if any.
+	Account string
+	// Trace carries the W3C trace context of the forwarding member, if any.
+	Trace map[string]string
+	// Sequence and Delta are the sequence number of the upload and whether
+	// it only holds the series that changed since BaseSequence.
+	Sequence         uint64
+	Delta            bool
+	BaseSequence     uint64
+	DeltaTimestampMs int64
+	// ID identifies the request in the response, and From is the name of
+	// the member the response is sent to. Both are empty if no response
+	// is expected.
+	ID   uint64
+	From string
+}
+
+type writeMessageHeader struct {
+	PartitionKey string
+	TimestampMs  int64
 }
 
+type deleteMessageHeader struct {
+	PartitionKey string
+}
+
+type partitionRequestHeader struct {
+	// ID identifies the request in the response, and From is the name of
+	// the member the response is sent to.
+	ID           uint64
+	From         string
+	PartitionKey string
+}
+
+type responseMessageHeader struct {
+	ID uint64
+	// Found is false if the requested partition is not stored.
+	Found bool
+	// SequenceMismatch is true if a delta was rejected because the stored
+	// metrics of the partition do not match its base.
+	SequenceMismatch bool
+	// Rejected is the reason a forwarded write was rejected, if any, and
+	// QuotaScope and RetryAfterMs describe the quota that rejected it.
+	Rejected     string
+	QuotaScope   string
+	RetryAfterMs int64
+	Error        string
+}
+
+// response is a responseMessage along with the metrics that remain after its header.
+type response struct {
+	header responseMessageHeader
+	body   *bytes.Buffer
+}
+
+type usageMessageHeader struct {
+	From         string
+	Account      string
+	PartitionKey string
+	Samples      int64
+	Bytes        int64
+	TimestampMs  int64
+}
+
+// WriteObserver is notified of the writes accepted by other members of the cluster.
+type WriteObserver interface {
+	ObserveWrite(partitionKey string, at time.Time)
+}
+
+// writeBroadcast is a writeMessage queued for gossiping. A newer write for the
+// same partition key replaces an older one that has not been fully gossiped yet.
+type writeBroadcast struct {
+	partitionKey string
+	msg          []byte
+}
+
+func (b *writeBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*writeBroadcast)
+	return ok && o.partitionKey == b.partitionKey
+}
+
+func (b *writeBroadcast) Message() []byte { return b.msg }
+
+func (b *writeBroadcast) Finished() {}
+
+// UsageObserver is notified of the usage of the writes accepted by other
+// members of the cluster. The usage of a member is the total since the given
+// time, so observing the same usage more than once must not count it twice.
+type UsageObserver interface {
+	ObserveUsage(member, account, partitionKey string, samples, size int64, at time.Time)
+}
+
+// usageBroadcast is a usageMessage queued for gossiping. Usage is a running
+// total, so a newer usage for the same account, partition key and time
+// replaces an older one that has not been fully gossiped yet.
+type usageBroadcast struct {
+	account      string
+	partitionKey string
+	at           int64
+	msg          []byte
+}
+
+func (b *usageBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*usageBroadcast)
+	return ok && o.account == b.account && o.partitionKey == b.partitionKey && o.at == b.at
+}
+
+func (b *usageBroadcast) Message() []byte { return b.msg }
+
+func (b *usageBroadcast) Finished() {}
+
 type nodeData struct {
 	problems int
 	last     time.Time
@@ -87,8 +257,11 @@ type memberlister interface {
 // It wraps a store.Store and can be used as a drop-in store replacement to
 // forward collected metrics to the actual target node based on the current hashring state.
 type DynamicCluster struct {
-	name  string
-	store store.Store
+	logger log.Logger
+	// dropLogger reports dropped messages at most once per interval.
+	dropLogger log.Logger
+	name       string
+	store      store.Store
 	// skip problematic endpoints for at least this amount of time
 	expiration time.Duration
 
@@ -100,14 +273,30 @@ type DynamicCluster struct {
 	// and is processed in the #handleMessage function.
 	queue chan ([]byte)
 
+	// observer is notified of the writes gossiped by other members.
+	// If it is set, the writes to this member are gossiped via broadcasts.
+	observer   WriteObserver
+	broadcasts *memberlist.TransmitLimitedQueue
+	// usageObserver is notified of the usage gossiped by other members.
+	usageObserver UsageObserver
+
+	// requests holds the requests to other members awaiting a response.
+	requestTimeout time.Duration
+	requestLock    sync.Mutex
+	lastRequestID  uint64
+	requests       map[uint64]chan response
+
 	lock        sync.RWMutex
 	ring        *hashring.HashRing
 	problematic map[string]*nodeData
 }
 
 // NewDynamic returns a new DynamicCluster struct for the given name and underlying store.
-func NewDynamic(name string, store store.Store) *DynamicCluster {
-	return &DynamicCluster{
+func NewDynamic(logger log.Logger, name string, store store.Store) *DynamicCluster {
+	logger = log.With(logging.OrNop(logger), "component", "cluster")
+	c := &DynamicCluster{
+		logger:     logger,
+		dropLogger: logging.NewRateLimited(logger, 10*time.Second),
 		name:       name,
 		store:      store,
 		expiration: 2 * time.Minute,
@@ -115,7 +304,62 @@ func NewDynamic(name string, store store.Store) *DynamicCluster {
 
 		queue:       make(chan []byte, 100),
 		problematic: make(map[string]*nodeData),
+
+		requestTimeout: defaultRequestTimeout,
+		requests:       make(map[uint64]chan response),
 	}
+	c.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes: func() int {
+			if c.ml == nil {
+				return 1
+			}
+			return c.ml.NumMembers()
+		},
+		RetransmitMult: 3,
+	}
+	return c
+}
+
+// ObserveWrites gossips every write to this member to the other members of the
+// cluster, and notifies the given observer of the writes gossiped by the other
+// members. This allows limits on writes per partition key to be enforced
+// cluster-wide rather than per member, regardless of which member receives a write.
+// It must be called before Start.
+func (c *DynamicCluster) ObserveWrites(observer WriteObserver) {
+	c.observer = observer
+}
+
+// ObserveUsage notifies the given observer of the usage gossiped by the other
+// members of the cluster with GossipUsage. This allows quotas to be enforced
+// cluster-wide rather than per member. It must be called before Start.
+func (c *DynamicCluster) ObserveUsage(observer UsageObserver) {
+	c.usageObserver = observer
+}
+
+// GossipUsage queues the total usage of the writes accepted by this member for
+// the partition key since the given time for gossiping to the other members
+// of the cluster.
+func (c *DynamicCluster) GossipUsage(account, partitionKey string, samples, size int64, at time.Time) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(usageMessage))
+	header := usageMessageHeader{
+		From:         c.name,
+		Account:      account,
+		PartitionKey: partitionKey,
+		Samples:      samples,
+		Bytes:        size,
+		TimestampMs:  at.UnixNano() / int64(time.Millisecond),
+	}
+	if err := codec.NewEncoder(buf, msgHandle).Encode(&header); err != nil {
+		level.Error(c.logger).Log("msg", "unable to gossip usage", "partition", partitionKey, "err", err)
+		return
+	}
+	c.broadcasts.QueueBroadcast(&usageBroadcast{
+		account:      account,
+		partitionKey: partitionKey,
+		at:           header.TimestampMs,
+		msg:          buf.Bytes(),
+	})
 }
 
 // Start starts processing the internal message queue
@@ -127,7 +371,8 @@ func (c *DynamicCluster) Start(ml memberlister, ctx context.Context) {
 	go func() {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Fatalf("Unable to refresh the hash ring: %v", err)
+				level.Error(c.logger).Log("msg", "unable to refresh the hash ring", "err", err)
+				os.Exit(1)
 			}
 		}()
 		for {
@@ -141,7 +386,7 @@ func (c *DynamicCluster) Start(ml memberlister, ctx context.Context) {
 			select {
 			case data := <-c.queue:
 				if err := c.handleMessage(data); err != nil {
-					log.Printf("error: Unable to handle incoming message: %v", err)
+					level.Error(c.logger).Log("msg", "unable to handle incoming message", "err", err)
 				}
 			case <-ctx.Done():
 				return
@@ -160,12 +405,12 @@ func (c *DynamicCluster) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	info := c.debugInfo()
 	data, err := json.MarshalIndent(info, "", "  ")
 	if err != nil {
-		log.Printf("marshaling debug info failed: %v", err)
+		level.Error(c.logger).Log("msg", "marshaling debug info failed", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	if _, err := w.Write(data); err != nil {
-		log.Printf("writing debug info failed: %v", err)
+		level.Error(c.logger).Log("msg", "writing debug info failed", "err", err)
 	}
 }
 
@@ -216,7 +461,7 @@ func (c *DynamicCluster) Join(seeds []string) error {
 func (c *DynamicCluster) NotifyJoin(node *memberlist.Node) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	log.Printf("[%s] node joined %s", c.name, node.Name)
+	level.Info(c.logger).Log("msg", "node joined", "node", node.Name)
 	c.ring.AddNode(node.Name)
 }
 
@@ -226,7 +471,7 @@ func (c *DynamicCluster) NotifyJoin(node *memberlist.Node) {
 func (c *DynamicCluster) NotifyLeave(node *memberlist.Node) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	log.Printf("[%s] node left %s", c.name, node.Name)
+	level.Info(c.logger).Log("msg", "node left", "node", node.Name)
 	c.ring.RemoveNode(node.Name)
 }
 
@@ -234,7 +479,7 @@ func (c *DynamicCluster) NotifyLeave(node *memberlist.Node) {
 //
 // See github.com/hashicorp/memberlist#EventDelegate.NotifyUpdate
 func (c *DynamicCluster) NotifyUpdate(node *memberlist.Node) {
-	log.Printf("[%s] node update %s", c.name, node.Name)
+	level.Info(c.logger).Log("msg", "node update", "node", node.Name)
 }
 
 // NodeMeta is the callback that is invoked when metadata is retrieved about this node.
@@ -252,18 +497,41 @@ func (c *DynamicCluster) NotifyMsg(data []byte) {
 	if len(data) == 0 {
 		return
 	}
+	// Gossiped writes and usage, and responses are cheap to handle, so they
+	// bypass the queue.
+	switch messageType(data[0]) {
+	case responseMessage:
+		if err := c.handleResponseMessage(data); err != nil {
+			level.Error(c.logger).Log("msg", "unable to handle incoming response message", "err", err)
+		}
+		return
+	case writeMessage:
+		if err := c.handleWriteMessage(data, time.Now()); err != nil {
+			level.Error(c.logger).Log("msg", "unable to handle incoming write message", "err", err)
+		}
+		return
+	case usageMessage:
+		if err := c.handleUsageMessage(data, time.Now()); err != nil {
+			level.Error(c.logger).Log("msg", "unable to handle incoming usage message", "err", err)
+		}
+		return
+	}
 	copied := make([]byte, len(data))
 	copy(copied, data)
 	select {
 	case c.queue <- copied:
 	default:
-		log.Printf("error: Too many incoming requests queued, dropped data")
+		level.Error(c.dropLogger).Log("msg", "too many incoming requests queued, dropped data")
 	}
 }
 
 // GetBroadcasts is the callback that is invoked, when user data messages can be broadcast.
-// It is unused.
-func (c *DynamicCluster) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+// It returns the queued write messages.
+//
+// See github.com/hashicorp/memberlist#Delegate.GetBroadcasts
+func (c *DynamicCluster) GetBroadcasts(overhead, limit int) [][]byte {
+	return c.broadcasts.GetBroadcasts(overhead, limit)
+}
 
 // LocalState is the callback that is invoked for a TCP Push/Pull.
 // It is unused.
@@ -293,19 +561,267 @@ func (c *DynamicCluster) handleMessage(data []byte) error {
 		if err != nil {
 			return err
 		}
-		if len(families) == 0 {
+		err = c.writeForwarded(header, families)
+		if header.ID == 0 {
+			return err
+		}
+		resp := writeResponse(header.ID, err)
+		if rerr := c.respond(header.From, resp, nil); rerr != nil {
+			return rerr
+		}
+		if resp.SequenceMismatch || len(resp.Rejected) > 0 {
+			// The forwarding member returns it to the client.
 			return nil
 		}
-		return c.store.WriteMetrics(c.ctx, &store.PartitionedMetrics{
-			PartitionKey: header.PartitionKey,
-			Families:     families,
-		})
+		return err
+
+	case deleteMessage:
+		var header deleteMessageHeader
+		if err := codec.NewDecoder(bytes.NewBuffer(data[1:]), msgHandle).Decode(&header); err != nil {
+			return err
+		}
+		if len(header.PartitionKey) == 0 {
+			return fmt.Errorf("delete message must have a partition key")
+		}
+		_, err := store.DeletePartition(c.ctx, c.store, header.PartitionKey)
+		return err
+
+	case partitionRequestMessage:
+		var header partitionRequestHeader
+		if err := codec.NewDecoder(bytes.NewBuffer(data[1:]), msgHandle).Decode(&header); err != nil {
+			return err
+		}
+		p, err := store.GetPartition(c.ctx, c.store, header.PartitionKey)
+		resp := responseMessageHeader{ID: header.ID, Found: p != nil}
+		var families []*clientmodel.MetricFamily
+		if err != nil {
+			resp.Found, resp.Error = false, err.Error()
+		} else if p != nil {
+			families = p.Families
+		}
+		return c.respond(header.From, resp, families)
 
 	default:
 		return fmt.Errorf("unrecognized message %0x, len=%d", data[0], len(data))
 	}
 }
 
+// writeForwarded stores the metrics forwarded by another member.
+func (c *DynamicCluster) writeForwarded(header metricMessageHeader, families []*clientmodel.MetricFamily) error {
+	if len(families) == 0 && !header.Delta {
+		return nil
+	}
+	span, ctx := tracing.Extract(c.ctx, "cluster.handleMessage", header.Trace)
+	if len(header.Account) > 0 {
+		ctx = authorize.WithClient(ctx, &authorize.Client{ID: header.Account})
+	}
+	p := &store.PartitionedMetrics{
+		PartitionKey: header.PartitionKey,
+		Families:     families,
+		Sequence:     header.Sequence,
+	}
+	if header.Delta {
+		p.Delta = &store.Delta{BaseSequence: header.BaseSequence, TimestampMs: header.DeltaTimestampMs}
+	}
+	err := c.store.WriteMetrics(ctx, p)
+	tracing.Finish(span, err)
+	return err
+}
+
+// writeResponse returns the response to a forwarded write that failed with
+// the given error, if any.
+func writeResponse(id uint64, err error) responseMessageHeader {
+	resp := responseMessageHeader{ID: id}
+	if err == nil {
+		return resp
+	}
+	resp.Error = err.Error()
+	if qerr, ok := err.(*quota.ExceededError); ok {
+		resp.Rejected, resp.QuotaScope = rejectedQuota, qerr.Scope
+		resp.RetryAfterMs = int64(qerr.RetryAfter / time.Millisecond)
+		return resp
+	}
+	switch err {
+	case store.ErrSequenceMismatch:
+		resp.SequenceMismatch = true
+	case ratelimited.ErrWriteLimitReached:
+		resp.Rejected = rejectedRateLimited
+	case memstore.ErrStoreFull:
+		resp.Rejected = rejectedStoreFull
+	}
+	return resp
+}
+
+// writeError returns the error with which the owner of a partition rejected
+// a forwarded write, as returned by its store.
+func writeError(resp responseMessageHeader) error {
+	switch {
+	case resp.SequenceMismatch:
+		return store.ErrSequenceMismatch
+	case resp.Rejected == rejectedRateLimited:
+		return ratelimited.ErrWriteLimitReached
+	case resp.Rejected == rejectedStoreFull:
+		return memstore.ErrStoreFull
+	case resp.Rejected == rejectedQuota:
+		return &quota.ExceededError{Scope: resp.QuotaScope, RetryAfter: time.Duration(resp.RetryAfterMs) * time.Millisecond}
+	default:
+		return fmt.Errorf("%s", resp.Error)
+	}
+}
+
+// handleWriteMessage notifies the observer of a write gossiped by another member.
+// Writes from the future, due to clock skew, are treated as happening now.
+func (c *DynamicCluster) handleWriteMessage(data []byte, now time.Time) error {
+	if c.observer == nil {
+		return nil
+	}
+	var header writeMessageHeader
+	if err := codec.NewDecoder(bytes.NewBuffer(data[1:]), msgHandle).Decode(&header); err != nil {
+		return err
+	}
+	if len(header.PartitionKey) == 0 {
+		return fmt.Errorf("write message must have a partition key")
+	}
+	at := time.Unix(0, header.TimestampMs*int64(time.Millisecond))
+	if at.After(now) {
+		at = now
+	}
+	c.observer.ObserveWrite(header.PartitionKey, at)
+	return nil
+}
+
+// handleResponseMessage passes a response to the request awaiting it, if any.
+func (c *DynamicCluster) handleResponseMessage(data []byte) error {
+	buf := bytes.NewBuffer(data[1:])
+	var header responseMessageHeader
+	if err := codec.NewDecoder(buf, msgHandle).Decode(&header); err != nil {
+		return err
+	}
+	c.requestLock.Lock()
+	ch, ok := c.requests[header.ID]
+	delete(c.requests, header.ID)
+	c.requestLock.Unlock()
+	if !ok {
+		// The request timed out.
+		return nil
+	}
+	// The body is only valid during NotifyMsg.
+	ch <- response{header: header, body: bytes.NewBuffer(append([]byte(nil), buf.Bytes()...))}
+	return nil
+}
+
+// request sends the message built by msg for a new request ID to the given
+// member and waits for its response.
+func (c *DynamicCluster) request(ctx context.Context, node *memberlist.Node, msg func(id uint64) ([]byte, error)) (response, error) {
+	ch := make(chan response, 1)
+	c.requestLock.Lock()
+	c.lastRequestID++
+	id := c.lastRequestID
+	c.requests[id] = ch
+	c.requestLock.Unlock()
+	defer func() {
+		c.requestLock.Lock()
+		delete(c.requests, id)
+		c.requestLock.Unlock()
+	}()
+
+	data, err := msg(id)
+	if err != nil {
+		return response{}, err
+	}
+	if err := c.ml.SendReliable(node, data); err != nil {
+		return response{}, err
+	}
+
+	timer := time.NewTimer(c.requestTimeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		if len(resp.header.Error) > 0 {
+			return resp, fmt.Errorf("%s", resp.header.Error)
+		}
+		return resp, nil
+	case <-timer.C:
+		return response{}, fmt.Errorf("no response from %s within %s", node.Name, c.requestTimeout)
+	case <-ctx.Done():
+		return response{}, ctx.Err()
+	}
+}
+
+// respond sends the response to a request to the member it came from.
+func (c *DynamicCluster) respond(to string, header responseMessageHeader, families []*clientmodel.MetricFamily) error {
+	node := c.memberByName(to)
+	if node == nil {
+		return fmt.Errorf("unable to respond to unknown member %s", to)
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(responseMessage))
+	if err := codec.NewEncoder(buf, msgHandle).Encode(&header); err != nil {
+		return err
+	}
+	if err := metricsclient.Write(buf, families); err != nil {
+		return fmt.Errorf("unable to write metrics: %v", err)
+	}
+	return c.ml.SendReliable(node, buf.Bytes())
+}
+
+// fetchPartition asks the given member for a partition in its store.
+func (c *DynamicCluster) fetchPartition(ctx context.Context, node *memberlist.Node, partitionKey string) (*store.PartitionedMetrics, error) {
+	resp, err := c.request(ctx, node, func(id uint64) ([]byte, error) {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(byte(partitionRequestMessage))
+		header := partitionRequestHeader{ID: id, From: c.name, PartitionKey: partitionKey}
+		if err := codec.NewEncoder(buf, msgHandle).Encode(&header); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+	if err != nil || !resp.header.Found {
+		return nil, err
+	}
+	families, err := metricsclient.Read(resp.body)
+	if err != nil {
+		return nil, err
+	}
+	return &store.PartitionedMetrics{PartitionKey: partitionKey, Families: families}, nil
+}
+
+// handleUsageMessage notifies the usage observer of the usage gossiped by another
+// member. Usage from the future, due to clock skew, is treated as happening now.
+func (c *DynamicCluster) handleUsageMessage(data []byte, now time.Time) error {
+	if c.usageObserver == nil {
+		return nil
+	}
+	var header usageMessageHeader
+	if err := codec.NewDecoder(bytes.NewBuffer(data[1:]), msgHandle).Decode(&header); err != nil {
+		return err
+	}
+	if len(header.PartitionKey) == 0 {
+		return fmt.Errorf("usage message must have a partition key")
+	}
+	at := time.Unix(0, header.TimestampMs*int64(time.Millisecond))
+	if at.After(now) {
+		at = now
+	}
+	c.usageObserver.ObserveUsage(header.From, header.Account, header.PartitionKey, header.Samples, header.Bytes, at)
+	return nil
+}
+
+// broadcastWrite queues a write message for the given partition key for gossiping.
+func (c *DynamicCluster) broadcastWrite(partitionKey string, now time.Time) error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(writeMessage))
+	header := writeMessageHeader{
+		PartitionKey: partitionKey,
+		TimestampMs:  now.UnixNano() / int64(time.Millisecond),
+	}
+	if err := codec.NewEncoder(buf, msgHandle).Encode(&header); err != nil {
+		return err
+	}
+	c.broadcasts.QueueBroadcast(&writeBroadcast{partitionKey: partitionKey, msg: buf.Bytes()})
+	return nil
+}
+
 func (c *DynamicCluster) memberByName(name string) *memberlist.Node {
 	for _, n := range c.ml.Members() {
 		if n.Name == name {
@@ -350,90 +866,231 @@ func (c *DynamicCluster) problemDetected(name string, now time.Time) {
 
 func (c *DynamicCluster) findRemote(partitionKey string, now time.Time) (*memberlist.Node, bool) {
 	if c.ml.NumMembers() < 2 {
-		log.Printf("Only a single node, do nothing")
+		level.Debug(c.logger).Log("msg", "only a single node, do nothing")
 		metricForwardResult.WithLabelValues("singleton").Inc()
 		return nil, false
 	}
 
 	nodeName, ok := c.getNodeForKey(partitionKey)
 	if !ok {
-		log.Printf("No node found in ring for %s", partitionKey)
+		level.Debug(c.logger).Log("msg", "no node found in ring", "partition", partitionKey)
 		metricForwardResult.WithLabelValues("no_key").Inc()
 		return nil, false
 	}
 
 	if c.hasProblems(nodeName, now) {
-		log.Printf("Node %s has failed recently, using local storage", nodeName)
+		level.Debug(c.logger).Log("msg", "node has failed recently, using local storage", "node", nodeName)
 		metricForwardResult.WithLabelValues("recently_failed").Inc()
 		return nil, false
 	}
 
 	node := c.memberByName(nodeName)
 	if node == nil {
-		log.Printf("No node found named %s", nodeName)
+		level.Debug(c.logger).Log("msg", "no node found", "node", nodeName)
 		metricForwardResult.WithLabelValues("no_member").Inc()
 		return nil, false
 	}
 	return node, true
 }
 
+// forwardMetrics sends the metrics to the member owning their partition key, and
+// returns false if they are to be stored locally. Numbered metrics are sent as a
+// request, so that the owner rejecting a delta is returned as
+// store.ErrSequenceMismatch, and so that a delta is never stored before the
+// upload it is based on. The other metrics are sent without waiting for the
+// owner to store them.
 func (c *DynamicCluster) forwardMetrics(ctx context.Context, p *store.PartitionedMetrics) (ok bool, err error) {
 	now := time.Now()
+	span, ctx := tracing.StartSpan(ctx, "cluster.forwardMetrics")
+	defer func() { tracing.Finish(span, err) }()
 
 	node, ok := c.findRemote(p.PartitionKey, now)
 	if !ok {
 		return false, fmt.Errorf("cannot forward")
 	}
+	span.SetAttributes(attribute.String("node", node.Name))
 	if node.Name == c.name {
 		return false, nil
 	}
 
-	buf := &bytes.Buffer{}
-	enc := codec.NewEncoder(buf, msgHandle)
-
-	// write the metric message
-	buf.WriteByte(byte(metricMessage))
-	if err := enc.Encode(&metricMessageHeader{PartitionKey: p.PartitionKey}); err != nil {
-		metricForwardResult.WithLabelValues("encode_header").Inc()
-		return false, err
+	header := metricMessageHeader{PartitionKey: p.PartitionKey, Trace: tracing.Inject(ctx)}
+	if client, ok := authorize.FromContext(ctx); ok {
+		header.Account = client.ID
 	}
-	if err := metricsclient.Write(buf, p.Families); err != nil {
+	header.Sequence = p.Sequence
+	if p.Delta != nil {
+		header.Delta, header.BaseSequence, header.DeltaTimestampMs = true, p.Delta.BaseSequence, p.Delta.TimestampMs
+	}
+	body := &bytes.Buffer{}
+	if err := metricsclient.Write(body, p.Families); err != nil {
 		metricForwardResult.WithLabelValues("encode").Inc()
 		return false, fmt.Errorf("unable to write metrics: %v", err)
 	}
+	msg := func(id uint64) ([]byte, error) {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(byte(metricMessage))
+		header.ID = id
+		if id != 0 {
+			header.From = c.name
+		}
+		if err := codec.NewEncoder(buf, msgHandle).Encode(&header); err != nil {
+			metricForwardResult.WithLabelValues("encode_header").Inc()
+			return nil, err
+		}
+		buf.Write(body.Bytes())
+		return buf.Bytes(), nil
+	}
 
 	metricForwardSamples.Add(float64(metricfamily.MetricsCount(p.Families)))
 
-	if err := c.ml.SendReliable(node, buf.Bytes()); err != nil {
-		log.Printf("error: Failed to forward metrics to %s: %v", node, err)
-		c.problemDetected(node.Name, now)
-		metricForwardResult.WithLabelValues("send").Inc()
-		metricForwardLatency.WithLabelValues("send").Observe(time.Since(now).Seconds())
-	} else {
-		metricForwardLatency.WithLabelValues("").Observe(time.Since(now).Seconds())
+	if p.Sequence == 0 {
+		data, err := msg(0)
+		if err != nil {
+			return false, err
+		}
+		if err := c.ml.SendReliable(node, data); err != nil {
+			c.forwarded(node, p.PartitionKey, now, err)
+			return false, err
+		}
+		c.forwarded(node, p.PartitionKey, now, nil)
+		return true, nil
 	}
 
+	resp, err := c.request(ctx, node, msg)
+	switch {
+	case len(resp.header.Error) > 0:
+		// The owner received the metrics but rejected them.
+		c.forwarded(node, p.PartitionKey, now, nil)
+		return true, writeError(resp.header)
+	case err != nil:
+		c.forwarded(node, p.PartitionKey, now, err)
+		return false, err
+	}
+	c.forwarded(node, p.PartitionKey, now, nil)
 	return true, nil
 }
 
+// forwarded records the outcome of sending metrics to the given member.
+func (c *DynamicCluster) forwarded(node *memberlist.Node, partitionKey string, start time.Time, err error) {
+	if err != nil {
+		level.Error(c.logger).Log("msg", "failed to forward metrics", "node", node.Name, "partition", partitionKey, "err", err)
+		c.problemDetected(node.Name, start)
+		metricForwardResult.WithLabelValues("send").Inc()
+		metricForwardLatency.WithLabelValues("send").Observe(time.Since(start).Seconds())
+		return
+	}
+	metricForwardLatency.WithLabelValues("").Observe(time.Since(start).Seconds())
+}
+
 // ReadMetrics simply forwards to the underlying store.
 func (c *DynamicCluster) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
 	return c.store.ReadMetrics(ctx, minTimestampMs)
 }
 
+// StreamMetrics simply forwards to the underlying store.
+func (c *DynamicCluster) StreamMetrics(ctx context.Context, minTimestampMs int64, fn func(*store.StreamedPartition) error) error {
+	return store.Stream(ctx, c.store, minTimestampMs, fn)
+}
+
+// ListPartitions lists the partitions stored locally, along with the member
+// each partition belongs to according to the current hash ring. The partitions
+// stored by the other members are not listed, so the partitions of the cluster
+// are listed by asking every member.
+func (c *DynamicCluster) ListPartitions(ctx context.Context) ([]*store.PartitionInfo, error) {
+	infos, err := store.ListPartitions(ctx, c.store)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if owner, ok := c.getNodeForKey(info.PartitionKey); ok {
+			info.Owner = owner
+		}
+	}
+	return infos, nil
+}
+
+// GetPartition returns the given partition if it is stored locally. Otherwise,
+// it asks the member the partition belongs to for it, and returns a
+// store.NotOwnerError if that member cannot be asked.
+func (c *DynamicCluster) GetPartition(ctx context.Context, partitionKey string) (*store.PartitionedMetrics, error) {
+	p, err := store.GetPartition(ctx, c.store, partitionKey)
+	if err != nil || p != nil {
+		return p, err
+	}
+	owner, ok := c.getNodeForKey(partitionKey)
+	if !ok || owner == c.name || c.ml == nil {
+		return nil, nil
+	}
+	node := c.memberByName(owner)
+	if node == nil {
+		return nil, &store.NotOwnerError{PartitionKey: partitionKey, Owner: owner, Err: fmt.Errorf("no such member")}
+	}
+	p, err = c.fetchPartition(ctx, node, partitionKey)
+	if err != nil {
+		return nil, &store.NotOwnerError{PartitionKey: partitionKey, Owner: owner, Err: err}
+	}
+	return p, nil
+}
+
+// DeletePartition deletes the given partition locally and asks every other member
+// to delete it as well, since it may have been stored outside of its owner when
+// forwarding failed. The other members delete it asynchronously, so it returns
+// true if the partition was stored locally or other members were asked to delete it.
+func (c *DynamicCluster) DeletePartition(ctx context.Context, partitionKey string) (bool, error) {
+	deleted, err := store.DeletePartition(ctx, c.store, partitionKey)
+	if err != nil {
+		return false, err
+	}
+	if c.ml == nil {
+		return deleted, nil
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(deleteMessage))
+	if err := codec.NewEncoder(buf, msgHandle).Encode(&deleteMessageHeader{PartitionKey: partitionKey}); err != nil {
+		return deleted, err
+	}
+	for _, n := range c.ml.Members() {
+		if n.Name == c.name {
+			continue
+		}
+		if err := c.ml.SendReliable(n, buf.Bytes()); err != nil {
+			return deleted, fmt.Errorf("unable to request deletion from %s: %v", n.Name, err)
+		}
+		deleted = true
+	}
+	return deleted, nil
+}
+
 // WriteMetrics stores metrics locally if they were meant for this node
 // and forwards them to the target node matching the given partition key.
+// If writes are observed, an accepted write is also gossiped to all other nodes.
+// A numbered write rejected by the target node returns the error of its store,
+// such as store.ErrSequenceMismatch or ratelimited.ErrWriteLimitReached.
 func (c *DynamicCluster) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
+	err := c.writeMetrics(ctx, p)
+	// Only accepted writes are gossiped, so that a rejected write does not
+	// count against the limits of the other members.
+	if err == nil && c.observer != nil {
+		if err := c.broadcastWrite(p.PartitionKey, time.Now()); err != nil {
+			level.Error(c.logger).Log("msg", "unable to gossip write", "partition", p.PartitionKey, "err", err)
+		}
+	}
+	return err
+}
+
+func (c *DynamicCluster) writeMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
 	ok, err := c.forwardMetrics(ctx, p)
-	if err != nil {
+	if err != nil && !ok {
 		// fallthrough to local metrics
-		log.Printf("error: Unable to write to remote metrics, falling back to local: %v", err)
+		level.Warn(c.logger).Log("msg", "unable to write to remote metrics, falling back to local", "partition", p.PartitionKey, "err", err)
 		return c.store.WriteMetrics(ctx, p)
 	}
 	if ok {
-		// metrics were forwarded successfully
+		// metrics were forwarded successfully, though the owner may have
+		// rejected them
 		metricForwardResult.WithLabelValues("").Inc()
-		return nil
+		return err
 	}
 
 	metricForwardResult.WithLabelValues("self").Inc()
@@ -5,15 +5,31 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
 	"reflect"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hashicorp/memberlist"
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/http/server"
+	"github.com/openshift/telemeter/pkg/metricsclient"
 	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/quota"
+	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/tracing"
+	"github.com/openshift/telemeter/pkg/validate"
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 type testStore struct {
@@ -52,6 +68,23 @@ func (l *testMemberlister) SendReliable(n *memberlist.Node, payload []byte) erro
 	return l.sendReliableErr
 }
 
+// linkedMemberlister delivers the messages sent to a member to its cluster,
+// so that requests are answered.
+type linkedMemberlister struct {
+	testMemberlister
+	clusters map[string]*DynamicCluster
+}
+
+func (l *linkedMemberlister) SendReliable(n *memberlist.Node, payload []byte) error {
+	if err := l.testMemberlister.SendReliable(n, payload); err != nil {
+		return err
+	}
+	if c, ok := l.clusters[n.Name]; ok {
+		c.NotifyMsg(payload)
+	}
+	return nil
+}
+
 func TestWriteMetrics(t *testing.T) {
 	pr := prometheus.NewRegistry()
 	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test", Help: "test"})
@@ -231,7 +264,7 @@ func TestWriteMetrics(t *testing.T) {
 			memberlisterCheck: forwardedToNode(&memberlist.Node{Name: "remote"}),
 		},
 		{
-			name: "2 ring members remote forward failure",
+			name: "2 ring members remote forward failure falls back to local",
 
 			partitionKey: "a",
 			memberlister: &testMemberlister{
@@ -245,7 +278,7 @@ func TestWriteMetrics(t *testing.T) {
 			localStore: &testStore{readErr: nil, writeErr: nil},
 
 			writeMetricsCheck: errIs(nil),
-			localStoreCheck:   noWrite,
+			localStoreCheck:   writtenPartitionKeyIs("a"),
 			memberlisterCheck: forwardedToNode(&memberlist.Node{Name: "remote"}),
 		},
 		{
@@ -267,7 +300,7 @@ func TestWriteMetrics(t *testing.T) {
 			},
 
 			writeMetricsCheck:   errIs(nil),
-			localStoreCheck:     noWrite,
+			localStoreCheck:     writtenPartitionKeyIs("a"),
 			memberlisterCheck:   forwardedToNode(&memberlist.Node{Name: "remote"}),
 			dynamicClusterCheck: nodeHasProblems(false, "remote", time.Now()),
 		},
@@ -347,13 +380,13 @@ func TestWriteMetrics(t *testing.T) {
 			},
 
 			writeMetricsCheck:   errIs(nil),
-			localStoreCheck:     noWrite,
+			localStoreCheck:     writtenPartitionKeyIs("a"),
 			memberlisterCheck:   forwardedToNode(&memberlist.Node{Name: "remote"}),
 			dynamicClusterCheck: nodeHasProblems(false, "remote", time.Now()),
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			dc := NewDynamic("local", tc.localStore)
+			dc := NewDynamic(nil, "local", tc.localStore)
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 			defer cancel()
 
@@ -391,3 +424,486 @@ func TestWriteMetrics(t *testing.T) {
 		})
 	}
 }
+
+type testObserver struct {
+	writes map[string]time.Time
+}
+
+func (o *testObserver) ObserveWrite(partitionKey string, at time.Time) {
+	o.writes[partitionKey] = at
+}
+
+func TestObserveWrites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	members := []*memberlist.Node{{Name: "local"}, {Name: "remote"}}
+
+	local := NewDynamic(nil, "local", &testStore{})
+	local.ObserveWrites(&testObserver{writes: make(map[string]time.Time)})
+	local.Start(&testMemberlister{numMembers: 2, members: members}, ctx)
+	local.refreshRing()
+
+	observer := &testObserver{writes: make(map[string]time.Time)}
+	remote := NewDynamic(nil, "remote", &testStore{})
+	remote.ObserveWrites(observer)
+	remote.Start(&testMemberlister{numMembers: 2, members: members}, ctx)
+
+	before := time.Now().Truncate(time.Millisecond)
+	for _, partitionKey := range []string{"a", "c", "a"} {
+		if err := local.WriteMetrics(ctx, &store.PartitionedMetrics{PartitionKey: partitionKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broadcasts := local.GetBroadcasts(0, 1400)
+	if len(broadcasts) != 2 {
+		t.Fatalf("expected one broadcast per partition key, got %d", len(broadcasts))
+	}
+	for _, msg := range broadcasts {
+		remote.NotifyMsg(msg)
+	}
+	for _, partitionKey := range []string{"a", "c"} {
+		at, ok := observer.writes[partitionKey]
+		if !ok {
+			t.Errorf("expected write for partition key %s to be observed", partitionKey)
+			continue
+		}
+		if at.Before(before) || at.After(time.Now()) {
+			t.Errorf("unexpected time %s of write for partition key %s", at, partitionKey)
+		}
+	}
+}
+
+type testUsageObserver struct {
+	usage []usageMessageHeader
+}
+
+func (o *testUsageObserver) ObserveUsage(member, account, partitionKey string, samples, size int64, at time.Time) {
+	o.usage = append(o.usage, usageMessageHeader{
+		From:         member,
+		Account:      account,
+		PartitionKey: partitionKey,
+		Samples:      samples,
+		Bytes:        size,
+		TimestampMs:  at.UnixNano() / int64(time.Millisecond),
+	})
+}
+
+func TestObserveUsage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	members := []*memberlist.Node{{Name: "local"}, {Name: "remote"}}
+
+	local := NewDynamic(nil, "local", &testStore{})
+	local.Start(&testMemberlister{numMembers: 2, members: members}, ctx)
+
+	observer := &testUsageObserver{}
+	remote := NewDynamic(nil, "remote", &testStore{})
+	remote.ObserveUsage(observer)
+	remote.Start(&testMemberlister{numMembers: 2, members: members}, ctx)
+
+	now := time.Now()
+	for i := int64(1); i <= 5; i++ {
+		local.GossipUsage("account", "a", i, i*10, now)
+	}
+	if n := local.broadcasts.NumQueued(); n != 1 {
+		t.Fatalf("expected the usage of a partition to be queued once, got %d", n)
+	}
+	local.GossipUsage("account", "a", 2, 50, now.Add(-time.Minute))
+	local.GossipUsage("", "b", 1, 10, now.Add(time.Hour))
+
+	broadcasts := local.GetBroadcasts(0, 1400)
+	if len(broadcasts) != 3 {
+		t.Fatalf("expected every partition and time to be broadcast, got %d", len(broadcasts))
+	}
+	for _, msg := range broadcasts {
+		remote.NotifyMsg(msg)
+	}
+	if len(observer.usage) != 3 {
+		t.Fatalf("expected 3 observed usages, got %v", observer.usage)
+	}
+	var samples, size int64
+	for _, u := range observer.usage {
+		samples += u.Samples
+		size += u.Bytes
+		if u.From != "local" {
+			t.Errorf("expected the usage to come from the local member, got %q", u.From)
+		}
+		if u.TimestampMs > time.Now().UnixNano()/int64(time.Millisecond) {
+			t.Errorf("expected usage from the future to be observed now, got %d", u.TimestampMs)
+		}
+		if u.PartitionKey == "a" && u.Account != "account" {
+			t.Errorf("expected the account of the usage, got %q", u.Account)
+		}
+	}
+	if samples != 8 || size != 110 {
+		t.Errorf("unexpected total usage of %d samples and %d bytes", samples, size)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	members := []*memberlist.Node{{Name: "local"}, {Name: "remote"}}
+
+	clusters := make(map[string]*DynamicCluster)
+	ml := &linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}
+	local := NewDynamic(nil, "local", memstore.New(time.Hour))
+	local.Start(ml, ctx)
+	local.refreshRing()
+	remoteStore := memstore.New(time.Hour)
+	remote := NewDynamic(nil, "remote", remoteStore)
+	remote.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	remote.refreshRing()
+	clusters["local"], clusters["remote"] = local, remote
+
+	// find a partition key owned by the remote member
+	var partitionKey string
+	for i := 0; len(partitionKey) == 0; i++ {
+		if owner, _ := local.getNodeForKey(fmt.Sprint(i)); owner == "remote" {
+			partitionKey = fmt.Sprint(i)
+		}
+	}
+	p := &store.PartitionedMetrics{
+		PartitionKey: partitionKey,
+		Families:     []*clientmodel.MetricFamily{{Name: proto.String("test"), Metric: []*clientmodel.Metric{{TimestampMs: proto.Int64(1)}}}},
+	}
+	if err := remoteStore.WriteMetrics(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched, err := local.GetPartition(ctx, partitionKey)
+	if err != nil {
+		t.Fatalf("expected the partition to be fetched from the remote member, got %v", err)
+	}
+	if fetched == nil || fetched.PartitionKey != partitionKey || len(fetched.Families) != 1 || !proto.Equal(fetched.Families[0], p.Families[0]) {
+		t.Fatalf("unexpected partition %v", fetched)
+	}
+	missing := partitionKey
+	for i := 0; missing == partitionKey; i++ {
+		if owner, _ := local.getNodeForKey(fmt.Sprint("missing", i)); owner == "remote" {
+			missing = fmt.Sprint("missing", i)
+		}
+	}
+	if fetched, err := local.GetPartition(ctx, missing); fetched != nil || err != nil {
+		t.Errorf("expected a missing partition not to be found, got %v, %v", fetched, err)
+	}
+
+	// A member that does not respond cannot be asked for its partitions.
+	delete(clusters, "remote")
+	local.requestTimeout = 10 * time.Millisecond
+	if _, err := local.GetPartition(ctx, partitionKey); err == nil {
+		t.Errorf("expected an error without a response")
+	} else if nerr, ok := err.(*store.NotOwnerError); !ok || nerr.Owner != "remote" {
+		t.Errorf("expected the partition to belong to the remote member, got %v", err)
+	}
+
+	infos, err := remote.ListPartitions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Owner != "remote" || infos[0].Series != 1 {
+		t.Fatalf("unexpected partitions %v", infos)
+	}
+
+	deleted, err := local.DeletePartition(ctx, partitionKey)
+	if err != nil || !deleted {
+		t.Fatalf("expected deletion to be requested, got %t, %v", deleted, err)
+	}
+	if ml.sendReliableNode.Name != "remote" {
+		t.Fatalf("expected deletion to be requested from the remote member, got %s", ml.sendReliableNode.Name)
+	}
+	if err := remote.handleMessage(ml.sendReliablePayload); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := remote.GetPartition(ctx, partitionKey); p != nil || err != nil {
+		t.Errorf("expected the partition to be deleted, got %v, %v", p, err)
+	}
+}
+
+func TestForwardDelta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	members := []*memberlist.Node{{Name: "local"}, {Name: "remote"}}
+
+	clusters := make(map[string]*DynamicCluster)
+	localStore := memstore.New(time.Hour)
+	local := NewDynamic(nil, "local", localStore)
+	local.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	local.refreshRing()
+	remote := NewDynamic(nil, "remote", memstore.New(time.Hour))
+	remote.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	remote.refreshRing()
+	clusters["local"], clusters["remote"] = local, remote
+
+	var partitionKey string
+	for i := 0; len(partitionKey) == 0; i++ {
+		if owner, _ := local.getNodeForKey(fmt.Sprint(i)); owner == "remote" {
+			partitionKey = fmt.Sprint(i)
+		}
+	}
+	gauge := func(name string, ts int64) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name:   proto.String(name),
+			Type:   clientmodel.MetricType_GAUGE.Enum(),
+			Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}, TimestampMs: proto.Int64(ts)}},
+		}
+	}
+
+	for _, tc := range []struct {
+		p       *store.PartitionedMetrics
+		wantErr error
+	}{
+		{p: &store.PartitionedMetrics{PartitionKey: partitionKey, Sequence: 1, Families: []*clientmodel.MetricFamily{gauge("a", 1)}}},
+		{p: &store.PartitionedMetrics{PartitionKey: partitionKey, Sequence: 2, Families: []*clientmodel.MetricFamily{gauge("b", 2)}, Delta: &store.Delta{BaseSequence: 1, TimestampMs: 2}}},
+		{
+			p:       &store.PartitionedMetrics{PartitionKey: partitionKey, Sequence: 4, Families: []*clientmodel.MetricFamily{gauge("c", 3)}, Delta: &store.Delta{BaseSequence: 3, TimestampMs: 3}},
+			wantErr: store.ErrSequenceMismatch,
+		},
+	} {
+		if err := local.WriteMetrics(ctx, tc.p); err != tc.wantErr {
+			t.Fatalf("sequence %d: expected error %v, got %v", tc.p.Sequence, tc.wantErr, err)
+		}
+	}
+
+	p, err := store.GetPartition(ctx, remote.store, partitionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || len(p.Families) != 2 || p.Families[0].Metric[0].GetTimestampMs() != 2 {
+		t.Fatalf("expected the delta to be applied to the partition, got %v", p)
+	}
+	if p, err := store.GetPartition(ctx, localStore, partitionKey); p != nil || err != nil {
+		t.Fatalf("expected the partition to only be stored by its owner, got %v, %v", p, err)
+	}
+}
+
+// TestForwardRejected tests that the error with which the owner of a partition
+// rejects a numbered write is returned by the member that forwarded it.
+func TestForwardRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	members := []*memberlist.Node{{Name: "local"}, {Name: "remote"}}
+
+	quotaStore, err := quota.New(nil, time.Hour, quota.Limits{}, quota.Limits{Samples: 2}, "", ratelimited.New(time.Minute, memstore.NewLimited(nil, time.Hour, memstore.Limits{Partitions: 1}, memstore.EvictNone)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := make(map[string]*DynamicCluster)
+	local := NewDynamic(nil, "local", memstore.New(time.Hour))
+	local.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	local.refreshRing()
+	remote := NewDynamic(nil, "remote", quotaStore)
+	remote.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	remote.refreshRing()
+	clusters["local"], clusters["remote"] = local, remote
+
+	var partitionKeys []string
+	for i := 0; len(partitionKeys) < 3; i++ {
+		if owner, _ := local.getNodeForKey(fmt.Sprint(i)); owner == "remote" {
+			partitionKeys = append(partitionKeys, fmt.Sprint(i))
+		}
+	}
+	gauge := func(values int) []*clientmodel.MetricFamily {
+		f := &clientmodel.MetricFamily{Name: proto.String("a"), Type: clientmodel.MetricType_GAUGE.Enum()}
+		for i := 0; i < values; i++ {
+			f.Metric = append(f.Metric, &clientmodel.Metric{
+				Label:       []*clientmodel.LabelPair{{Name: proto.String("i"), Value: proto.String(fmt.Sprint(i))}},
+				Gauge:       &clientmodel.Gauge{Value: proto.Float64(1)},
+				TimestampMs: proto.Int64(1),
+			})
+		}
+		return []*clientmodel.MetricFamily{f}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		p       *store.PartitionedMetrics
+		wantErr func(error) bool
+	}{
+		{
+			name:    "accepted",
+			p:       &store.PartitionedMetrics{PartitionKey: partitionKeys[0], Sequence: 1, Families: gauge(1)},
+			wantErr: func(err error) bool { return err == nil },
+		},
+		{
+			name:    "rate limited",
+			p:       &store.PartitionedMetrics{PartitionKey: partitionKeys[0], Sequence: 2, Families: gauge(1)},
+			wantErr: func(err error) bool { return err == ratelimited.ErrWriteLimitReached },
+		},
+		{
+			name: "quota exceeded",
+			p:    &store.PartitionedMetrics{PartitionKey: partitionKeys[1], Sequence: 1, Families: gauge(3)},
+			wantErr: func(err error) bool {
+				qerr, ok := err.(*quota.ExceededError)
+				return ok && qerr.Scope == quota.ScopePartition && qerr.RetryAfter > 0
+			},
+		},
+		{
+			name:    "store full",
+			p:       &store.PartitionedMetrics{PartitionKey: partitionKeys[2], Sequence: 1, Families: gauge(1)},
+			wantErr: func(err error) bool { return err == memstore.ErrStoreFull },
+		},
+	} {
+		if err := local.WriteMetrics(ctx, tc.p); !tc.wantErr(err) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+	if p, err := store.GetPartition(ctx, local.store, partitionKeys[0]); p != nil || err != nil {
+		t.Fatalf("expected rejected writes not to fall back to the local store, got %v, %v", p, err)
+	}
+}
+
+// TestRejectedWriteNotGossiped tests that a delta rejected by the owner of a
+// partition does not count against the write limit of the other members, so
+// that the partition can be uploaded in full through any member right away.
+func TestRejectedWriteNotGossiped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	members := []*memberlist.Node{{Name: "local"}, {Name: "remote"}}
+
+	clusters := make(map[string]*DynamicCluster)
+	localLimited := ratelimited.New(time.Minute, memstore.New(time.Hour))
+	local := NewDynamic(nil, "local", localLimited)
+	local.ObserveWrites(localLimited)
+	local.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	local.refreshRing()
+	remoteLimited := ratelimited.New(time.Minute, memstore.New(time.Hour))
+	remote := NewDynamic(nil, "remote", remoteLimited)
+	remote.ObserveWrites(remoteLimited)
+	remote.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	remote.refreshRing()
+	clusters["local"], clusters["remote"] = local, remote
+
+	var partitionKey string
+	for i := 0; len(partitionKey) == 0; i++ {
+		if owner, _ := local.getNodeForKey(fmt.Sprint(i)); owner == "remote" {
+			partitionKey = fmt.Sprint(i)
+		}
+	}
+	families := []*clientmodel.MetricFamily{{
+		Name:   proto.String("a"),
+		Type:   clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}, TimestampMs: proto.Int64(1)}},
+	}}
+
+	delta := &store.PartitionedMetrics{PartitionKey: partitionKey, Sequence: 2, Families: families, Delta: &store.Delta{BaseSequence: 1, TimestampMs: 1}}
+	if err := local.WriteMetrics(ctx, delta); err != store.ErrSequenceMismatch {
+		t.Fatalf("expected the delta to be rejected, got %v", err)
+	}
+	if n := local.broadcasts.NumQueued(); n != 0 {
+		t.Fatalf("expected the rejected write not to be gossiped, got %d broadcasts", n)
+	}
+
+	full := &store.PartitionedMetrics{PartitionKey: partitionKey, Sequence: 2, Families: families}
+	if err := remote.WriteMetrics(ctx, full); err != nil {
+		t.Fatalf("expected the full upload to be accepted, got %v", err)
+	}
+	broadcasts := remote.GetBroadcasts(0, 1400)
+	if len(broadcasts) != 1 {
+		t.Fatalf("expected the accepted write to be gossiped, got %d broadcasts", len(broadcasts))
+	}
+	for _, msg := range broadcasts {
+		local.NotifyMsg(msg)
+	}
+	if err := localLimited.WriteMetrics(ctx, full); err != ratelimited.ErrWriteLimitReached {
+		t.Fatalf("expected the gossiped write to count against the limit, got %v", err)
+	}
+}
+
+// TestTracing tests that an upload is traced from the client through the
+// server receiving it to the member of the cluster storing it.
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	members := []*memberlist.Node{{Name: "local"}, {Name: "remote"}}
+	clusters := make(map[string]*DynamicCluster)
+	local := NewDynamic(nil, "local", memstore.New(time.Hour))
+	local.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	local.refreshRing()
+	remoteStore := memstore.New(time.Hour)
+	remote := NewDynamic(nil, "remote", remoteStore)
+	remote.Start(&linkedMemberlister{testMemberlister: testMemberlister{numMembers: 2, members: members}, clusters: clusters}, ctx)
+	clusters["local"], clusters["remote"] = local, remote
+
+	// find a partition key owned by the remote member
+	var partitionKey string
+	for i := 0; len(partitionKey) == 0; i++ {
+		if owner, _ := local.getNodeForKey(fmt.Sprint(i)); owner == "remote" {
+			partitionKey = fmt.Sprint(i)
+		}
+	}
+
+	s := server.New(nil, local, validate.New("_id", 0, 0), nil, time.Hour)
+	upload := httptest.NewServer(tracing.Handler("upload", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client := &authorize.Client{ID: "account", Labels: map[string]string{"_id": partitionKey}}
+		s.Post(w, req.WithContext(authorize.WithClient(req.Context(), client)))
+	})))
+	defer upload.Close()
+	to, err := url.Parse(upload.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	span, sendCtx := tracing.StartSpan(ctx, "forwarder.forward")
+	families := []*clientmodel.MetricFamily{{
+		Name: proto.String("up"),
+		Type: clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{
+			Label:       []*clientmodel.LabelPair{{Name: proto.String("_id"), Value: proto.String(partitionKey)}},
+			Gauge:       &clientmodel.Gauge{Value: proto.Float64(1)},
+			TimestampMs: proto.Int64(time.Now().UnixNano() / int64(time.Millisecond)),
+		}},
+	}}
+	err = metricsclient.New(nil, &http.Client{}, 0, time.Second, "test").Send(sendCtx, &http.Request{Method: "POST", URL: to}, families)
+	tracing.Finish(span, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The remote member stores the partition asynchronously.
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for len(spans) == 0 || spans["cluster.handleMessage"] == nil {
+		if ctx.Err() != nil {
+			t.Fatalf("expected the remote member to store the partition, got spans %v", spans)
+		}
+		time.Sleep(10 * time.Millisecond)
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+	}
+
+	parents := map[string]string{
+		"metricsclient.send":           "forwarder.forward",
+		"upload":                       "metricsclient.send",
+		"server.validate":              "upload",
+		"server.decodeAndStoreMetrics": "upload",
+		"server.store":                 "server.decodeAndStoreMetrics",
+		"cluster.forwardMetrics":       "server.store",
+		"cluster.handleMessage":        "cluster.forwardMetrics",
+	}
+	root := spans["forwarder.forward"]
+	if root == nil {
+		t.Fatalf("expected the client span to be finished, got %v", spans)
+	}
+	for operation, parent := range parents {
+		span, ok := spans[operation]
+		if !ok {
+			t.Errorf("expected a %s span", operation)
+			continue
+		}
+		if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("expected the %s span to be part of the trace", operation)
+		}
+		if p := spans[parent]; p == nil || span.Parent().SpanID() != p.SpanContext().SpanID() {
+			t.Errorf("expected the %s span to follow the %s span", operation, parent)
+		}
+	}
+	if p, err := remoteStore.GetPartition(ctx, partitionKey); p == nil || err != nil {
+		t.Errorf("expected the partition to be stored by the remote member, got %v, %v", p, err)
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/hashicorp/memberlist"
+
+	"github.com/openshift/telemeter/pkg/logging"
 )
 
 type delegate interface {
@@ -15,7 +19,7 @@ type delegate interface {
 	memberlist.Delegate
 }
 
-func NewMemberlist(name, addr string, secret []byte, verbose bool, d delegate) (*memberlist.Memberlist, error) {
+func NewMemberlist(logger log.Logger, name, addr string, secret []byte, verbose bool, d delegate) (*memberlist.Memberlist, error) {
 	if len(secret) != 32 {
 		return nil, fmt.Errorf("invalid secret size, must be 32 bytes: %d", len(secret))
 	}
@@ -40,8 +44,9 @@ func NewMemberlist(name, addr string, secret []byte, verbose bool, d delegate) (
 	cfg.BindPort = port
 	cfg.AdvertisePort = port
 
-	if !verbose {
-		cfg.LogOutput = ioutil.Discard
+	cfg.LogOutput = ioutil.Discard
+	if verbose {
+		cfg.LogOutput = log.NewStdlibAdapter(level.Info(log.With(logging.OrNop(logger), "component", "memberlist")))
 	}
 
 	cfg.SecretKey = secret
@@ -0,0 +1,114 @@
+package forwarder
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// backoff computes the delay before the next attempt after consecutive failures.
+// Retryable errors are retried with an exponentially increasing, jittered delay,
+// honouring any delay requested by the server. Permanent errors and failures of
+// the last of maxAttempts retries are only retried after the regular interval.
+type backoff struct {
+	min         time.Duration
+	max         time.Duration
+	maxAttempts int
+	interval    time.Duration
+	// jitter returns a random duration in [0, d).
+	jitter func(d time.Duration) time.Duration
+}
+
+func newBackoff(min, max time.Duration, maxAttempts int, interval time.Duration) backoff {
+	return backoff{
+		min:         min,
+		max:         max,
+		maxAttempts: maxAttempts,
+		interval:    interval,
+		jitter: func(d time.Duration) time.Duration {
+			if d <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(d)))
+		},
+	}
+}
+
+// retryState tracks the consecutive failures of a source or destination.
+type retryState struct {
+	attempts int
+}
+
+// failure records a failed attempt and returns the delay until the next one.
+func (r *retryState) failure(b backoff, err error) time.Duration {
+	r.attempts++
+	if !isRetryable(err) || (b.maxAttempts > 0 && r.attempts > b.maxAttempts) {
+		r.attempts = 0
+		return b.interval
+	}
+
+	d := b.min
+	for i := 1; i < r.attempts && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	// Use half of the delay as a fixed part and randomize the rest,
+	// so that clients that failed at the same time spread out.
+	d = d/2 + b.jitter(d/2)
+
+	if after := retryAfter(err); after > d {
+		d = after
+	}
+	return d
+}
+
+// success resets the consecutive failures.
+func (r *retryState) success() {
+	r.attempts = 0
+}
+
+type statusCodeErr interface {
+	HTTPStatusCode() int
+}
+
+type retryAfterErr interface {
+	RetryAfterDuration() time.Duration
+}
+
+// unwrapURLError returns the underlying error of errors returned by an http.Client.
+func unwrapURLError(err error) error {
+	if uerr, ok := err.(*url.Error); ok {
+		return uerr.Err
+	}
+	return err
+}
+
+// isRetryable returns whether the failed request may succeed when retried.
+// Errors without a status code, such as network errors, are retryable, as are
+// server errors, rate limiting and expired credentials. Other client errors are
+// permanent.
+func isRetryable(err error) bool {
+	serr, ok := unwrapURLError(err).(statusCodeErr)
+	if !ok {
+		return true
+	}
+	switch code := serr.HTTPStatusCode(); {
+	case code == http.StatusUnauthorized, code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code >= http.StatusInternalServerError:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter returns the delay requested by the server, if any.
+func retryAfter(err error) time.Duration {
+	if rerr, ok := unwrapURLError(err).(retryAfterErr); ok {
+		return rerr.RetryAfterDuration()
+	}
+	return 0
+}
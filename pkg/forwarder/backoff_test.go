@@ -0,0 +1,72 @@
+package forwarder
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+func TestRetryStateFailure(t *testing.T) {
+	b := newBackoff(10*time.Second, time.Minute, 6, 5*time.Minute)
+	// Use the maximum jitter to make the delays deterministic.
+	b.jitter = func(d time.Duration) time.Duration { return d }
+
+	var (
+		network   = errors.New("connection refused")
+		permanent = &metricsclient.StatusError{StatusCode: http.StatusBadRequest}
+		limited   = &url.Error{Op: "Post", URL: "/upload", Err: &metricsclient.StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Minute}}
+	)
+
+	var r retryState
+	for i, tc := range []struct {
+		err  error
+		want time.Duration
+	}{
+		{err: network, want: 10 * time.Second},
+		{err: network, want: 20 * time.Second},
+		{err: network, want: 40 * time.Second},
+		{err: network, want: time.Minute},
+		// The server may ask for a longer delay than the backoff.
+		{err: limited, want: 2 * time.Minute},
+		{err: network, want: time.Minute},
+		// The maximum number of retries is reached, so wait for the interval.
+		{err: network, want: 5 * time.Minute},
+		// The attempts are reset after reaching the maximum.
+		{err: network, want: 10 * time.Second},
+		// Permanent errors are not retried before the interval.
+		{err: permanent, want: 5 * time.Minute},
+		{err: network, want: 10 * time.Second},
+	} {
+		if got := r.failure(b, tc.err); got != tc.want {
+			t.Errorf("attempt %d: got delay %v, want %v", i, got, tc.want)
+		}
+	}
+
+	r.success()
+	if got := r.failure(b, network); got != 10*time.Second {
+		t.Errorf("expected the backoff to be reset after a success, got %v", got)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		want bool
+	}{
+		{code: http.StatusBadRequest, want: false},
+		{code: http.StatusUnauthorized, want: true},
+		{code: http.StatusForbidden, want: false},
+		{code: http.StatusRequestEntityTooLarge, want: false},
+		{code: http.StatusTooManyRequests, want: true},
+		{code: http.StatusInternalServerError, want: true},
+		{code: http.StatusServiceUnavailable, want: true},
+	} {
+		if got := isRetryable(&metricsclient.StatusError{StatusCode: tc.code}); got != tc.want {
+			t.Errorf("status %d: got retryable %t, want %t", tc.code, got, tc.want)
+		}
+	}
+}
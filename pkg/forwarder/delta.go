@@ -0,0 +1,88 @@
+package forwarder
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+)
+
+// deltaState tracks the last upload a destination accepted, so that only the
+// series that changed since then need to be sent. A nil state sends nothing
+// but full uploads.
+type deltaState struct {
+	fullEvery int
+
+	// sequence is the sequence number of the last upload.
+	sequence uint64
+	// base is the sequence number of the last accepted upload, or zero if
+	// the next upload must be sent in full, and families its series.
+	base     uint64
+	families []*clientmodel.MetricFamily
+	// deltas is the number of delta uploads since the last full upload.
+	deltas int
+}
+
+// reset makes the next upload a full upload.
+func (s *deltaState) reset() {
+	if s == nil {
+		return
+	}
+	s.base, s.families, s.deltas = 0, nil, 0
+}
+
+// sendNumbered uploads the series of families that changed since the last
+// accepted upload, or all of them if there is none, the destination did not
+// store it, or enough deltas were sent since the last full upload.
+func (d *destination) sendNumbered(ctx context.Context, families []*clientmodel.MetricFamily, now time.Time) error {
+	s := d.delta
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+
+	if s.base > 0 && s.deltas < s.fullEvery {
+		s.sequence++
+		req := d.numberedRequest(s.sequence)
+		req.Header.Set(metricsclient.BaseSequenceHeader, strconv.FormatUint(s.base, 10))
+		req.Header.Set(metricsclient.TimestampHeader, strconv.FormatInt(nowMs, 10))
+		err := d.client.Send(ctx, req, metricfamily.Diff(s.families, families, nowMs))
+		if err == nil {
+			counterFederateDestinationUploads.WithLabelValues(d.name, "delta").Inc()
+			s.base, s.families = s.sequence, families
+			s.deltas++
+			return nil
+		}
+		if !isConflict(err) {
+			s.reset()
+			return err
+		}
+		level.Info(d.logger).Log("msg", "destination did not accept the changed series, sending all series", "err", err)
+	}
+
+	s.sequence++
+	if err := d.client.Send(ctx, d.numberedRequest(s.sequence), families); err != nil {
+		s.reset()
+		return err
+	}
+	counterFederateDestinationUploads.WithLabelValues(d.name, "full").Inc()
+	s.base, s.families, s.deltas = s.sequence, families, 0
+	return nil
+}
+
+// numberedRequest returns an upload request with the given sequence number.
+func (d *destination) numberedRequest(sequence uint64) *http.Request {
+	req := &http.Request{Method: "POST", URL: d.to, Header: make(http.Header)}
+	req.Header.Set(metricsclient.SequenceHeader, strconv.FormatUint(sequence, 10))
+	return req
+}
+
+// isConflict returns true if the destination rejected a delta upload because
+// it did not store the upload the delta is based on.
+func isConflict(err error) bool {
+	serr, ok := unwrapURLError(err).(statusCodeErr)
+	return ok && serr.HTTPStatusCode() == http.StatusConflict
+}
@@ -1,26 +1,37 @@
 package forwarder
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/buffer"
 	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/logging"
 	"github.com/openshift/telemeter/pkg/metricfamily"
 	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/tracing"
 )
 
 type RuleMatcher interface {
@@ -40,16 +51,107 @@ var (
 		Name: "federate_errors",
 		Help: "The number of times forwarding federated metrics has failed",
 	})
+	gaugeFederateSourceErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_source_errors",
+		Help: "The number of times retrieving metrics from a federation source has failed",
+	}, []string{"source"})
+	gaugeFederateSourceSamples = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_source_samples",
+		Help: "Tracks the number of samples retrieved per federation source",
+	}, []string{"source"})
+	gaugeFederateDestinationErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_destination_errors",
+		Help: "The number of times sending metrics to a destination has failed",
+	}, []string{"destination"})
+	gaugeFederateDestinationLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_destination_last_success_timestamp_seconds",
+		Help: "The last time metrics were successfully sent to a destination",
+	}, []string{"destination"})
+	gaugeFederateDestinationBackoff = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_destination_backoff_seconds",
+		Help: "The current delay before retrying to send metrics to a destination after a failure",
+	}, []string{"destination"})
+	gaugeFederateBufferedPayloads = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_buffered_payloads",
+		Help: "Tracks the number of payloads buffered for a destination",
+	}, []string{"destination"})
+	gaugeFederateBufferedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "federate_buffered_bytes",
+		Help: "Tracks the size of the payloads buffered for a destination",
+	}, []string{"destination"})
+	counterFederateDestinationUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "federate_destination_uploads_total",
+		Help: "The number of numbered uploads accepted by a destination, by whether they held all series or only the changed ones",
+	}, []string{"destination", "upload"})
 )
 
 func init() {
 	prometheus.MustRegister(
 		gaugeFederateErrors, gaugeFederateSamples, gaugeFederateFilteredSamples,
+		gaugeFederateSourceErrors, gaugeFederateSourceSamples,
+		gaugeFederateDestinationErrors, gaugeFederateDestinationLastSuccess, gaugeFederateDestinationBackoff,
+		gaugeFederateBufferedPayloads, gaugeFederateBufferedBytes,
+		counterFederateDestinationUploads,
 	)
 }
 
+const (
+	// defaultSourceName is the name of the source configured via the `From` field of a Config.
+	defaultSourceName = "default"
+	// defaultDestinationName is the name of the destination configured via the `ToUpload`
+	// field of a Config.
+	defaultDestinationName = "default"
+
+	// maxBufferAge is the maximum age of buffered samples. The server rejects uploads
+	// containing samples older than 24 hours, so leave some room for clock skew.
+	maxBufferAge = 24*time.Hour - 15*time.Minute
+	// defaultBufferMaxBytes is the default size limit of the buffer of each destination.
+	defaultBufferMaxBytes = 64 * 1024 * 1024
+
+	// defaultMinBackoff is the default delay before the first retry after a failure.
+	defaultMinBackoff = 30 * time.Second
+
+	// defaultDeltaFullEvery is the default number of delta uploads between full uploads.
+	defaultDeltaFullEvery = 10
+)
+
+// Query is a PromQL expression whose result is sent as the metric named Record,
+// like a Prometheus recording rule.
+type Query struct {
+	Record string
+	Expr   string
+}
+
+// Source defines a Prometheus server to federate from, in addition to the one
+// given by the `From` field of a Config. Each source has its own credentials
+// and match rules.
+// If Queries are given, the source evaluates them via the Prometheus query API
+// instead of federating, and the match rules are not used.
+type Source struct {
+	Name      string
+	From      *url.URL
+	Token     string
+	TokenFile string
+	CAFile    string
+	Rules     []string
+	RulesFile string
+	Queries   []Query
+}
+
+// Destination defines a telemeter server to send metrics to, in addition to the one
+// given by the `ToUpload` field of a Config. Each destination has its own credentials
+// and retry state and may apply additional transformations to the metrics it receives.
+type Destination struct {
+	Name        string
+	ToAuthorize *url.URL
+	ToUpload    *url.URL
+	ToToken     string
+	ToTokenFile string
+	Transformer metricfamily.Transformer
+}
+
 // Config defines the parameters that can be used to configure a worker.
-// The only required field is `From`.
+// Either `From` or at least one entry in `Sources` is required.
 type Config struct {
 	From          *url.URL
 	ToAuthorize   *url.URL
@@ -63,26 +165,106 @@ type Config struct {
 	AnonymizeLabels   []string
 	AnonymizeSalt     string
 	AnonymizeSaltFile string
-	Debug             bool
-	Interval          time.Duration
-	LimitBytes        int64
-	Rules             []string
-	RulesFile         string
-	Transformer       metricfamily.Transformer
+	// AnonymizeMetricsLabels maps metric names to labels that are anonymized
+	// on those metrics only, in addition to AnonymizeLabels.
+	AnonymizeMetricsLabels map[string][]string
+	// AnonymizeHMAC hashes with an HMAC keyed by the salt, keeping
+	// AnonymizeHashLength bytes of the hash, instead of the legacy salted
+	// SHA-256. The hashes of AnonymizePreviousSalts are added as labels
+	// suffixed by their version, to keep anonymized labels correlated while
+	// the salt is rotated.
+	AnonymizeHMAC          bool
+	AnonymizeHashLength    int
+	AnonymizePreviousSalts []metricfamily.Salt
+	// ScrubLabels maps label names to the rules redacting their values before
+	// anonymization. Redacted values are replaced by ScrubPlaceholder, which
+	// defaults to metricfamily.DefaultScrubPlaceholder.
+	ScrubLabels      map[string]metricfamily.ScrubRule
+	ScrubPlaceholder string
+	Debug            bool
+	Interval         time.Duration
+	LimitBytes       int64
+	Rules            []string
+	RulesFile        string
+	Queries          []Query
+	Sources          []Source
+	Destinations     []Destination
+	Transformer      metricfamily.Transformer
+
+	// BufferDir enables buffering of payloads that could not be sent, so that they
+	// can be replayed once the destination is reachable again. Each destination
+	// buffers into its own subdirectory, at most one payload per interval.
+	BufferDir      string
+	BufferMaxAge   time.Duration
+	BufferMaxBytes int64
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between retries of
+	// failed scrapes and uploads. MaxBackoff defaults to the interval.
+	// A failure is retried up to MaxAttempts times, not counting the first try.
+	// After that, or on errors that are not retryable, the next attempt happens
+	// after the regular interval. Zero means no limit.
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+
+	// DeltaUploads numbers the uploads to each destination, so that only the
+	// series that changed since the last upload the destination accepted are
+	// sent. After DeltaFullEvery such uploads, all series are sent again so
+	// that destinations which lost them recover. It defaults to 10.
+	DeltaUploads   bool
+	DeltaFullEvery int
+
+	Logger log.Logger
+}
+
+// source is a configured Prometheus server to retrieve metrics from.
+type source struct {
+	logger  log.Logger
+	name    string
+	client  *metricsclient.Client
+	from    *url.URL
+	rules   []string
+	query   *url.URL
+	queries []Query
+}
+
+// destination is a configured telemeter server to send metrics to.
+type destination struct {
+	logger      log.Logger
+	name        string
+	client      *metricsclient.Client
+	to          *url.URL
+	transformer metricfamily.Transformer
+	// authorizer adds the labels the authorize endpoint expects, if any. It is
+	// applied separately from transformer, so that metrics are still buffered
+	// while the endpoint cannot be reached.
+	authorizer metricfamily.Transformer
+	buffer     *buffer.Buffer
+	limitBytes int64
+	retry      retryState
+	delta      *deltaState
+	// interval is the time between scrapes, and buffered the time at which
+	// metrics were last buffered, so that retries do not buffer the same
+	// metrics again.
+	interval time.Duration
+	buffered time.Time
+
+	// next is the earliest time at which metrics should be sent again.
+	next time.Time
 }
 
 // Worker represents a metrics forwarding agent. It collects metrics from a source URL and forwards them to a sink.
 // A Worker should be configured with a `Config` and instantiated with the `New` func.
 // Workers are thread safe; all access to shared fields are synchronized.
 type Worker struct {
-	fromClient *metricsclient.Client
-	toClient   *metricsclient.Client
-	from       *url.URL
-	to         *url.URL
+	logger       log.Logger
+	sources      []*source
+	destinations []*destination
 
 	interval    time.Duration
 	transformer metricfamily.Transformer
-	rules       []string
+	backoff     backoff
+	scrapeRetry retryState
 
 	lastMetrics []*clientmodel.MetricFamily
 	lock        sync.Mutex
@@ -92,20 +274,42 @@ type Worker struct {
 // New creates a new Worker based on the provided Config. If the Config contains invalid
 // values, then an error is returned.
 func New(cfg Config) (*Worker, error) {
-	if cfg.From == nil {
+	if cfg.From == nil && len(cfg.Sources) == 0 {
 		return nil, errors.New("a URL from which to scrape is required")
 	}
 	w := Worker{
-		from:        cfg.From,
+		logger:      log.With(logging.OrNop(cfg.Logger), "component", "forwarder"),
 		interval:    cfg.Interval,
 		reconfigure: make(chan struct{}),
-		to:          cfg.ToUpload,
 	}
 
 	if w.interval == 0 {
 		w.interval = 4*time.Minute + 30*time.Second
 	}
 
+	// Configure the retry policy.
+	minBackoff, maxBackoff := cfg.MinBackoff, cfg.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = w.interval
+	}
+	if minBackoff > maxBackoff {
+		return nil, fmt.Errorf("the minimum backoff %s must not be greater than the maximum backoff %s", minBackoff, maxBackoff)
+	}
+	if cfg.MaxAttempts < 0 {
+		return nil, errors.New("the maximum number of attempts must not be negative")
+	}
+	fullEvery := cfg.DeltaFullEvery
+	if fullEvery < 0 {
+		return nil, errors.New("the number of delta uploads between full uploads must not be negative")
+	}
+	if fullEvery == 0 {
+		fullEvery = defaultDeltaFullEvery
+	}
+	w.backoff = newBackoff(minBackoff, maxBackoff, cfg.MaxAttempts, w.interval)
+
 	// Configure the anonymization.
 	anonymizeSalt := cfg.AnonymizeSalt
 	if len(cfg.AnonymizeSalt) == 0 && len(cfg.AnonymizeSaltFile) > 0 {
@@ -115,11 +319,15 @@ func New(cfg Config) (*Worker, error) {
 		}
 		anonymizeSalt = strings.TrimSpace(string(data))
 	}
-	if len(cfg.AnonymizeLabels) != 0 && len(anonymizeSalt) == 0 {
+	anonymize := len(cfg.AnonymizeLabels) > 0 || len(cfg.AnonymizeMetricsLabels) > 0
+	if anonymize && len(anonymizeSalt) == 0 {
 		return nil, fmt.Errorf("anonymize-salt must be specified if anonymize-labels is set")
 	}
-	if len(cfg.AnonymizeLabels) == 0 {
-		log.Printf("warning: not anonymizing any labels")
+	if !anonymize {
+		level.Warn(w.logger).Log("msg", "not anonymizing any labels")
+	}
+	if !cfg.AnonymizeHMAC && len(cfg.AnonymizePreviousSalts) > 0 {
+		return nil, fmt.Errorf("previous anonymize salts are only supported with HMAC anonymization")
 	}
 
 	// Configure a transformer.
@@ -127,72 +335,201 @@ func New(cfg Config) (*Worker, error) {
 	if cfg.Transformer != nil {
 		transformer.With(cfg.Transformer)
 	}
-	if len(cfg.AnonymizeLabels) > 0 {
-		transformer.With(metricfamily.NewMetricsAnonymizer(anonymizeSalt, cfg.AnonymizeLabels, nil))
-	}
-
-	// Create the `fromClient`.
-	fromTransport := metricsclient.DefaultTransport()
-	if len(cfg.FromCAFile) > 0 {
-		if fromTransport.TLSClientConfig == nil {
-			fromTransport.TLSClientConfig = &tls.Config{}
+	if len(cfg.ScrubLabels) > 0 {
+		placeholder := cfg.ScrubPlaceholder
+		if len(placeholder) == 0 {
+			placeholder = metricfamily.DefaultScrubPlaceholder
 		}
-		pool, err := x509.SystemCertPool()
+		scrubber, err := metricfamily.NewScrubLabels(placeholder, cfg.ScrubLabels)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read system certificates: %v", err)
+			return nil, fmt.Errorf("failed to configure scrubbing: %v", err)
 		}
-		data, err := ioutil.ReadFile(cfg.FromCAFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read from-ca-file: %v", err)
+		transformer.With(scrubber)
+	}
+	switch {
+	case anonymize && cfg.AnonymizeHMAC:
+		length := cfg.AnonymizeHashLength
+		if length == 0 {
+			length = metricfamily.DefaultHashLength
 		}
-		if !pool.AppendCertsFromPEM(data) {
-			log.Printf("warning: no certs found in from-ca-file")
+		anonymizer, err := metricfamily.NewHMACAnonymizer(anonymizeSalt, cfg.AnonymizePreviousSalts, length, cfg.AnonymizeLabels, cfg.AnonymizeMetricsLabels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure anonymization: %v", err)
 		}
-		fromTransport.TLSClientConfig.RootCAs = pool
+		transformer.With(anonymizer)
+	case anonymize:
+		transformer.With(metricfamily.NewMetricsAnonymizer(anonymizeSalt, cfg.AnonymizeLabels, cfg.AnonymizeMetricsLabels))
 	}
-	fromClient := &http.Client{Transport: fromTransport}
-	if cfg.Debug {
-		fromClient.Transport = telemeterhttp.NewDebugRoundTripper(fromClient.Transport)
+
+	// Create the sources.
+	sources := cfg.Sources
+	if cfg.From != nil {
+		sources = append([]Source{{
+			Name:      defaultSourceName,
+			From:      cfg.From,
+			Token:     cfg.FromToken,
+			TokenFile: cfg.FromTokenFile,
+			CAFile:    cfg.FromCAFile,
+			Rules:     cfg.Rules,
+			RulesFile: cfg.RulesFile,
+			Queries:   cfg.Queries,
+		}}, sources...)
 	}
-	if len(cfg.FromToken) == 0 && len(cfg.FromTokenFile) > 0 {
-		data, err := ioutil.ReadFile(cfg.FromTokenFile)
+	names := make(map[string]struct{})
+	for _, sc := range sources {
+		if _, ok := names[sc.Name]; ok {
+			return nil, fmt.Errorf("source names must be unique: %q", sc.Name)
+		}
+		names[sc.Name] = struct{}{}
+		s, err := newSource(w.logger, sc, cfg.Debug, cfg.LimitBytes, w.interval)
 		if err != nil {
-			return nil, fmt.Errorf("unable to read from-token-file: %v", err)
+			return nil, err
 		}
-		cfg.FromToken = strings.TrimSpace(string(data))
+		w.sources = append(w.sources, s)
 	}
-	if len(cfg.FromToken) > 0 {
-		fromClient.Transport = telemeterhttp.NewBearerRoundTripper(cfg.FromToken, fromClient.Transport)
+
+	// Create the destinations.
+	destinations := cfg.Destinations
+	if len(destinations) == 0 || cfg.ToUpload != nil || cfg.ToAuthorize != nil || len(cfg.ToToken) > 0 || len(cfg.ToTokenFile) > 0 {
+		destinations = append([]Destination{{
+			Name:        defaultDestinationName,
+			ToAuthorize: cfg.ToAuthorize,
+			ToUpload:    cfg.ToUpload,
+			ToToken:     cfg.ToToken,
+			ToTokenFile: cfg.ToTokenFile,
+		}}, destinations...)
+	} else {
+		for _, dc := range destinations {
+			if dc.ToUpload == nil {
+				return nil, fmt.Errorf("destination %q: an upload URL is required", dc.Name)
+			}
+		}
 	}
-	w.fromClient = metricsclient.New(fromClient, cfg.LimitBytes, w.interval, "federate_from")
+	names = make(map[string]struct{})
+	for _, dc := range destinations {
+		if _, ok := names[dc.Name]; ok {
+			return nil, fmt.Errorf("destination names must be unique: %q", dc.Name)
+		}
+		names[dc.Name] = struct{}{}
+		d, err := newDestination(w.logger, dc, cfg.Debug, cfg.LimitBytes, w.interval)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.BufferDir) > 0 && d.to != nil {
+			maxAge := cfg.BufferMaxAge
+			if maxAge <= 0 || maxAge > maxBufferAge {
+				maxAge = maxBufferAge
+			}
+			maxBytes := cfg.BufferMaxBytes
+			if maxBytes <= 0 {
+				maxBytes = defaultBufferMaxBytes
+			}
+			d.buffer, err = buffer.New(d.logger, filepath.Join(cfg.BufferDir, d.name), maxAge, maxBytes)
+			if err != nil {
+				return nil, fmt.Errorf("destination %q: %v", d.name, err)
+			}
+		}
+		if cfg.DeltaUploads && d.to != nil {
+			d.delta = &deltaState{fullEvery: fullEvery}
+		}
+		w.destinations = append(w.destinations, d)
+	}
+	w.transformer = transformer
+
+	return &w, nil
+}
 
-	// Create the `toClient`.
-	toClient := &http.Client{Transport: metricsclient.DefaultTransport()}
-	if cfg.Debug {
-		toClient.Transport = telemeterhttp.NewDebugRoundTripper(toClient.Transport)
+// newDestination creates a destination from the given configuration.
+func newDestination(logger log.Logger, cfg Destination, debug bool, limitBytes int64, timeout time.Duration) (*destination, error) {
+	client := &http.Client{Transport: metricsclient.DefaultTransport()}
+	if debug {
+		client.Transport = telemeterhttp.NewDebugRoundTripper(client.Transport)
 	}
-	if len(cfg.ToToken) == 0 && len(cfg.ToTokenFile) > 0 {
+	token := cfg.ToToken
+	if len(token) == 0 && len(cfg.ToTokenFile) > 0 {
 		data, err := ioutil.ReadFile(cfg.ToTokenFile)
 		if err != nil {
 			return nil, fmt.Errorf("unable to read to-token-file: %v", err)
 		}
-		cfg.ToToken = strings.TrimSpace(string(data))
+		token = strings.TrimSpace(string(data))
 	}
-	if (len(cfg.ToToken) > 0) != (cfg.ToAuthorize != nil) {
+	if (len(token) > 0) != (cfg.ToAuthorize != nil) {
 		return nil, errors.New("an authorization URL and authorization token must both specified or empty")
 	}
-	if len(cfg.ToToken) > 0 {
+
+	var transformer metricfamily.MultiTransformer
+	if cfg.Transformer != nil {
+		transformer.With(cfg.Transformer)
+	}
+	var authorizer metricfamily.Transformer
+	if len(token) > 0 {
 		// Exchange our token for a token from the authorize endpoint, which also gives us a
 		// set of expected labels we must include.
-		rt := authorize.NewServerRotatingRoundTripper(cfg.ToToken, cfg.ToAuthorize, toClient.Transport)
-		toClient.Transport = rt
-		transformer.With(metricfamily.NewLabel(nil, rt))
+		rt := authorize.NewServerRotatingRoundTripper(token, cfg.ToAuthorize, client.Transport)
+		client.Transport = rt
+		authorizer = metricfamily.NewLabel(nil, rt)
+	}
+
+	metricsName := "federate_to"
+	if cfg.Name != defaultDestinationName {
+		metricsName = "federate_to_" + cfg.Name
+	}
+
+	return &destination{
+		logger:      log.With(logger, "destination", cfg.Name),
+		name:        cfg.Name,
+		client:      metricsclient.New(logger, client, limitBytes, timeout, metricsName),
+		to:          cfg.ToUpload,
+		transformer: transformer,
+		authorizer:  authorizer,
+		limitBytes:  limitBytes,
+		interval:    timeout,
+	}, nil
+}
+
+// newSource creates a source from the given configuration. The credentials, CA
+// and match rules of each source are independent of the others.
+func newSource(logger log.Logger, cfg Source, debug bool, limitBytes int64, timeout time.Duration) (*source, error) {
+	if cfg.From == nil {
+		return nil, fmt.Errorf("source %q: a URL from which to scrape is required", cfg.Name)
+	}
+
+	transport := metricsclient.DefaultTransport()
+	if len(cfg.CAFile) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read system certificates: %v", err)
+		}
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from-ca-file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			level.Warn(logger).Log("msg", "no certs found in from-ca-file", "source", cfg.Name)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	client := &http.Client{Transport: transport}
+	if debug {
+		client.Transport = telemeterhttp.NewDebugRoundTripper(client.Transport)
+	}
+	token := cfg.Token
+	if len(token) == 0 && len(cfg.TokenFile) > 0 {
+		data, err := ioutil.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read from-token-file: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if len(token) > 0 {
+		client.Transport = telemeterhttp.NewBearerRoundTripper(token, client.Transport)
 	}
-	w.toClient = metricsclient.New(toClient, cfg.LimitBytes, w.interval, "federate_to")
-	w.transformer = transformer
 
 	// Configure the matching rules.
-	rules := cfg.Rules
+	rules := append([]string{}, cfg.Rules...)
 	if len(cfg.RulesFile) > 0 {
 		data, err := ioutil.ReadFile(cfg.RulesFile)
 		if err != nil {
@@ -209,9 +546,38 @@ func New(cfg Config) (*Worker, error) {
 		rules[i] = s
 		i++
 	}
-	w.rules = rules
 
-	return &w, nil
+	var query *url.URL
+	for _, q := range cfg.Queries {
+		if !model.IsValidMetricName(model.LabelValue(q.Record)) {
+			return nil, fmt.Errorf("source %q: invalid metric name for query %q: %q", cfg.Name, q.Expr, q.Record)
+		}
+		if len(strings.TrimSpace(q.Expr)) == 0 {
+			return nil, fmt.Errorf("source %q: the query for %q must not be empty", cfg.Name, q.Record)
+		}
+	}
+	if len(cfg.Queries) > 0 {
+		// The query API is served next to the federation endpoint.
+		u := *cfg.From
+		u.Path = path.Join("/", strings.TrimSuffix(u.Path, "/federate"), "api/v1/query")
+		u.RawQuery = ""
+		query = &u
+	}
+
+	metricsName := "federate_from"
+	if cfg.Name != defaultSourceName {
+		metricsName = "federate_from_" + cfg.Name
+	}
+
+	return &source{
+		logger:  log.With(logger, "source", cfg.Name),
+		name:    cfg.Name,
+		client:  metricsclient.New(logger, client, limitBytes, timeout, metricsName),
+		from:    cfg.From,
+		rules:   rules,
+		query:   query,
+		queries: cfg.Queries,
+	}, nil
 }
 
 // Reconfigure temporarily stops a worker and reconfigures is with the provided Config.
@@ -225,13 +591,13 @@ func (w *Worker) Reconfigure(cfg Config) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	w.fromClient = worker.fromClient
-	w.toClient = worker.toClient
+	w.logger = worker.logger
+	w.sources = worker.sources
+	w.destinations = worker.destinations
 	w.interval = worker.interval
-	w.from = worker.from
-	w.to = worker.to
 	w.transformer = worker.transformer
-	w.rules = worker.rules
+	w.backoff = worker.backoff
+	w.scrapeRetry = worker.scrapeRetry
 
 	// Signal a restart to Run func.
 	// Do this in a goroutine since we do not care if restarting the Run loop is asynchronous.
@@ -255,9 +621,15 @@ func (w *Worker) Run(ctx context.Context) {
 
 		if err := w.forward(ctx); err != nil {
 			gaugeFederateErrors.Inc()
-			log.Printf("error: unable to forward results: %v", err)
+			level.Error(w.logger).Log("msg", "unable to forward results", "err", err)
 			wait = time.Minute
 		}
+		if next, ok := w.nextSend(); ok {
+			wait = time.Until(next)
+			if wait < 0 {
+				wait = 0
+			}
+		}
 
 		select {
 		// If the context is cancelled, then we're done.
@@ -270,46 +642,393 @@ func (w *Worker) Run(ctx context.Context) {
 	}
 }
 
-func (w *Worker) forward(ctx context.Context) error {
+// nextSend returns the earliest time at which any destination expects to receive
+// metrics again. It returns false if no destination has sent or failed yet.
+func (w *Worker) nextSend() (time.Time, bool) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	// Load the match rules each time.
-	from := w.from
-	v := from.Query()
-	for _, rule := range w.rules {
-		v.Add("match[]", rule)
+	var next time.Time
+	for _, d := range w.destinations {
+		if d.next.IsZero() {
+			return time.Time{}, false
+		}
+		if next.IsZero() || d.next.Before(next) {
+			next = d.next
+		}
 	}
-	from.RawQuery = v.Encode()
+	return next, !next.IsZero()
+}
 
-	req := &http.Request{Method: "GET", URL: from}
-	families, err := w.fromClient.Retrieve(ctx, req)
-	if err != nil {
-		return err
+func (w *Worker) forward(ctx context.Context) (err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	now := time.Now()
+	due := make([]*destination, 0, len(w.destinations))
+	for _, d := range w.destinations {
+		if !d.next.After(now) {
+			due = append(due, d)
+		}
+	}
+	if len(due) == 0 {
+		return nil
 	}
 
-	before := metricfamily.MetricsCount(families)
-	if err := metricfamily.Filter(families, w.transformer); err != nil {
+	span, ctx := tracing.StartSpan(ctx, "forwarder.forward")
+	defer func() { tracing.Finish(span, err) }()
+
+	var before int
+	families, err := w.retrieve(ctx)
+	if err == nil {
+		before = metricfamily.MetricsCount(families)
+		err = metricfamily.Filter(families, w.transformer)
+	}
+	if err != nil {
+		delay := w.scrapeRetry.failure(w.backoff, err)
+		for _, d := range due {
+			d.next = now.Add(delay)
+		}
 		return err
 	}
+	w.scrapeRetry.success()
 
 	families = metricfamily.Pack(families)
 	after := metricfamily.MetricsCount(families)
 
 	gaugeFederateSamples.Set(float64(before))
 	gaugeFederateFilteredSamples.Set(float64(before - after))
-
-	w.lastMetrics = families
+	span.SetAttributes(attribute.Int("samples", before), attribute.Int("filtered_samples", before-after))
 
 	if len(families) == 0 {
-		log.Printf("warning: no metrics to send, doing nothing")
+		for _, d := range due {
+			d.next = now.Add(w.interval)
+		}
+		w.lastMetrics = families
+		level.Warn(w.logger).Log("msg", "no metrics to send, doing nothing")
 		return nil
 	}
 
-	if w.to == nil {
-		return nil
+	var failed []string
+	for i, d := range due {
+		// Destinations may modify the families, so each one but the last gets a copy.
+		out := families
+		if i < len(due)-1 {
+			out = cloneFamilies(families)
+		}
+		out, err := d.send(ctx, out, now)
+		if err != nil {
+			gaugeFederateDestinationErrors.WithLabelValues(d.name).Inc()
+			level.Error(d.logger).Log("msg", "unable to send metrics", "err", err)
+			failed = append(failed, d.name)
+			delay := d.retry.failure(w.backoff, err)
+			gaugeFederateDestinationBackoff.WithLabelValues(d.name).Set(delay.Seconds())
+			d.next = now.Add(delay)
+			continue
+		}
+		d.retry.success()
+		gaugeFederateDestinationBackoff.WithLabelValues(d.name).Set(0)
+		if d.to != nil {
+			gaugeFederateDestinationLastSuccess.WithLabelValues(d.name).Set(float64(now.Unix()))
+		}
+		d.next = now.Add(w.interval)
+		if d == w.destinations[0] {
+			w.lastMetrics = out
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to send metrics to destinations %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// send applies the destination specific transformations and uploads the
+// families to the destination, if an upload URL is configured.
+// If the destination has a buffer, any buffered payloads are sent along
+// with the families, and the families are buffered if the upload or the
+// authorization fails with a retryable error.
+// It returns the transformed families.
+func (d *destination) send(ctx context.Context, families []*clientmodel.MetricFamily, now time.Time) ([]*clientmodel.MetricFamily, error) {
+	if err := metricfamily.Filter(families, d.transformer); err != nil {
+		return nil, err
+	}
+	families = metricfamily.Pack(families)
+
+	if d.to == nil || len(families) == 0 {
+		return families, nil
+	}
+	if d.authorizer != nil {
+		// The labels are added to the buffered families once the destination
+		// authorizes the client again.
+		if err := metricfamily.Filter(families, d.authorizer); err != nil {
+			d.bufferFailed(families, now, err)
+			return families, err
+		}
+	}
+
+	upload := families
+	var batch *buffer.Batch
+	if d.buffer != nil {
+		defer func() {
+			gaugeFederateBufferedPayloads.WithLabelValues(d.name).Set(float64(d.buffer.Len()))
+			gaugeFederateBufferedBytes.WithLabelValues(d.name).Set(float64(d.buffer.Size()))
+		}()
+		var err error
+		batch, err = d.buffer.Next(d.limitBytes, now)
+		if err != nil {
+			level.Error(d.logger).Log("msg", "unable to read buffered metrics", "err", err)
+		}
+		if batch != nil && d.authorizer != nil {
+			if err := metricfamily.Filter(batch.Families, d.authorizer); err != nil {
+				return families, err
+			}
+		}
+		if batch != nil {
+			upload = mergeBuffered(batch.Families, families, now.Add(-maxBufferAge))
+		}
+	}
+
+	var err error
+	if d.delta != nil && batch == nil {
+		err = d.sendNumbered(ctx, families, now)
+	} else {
+		// Buffered samples are not numbered, so the next upload is sent in full.
+		d.delta.reset()
+		err = d.client.Send(ctx, &http.Request{Method: "POST", URL: d.to}, upload)
+	}
+	if err != nil {
+		d.bufferFailed(families, now, err)
+		return families, err
+	}
+
+	if batch != nil {
+		if err := d.buffer.Commit(batch); err != nil {
+			level.Error(d.logger).Log("msg", "unable to remove buffered metrics", "err", err)
+		}
+	}
+	return families, nil
+}
+
+// bufferFailed buffers the families that could not be sent because of err, if
+// the destination has a buffer and nothing was buffered within the last
+// interval. There is no point in buffering metrics the server will never
+// accept, or in buffering the metrics of every retry.
+func (d *destination) bufferFailed(families []*clientmodel.MetricFamily, now time.Time, err error) {
+	if d.buffer == nil || !isRetryable(err) || now.Sub(d.buffered) < d.interval {
+		return
+	}
+	if err := d.buffer.Push(families, now); err != nil {
+		level.Error(d.logger).Log("msg", "unable to buffer metrics", "err", err)
+		return
+	}
+	d.buffered = now
+}
+
+// mergeBuffered combines previously buffered families with the current families
+// into a single payload with one family per name and metrics sorted by timestamp,
+// as required by the server. Samples older than min are dropped.
+func mergeBuffered(buffered, current []*clientmodel.MetricFamily, min time.Time) []*clientmodel.MetricFamily {
+	families := append(buffered, cloneFamilies(current)...)
+	expired := metricfamily.NewDropExpiredSamples(min)
+	for i, family := range families {
+		if family == nil {
+			continue
+		}
+		if _, err := expired.Transform(family); err != nil {
+			families[i] = nil
+			continue
+		}
+		if ok, _ := metricfamily.PackMetrics(family); !ok {
+			families[i] = nil
+			continue
+		}
+		metricfamily.SortMetrics(family)
+	}
+	families = metricfamily.Pack(families)
+	sort.Stable(metricfamily.PackedFamilyWithTimestampsByName(families))
+	return metricfamily.MergeSortedWithTimestamps(families)
+}
+
+// cloneFamilies returns a deep copy of the given families.
+func cloneFamilies(families []*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	clone := make([]*clientmodel.MetricFamily, 0, len(families))
+	for _, family := range families {
+		clone = append(clone, proto.Clone(family).(*clientmodel.MetricFamily))
 	}
+	return clone
+}
+
+// DryRun scrapes all sources once and applies the transformations without sending
+// the result to any destination. The match rules of the sources are also applied
+// to the scraped metrics, so that metrics the sources return regardless of the rules
+// are reported. Transformations specific to a destination, such as the labels
+// provided by the authorize endpoint, are not applied.
+// It returns an explanation of the transformations and the size of the resulting
+// compressed payload in bytes.
+func (w *Worker) DryRun(ctx context.Context) (*metricfamily.Explanation, int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	families, err := w.retrieve(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var t metricfamily.MultiTransformer
+	var rules []string
+	for _, s := range w.sources {
+		if len(s.rules) == 0 || len(s.queries) > 0 {
+			// A source without rules, or one that evaluates queries, matches everything.
+			rules = nil
+			break
+		}
+		rules = append(rules, s.rules...)
+	}
+	if len(rules) > 0 {
+		whitelist, err := metricfamily.NewWhitelist(rules)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to parse match rules: %v", err)
+		}
+		t.With(whitelist)
+	}
+	t.With(w.transformer)
+
+	e, err := metricfamily.Explain(families, t)
+	if err != nil {
+		return nil, 0, err
+	}
+	families = metricfamily.Pack(families)
+
+	buf := &bytes.Buffer{}
+	if err := metricsclient.Write(buf, families); err != nil {
+		return nil, 0, err
+	}
+	return e, buf.Len(), nil
+}
+
+// retrieve scrapes all sources and merges the results into a single set of
+// families. A failing source does not prevent metrics from the other sources
+// from being returned; an error is only returned if every source failed.
+func (w *Worker) retrieve(ctx context.Context) ([]*clientmodel.MetricFamily, error) {
+	var (
+		results [][]*clientmodel.MetricFamily
+		lastErr error
+	)
+	for _, s := range w.sources {
+		families, err := s.retrieve(ctx)
+		if err != nil {
+			gaugeFederateSourceErrors.WithLabelValues(s.name).Inc()
+			level.Error(s.logger).Log("msg", "unable to retrieve metrics", "err", err)
+			lastErr = err
+			continue
+		}
+		gaugeFederateSourceSamples.WithLabelValues(s.name).Set(float64(metricfamily.MetricsCount(families)))
+		results = append(results, families)
+	}
+	if len(results) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return mergeFamilies(w.logger, results...), nil
+}
 
-	req = &http.Request{Method: "POST", URL: w.to}
-	return w.toClient.Send(ctx, req, families)
+func (s *source) retrieve(ctx context.Context) ([]*clientmodel.MetricFamily, error) {
+	if len(s.queries) > 0 {
+		return s.evaluate(ctx)
+	}
+
+	// Load the match rules each time.
+	from := *s.from
+	v := from.Query()
+	for _, rule := range s.rules {
+		v.Add("match[]", rule)
+	}
+	from.RawQuery = v.Encode()
+
+	req := &http.Request{Method: "GET", URL: &from}
+	return s.client.Retrieve(ctx, req)
+}
+
+// evaluate runs the queries of the source and returns one family per query.
+func (s *source) evaluate(ctx context.Context) ([]*clientmodel.MetricFamily, error) {
+	results := make([][]*clientmodel.MetricFamily, 0, len(s.queries))
+	for _, q := range s.queries {
+		u := *s.query
+		v := u.Query()
+		v.Set("query", q.Expr)
+		u.RawQuery = v.Encode()
+
+		req := &http.Request{Method: "GET", URL: &u}
+		vector, err := s.client.Query(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("unable to evaluate query for %s: %v", q.Record, err)
+		}
+		results = append(results, []*clientmodel.MetricFamily{vectorToFamily(q.Record, vector)})
+	}
+	// Several queries may record into the same metric.
+	return mergeFamilies(s.logger, results...), nil
+}
+
+// vectorToFamily converts the result of an instant query into a family with the
+// given name. Like the series returned by the federation endpoint, the metrics are
+// untyped and keep the timestamp at which they were evaluated.
+func vectorToFamily(name string, vector model.Vector) *clientmodel.MetricFamily {
+	family := &clientmodel.MetricFamily{
+		Name:   proto.String(name),
+		Type:   clientmodel.MetricType_UNTYPED.Enum(),
+		Metric: make([]*clientmodel.Metric, 0, len(vector)),
+	}
+	for _, sample := range vector {
+		names := make([]string, 0, len(sample.Metric))
+		for label := range sample.Metric {
+			if label != model.MetricNameLabel {
+				names = append(names, string(label))
+			}
+		}
+		sort.Strings(names)
+
+		m := &clientmodel.Metric{
+			Label:       make([]*clientmodel.LabelPair, 0, len(names)),
+			Untyped:     &clientmodel.Untyped{Value: proto.Float64(float64(sample.Value))},
+			TimestampMs: proto.Int64(int64(sample.Timestamp)),
+		}
+		for _, label := range names {
+			m.Label = append(m.Label, &clientmodel.LabelPair{
+				Name:  proto.String(label),
+				Value: proto.String(string(sample.Metric[model.LabelName(label)])),
+			})
+		}
+		family.Metric = append(family.Metric, m)
+	}
+	return family
+}
+
+// mergeFamilies combines the families retrieved from several sources so that
+// each metric name appears only once. Families with the same name but a
+// different type than the first occurrence are dropped.
+func mergeFamilies(logger log.Logger, results ...[]*clientmodel.MetricFamily) []*clientmodel.MetricFamily {
+	if len(results) == 1 {
+		return results[0]
+	}
+	var merged []*clientmodel.MetricFamily
+	byName := make(map[string]*clientmodel.MetricFamily)
+	for _, families := range results {
+		for _, family := range families {
+			if family == nil {
+				continue
+			}
+			existing, ok := byName[family.GetName()]
+			if !ok {
+				byName[family.GetName()] = family
+				merged = append(merged, family)
+				continue
+			}
+			if existing.GetType() != family.GetType() {
+				level.Warn(logger).Log("msg", "dropping family from source with conflicting type", "family", family.GetName(), "type", family.GetType())
+				continue
+			}
+			existing.Metric = append(existing.Metric, family.Metric...)
+		}
+	}
+	return merged
 }
@@ -3,12 +3,23 @@ package forwarder
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/metricsclient"
 )
 
 func TestNew(t *testing.T) {
@@ -134,6 +145,54 @@ func TestNew(t *testing.T) {
 			},
 			err: false,
 		},
+		{
+			// Providing only `AnonymizeMetricsLabels` should error.
+			c: Config{
+				From:                   from,
+				AnonymizeMetricsLabels: map[string][]string{"up": {"foo"}},
+			},
+			err: true,
+		},
+		{
+			// Providing `AnonymizePreviousSalts` without `AnonymizeHMAC` should error.
+			c: Config{
+				From:                   from,
+				AnonymizeLabels:        []string{"foo"},
+				AnonymizeSalt:          "1",
+				AnonymizePreviousSalts: []metricfamily.Salt{{Version: "v1", Secret: "0"}},
+			},
+			err: true,
+		},
+		{
+			// Providing `AnonymizePreviousSalts` with `AnonymizeHMAC` should not error.
+			c: Config{
+				From:                   from,
+				AnonymizeLabels:        []string{"foo"},
+				AnonymizeSalt:          "1",
+				AnonymizeHMAC:          true,
+				AnonymizePreviousSalts: []metricfamily.Salt{{Version: "v1", Secret: "0"}},
+			},
+			err: false,
+		},
+		{
+			// Providing an invalid `AnonymizeHashLength` should error.
+			c: Config{
+				From:                from,
+				AnonymizeLabels:     []string{"foo"},
+				AnonymizeSalt:       "1",
+				AnonymizeHMAC:       true,
+				AnonymizeHashLength: 64,
+			},
+			err: true,
+		},
+		{
+			// Providing an invalid scrub pattern should error.
+			c: Config{
+				From:        from,
+				ScrubLabels: map[string]metricfamily.ScrubRule{"reason": {Redact: []string{"("}}},
+			},
+			err: true,
+		},
 		{
 			// Providing an invalid `FromCAFile` should error.
 			c: Config{
@@ -142,6 +201,36 @@ func TestNew(t *testing.T) {
 			},
 			err: true,
 		},
+		{
+			// Providing only `Sources` should not error.
+			c: Config{
+				Sources: []Source{{Name: "a", From: from}, {Name: "b", From: from}},
+			},
+			err: false,
+		},
+		{
+			// Providing a source without `From` should error.
+			c: Config{
+				From:    from,
+				Sources: []Source{{Name: "a"}},
+			},
+			err: true,
+		},
+		{
+			// Providing sources with duplicate names should error.
+			c: Config{
+				Sources: []Source{{Name: "a", From: from}, {Name: "a", From: from}},
+			},
+			err: true,
+		},
+		{
+			// Providing a source with an invalid `TokenFile` should error.
+			c: Config{
+				From:    from,
+				Sources: []Source{{Name: "a", From: from, TokenFile: "/this/path/does/not/exist"}},
+			},
+			err: true,
+		},
 	}
 
 	for i := range tc {
@@ -277,6 +366,446 @@ func TestRun(t *testing.T) {
 	wg.Wait()
 }
 
+// TestForwardSources tests that metrics from multiple sources are merged into a
+// single upload and that a failing source does not block the others.
+func TestForwardSources(t *testing.T) {
+	handler := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if got := req.URL.Query()["match[]"]; len(got) != 1 {
+				t.Errorf("expected one match rule, got %v", got)
+			}
+			w.Header().Set("Content-Type", string(expfmt.FmtText))
+			fmt.Fprint(w, body)
+		}
+	}
+	ts1 := httptest.NewServer(handler("# TYPE up gauge\nup{job=\"a\"} 1 1000\n"))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(handler("# TYPE up gauge\nup{job=\"b\"} 0 2000\n# TYPE other counter\nother 3 2000\n"))
+	defer ts2.Close()
+	ts3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts3.Close()
+
+	var received []*clientmodel.MetricFamily
+	to := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Errorf("failed to read uploaded metrics: %v", err)
+		}
+		received = families
+	}))
+	defer to.Close()
+
+	mustParse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse URL: %v", err)
+		}
+		return u
+	}
+
+	w, err := New(Config{
+		From:       mustParse(ts1.URL),
+		Rules:      []string{`{__name__="up"}`},
+		ToUpload:   mustParse(to.URL),
+		LimitBytes: 200 * 1024,
+		Sources: []Source{
+			{Name: "second", From: mustParse(ts2.URL), Rules: []string{`{job="b"}`}},
+			{Name: "failing", From: mustParse(ts3.URL), Rules: []string{`{job="c"}`}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	// Forward twice to ensure match rules do not accumulate on the source URLs.
+	for i := 0; i < 2; i++ {
+		if err := w.forward(context.Background()); err != nil {
+			t.Fatalf("failed to forward metrics: %v", err)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, family := range received {
+		counts[family.GetName()] += len(family.Metric)
+	}
+	if len(received) != 2 || counts["up"] != 2 || counts["other"] != 1 {
+		t.Fatalf("unexpected families received: %v", received)
+	}
+}
+
+// TestForwardQueries tests that a source with queries evaluates them via the
+// query API and sends the results as the recorded metrics.
+func TestForwardQueries(t *testing.T) {
+	results := map[string]string{
+		`sum by (job) (up)`: `{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1000,"2"]},{"metric":{"job":"b"},"value":[1000,"1"]}]}`,
+		`count(up)`:         `{"resultType":"scalar","result":[1000,"3"]}`,
+		`max(up)`:           `{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"c"},"value":[1000,"1"]}]}`,
+	}
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/prometheus/api/v1/query" {
+			t.Errorf("unexpected path %s", req.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		result, ok := results[req.URL.Query().Get("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","data":%s}`, result)
+	}))
+	defer from.Close()
+
+	var received []*clientmodel.MetricFamily
+	to := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Errorf("failed to read uploaded metrics: %v", err)
+		}
+		received = families
+	}))
+	defer to.Close()
+
+	fromURL, _ := url.Parse(from.URL + "/prometheus/federate")
+	toURL, _ := url.Parse(to.URL)
+	cfg := Config{
+		From:       fromURL,
+		Rules:      []string{`{__name__="up"}`},
+		ToUpload:   toURL,
+		LimitBytes: 200 * 1024,
+		Queries: []Query{
+			{Record: "job:up:sum", Expr: `sum by (job) (up)`},
+			{Record: "cluster:up:count", Expr: `count(up)`},
+			{Record: "job:up:sum", Expr: `max(up)`},
+		},
+	}
+	w, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("failed to forward metrics: %v", err)
+	}
+
+	got := make(map[string][]string)
+	for _, family := range received {
+		if family.GetType() != clientmodel.MetricType_UNTYPED {
+			t.Errorf("expected family %s to be untyped, got %s", family.GetName(), family.GetType())
+		}
+		for _, m := range family.Metric {
+			if m.GetTimestampMs() != 1000000 {
+				t.Errorf("expected the evaluation timestamp, got %d", m.GetTimestampMs())
+			}
+			var labels []string
+			for _, l := range m.Label {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			got[family.GetName()] = append(got[family.GetName()], fmt.Sprintf("%v %v", labels, m.GetUntyped().GetValue()))
+		}
+	}
+	want := map[string][]string{
+		"job:up:sum":       {"[job=a] 2", "[job=b] 1", "[job=c] 1"},
+		"cluster:up:count": {"[] 3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected families received: %v", got)
+	}
+
+	// A failing query fails the source.
+	cfg.Queries = []Query{{Record: "invalid", Expr: "sum("}}
+	if w, err = New(cfg); err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+	if err := w.forward(context.Background()); err == nil || !strings.Contains(err.Error(), "parse error") {
+		t.Fatalf("expected the query error to be returned, got %v", err)
+	}
+
+	cfg.Queries = []Query{{Record: "not a name", Expr: "up"}}
+	if _, err := New(cfg); err == nil {
+		t.Fatalf("expected an invalid record name to be rejected")
+	}
+}
+
+// TestForwardDestinations tests that metrics are sent to every destination with
+// the destination specific transformations applied, and that a failing destination
+// is retried independently of the others.
+func TestForwardDestinations(t *testing.T) {
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprint(w, "# TYPE up gauge\nup{job=\"a\"} 1 1000\n")
+	}))
+	defer from.Close()
+
+	var mu sync.Mutex
+	received := make(map[string][]*clientmodel.MetricFamily)
+	sends := make(map[string]int)
+	upload := func(name string, code int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			families, err := metricsclient.Read(req.Body)
+			if err != nil {
+				t.Errorf("failed to read uploaded metrics: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			received[name] = families
+			sends[name]++
+			w.WriteHeader(code)
+		}))
+	}
+	ok := upload("ok", http.StatusOK)
+	defer ok.Close()
+	failing := upload("failing", http.StatusInternalServerError)
+	defer failing.Close()
+
+	mustParse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse URL: %v", err)
+		}
+		return u
+	}
+
+	w, err := New(Config{
+		From:       mustParse(from.URL),
+		LimitBytes: 200 * 1024,
+		Destinations: []Destination{
+			{Name: "ok", ToUpload: mustParse(ok.URL), Transformer: metricfamily.NewLabel(map[string]string{"env": "stage"}, nil)},
+			{Name: "failing", ToUpload: mustParse(failing.URL)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	if err := w.forward(context.Background()); err == nil {
+		t.Fatalf("expected an error from the failing destination")
+	}
+	// Neither destination is due again yet.
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sends["ok"] != 1 || sends["failing"] != 1 {
+		t.Fatalf("unexpected number of sends: %v", sends)
+	}
+	if len(received["ok"]) != 1 || len(received["ok"][0].Metric[0].Label) != 2 {
+		t.Fatalf("expected the ok destination to receive the extra label: %v", received["ok"])
+	}
+	if len(received["failing"]) != 1 || len(received["failing"][0].Metric[0].Label) != 1 {
+		t.Fatalf("expected the failing destination to receive the original labels: %v", received["failing"])
+	}
+
+	// Make the failing destination due and ensure only it is retried.
+	w.destinations[1].next = time.Time{}
+	if err := w.forward(context.Background()); err == nil {
+		t.Fatalf("expected an error from the failing destination")
+	}
+	if sends["ok"] != 1 || sends["failing"] != 2 {
+		t.Fatalf("unexpected number of sends: %v", sends)
+	}
+}
+
+// TestForwardBuffer tests that metrics that could not be sent are buffered and
+// sent along with the next successful upload.
+func TestForwardBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var scrapes int64
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		scrapes++
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "# TYPE up gauge\nup{job=\"a\"} %d %d\n", scrapes, now+scrapes)
+	}))
+	defer from.Close()
+
+	var received []*clientmodel.MetricFamily
+	code := http.StatusServiceUnavailable
+	to := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Errorf("failed to read uploaded metrics: %v", err)
+		}
+		received = families
+		w.WriteHeader(code)
+	}))
+	defer to.Close()
+
+	fromURL, _ := url.Parse(from.URL)
+	toURL, _ := url.Parse(to.URL)
+	w, err := New(Config{
+		From:       fromURL,
+		ToUpload:   toURL,
+		LimitBytes: 200 * 1024,
+		BufferDir:  dir,
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	// Retries within an interval are not buffered again.
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			w.destinations[0].buffered = time.Time{}
+		}
+		w.destinations[0].next = time.Time{}
+		if err := w.forward(context.Background()); err == nil {
+			t.Fatalf("expected an error while the destination is unavailable")
+		}
+	}
+	if n := w.destinations[0].buffer.Len(); n != 2 {
+		t.Fatalf("expected 2 buffered payloads, got %d", n)
+	}
+
+	code = http.StatusOK
+	w.destinations[0].next = time.Time{}
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(received) != 1 || len(received[0].Metric) != 3 {
+		t.Fatalf("expected one family with all three samples, got %v", received)
+	}
+	for i, scrape := range []int64{1, 3, 4} {
+		if received[0].Metric[i].GetTimestampMs() != now+scrape {
+			t.Fatalf("expected samples in timestamp order, got %v", received[0].Metric)
+		}
+	}
+	if n := w.destinations[0].buffer.Len(); n != 0 {
+		t.Fatalf("expected the buffer to be empty, got %d", n)
+	}
+}
+
+// TestForwardBufferUnauthorized tests that metrics are buffered while the
+// authorize endpoint is unavailable, and sent with the labels it returns once
+// it is available again.
+func TestForwardBufferUnauthorized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var scrapes int64
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		scrapes++
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "# TYPE up gauge\nup{job=\"a\"} %d %d\n", scrapes, now+scrapes)
+	}))
+	defer from.Close()
+
+	code := http.StatusServiceUnavailable
+	authorize := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		fmt.Fprint(w, `{"version":1,"token":"b","labels":{"_id":"c"}}`)
+	}))
+	defer authorize.Close()
+
+	var received []*clientmodel.MetricFamily
+	to := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Errorf("failed to read uploaded metrics: %v", err)
+		}
+		received = families
+	}))
+	defer to.Close()
+
+	fromURL, _ := url.Parse(from.URL)
+	toURL, _ := url.Parse(to.URL)
+	authorizeURL, _ := url.Parse(authorize.URL)
+	w, err := New(Config{
+		From:        fromURL,
+		ToUpload:    toURL,
+		ToAuthorize: authorizeURL,
+		ToToken:     "a",
+		LimitBytes:  200 * 1024,
+		BufferDir:   dir,
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	if err := w.forward(context.Background()); err == nil {
+		t.Fatalf("expected an error while the authorize endpoint is unavailable")
+	}
+	if n := w.destinations[0].buffer.Len(); n != 1 {
+		t.Fatalf("expected 1 buffered payload, got %d", n)
+	}
+
+	code = http.StatusOK
+	w.destinations[0].next = time.Time{}
+	if err := w.forward(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(received) != 1 || len(received[0].Metric) != 2 {
+		t.Fatalf("expected one family with both samples, got %v", received)
+	}
+	for _, m := range received[0].Metric {
+		found := false
+		for _, l := range m.Label {
+			found = found || l.GetName() == "_id" && l.GetValue() == "c"
+		}
+		if !found {
+			t.Errorf("expected the labels of the authorize endpoint, got %v", m.Label)
+		}
+	}
+}
+
+// TestForwardMaxAttempts tests that a failing upload is retried exactly
+// MaxAttempts times before the worker waits for the regular interval.
+func TestForwardMaxAttempts(t *testing.T) {
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprint(w, "# TYPE up gauge\nup{job=\"a\"} 1 1000\n")
+	}))
+	defer from.Close()
+
+	var sends int
+	to := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		sends++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer to.Close()
+
+	fromURL, _ := url.Parse(from.URL)
+	toURL, _ := url.Parse(to.URL)
+	w, err := New(Config{
+		From:        fromURL,
+		ToUpload:    toURL,
+		LimitBytes:  200 * 1024,
+		Interval:    time.Hour,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Minute,
+		MaxAttempts: 3,
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	// Retry until the worker backs off for the whole interval.
+	for i := 0; i < 10; i++ {
+		w.destinations[0].next = time.Time{}
+		if err := w.forward(context.Background()); err == nil {
+			t.Fatalf("expected an error while the destination is unavailable")
+		}
+		if time.Until(w.destinations[0].next) > time.Minute {
+			break
+		}
+	}
+	if sends != 4 {
+		t.Fatalf("expected the first try and 3 retries, got %d sends", sends)
+	}
+}
+
 type fakeRoundTripper struct {
 	fn func(*http.Request)
 }
@@ -288,3 +817,82 @@ func (frt *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 		StatusCode: http.StatusOK,
 	}, nil
 }
+
+func TestForwardDelta(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	var scrapes int64
+	from := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		scrapes++
+		w.Header().Set("Content-Type", string(expfmt.FmtText))
+		fmt.Fprintf(w, "# TYPE up gauge\nup{job=\"a\"} 1 %d\nup{job=\"b\"} %d %d\n", now, scrapes, now)
+	}))
+	defer from.Close()
+
+	type upload struct {
+		sequence, base string
+		series         int
+	}
+	var (
+		uploads  []upload
+		conflict bool
+	)
+	to := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		families, err := metricsclient.Read(req.Body)
+		if err != nil {
+			t.Errorf("failed to read uploaded metrics: %v", err)
+		}
+		u := upload{
+			sequence: req.Header.Get(metricsclient.SequenceHeader),
+			base:     req.Header.Get(metricsclient.BaseSequenceHeader),
+			series:   metricfamily.MetricsCount(families),
+		}
+		uploads = append(uploads, u)
+		if conflict && len(u.base) > 0 {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer to.Close()
+
+	fromURL, _ := url.Parse(from.URL)
+	toURL, _ := url.Parse(to.URL)
+	w, err := New(Config{
+		From:           fromURL,
+		ToUpload:       toURL,
+		LimitBytes:     200 * 1024,
+		DeltaUploads:   true,
+		DeltaFullEvery: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create new worker: %v", err)
+	}
+
+	forward := func() {
+		w.destinations[0].next = time.Time{}
+		if err := w.forward(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	forward()
+	forward()
+	conflict = true
+	forward()
+	conflict = false
+	forward()
+	forward()
+	forward()
+
+	expected := []upload{
+		{sequence: "1", series: 2},
+		{sequence: "2", base: "1", series: 1},
+		// The delta is rejected and all series are sent instead.
+		{sequence: "3", base: "2", series: 1},
+		{sequence: "4", series: 2},
+		{sequence: "5", base: "4", series: 1},
+		{sequence: "6", base: "5", series: 1},
+		// All series are sent again after two deltas.
+		{sequence: "7", series: 2},
+	}
+	if !reflect.DeepEqual(uploads, expected) {
+		t.Fatalf("expected uploads %v, got %v", expected, uploads)
+	}
+}
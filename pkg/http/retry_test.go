@@ -0,0 +1,26 @@
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2019, 2, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "120", want: 2 * time.Minute},
+		{value: " 5 ", want: 5 * time.Second},
+		{value: "-5", want: 0},
+		{value: "soon", want: 0},
+		{value: "Fri, 01 Feb 2019 12:05:00 GMT", want: 5 * time.Minute},
+		{value: "Fri, 01 Feb 2019 11:55:00 GMT", want: 0},
+	} {
+		if got := RetryAfter(tc.value, now); got != tc.want {
+			t.Errorf("RetryAfter(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
@@ -1,32 +1,57 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/golang/snappy"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/openshift/telemeter/pkg/audit"
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/ingest"
+	"github.com/openshift/telemeter/pkg/logging"
+	"github.com/openshift/telemeter/pkg/metadata"
 	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/metricsclient"
+	"github.com/openshift/telemeter/pkg/openmetrics"
+	"github.com/openshift/telemeter/pkg/reader"
 	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+	"github.com/openshift/telemeter/pkg/store/quota"
 	"github.com/openshift/telemeter/pkg/store/ratelimited"
+	"github.com/openshift/telemeter/pkg/tracing"
 	"github.com/openshift/telemeter/pkg/validate"
 )
 
 type Server struct {
+	logger       log.Logger
 	maxSampleAge time.Duration
 	store        store.Store
 	transformer  metricfamily.Transformer
 	validator    validate.Validator
 	nowFn        func() time.Time
+	audit        *audit.Logger
+	stats        *ingest.Stats
 }
 
-func New(store store.Store, validator validate.Validator, transformer metricfamily.Transformer, maxSampleAge time.Duration) *Server {
+func New(logger log.Logger, store store.Store, validator validate.Validator, transformer metricfamily.Transformer, maxSampleAge time.Duration) *Server {
 	return &Server{
+		logger:       log.With(logging.OrNop(logger), "component", "server"),
 		maxSampleAge: maxSampleAge,
 		store:        store,
 		transformer:  transformer,
@@ -35,8 +60,9 @@ func New(store store.Store, validator validate.Validator, transformer metricfami
 	}
 }
 
-func NewNonExpiring(store store.Store, validator validate.Validator, transformer metricfamily.Transformer, maxSampleAge time.Duration) *Server {
+func NewNonExpiring(logger log.Logger, store store.Store, validator validate.Validator, transformer metricfamily.Transformer, maxSampleAge time.Duration) *Server {
 	return &Server{
+		logger:       log.With(logging.OrNop(logger), "component", "server"),
 		maxSampleAge: maxSampleAge,
 		store:        store,
 		transformer:  transformer,
@@ -45,46 +71,227 @@ func NewNonExpiring(store store.Store, validator validate.Validator, transformer
 	}
 }
 
+// SetAuditLogger records every upload to the given logger.
+func (s *Server) SetAuditLogger(l *audit.Logger) {
+	s.audit = l
+}
+
+// SetIngestStats records the outcome of every upload with a known partition
+// in the given statistics.
+func (s *Server) SetIngestStats(stats *ingest.Stats) {
+	s.stats = stats
+}
+
 func (s *Server) Get(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	format := expfmt.Negotiate(req.Header)
-	encoder := expfmt.NewEncoder(w, format)
-	ctx := context.Background()
+	shard, shards, selector, err := parseFederateParams(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := openmetrics.Negotiate(req.Header)
+	w.Header().Set("Content-Type", string(format))
+	ctx := req.Context()
+	logger := logging.FromContext(ctx, s.logger)
 
 	// samples older than 10 minutes must be ignored
 	var minTimeMs int64
-	var filter metricfamily.MultiTransformer
-	if s.nowFn != nil {
-		filter.With(metricfamily.NewDropExpiredSamples(s.nowFn().Add(-s.maxSampleAge)))
-		filter.With(metricfamily.TransformerFunc(metricfamily.PackMetrics))
+	expire := s.nowFn != nil
+	if expire {
+		minTimeMs = s.nowFn().Add(-s.maxSampleAge).Unix() * 1000
 	}
 
-	filter.With(metricfamily.TransformerFunc(metricfamily.DropTimestamp))
-
-	ps, err := s.store.ReadMetrics(ctx, minTimeMs)
+	buf := &bytes.Buffer{}
+	written := false
+	err = store.Stream(ctx, s.store, minTimeMs, func(p *store.StreamedPartition) error {
+		if shards > 1 && partitionShard(p.PartitionKey, shards) != shard {
+			return nil
+		}
+		written = true
+		// The samples of a partition without expired samples are encoded once
+		// and served from the cache until the partition is written again.
+		// Selected samples vary by request, so they are never cached.
+		if selector == nil && (!expire || p.OldestTimestampMs >= minTimeMs) {
+			data, ok := p.Cache.Get(string(format))
+			if !ok {
+				buf.Reset()
+				if err := encodeFamilies(openmetrics.NewEncoder(buf, format), p.Families, nil, false, 0); err != nil {
+					return err
+				}
+				data = append([]byte(nil), buf.Bytes()...)
+				p.Cache.Set(string(format), data)
+			}
+			_, err := w.Write(data)
+			return err
+		}
+		return encodeFamilies(openmetrics.NewEncoder(w, format), p.Families, selector, expire, minTimeMs)
+	})
 	if err != nil {
-		log.Printf("error reading metrics: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		level.Error(logger).Log("msg", "error streaming metrics", "err", err)
+		if !written {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
+	if format == openmetrics.FmtOpenMetrics {
+		if err := openmetrics.WriteEOF(w); err != nil {
+			level.Error(logger).Log("msg", "error streaming metrics", "err", err)
+		}
+	}
+}
 
-	for _, p := range ps {
-		for _, family := range p.Families {
-			if family == nil {
+// parseFederateParams parses the optional shard, shards and match[] parameters
+// of a federate request. Only the partitions whose key hashes to the given shard
+// out of shards are returned, and only the samples matching at least one of the
+// match[] selectors. The returned selector is nil if no selectors were given.
+func parseFederateParams(req *http.Request) (shard, shards uint64, selector metricfamily.Selector, err error) {
+	if err := req.ParseForm(); err != nil {
+		return 0, 0, nil, err
+	}
+	if len(req.Form.Get("shard")) > 0 || len(req.Form.Get("shards")) > 0 {
+		if shards, err = strconv.ParseUint(req.Form.Get("shards"), 10, 64); err != nil || shards == 0 {
+			return 0, 0, nil, fmt.Errorf("shards must be a positive integer")
+		}
+		if shard, err = strconv.ParseUint(req.Form.Get("shard"), 10, 64); err != nil || shard >= shards {
+			return 0, 0, nil, fmt.Errorf("shard must be an integer between 0 and %d", shards-1)
+		}
+	}
+	if matches := req.Form["match[]"]; len(matches) > 0 {
+		if selector, err = metricfamily.NewSelector(matches); err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid match[] selector: %v", err)
+		}
+	}
+	return shard, shards, selector, nil
+}
+
+// partitionShard returns the shard out of shards the given partition key belongs to.
+func partitionShard(partitionKey string, shards uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(partitionKey))
+	return h.Sum64() % shards
+}
+
+// encodeFamilies encodes the given families without timestamps, skipping the
+// samples not matching the selector if it is not nil, the samples older than
+// minTimeMs if expire is set, and the families without samples.
+// The families are not modified, the encoder is passed shallow copies instead.
+func encodeFamilies(encoder expfmt.Encoder, families []*clientmodel.MetricFamily, selector metricfamily.Selector, expire bool, minTimeMs int64) error {
+	var (
+		metrics []*clientmodel.Metric
+		values  []clientmodel.Metric
+	)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		metrics = metrics[:0]
+		if cap(values) < len(family.Metric) {
+			values = make([]clientmodel.Metric, len(family.Metric))
+		}
+		for _, m := range family.Metric {
+			if m == nil || expire && m.GetTimestampMs() < minTimeMs {
 				continue
 			}
-			if ok, err := filter.Transform(family); err != nil || !ok {
+			if selector != nil && !selector.Matches(family.GetName(), m) {
 				continue
 			}
-			if err := encoder.Encode(family); err != nil {
-				log.Printf("error encoding metrics family: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			value := &values[len(metrics)]
+			*value = *m
+			value.TimestampMs = nil
+			metrics = append(metrics, value)
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+
+		f := *family
+		f.Metric = metrics
+		if err := encoder.Encode(&f); err != nil {
+			return fmt.Errorf("unable to encode metrics family %s: %v", family.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// Partitions serves the admin API of the stored partitions. GET /partitions lists
+// the partitions, GET /partitions/<key> returns the metrics of a partition with
+// their timestamps and DELETE /partitions/<key> deletes a partition. In a cluster,
+// only the partitions stored by the member serving the request are listed, but
+// a partition is fetched from the member it belongs to.
+func (s *Server) Partitions(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	partitionKey := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/partitions"), "/")
+	logger := log.With(logging.FromContext(ctx, s.logger), "partition", partitionKey)
+
+	switch {
+	case req.Method == "GET" && len(partitionKey) == 0:
+		infos, err := store.ListPartitions(ctx, s.store)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			level.Error(logger).Log("msg", "error writing partitions", "err", err)
+		}
+
+	case req.Method == "GET":
+		p, err := store.GetPartition(ctx, s.store, partitionKey)
+		if _, ok := err.(*store.NotOwnerError); ok {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if p == nil {
+			http.Error(w, fmt.Sprintf("partition %s not found", partitionKey), http.StatusNotFound)
+			return
+		}
+		format := openmetrics.Negotiate(req.Header)
+		w.Header().Set("Content-Type", string(format))
+		encoder := openmetrics.NewEncoder(w, format)
+		for _, family := range p.Families {
+			if family == nil {
 				continue
 			}
+			if err := encoder.Encode(family); err != nil {
+				level.Error(logger).Log("msg", "error writing partition", "err", err)
+				return
+			}
 		}
+		if format == openmetrics.FmtOpenMetrics {
+			if err := openmetrics.WriteEOF(w); err != nil {
+				level.Error(logger).Log("msg", "error writing partition", "err", err)
+			}
+		}
+
+	case req.Method == "DELETE" && len(partitionKey) > 0:
+		deleted, err := store.DeletePartition(ctx, s.store, partitionKey)
+		switch {
+		case err == store.ErrNotSupported:
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case !deleted:
+			http.Error(w, fmt.Sprintf("partition %s not found", partitionKey), http.StatusNotFound)
+		default:
+			level.Info(logger).Log("msg", "deleted partition")
+			s.stats.Forget(partitionKey)
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
@@ -95,12 +302,43 @@ func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
 	}
 	defer req.Body.Close()
 
+	logger := logging.FromContext(req.Context(), s.logger)
+	rec := audit.NewRecord("upload", req, time.Now())
+	defer s.audit.Log(rec)
+	body := &reader.CountingReader{R: req.Body}
+	req.Body = ioutil.NopCloser(body)
+	fail := func(status int, err error) {
+		level.Debug(logger).Log("msg", "upload rejected", "status", status, "err", err)
+		rec.Fail(status, err)
+		rec.Bytes = body.Count()
+		http.Error(w, err.Error(), status)
+	}
+
 	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
 	defer cancel()
 
+	validateSpan, _ := tracing.StartSpan(ctx, "server.validate")
 	partitionKey, transforms, err := s.validator.Validate(ctx, req)
+	tracing.Finish(validateSpan, err)
+	if client, ok := authorize.FromContext(ctx); ok {
+		rec.Subject = client.ID
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	rec.ClientID, rec.PartitionKey = partitionKey, partitionKey
+	logger = log.With(logger, "partition", partitionKey)
+	var upload ingest.Upload
+	defer func() {
+		upload.Bytes = body.Count()
+		s.stats.Record(partitionKey, upload)
+	}()
+
+	sequence, delta, err := parseSequence(req.Header, time.Now())
+	if err != nil {
+		upload.Reason = ingest.Invalid
+		fail(http.StatusBadRequest, err)
 		return
 	}
 
@@ -109,35 +347,106 @@ func (s *Server) Post(w http.ResponseWriter, req *http.Request) {
 	t.With(s.transformer)
 
 	// read the response into memory
-	format := expfmt.ResponseFormat(req.Header)
+	format := openmetrics.ResponseFormat(req.Header)
 	var r io.Reader = req.Body
 	if req.Header.Get("Content-Encoding") == "snappy" {
 		r = snappy.NewReader(r)
 	}
-	decoder := expfmt.NewDecoder(r, format)
+	decoder := openmetrics.NewDecoder(r, format)
 
-	errCh := make(chan error)
-	go func() { errCh <- s.decodeAndStoreMetrics(ctx, partitionKey, decoder, t) }()
+	resultCh := make(chan storeResult, 1)
+	go func() {
+		resultCh <- s.decodeAndStoreMetrics(ctx, &store.PartitionedMetrics{PartitionKey: partitionKey, Sequence: sequence, Delta: delta}, decoder, t)
+	}()
 
 	select {
 	case <-ctx.Done():
-		http.Error(w, "Timeout while storing metrics", http.StatusInternalServerError)
-		log.Printf("timeout processing incoming request")
+		upload.Reason = ingest.Timeout
+		fail(http.StatusInternalServerError, fmt.Errorf("Timeout while storing metrics"))
+		level.Warn(logger).Log("msg", "timeout processing incoming request")
 		return
-	case err := <-errCh:
+	case result := <-resultCh:
+		rec.SeriesIn, rec.SeriesOut = result.seriesIn, result.seriesOut
+		rec.Bytes = body.Count()
+		upload.Samples, upload.Accepted = result.seriesIn, result.seriesOut
+		err := result.err
+		if _, ok := err.(*metadata.MismatchError); ok {
+			upload.Reason = ingest.Invalid
+			fail(http.StatusBadRequest, err)
+			return
+		}
+		if qerr, ok := err.(*quota.ExceededError); ok {
+			upload.Reason = ingest.QuotaExceeded
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(qerr.RetryAfter.Seconds()))))
+			fail(http.StatusTooManyRequests, err)
+			return
+		}
 		switch err {
 		case nil:
 			break
 		case ratelimited.ErrWriteLimitReached:
-			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			upload.Reason = ingest.RateLimited
+			fail(http.StatusTooManyRequests, err)
+		case memstore.ErrStoreFull:
+			upload.Reason = ingest.StoreFull
+			fail(http.StatusServiceUnavailable, err)
+		case store.ErrSequenceMismatch:
+			upload.Reason = ingest.SequenceMismatch
+			fail(http.StatusConflict, err)
 		default:
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			upload.Reason = ingest.Failed
+			fail(http.StatusInternalServerError, err)
 		}
 		return
 	}
 }
 
-func (s *Server) decodeAndStoreMetrics(ctx context.Context, partitionKey string, decoder expfmt.Decoder, transformer metricfamily.Transformer) error {
+// parseSequence returns the sequence number of a numbered upload and, if the
+// upload only holds the series that changed since a previous upload, the delta.
+// The timestamp of the unchanged series is capped at now.
+func parseSequence(h http.Header, now time.Time) (uint64, *store.Delta, error) {
+	if len(h.Get(metricsclient.SequenceHeader)) == 0 {
+		if len(h.Get(metricsclient.BaseSequenceHeader)) > 0 {
+			return 0, nil, fmt.Errorf("the %s header requires the %s header", metricsclient.BaseSequenceHeader, metricsclient.SequenceHeader)
+		}
+		return 0, nil, nil
+	}
+	sequence, err := strconv.ParseUint(h.Get(metricsclient.SequenceHeader), 10, 64)
+	if err != nil || sequence == 0 {
+		return 0, nil, fmt.Errorf("the %s header must be a positive integer", metricsclient.SequenceHeader)
+	}
+	if len(h.Get(metricsclient.BaseSequenceHeader)) == 0 {
+		return sequence, nil, nil
+	}
+	base, err := strconv.ParseUint(h.Get(metricsclient.BaseSequenceHeader), 10, 64)
+	if err != nil || base == 0 {
+		return 0, nil, fmt.Errorf("the %s header must be a positive integer", metricsclient.BaseSequenceHeader)
+	}
+	timestampMs, err := strconv.ParseInt(h.Get(metricsclient.TimestampHeader), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("the %s header must be a timestamp in milliseconds", metricsclient.TimestampHeader)
+	}
+	if nowMs := now.UnixNano() / int64(time.Millisecond); timestampMs > nowMs {
+		timestampMs = nowMs
+	}
+	return sequence, &store.Delta{BaseSequence: base, TimestampMs: timestampMs}, nil
+}
+
+// storeResult is the outcome of decoding and storing an upload.
+type storeResult struct {
+	seriesIn  int
+	seriesOut int
+	err       error
+}
+
+// decodeAndStoreMetrics decodes, transforms and writes the families of an
+// upload to the partition described by p.
+func (s *Server) decodeAndStoreMetrics(ctx context.Context, p *store.PartitionedMetrics, decoder expfmt.Decoder, transformer metricfamily.Transformer) storeResult {
+	var result storeResult
+	span, ctx := tracing.StartSpan(ctx, "server.decodeAndStoreMetrics")
+	defer func() { tracing.Finish(span, result.err) }()
+
+	decodeSpan, _ := tracing.StartSpan(ctx, "server.decode")
 	families := make([]*clientmodel.MetricFamily, 0, 100)
 	for {
 		family := &clientmodel.MetricFamily{}
@@ -146,17 +455,28 @@ func (s *Server) decodeAndStoreMetrics(ctx context.Context, partitionKey string,
 			if err == io.EOF {
 				break
 			}
-			return err
+			result.err = err
+			tracing.Finish(decodeSpan, err)
+			return result
 		}
 	}
+	result.seriesIn = metricfamily.MetricsCount(families)
+	decodeSpan.SetAttributes(attribute.Int("series", result.seriesIn))
+	decodeSpan.End()
 
-	if err := metricfamily.Filter(families, transformer); err != nil {
-		return err
+	transformSpan, _ := tracing.StartSpan(ctx, "server.transform")
+	if result.err = metricfamily.Filter(families, transformer); result.err != nil {
+		tracing.Finish(transformSpan, result.err)
+		return result
 	}
 	families = metricfamily.Pack(families)
+	result.seriesOut = metricfamily.MetricsCount(families)
+	transformSpan.SetAttributes(attribute.Int("series", result.seriesOut))
+	transformSpan.End()
 
-	return s.store.WriteMetrics(ctx, &store.PartitionedMetrics{
-		PartitionKey: partitionKey,
-		Families:     families,
-	})
+	storeSpan, ctx := tracing.StartSpan(ctx, "server.store")
+	p.Families = families
+	result.err = s.store.WriteMetrics(ctx, p)
+	tracing.Finish(storeSpan, result.err)
+	return result
 }
@@ -3,13 +3,18 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sort"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+
 	"github.com/openshift/telemeter/pkg/store"
 	"github.com/openshift/telemeter/pkg/store/memstore"
 	"github.com/openshift/telemeter/pkg/validate"
@@ -77,6 +82,65 @@ func TestServer_Get(t *testing.T) {
 			},
 			wantCode: 200,
 		},
+		{
+			name: "drop timestamps of unexpired samples",
+			fields: fields{
+				store: storeWithData(map[string][]*clientmodel.MetricFamily{
+					"cluster-1": {
+						family("test_1", 1000000, 1002000),
+					},
+					"cluster-2": {
+						family("test_2", 1004000),
+					},
+				}),
+				nowFn: func() time.Time { return time.Unix(1100, 0) },
+			},
+			req: &http.Request{
+				Method: "GET",
+			},
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_1", -1, -1),
+				family("test_2", -1),
+			},
+			wantCode: 200,
+		},
+		{
+			name: "select samples",
+			fields: fields{
+				store: storeWithData(map[string][]*clientmodel.MetricFamily{
+					"cluster-1": {
+						family("test_1", 1000000, 1002000),
+						family("test_2", 1000000),
+					},
+					"cluster-2": {
+						family("test_3", 1004000),
+					},
+				}),
+				nowFn: func() time.Time { return time.Unix(1100, 0) },
+			},
+			req: httptest.NewRequest("GET", `/federate?match[]={__name__="test_1"}&match[]=test_3`, nil),
+			wantFamilies: []*clientmodel.MetricFamily{
+				family("test_1", -1, -1),
+				family("test_3", -1),
+			},
+			wantCode: 200,
+		},
+		{
+			name: "invalid shard",
+			fields: fields{
+				store: storeWithData(nil),
+			},
+			req:      httptest.NewRequest("GET", "/federate?shard=2&shards=2", nil),
+			wantCode: 400,
+		},
+		{
+			name: "invalid selector",
+			fields: fields{
+				store: storeWithData(nil),
+			},
+			req:      httptest.NewRequest("GET", "/federate?match[]={", nil),
+			wantCode: 400,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -86,24 +150,103 @@ func TestServer_Get(t *testing.T) {
 				validator:    tt.fields.validator,
 				nowFn:        tt.fields.nowFn,
 			}
-			w := httptest.NewRecorder()
-			s.Get(w, tt.req)
-			if w.Code != tt.wantCode {
-				t.Fatalf("unexpected code %d", w.Code)
-			}
-			families, err := read(w.Body)
-			if err != nil {
-				t.Fatal(err)
-			}
-			sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
-			got, expected := familiesToText(families), familiesToText(tt.wantFamilies)
-			if got != expected {
-				t.Fatalf("got\n%s\nwant\n%s", got, expected)
+			// Scrape twice, the stored metrics must not be modified by a scrape.
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				s.Get(w, tt.req)
+				if w.Code != tt.wantCode {
+					t.Fatalf("unexpected code %d", w.Code)
+				}
+				if w.Code != http.StatusOK {
+					return
+				}
+				families, err := read(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+				got, expected := familiesToText(families), familiesToText(tt.wantFamilies)
+				if got != expected {
+					t.Fatalf("scrape %d: got\n%s\nwant\n%s", i, got, expected)
+				}
 			}
 		})
 	}
 }
 
+func TestServer_GetSharded(t *testing.T) {
+	data := make(map[string][]*clientmodel.MetricFamily)
+	for i := 0; i < 20; i++ {
+		partitionKey := "cluster-" + strconv.Itoa(i)
+		data[partitionKey] = []*clientmodel.MetricFamily{family("test_"+strconv.Itoa(i), 1000000)}
+	}
+	s := &Server{
+		maxSampleAge: 10 * time.Minute,
+		store:        storeWithData(data),
+		nowFn:        func() time.Time { return time.Unix(1100, 0) },
+	}
+
+	seen := make(map[string]int)
+	for shard := 0; shard < 3; shard++ {
+		w := httptest.NewRecorder()
+		s.Get(w, httptest.NewRequest("GET", "/federate?shards=3&shard="+strconv.Itoa(shard), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected code %d", w.Code)
+		}
+		families, err := read(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) == 0 || len(families) == len(data) {
+			t.Errorf("expected shard %d to hold some of the partitions, got %d", shard, len(families))
+		}
+		for _, f := range families {
+			seen[f.GetName()]++
+		}
+	}
+	if len(seen) != len(data) {
+		t.Errorf("expected the shards to hold all %d partitions, got %d", len(data), len(seen))
+	}
+	for name, n := range seen {
+		if n != 1 {
+			t.Errorf("expected %s to be in exactly one shard, got %d", name, n)
+		}
+	}
+}
+
+func TestServer_GetNativeHistogram(t *testing.T) {
+	// Schema 3 of a native histogram, unknown to the vendored client model.
+	native := &clientmodel.MetricFamily{
+		Name: proto.String("test_native"),
+		Type: clientmodel.MetricType_HISTOGRAM.Enum(),
+		Metric: []*clientmodel.Metric{{
+			Histogram: &clientmodel.Histogram{
+				SampleCount:      proto.Uint64(1),
+				XXX_unrecognized: []byte{0x28, 0x06},
+			},
+			TimestampMs: proto.Int64(1000000),
+		}},
+	}
+	s := &Server{
+		maxSampleAge: 10 * time.Minute,
+		store:        storeWithData(map[string][]*clientmodel.MetricFamily{"cluster-1": {native}}),
+		nowFn:        func() time.Time { return time.Unix(1100, 0) },
+	}
+
+	req := httptest.NewRequest("GET", "/federate", nil)
+	req.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+	w := httptest.NewRecorder()
+	s.Get(w, req)
+
+	got := &clientmodel.MetricFamily{}
+	if err := expfmt.NewDecoder(w.Body, expfmt.FmtProtoDelim).Decode(got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Metric[0].Histogram.XXX_unrecognized, native.Metric[0].Histogram.XXX_unrecognized) {
+		t.Errorf("expected native histogram fields to be preserved, got %v", got)
+	}
+}
+
 func familiesToText(families []*clientmodel.MetricFamily) string {
 	buf := &bytes.Buffer{}
 	for _, f := range families {
@@ -127,3 +270,99 @@ func read(r io.Reader) ([]*clientmodel.MetricFamily, error) {
 	}
 	return families, nil
 }
+
+func TestServer_Partitions(t *testing.T) {
+	s := &Server{store: storeWithData(map[string][]*clientmodel.MetricFamily{
+		"a": {family("test_a", 1000, 2000)},
+		"b": {family("test_b", 3000), family("other_b", 1000)},
+	})}
+
+	w := httptest.NewRecorder()
+	s.Partitions(w, httptest.NewRequest("GET", "/partitions", nil))
+	var infos []*store.PartitionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("unable to parse %q: %v", w.Body.String(), err)
+	}
+	if len(infos) != 2 || infos[0].PartitionKey != "a" || infos[1].PartitionKey != "b" {
+		t.Fatalf("unexpected partitions %s", w.Body.String())
+	}
+	if b := infos[1]; b.Families != 2 || b.Series != 2 || b.NewestTimestampMs != 3000 || b.LastWrite.IsZero() {
+		t.Errorf("unexpected summary of partition b %#v", b)
+	}
+
+	w = httptest.NewRecorder()
+	s.Partitions(w, httptest.NewRequest("GET", "/partitions/a", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected code %d", w.Code)
+	}
+	if got, want := w.Body.String(), "# TYPE test_a counter\ntest_a 1 1000\ntest_a 1 2000\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{method: "DELETE", path: "/partitions/a", code: http.StatusNoContent},
+		{method: "DELETE", path: "/partitions/a", code: http.StatusNotFound},
+		{method: "GET", path: "/partitions/a", code: http.StatusNotFound},
+		{method: "DELETE", path: "/partitions", code: http.StatusMethodNotAllowed},
+	} {
+		w = httptest.NewRecorder()
+		s.Partitions(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s %s: expected code %d, got %d", tc.method, tc.path, tc.code, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	s.Partitions(w, httptest.NewRequest("GET", "/partitions", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].PartitionKey != "b" {
+		t.Errorf("expected only partition b to be left, got %s", w.Body.String())
+	}
+}
+
+func TestParseSequence(t *testing.T) {
+	now := time.Unix(100, 0)
+	for _, tc := range []struct {
+		name     string
+		headers  map[string]string
+		sequence uint64
+		delta    *store.Delta
+		wantErr  bool
+	}{
+		{name: "unnumbered"},
+		{name: "full", headers: map[string]string{"Telemeter-Sequence": "2"}, sequence: 2},
+		{
+			name:     "delta",
+			headers:  map[string]string{"Telemeter-Sequence": "2", "Telemeter-Base-Sequence": "1", "Telemeter-Timestamp": "99000"},
+			sequence: 2,
+			delta:    &store.Delta{BaseSequence: 1, TimestampMs: 99000},
+		},
+		{
+			name:     "delta from the future",
+			headers:  map[string]string{"Telemeter-Sequence": "2", "Telemeter-Base-Sequence": "1", "Telemeter-Timestamp": "200000"},
+			sequence: 2,
+			delta:    &store.Delta{BaseSequence: 1, TimestampMs: 100000},
+		},
+		{name: "zero sequence", headers: map[string]string{"Telemeter-Sequence": "0"}, wantErr: true},
+		{name: "base without sequence", headers: map[string]string{"Telemeter-Base-Sequence": "1"}, wantErr: true},
+		{name: "delta without timestamp", headers: map[string]string{"Telemeter-Sequence": "2", "Telemeter-Base-Sequence": "1"}, wantErr: true},
+	} {
+		h := make(http.Header)
+		for k, v := range tc.headers {
+			h.Set(k, v)
+		}
+		sequence, delta, err := parseSequence(h, now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if sequence != tc.sequence || !reflect.DeepEqual(delta, tc.delta) {
+			t.Errorf("%s: expected %d, %v, got %d, %v", tc.name, tc.sequence, tc.delta, sequence, delta)
+		}
+	}
+}
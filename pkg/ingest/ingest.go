@@ -0,0 +1,285 @@
+// Package ingest keeps statistics about the uploads of every partition. They
+// are served as JSON, while only aggregates are exported as metrics, so that the
+// number of series does not grow with the number of partitions.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/logging"
+)
+
+var (
+	uploadBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "telemeter_upload_bytes",
+		Help:    "Tracks the size of uploads in bytes, as received before decompression.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+	})
+
+	uploadSamples = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "telemeter_upload_samples",
+		Help:    "Tracks the number of samples per upload, before filtering.",
+		Buckets: prometheus.ExponentialBuckets(10, 4, 8),
+	})
+
+	uploadSamplesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_upload_samples_total",
+		Help: "Tracks the number of uploaded samples, by whether they were accepted or the reason they were dropped.",
+	}, []string{"result"})
+
+	lastUploadAgeDesc = prometheus.NewDesc(
+		"telemeter_partition_last_upload_age_seconds",
+		"The distribution of the time since the last upload of the tracked partitions.",
+		nil, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadBytes, uploadSamples, uploadSamplesTotal)
+}
+
+// ageBuckets are the buckets of the last upload age distribution.
+var ageBuckets = []float64{60, 5 * 60, 10 * 60, 30 * 60, 60 * 60, 6 * 60 * 60, 24 * 60 * 60}
+
+// The results of uploaded samples. All but Accepted are reasons for dropping them.
+const (
+	Accepted         = "accepted"
+	Filtered         = "filtered"
+	Invalid          = "invalid"
+	RateLimited      = "rate_limited"
+	QuotaExceeded    = "quota_exceeded"
+	StoreFull        = "store_full"
+	SequenceMismatch = "sequence_mismatch"
+	Timeout          = "timeout"
+	Failed           = "error"
+)
+
+// Upload describes the outcome of a single upload.
+type Upload struct {
+	// Bytes is the size of the upload as received, before decompression.
+	Bytes int64
+	// Samples is the number of uploaded samples and Accepted the number left
+	// after filtering.
+	Samples  int
+	Accepted int
+	// Reason is the reason the whole upload was rejected, if it was.
+	Reason string
+}
+
+// Partition holds the statistics of the uploads of a partition.
+type Partition struct {
+	PartitionKey string    `json:"partitionKey"`
+	LastUpload   time.Time `json:"lastUpload"`
+	// LastAccepted is the time of the last upload that was stored, if any.
+	LastAccepted         time.Time        `json:"lastAccepted"`
+	LastUploadAgeSeconds float64          `json:"lastUploadAgeSeconds"`
+	LastBytes            int64            `json:"lastBytes"`
+	Uploads              int64            `json:"uploads"`
+	Bytes                int64            `json:"bytes"`
+	SamplesAccepted      int64            `json:"samplesAccepted"`
+	SamplesDropped       map[string]int64 `json:"samplesDropped,omitempty"`
+}
+
+// Stats tracks the uploads of the partitions that uploaded within the TTL.
+// A nil Stats tracks nothing.
+type Stats struct {
+	logger log.Logger
+	ttl    time.Duration
+	nowFn  func() time.Time
+
+	mu         sync.Mutex // protects fields below
+	partitions map[string]*Partition
+}
+
+// New returns statistics that forget partitions which did not upload within ttl.
+func New(logger log.Logger, ttl time.Duration) *Stats {
+	return &Stats{
+		logger:     log.With(logging.OrNop(logger), "component", "ingest"),
+		ttl:        ttl,
+		nowFn:      time.Now,
+		partitions: make(map[string]*Partition),
+	}
+}
+
+// Record adds the given upload to the statistics of its partition.
+func (s *Stats) Record(partitionKey string, u Upload) {
+	if s == nil {
+		return
+	}
+	uploadBytes.Observe(float64(u.Bytes))
+	uploadSamples.Observe(float64(u.Samples))
+
+	now := s.nowFn()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.partitions[partitionKey]
+	if !ok {
+		p = &Partition{PartitionKey: partitionKey}
+		s.partitions[partitionKey] = p
+	}
+	p.LastUpload = now
+	p.LastBytes = u.Bytes
+	p.Uploads++
+	p.Bytes += u.Bytes
+
+	if len(u.Reason) > 0 {
+		p.drop(u.Reason, u.Samples)
+		return
+	}
+	p.LastAccepted = now
+	p.SamplesAccepted += int64(u.Accepted)
+	uploadSamplesTotal.WithLabelValues(Accepted).Add(float64(u.Accepted))
+	p.drop(Filtered, u.Samples-u.Accepted)
+}
+
+// drop counts the given number of samples as dropped for the given reason.
+func (p *Partition) drop(reason string, samples int) {
+	if samples <= 0 {
+		return
+	}
+	if p.SamplesDropped == nil {
+		p.SamplesDropped = make(map[string]int64)
+	}
+	p.SamplesDropped[reason] += int64(samples)
+	uploadSamplesTotal.WithLabelValues(reason).Add(float64(samples))
+}
+
+// Forget removes the statistics of the given partition.
+func (s *Stats) Forget(partitionKey string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.partitions, partitionKey)
+}
+
+// StartCleaner starts a goroutine, forgetting the partitions that did not
+// upload within the TTL at regular intervals specified by "interval".
+// The goroutine will be stopped when the given context is done.
+func (s *Stats) StartCleaner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s.cleanup(s.nowFn())
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (s *Stats) cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for partitionKey, p := range s.partitions {
+		if now.Sub(p.LastUpload) > s.ttl {
+			delete(s.partitions, partitionKey)
+		}
+	}
+}
+
+// Partitions returns a copy of the statistics of every tracked partition,
+// sorted by key.
+func (s *Stats) Partitions() []Partition {
+	if s == nil {
+		return nil
+	}
+	now := s.nowFn()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	partitions := make([]Partition, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		c := *p
+		c.LastUploadAgeSeconds = now.Sub(p.LastUpload).Seconds()
+		if p.SamplesDropped != nil {
+			c.SamplesDropped = make(map[string]int64, len(p.SamplesDropped))
+			for reason, n := range p.SamplesDropped {
+				c.SamplesDropped[reason] = n
+			}
+		}
+		partitions = append(partitions, c)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].PartitionKey < partitions[j].PartitionKey })
+	return partitions
+}
+
+// Describe implements the prometheus.Collector interface.
+func (s *Stats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastUploadAgeDesc
+}
+
+// Collect implements the prometheus.Collector interface. It exports the
+// distribution of the time since the last upload of the tracked partitions.
+func (s *Stats) Collect(ch chan<- prometheus.Metric) {
+	now := s.nowFn()
+	buckets := make(map[float64]uint64, len(ageBuckets))
+	var count uint64
+	var sum float64
+
+	s.mu.Lock()
+	for _, p := range s.partitions {
+		age := now.Sub(p.LastUpload).Seconds()
+		count++
+		sum += age
+		for _, b := range ageBuckets {
+			if age <= b {
+				buckets[b]++
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	ch <- prometheus.MustNewConstHistogram(lastUploadAgeDesc, count, sum, buckets)
+}
+
+// ServeHTTP lists the statistics of the tracked partitions as JSON. The
+// partition query parameter restricts the list to a single partition.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	partitions := s.Partitions()
+	if partition := req.URL.Query().Get("partition"); len(partition) > 0 {
+		filtered := partitions[:0]
+		for _, p := range partitions {
+			if p.PartitionKey == partition {
+				filtered = append(filtered, p)
+			}
+		}
+		partitions = filtered
+	}
+
+	var logger log.Logger
+	if s != nil {
+		logger = s.logger
+	}
+	logger = logging.FromContext(req.Context(), logger)
+	data, err := json.MarshalIndent(partitions, "", "  ")
+	if err != nil {
+		level.Error(logger).Log("msg", "unable to encode ingestion stats", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		level.Warn(logger).Log("msg", "unable to write ingestion stats", "err", err)
+	}
+}
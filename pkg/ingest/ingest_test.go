@@ -0,0 +1,84 @@
+package ingest
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestRecord(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := New(nil, time.Hour)
+	s.nowFn = func() time.Time { return now }
+
+	s.Record("a", Upload{Bytes: 100, Samples: 10, Accepted: 8})
+	now = now.Add(time.Minute)
+	s.Record("a", Upload{Bytes: 50, Samples: 5, Reason: RateLimited})
+	s.Record("b", Upload{Bytes: 10, Samples: 1, Accepted: 1})
+	now = now.Add(time.Minute)
+
+	want := []Partition{
+		{
+			PartitionKey:         "a",
+			LastUpload:           time.Unix(1060, 0),
+			LastAccepted:         time.Unix(1000, 0),
+			LastUploadAgeSeconds: 60,
+			LastBytes:            50,
+			Uploads:              2,
+			Bytes:                150,
+			SamplesAccepted:      8,
+			SamplesDropped:       map[string]int64{Filtered: 2, RateLimited: 5},
+		},
+		{
+			PartitionKey:         "b",
+			LastUpload:           time.Unix(1060, 0),
+			LastAccepted:         time.Unix(1060, 0),
+			LastUploadAgeSeconds: 60,
+			LastBytes:            10,
+			Uploads:              1,
+			Bytes:                10,
+			SamplesAccepted:      1,
+		},
+	}
+	if got := s.Partitions(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/ingestion?partition=b", nil))
+	var served []Partition
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || served[0].PartitionKey != "b" || served[0].SamplesAccepted != 1 {
+		t.Errorf("expected only partition b to be served, got %s", w.Body)
+	}
+
+	ch := make(chan prometheus.Metric, 1)
+	s.Collect(ch)
+	m := &clientmodel.Metric{}
+	if err := (<-ch).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if h := m.GetHistogram(); h.GetSampleCount() != 2 || h.GetSampleSum() != 120 || h.Bucket[0].GetCumulativeCount() != 2 {
+		t.Errorf("unexpected upload age histogram %v", h)
+	}
+
+	now = now.Add(time.Hour)
+	s.Record("b", Upload{})
+	s.cleanup(now)
+	if got := s.Partitions(); len(got) != 1 || got[0].PartitionKey != "b" {
+		t.Errorf("expected partition a to be forgotten, got %+v", got)
+	}
+
+	var nilStats *Stats
+	nilStats.Record("a", Upload{})
+	if got := nilStats.Partitions(); got != nil {
+		t.Errorf("expected no partitions, got %+v", got)
+	}
+}
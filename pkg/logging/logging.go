@@ -0,0 +1,159 @@
+// Package logging creates the structured, leveled loggers of the server and the
+// client, and carries request IDs in contexts.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// FormatLogfmt writes one logfmt line per entry.
+	FormatLogfmt = "logfmt"
+	// FormatJSON writes one JSON object per entry.
+	FormatJSON = "json"
+)
+
+// New returns a logger writing entries of the given level or above to w in the
+// given format, with a timestamp and the caller. The caller is the first
+// function outside of the go-kit log package and of the loggers wrapping it
+// here, such as NewRateLimited.
+func New(w io.Writer, format, lvl string) (log.Logger, error) {
+	var logger log.Logger
+	switch format {
+	case FormatLogfmt:
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case FormatJSON:
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be one of logfmt or json", format)
+	}
+
+	var option level.Option
+	switch lvl {
+	case "debug":
+		option = level.AllowDebug()
+	case "info":
+		option = level.AllowInfo()
+	case "warn":
+		option = level.AllowWarn()
+	case "error":
+		option = level.AllowError()
+	default:
+		return nil, fmt.Errorf("unknown log level %q, must be one of debug, info, warn or error", lvl)
+	}
+	logger = level.NewFilter(logger, option)
+	return log.With(logger, "ts", log.DefaultTimestampUTC, "caller", caller), nil
+}
+
+// caller is the file and line of the function that wrote an entry.
+var caller log.Valuer = func() interface{} {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !more || !isLoggerFrame(frame.Function) {
+			return frame.File[strings.LastIndex(frame.File, "/")+1:] + ":" + strconv.Itoa(frame.Line)
+		}
+	}
+}
+
+// isLoggerFrame returns true if the given function writes entries on behalf
+// of its caller.
+func isLoggerFrame(function string) bool {
+	return strings.Contains(function, "/go-kit/kit/log.") ||
+		strings.Contains(function, "/pkg/logging.(*rateLimited).")
+}
+
+// OrNop returns logger, or a logger discarding all entries if it is nil.
+func OrNop(logger log.Logger) log.Logger {
+	if logger == nil {
+		return log.NewNopLogger()
+	}
+	return logger
+}
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+// WithRequestID returns a context holding the given request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID held by ctx, if any.
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey).(string)
+	return id, ok
+}
+
+// FromContext returns logger, with the request ID held by ctx if there is one.
+// A nil logger discards all entries.
+func FromContext(ctx context.Context, logger log.Logger) log.Logger {
+	logger = OrNop(logger)
+	if id, ok := RequestID(ctx); ok {
+		return log.With(logger, "request", id)
+	}
+	return logger
+}
+
+// RequestHandler passes every request to next with a context holding the ID of
+// the request. The ID is taken from the X-Request-Id header if present, and
+// generated otherwise.
+func RequestHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-Id")
+		if len(id) == 0 {
+			id = strconv.FormatUint(uint64(rand.Int63()), 36)
+		}
+		next.ServeHTTP(w, req.WithContext(WithRequestID(req.Context(), id)))
+	})
+}
+
+// rateLimited writes at most one entry per interval.
+type rateLimited struct {
+	next     log.Logger
+	interval time.Duration
+	nowFn    func() time.Time
+
+	mu         sync.Mutex // protects fields below
+	last       time.Time
+	suppressed int
+}
+
+// NewRateLimited returns a logger writing at most one entry per interval to
+// next, for hot paths that may fail repeatedly. The number of entries dropped
+// since the last written entry is added to the next written entry.
+func NewRateLimited(next log.Logger, interval time.Duration) log.Logger {
+	return &rateLimited{next: next, interval: interval, nowFn: time.Now}
+}
+
+func (l *rateLimited) Log(keyvals ...interface{}) error {
+	l.mu.Lock()
+	now := l.nowFn()
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		l.suppressed++
+		l.mu.Unlock()
+		return nil
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed = now, 0
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		keyvals = append(keyvals, "suppressed", suppressed)
+	}
+	return l.next.Log(keyvals...)
+}
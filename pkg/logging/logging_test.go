@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestNew(t *testing.T) {
+	for _, tc := range []struct {
+		format, level string
+		want          []string
+		wantErr       bool
+	}{
+		{format: FormatLogfmt, level: "info", want: []string{"caller=logging_test.go", "level=warn"}},
+		{format: FormatJSON, level: "warn", want: []string{`"level":"warn"`}},
+		{format: FormatLogfmt, level: "debug", want: []string{"level=debug", "level=info", "level=warn"}},
+		{format: "xml", level: "info", wantErr: true},
+		{format: FormatLogfmt, level: "trace", wantErr: true},
+	} {
+		buf := &bytes.Buffer{}
+		logger, err := New(buf, tc.format, tc.level)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s/%s: expected error", tc.format, tc.level)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		level.Debug(logger).Log("msg", "debug entry")
+		level.Info(logger).Log("msg", "info entry")
+		level.Warn(logger).Log("msg", "warn entry")
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != len(tc.want) {
+			t.Fatalf("%s/%s: expected %d entries, got %q", tc.format, tc.level, len(tc.want), buf.String())
+		}
+		for i, want := range tc.want {
+			if !strings.Contains(lines[i], want) {
+				t.Errorf("%s/%s: expected entry %q to contain %q", tc.format, tc.level, lines[i], want)
+			}
+		}
+	}
+}
+
+func TestRequestHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.NewLogfmtLogger(buf)
+	h := RequestHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		FromContext(req.Context(), logger).Log("msg", "handled")
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got, want := buf.String(), "request=abc msg=handled\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	buf.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !strings.HasPrefix(buf.String(), "request=") {
+		t.Errorf("expected a generated request ID, got %q", buf.String())
+	}
+
+	if err := FromContext(context.Background(), nil).Log("msg", "discarded"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	buf := &bytes.Buffer{}
+	now := time.Unix(0, 0)
+	l := NewRateLimited(log.NewLogfmtLogger(buf), 10*time.Second).(*rateLimited)
+	l.nowFn = func() time.Time { return now }
+
+	for _, step := range []time.Duration{0, time.Second, time.Second, 10 * time.Second, time.Second} {
+		now = now.Add(step)
+		l.Log("msg", "dropped")
+	}
+	want := "msg=dropped\nmsg=dropped suppressed=2\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	buf.Reset()
+	logger, err := New(buf, FormatLogfmt, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	level.Warn(NewRateLimited(log.With(logger, "component", "test"), time.Second)).Log("msg", "dropped")
+	if got := buf.String(); !strings.Contains(got, "caller=logging_test.go:") {
+		t.Errorf("expected the caller to be the test, got %q", got)
+	}
+}
@@ -0,0 +1,291 @@
+// Package metadata maintains a catalog of the canonical type, help and unit of
+// the metric names accepted by the server.
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/openshift/telemeter/pkg/logging"
+)
+
+var (
+	mismatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_metadata_mismatches_total",
+		Help: "Tracks the number of uploaded families whose type did not match the catalog, by the action taken.",
+	}, []string{"action"})
+)
+
+func init() {
+	prometheus.MustRegister(mismatchesTotal)
+}
+
+// maxMetrics bounds the number of metric names the catalog learns from uploads.
+// Families of other names are passed through unchecked once it is reached.
+const maxMetrics = 10000
+
+// Mode is the action taken on uploaded families whose type does not match the catalog.
+type Mode string
+
+const (
+	// Reject fails the whole upload.
+	Reject Mode = "reject"
+	// Coerce converts the family to the canonical type if possible, and drops it otherwise.
+	Coerce Mode = "coerce"
+	// Drop drops the family.
+	Drop Mode = "drop"
+)
+
+// ParseMode returns the mode with the given name.
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(name); mode {
+	case Reject, Coerce, Drop:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q, must be one of reject, coerce or drop", name)
+	}
+}
+
+// Metadata describes a metric name. The type is empty until it is known.
+type Metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// MismatchError is returned when an uploaded family does not have the canonical type.
+type MismatchError struct {
+	Name     string
+	Type     string
+	Expected string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("metric %s has type %s, but is known to be a %s", e.Name, e.Type, e.Expected)
+}
+
+// Catalog is a Transformer that records the type and help of uploaded families
+// and makes them consistent across uploads. The first type seen for a metric name
+// is canonical, unless it is seeded. Families carry the canonical help afterwards.
+type Catalog struct {
+	logger log.Logger
+	mode   Mode
+
+	mu      sync.RWMutex // protects fields below
+	metrics map[string]Metadata
+}
+
+// New returns an empty catalog, handling mismatching families according to mode.
+func New(logger log.Logger, mode Mode) *Catalog {
+	return &Catalog{
+		logger:  log.With(logging.OrNop(logger), "component", "metadata"),
+		mode:    mode,
+		metrics: make(map[string]Metadata),
+	}
+}
+
+// Seed sets the canonical metadata of the given metric name.
+func (c *Catalog) Seed(name string, md Metadata) error {
+	if len(md.Type) > 0 {
+		if _, ok := clientmodel.MetricType_value[strings.ToUpper(md.Type)]; !ok {
+			return fmt.Errorf("metric %s has unknown type %q", name, md.Type)
+		}
+		md.Type = strings.ToLower(md.Type)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics[name] = md
+	return nil
+}
+
+// SeedFile seeds the catalog from a JSON file mapping metric names to their metadata.
+func (c *Catalog) SeedFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var metrics map[string]Metadata
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return fmt.Errorf("unable to parse metadata: %v", err)
+	}
+	for name, md := range metrics {
+		if err := c.Seed(name, md); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SeedWhitelist adds the metric names selected by equality in the given
+// whitelist rules to the catalog, so that they are listed before any upload.
+func (c *Catalog) SeedWhitelist(rules []string) error {
+	for _, rule := range rules {
+		matchers, err := promql.ParseMetricSelector(rule)
+		if err != nil {
+			return err
+		}
+		for _, m := range matchers {
+			if m.Name != labels.MetricName || m.Type != labels.MatchEqual {
+				continue
+			}
+			c.mu.Lock()
+			if _, ok := c.metrics[m.Value]; !ok {
+				c.metrics[m.Value] = Metadata{}
+			}
+			c.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// Transform implements the Transformer interface.
+func (c *Catalog) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	name := family.GetName()
+	if len(name) == 0 {
+		return true, nil
+	}
+	typ := strings.ToLower(family.GetType().String())
+
+	c.mu.Lock()
+	md, ok := c.metrics[name]
+	if (ok && len(md.Type) == 0) || (!ok && len(c.metrics) < maxMetrics) {
+		md.Type = typ
+		if len(md.Help) == 0 {
+			md.Help = family.GetHelp()
+		}
+		c.metrics[name] = md
+		ok = true
+	}
+	c.mu.Unlock()
+	if !ok {
+		return true, nil
+	}
+
+	if len(md.Help) > 0 && family.GetHelp() != md.Help {
+		help := md.Help
+		family.Help = &help
+	}
+	if typ == md.Type {
+		return true, nil
+	}
+
+	switch c.mode {
+	case Reject:
+		mismatchesTotal.WithLabelValues(string(Reject)).Inc()
+		return false, &MismatchError{Name: name, Type: typ, Expected: md.Type}
+	case Coerce:
+		if coerce(family, clientmodel.MetricType(clientmodel.MetricType_value[strings.ToUpper(md.Type)])) {
+			mismatchesTotal.WithLabelValues(string(Coerce)).Inc()
+			return true, nil
+		}
+	}
+	mismatchesTotal.WithLabelValues(string(Drop)).Inc()
+	return false, nil
+}
+
+// coerce converts the metrics of the given family to the given type. Only
+// counters, gauges and untyped metrics can be converted into each other.
+func coerce(family *clientmodel.MetricFamily, typ clientmodel.MetricType) bool {
+	if !isScalar(family.GetType()) || !isScalar(typ) {
+		return false
+	}
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		var value *float64
+		switch {
+		case m.Counter != nil:
+			value = m.Counter.Value
+		case m.Gauge != nil:
+			value = m.Gauge.Value
+		case m.Untyped != nil:
+			value = m.Untyped.Value
+		}
+		m.Counter, m.Gauge, m.Untyped = nil, nil, nil
+		switch typ {
+		case clientmodel.MetricType_COUNTER:
+			m.Counter = &clientmodel.Counter{Value: value}
+		case clientmodel.MetricType_GAUGE:
+			m.Gauge = &clientmodel.Gauge{Value: value}
+		case clientmodel.MetricType_UNTYPED:
+			m.Untyped = &clientmodel.Untyped{Value: value}
+		}
+	}
+	family.Type = typ.Enum()
+	return true
+}
+
+func isScalar(typ clientmodel.MetricType) bool {
+	switch typ {
+	case clientmodel.MetricType_COUNTER, clientmodel.MetricType_GAUGE, clientmodel.MetricType_UNTYPED:
+		return true
+	default:
+		return false
+	}
+}
+
+// ServeHTTP lists the catalog in the format of the Prometheus metadata API.
+// The metric and limit query parameters restrict the listed metric names.
+func (c *Catalog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	metric := req.URL.Query().Get("metric")
+	limit := -1
+	if s := req.URL.Query().Get("limit"); len(s) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "limit must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.mu.RLock()
+	names := make([]string, 0, len(c.metrics))
+	for name := range c.metrics {
+		if len(metric) == 0 || name == metric {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if limit >= 0 && limit < len(names) {
+		names = names[:limit]
+	}
+	data := make(map[string][]Metadata, len(names))
+	for _, name := range names {
+		md := c.metrics[name]
+		if len(md.Type) == 0 {
+			md.Type = "unknown"
+		}
+		data[name] = []Metadata{md}
+	}
+	c.mu.RUnlock()
+
+	body, err := json.Marshal(struct {
+		Status string                `json:"status"`
+		Data   map[string][]Metadata `json:"data"`
+	}{Status: "success", Data: data})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		level.Error(c.logger).Log("msg", "unable to write metadata", "err", err)
+	}
+}
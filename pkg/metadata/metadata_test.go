@@ -0,0 +1,154 @@
+package metadata
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func family(name string, typ clientmodel.MetricType, help string) *clientmodel.MetricFamily {
+	m := &clientmodel.Metric{}
+	switch typ {
+	case clientmodel.MetricType_COUNTER:
+		m.Counter = &clientmodel.Counter{Value: proto.Float64(1)}
+	case clientmodel.MetricType_GAUGE:
+		m.Gauge = &clientmodel.Gauge{Value: proto.Float64(1)}
+	case clientmodel.MetricType_HISTOGRAM:
+		m.Histogram = &clientmodel.Histogram{SampleCount: proto.Uint64(1)}
+	}
+	return &clientmodel.MetricFamily{Name: proto.String(name), Type: typ.Enum(), Help: proto.String(help), Metric: []*clientmodel.Metric{m}}
+}
+
+func TestTransform(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		mode     Mode
+		families []*clientmodel.MetricFamily
+		wantOK   []bool
+		wantErr  bool
+		wantType clientmodel.MetricType
+		wantHelp string
+	}{
+		{
+			name: "first type and help are canonical",
+			mode: Reject,
+			families: []*clientmodel.MetricFamily{
+				family("requests", clientmodel.MetricType_COUNTER, "first"),
+				family("requests", clientmodel.MetricType_COUNTER, "second"),
+			},
+			wantOK:   []bool{true, true},
+			wantType: clientmodel.MetricType_COUNTER,
+			wantHelp: "first",
+		},
+		{
+			name: "mismatching type is rejected",
+			mode: Reject,
+			families: []*clientmodel.MetricFamily{
+				family("requests", clientmodel.MetricType_COUNTER, ""),
+				family("requests", clientmodel.MetricType_GAUGE, ""),
+			},
+			wantOK:  []bool{true, false},
+			wantErr: true,
+		},
+		{
+			name: "mismatching type is coerced",
+			mode: Coerce,
+			families: []*clientmodel.MetricFamily{
+				family("requests", clientmodel.MetricType_COUNTER, ""),
+				family("requests", clientmodel.MetricType_GAUGE, "help"),
+			},
+			wantOK:   []bool{true, true},
+			wantType: clientmodel.MetricType_COUNTER,
+			wantHelp: "help",
+		},
+		{
+			name: "histogram cannot be coerced",
+			mode: Coerce,
+			families: []*clientmodel.MetricFamily{
+				family("requests", clientmodel.MetricType_COUNTER, ""),
+				family("requests", clientmodel.MetricType_HISTOGRAM, ""),
+			},
+			wantOK: []bool{true, false},
+		},
+		{
+			name: "mismatching type is dropped",
+			mode: Drop,
+			families: []*clientmodel.MetricFamily{
+				family("requests", clientmodel.MetricType_GAUGE, ""),
+				family("requests", clientmodel.MetricType_COUNTER, ""),
+			},
+			wantOK: []bool{true, false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(nil, tc.mode)
+			var last *clientmodel.MetricFamily
+			for i, f := range tc.families {
+				ok, err := c.Transform(f)
+				if ok != tc.wantOK[i] {
+					t.Errorf("family %d: expected ok %t, got %t", i, tc.wantOK[i], ok)
+				}
+				if _, isMismatch := err.(*MismatchError); isMismatch != (tc.wantErr && i == len(tc.families)-1) {
+					t.Errorf("family %d: unexpected error %v", i, err)
+				}
+				last = f
+			}
+			if !tc.wantOK[len(tc.wantOK)-1] {
+				return
+			}
+			if last.GetType() != tc.wantType {
+				t.Errorf("expected type %s, got %s", tc.wantType, last.GetType())
+			}
+			if last.GetHelp() != tc.wantHelp {
+				t.Errorf("expected help %q, got %q", tc.wantHelp, last.GetHelp())
+			}
+			if tc.wantType == clientmodel.MetricType_COUNTER && last.Metric[0].Counter.GetValue() != 1 {
+				t.Errorf("expected value to be kept, got %v", last.Metric[0])
+			}
+		})
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	c := New(nil, Coerce)
+	if err := c.SeedWhitelist([]string{`{__name__="up"}`, `{__name__=~"cluster_.*"}`, `{__name__="requests",job="a"}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Seed("requests", Metadata{Type: "Counter", Help: "Requests.", Unit: "requests"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Transform(family("up", clientmodel.MetricType_GAUGE, "Up.")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/metadata", nil))
+	var got struct {
+		Status string
+		Data   map[string][]Metadata
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unable to parse %q: %v", rec.Body.String(), err)
+	}
+	want := map[string][]Metadata{
+		"requests": {{Type: "counter", Help: "Requests.", Unit: "requests"}},
+		"up":       {{Type: "gauge", Help: "Up."}},
+	}
+	if got.Status != "success" || !reflect.DeepEqual(got.Data, want) {
+		t.Errorf("unexpected metadata %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/metadata?metric=up&limit=1", nil))
+	got.Data = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Data) != 1 || len(got.Data["up"]) != 1 {
+		t.Errorf("expected only the metadata of up, got %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,273 @@
+package metricfamily
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/logging"
+)
+
+// The operations an Aggregation can apply.
+const (
+	AggregateSum   = "sum"
+	AggregateCount = "count"
+	AggregateMax   = "max"
+	AggregateMin   = "min"
+)
+
+var aggregationRe = regexp.MustCompile(`^\s*(sum|count|max|min)\s*(?:(by|without)\s*\(([^)]*)\))?\s*$`)
+
+// Aggregation describes how the series of a family are aggregated into fewer
+// series, like the PromQL aggregation operators.
+type Aggregation struct {
+	// Op is one of AggregateSum, AggregateCount, AggregateMax or AggregateMin.
+	Op string
+	// Without aggregates over Labels, so that all other labels are kept.
+	// Otherwise only Labels are kept.
+	Without bool
+	Labels  []string
+}
+
+// ParseAggregation parses an aggregation in the syntax of the PromQL
+// aggregation operators, such as "sum without (pod)" or "count by (namespace)".
+func ParseAggregation(s string) (Aggregation, error) {
+	m := aggregationRe.FindStringSubmatch(s)
+	if m == nil {
+		return Aggregation{}, fmt.Errorf("invalid aggregation %q, must be of the form 'sum|count|max|min [by|without (label, ...)]'", s)
+	}
+	a := Aggregation{Op: m[1], Without: m[2] == "without"}
+	for _, label := range strings.Split(m[3], ",") {
+		if label = strings.TrimSpace(label); len(label) > 0 {
+			a.Labels = append(a.Labels, label)
+		}
+	}
+	return a, nil
+}
+
+func (a Aggregation) String() string {
+	clause := "by"
+	if a.Without {
+		clause = "without"
+	}
+	return fmt.Sprintf("%s %s (%s)", a.Op, clause, strings.Join(a.Labels, ", "))
+}
+
+// keeps returns true if the given label is kept by the aggregation.
+func (a Aggregation) keeps(name string) bool {
+	for _, label := range a.Labels {
+		if label == name {
+			return !a.Without
+		}
+	}
+	return a.Without
+}
+
+type aggregate struct {
+	logger log.Logger
+	rules  map[string]Aggregation
+
+	mu sync.Mutex // protects fields below
+	// unsupported holds the families whose rule is not supported for their
+	// type, so that this is only reported once per family.
+	unsupported map[string]struct{}
+}
+
+// NewAggregate returns a transformer aggregating the series of the families
+// with the given names according to their aggregation, to reduce the number of
+// uploaded series of metrics that are only used in aggregate.
+//
+// Counters, gauges and untyped series are summed, counted, or their maximum or
+// minimum kept. Counting series results in a gauge. Histograms can only be
+// summed, which merges their buckets, so histograms with different buckets are
+// left unchanged, as are summaries. A warning is logged the first time a rule
+// is not supported for the type of its family. The timestamp of an aggregated
+// series is the latest timestamp of its series.
+func NewAggregate(logger log.Logger, rules map[string]Aggregation) (*aggregate, error) {
+	for name, rule := range rules {
+		switch rule.Op {
+		case AggregateSum, AggregateCount, AggregateMax, AggregateMin:
+		default:
+			return nil, fmt.Errorf("unknown aggregation %q for metric %s", rule.Op, name)
+		}
+	}
+	return &aggregate{
+		logger:      log.With(logging.OrNop(logger), "component", "aggregate"),
+		rules:       rules,
+		unsupported: make(map[string]struct{}),
+	}, nil
+}
+
+// warnUnsupported logs that the rule of the given family is not supported for
+// its type, once per family.
+func (t *aggregate) warnUnsupported(family *clientmodel.MetricFamily, rule Aggregation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.unsupported[family.GetName()]; ok {
+		return
+	}
+	t.unsupported[family.GetName()] = struct{}{}
+	level.Warn(t.logger).Log("msg", "aggregation is not supported for the type of the metric, leaving it unchanged", "metric", family.GetName(), "type", strings.ToLower(family.GetType().String()), "aggregation", rule)
+}
+
+// group holds the series aggregated into a single series.
+type group struct {
+	labels      []*clientmodel.LabelPair
+	value       float64
+	count       uint64
+	timestampMs *int64
+	histogram   *clientmodel.Histogram
+}
+
+func (t *aggregate) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family == nil {
+		return true, nil
+	}
+	rule, ok := t.rules[family.GetName()]
+	if !ok {
+		return true, nil
+	}
+	histogram := family.GetType() == clientmodel.MetricType_HISTOGRAM
+	if histogram && rule.Op != AggregateSum || family.GetType() == clientmodel.MetricType_SUMMARY {
+		t.warnUnsupported(family, rule)
+		return true, nil
+	}
+
+	var groups []*group
+	byKey := make(map[string]*group)
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		var labels []*clientmodel.LabelPair
+		for _, pair := range m.Label {
+			if rule.keeps(pair.GetName()) {
+				labels = append(labels, &clientmodel.LabelPair{Name: proto.String(pair.GetName()), Value: proto.String(pair.GetValue())})
+			}
+		}
+		// The same series may list its labels in a different order.
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+		var key strings.Builder
+		for _, pair := range labels {
+			key.WriteString(pair.GetName())
+			key.WriteByte(0xff)
+			key.WriteString(pair.GetValue())
+			key.WriteByte(0xff)
+		}
+		g, ok := byKey[key.String()]
+		if !ok {
+			g = &group{labels: labels}
+			byKey[key.String()] = g
+			groups = append(groups, g)
+		}
+		if m.TimestampMs != nil && (g.timestampMs == nil || *m.TimestampMs > *g.timestampMs) {
+			g.timestampMs = proto.Int64(*m.TimestampMs)
+		}
+
+		if histogram {
+			if !mergeHistogram(g, m.Histogram) {
+				return true, nil
+			}
+			continue
+		}
+		v := scalarValue(m)
+		switch {
+		case g.count == 0:
+			g.value = v
+		case rule.Op == AggregateSum:
+			g.value += v
+		case rule.Op == AggregateMax:
+			g.value = math.Max(g.value, v)
+		case rule.Op == AggregateMin:
+			g.value = math.Min(g.value, v)
+		}
+		g.count++
+	}
+
+	metrics := make([]*clientmodel.Metric, 0, len(groups))
+	for _, g := range groups {
+		m := &clientmodel.Metric{Label: g.labels, TimestampMs: g.timestampMs}
+		switch {
+		case histogram:
+			m.Histogram = g.histogram
+		case rule.Op == AggregateCount:
+			m.Gauge = &clientmodel.Gauge{Value: proto.Float64(float64(g.count))}
+		default:
+			setScalarValue(m, family.GetType(), g.value)
+		}
+		metrics = append(metrics, m)
+	}
+	if rule.Op == AggregateCount {
+		family.Type = clientmodel.MetricType_GAUGE.Enum()
+	}
+	family.Metric = metrics
+	return len(metrics) > 0, nil
+}
+
+// mergeHistogram adds the given histogram to the histogram of the group, and
+// returns false if their buckets differ.
+func mergeHistogram(g *group, h *clientmodel.Histogram) bool {
+	if h == nil {
+		return true
+	}
+	if g.histogram == nil {
+		g.histogram = &clientmodel.Histogram{
+			SampleCount: proto.Uint64(h.GetSampleCount()),
+			SampleSum:   proto.Float64(h.GetSampleSum()),
+		}
+		for _, b := range h.Bucket {
+			g.histogram.Bucket = append(g.histogram.Bucket, &clientmodel.Bucket{
+				UpperBound:      proto.Float64(b.GetUpperBound()),
+				CumulativeCount: proto.Uint64(b.GetCumulativeCount()),
+			})
+		}
+		return true
+	}
+	if len(g.histogram.Bucket) != len(h.Bucket) {
+		return false
+	}
+	for i, b := range h.Bucket {
+		if g.histogram.Bucket[i].GetUpperBound() != b.GetUpperBound() {
+			return false
+		}
+	}
+	for i, b := range h.Bucket {
+		*g.histogram.Bucket[i].CumulativeCount += b.GetCumulativeCount()
+	}
+	*g.histogram.SampleCount += h.GetSampleCount()
+	*g.histogram.SampleSum += h.GetSampleSum()
+	return true
+}
+
+func scalarValue(m *clientmodel.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	default:
+		return 0
+	}
+}
+
+func setScalarValue(m *clientmodel.Metric, typ clientmodel.MetricType, value float64) {
+	switch typ {
+	case clientmodel.MetricType_COUNTER:
+		m.Counter = &clientmodel.Counter{Value: proto.Float64(value)}
+	case clientmodel.MetricType_GAUGE:
+		m.Gauge = &clientmodel.Gauge{Value: proto.Float64(value)}
+	default:
+		m.Untyped = &clientmodel.Untyped{Value: proto.Float64(value)}
+	}
+}
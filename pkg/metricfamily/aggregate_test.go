@@ -0,0 +1,195 @@
+package metricfamily
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestParseAggregation(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    Aggregation
+		wantErr bool
+	}{
+		{in: "sum without (pod)", want: Aggregation{Op: AggregateSum, Without: true, Labels: []string{"pod"}}},
+		{in: " count by(namespace, node) ", want: Aggregation{Op: AggregateCount, Labels: []string{"namespace", "node"}}},
+		{in: "max", want: Aggregation{Op: AggregateMax}},
+		{in: "min by ()", want: Aggregation{Op: AggregateMin}},
+		{in: "avg by (namespace)", wantErr: true},
+		{in: "sum without pod", wantErr: true},
+	} {
+		got, err := ParseAggregation(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: unexpected error %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: expected %#v, got %#v", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	labels := func(pairs ...string) []*clientmodel.LabelPair {
+		var l []*clientmodel.LabelPair
+		for i := 0; i < len(pairs); i += 2 {
+			l = append(l, &clientmodel.LabelPair{Name: proto.String(pairs[i]), Value: proto.String(pairs[i+1])})
+		}
+		return l
+	}
+	counter := func(v float64, ts int64, pairs ...string) *clientmodel.Metric {
+		return &clientmodel.Metric{Label: labels(pairs...), Counter: &clientmodel.Counter{Value: proto.Float64(v)}, TimestampMs: proto.Int64(ts)}
+	}
+	gauge := func(v float64, ts int64, pairs ...string) *clientmodel.Metric {
+		return &clientmodel.Metric{Label: labels(pairs...), Gauge: &clientmodel.Gauge{Value: proto.Float64(v)}, TimestampMs: proto.Int64(ts)}
+	}
+	histogram := func(count uint64, sum float64, bounds []float64, counts []uint64, pairs ...string) *clientmodel.Metric {
+		h := &clientmodel.Histogram{SampleCount: proto.Uint64(count), SampleSum: proto.Float64(sum)}
+		for i := range bounds {
+			h.Bucket = append(h.Bucket, &clientmodel.Bucket{UpperBound: proto.Float64(bounds[i]), CumulativeCount: proto.Uint64(counts[i])})
+		}
+		return &clientmodel.Metric{Label: labels(pairs...), Histogram: h, TimestampMs: proto.Int64(1)}
+	}
+	family := func(name string, typ clientmodel.MetricType, metrics ...*clientmodel.Metric) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{Name: proto.String(name), Type: typ.Enum(), Metric: metrics}
+	}
+
+	restarts := func() *clientmodel.MetricFamily {
+		return family("restarts", clientmodel.MetricType_COUNTER,
+			counter(1, 1, "namespace", "a", "pod", "1"),
+			counter(2, 3, "namespace", "a", "pod", "2"),
+			counter(4, 2, "namespace", "b", "pod", "3"),
+		)
+	}
+	memory := func() *clientmodel.MetricFamily {
+		return family("memory", clientmodel.MetricType_GAUGE,
+			gauge(5, 1, "namespace", "a", "pod", "1"),
+			gauge(7, 1, "namespace", "a", "pod", "2"),
+		)
+	}
+	latency := func(bounds ...float64) *clientmodel.MetricFamily {
+		return family("latency", clientmodel.MetricType_HISTOGRAM,
+			histogram(3, 1.5, []float64{0.1, 1}, []uint64{1, 3}, "handler", "a", "pod", "1"),
+			histogram(2, 0.5, bounds, []uint64{2, 2}, "handler", "a", "pod", "2"),
+		)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		rule   Aggregation
+		family *clientmodel.MetricFamily
+		want   *clientmodel.MetricFamily
+	}{
+		{
+			name:   "sum without",
+			rule:   Aggregation{Op: AggregateSum, Without: true, Labels: []string{"pod"}},
+			family: restarts(),
+			want: family("restarts", clientmodel.MetricType_COUNTER,
+				counter(3, 3, "namespace", "a"),
+				counter(4, 2, "namespace", "b"),
+			),
+		},
+		{
+			name:   "sum by nothing",
+			rule:   Aggregation{Op: AggregateSum},
+			family: restarts(),
+			want:   family("restarts", clientmodel.MetricType_COUNTER, counter(7, 3)),
+		},
+		{
+			name:   "count by",
+			rule:   Aggregation{Op: AggregateCount, Labels: []string{"namespace"}},
+			family: restarts(),
+			want: family("restarts", clientmodel.MetricType_GAUGE,
+				gauge(2, 3, "namespace", "a"),
+				gauge(1, 2, "namespace", "b"),
+			),
+		},
+		{
+			name:   "max",
+			rule:   Aggregation{Op: AggregateMax, Labels: []string{"namespace"}},
+			family: memory(),
+			want:   family("memory", clientmodel.MetricType_GAUGE, gauge(7, 1, "namespace", "a")),
+		},
+		{
+			name:   "min",
+			rule:   Aggregation{Op: AggregateMin, Labels: []string{"namespace"}},
+			family: memory(),
+			want:   family("memory", clientmodel.MetricType_GAUGE, gauge(5, 1, "namespace", "a")),
+		},
+		{
+			name:   "histogram buckets are merged",
+			rule:   Aggregation{Op: AggregateSum, Without: true, Labels: []string{"pod"}},
+			family: latency(0.1, 1),
+			want: family("latency", clientmodel.MetricType_HISTOGRAM,
+				histogram(5, 2, []float64{0.1, 1}, []uint64{3, 5}, "handler", "a"),
+			),
+		},
+		{
+			name:   "histograms with different buckets are kept",
+			rule:   Aggregation{Op: AggregateSum, Without: true, Labels: []string{"pod"}},
+			family: latency(0.5, 1),
+			want:   latency(0.5, 1),
+		},
+		{
+			name: "labels are grouped regardless of their order",
+			rule: Aggregation{Op: AggregateSum, Without: true, Labels: []string{"pod"}},
+			family: family("restarts", clientmodel.MetricType_COUNTER,
+				counter(1, 1, "namespace", "a", "node", "x", "pod", "1"),
+				counter(2, 1, "pod", "2", "node", "x", "namespace", "a"),
+			),
+			want: family("restarts", clientmodel.MetricType_COUNTER, counter(3, 1, "namespace", "a", "node", "x")),
+		},
+		{
+			name:   "histograms are only summed",
+			rule:   Aggregation{Op: AggregateMax, Without: true, Labels: []string{"pod"}},
+			family: latency(0.1, 1),
+			want:   latency(0.1, 1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := NewAggregate(nil, map[string]Aggregation{tc.family.GetName(): tc.rule, "other": {Op: AggregateSum}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := a.Transform(tc.family); !ok || err != nil {
+				t.Fatalf("unexpected result %t, %v", ok, err)
+			}
+			if !proto.Equal(tc.family, tc.want) {
+				t.Errorf("expected\n%v\ngot\n%v", proto.MarshalTextString(tc.want), proto.MarshalTextString(tc.family))
+			}
+		})
+	}
+
+	a, err := NewAggregate(nil, map[string]Aggregation{"other": {Op: AggregateSum}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := restarts()
+	if ok, err := a.Transform(f); !ok || err != nil || !proto.Equal(f, restarts()) {
+		t.Errorf("expected families without a rule to be unchanged, got %v", f)
+	}
+
+	if _, err := NewAggregate(nil, map[string]Aggregation{"restarts": {Op: "avg"}}); err == nil {
+		t.Errorf("expected error for unknown aggregation")
+	}
+
+	var buf bytes.Buffer
+	a, err = NewAggregate(log.NewLogfmtLogger(&buf), map[string]Aggregation{"latency": {Op: AggregateMax}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if ok, err := a.Transform(latency(0.1, 1)); !ok || err != nil {
+			t.Fatalf("unexpected result %t, %v", ok, err)
+		}
+	}
+	if n := strings.Count(buf.String(), "level=warn"); n != 1 {
+		t.Errorf("expected an unsupported aggregation to be reported once, got %d warnings: %s", n, buf.String())
+	}
+}
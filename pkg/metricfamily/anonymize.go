@@ -1,14 +1,45 @@
 package metricfamily
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
 
+	"github.com/golang/protobuf/proto"
 	clientmodel "github.com/prometheus/client_model/go"
 )
 
+const (
+	// DefaultHashLength is the number of bytes of the hash kept in anonymized values.
+	DefaultHashLength = 9
+	// minHashLength and maxHashLength bound the configurable number of bytes of
+	// the hash kept in anonymized values.
+	minHashLength = 6
+	maxHashLength = sha256.Size
+)
+
+var saltVersionRe = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Salt is a previous secret used to anonymize label values. Previous salts are
+// versioned, so that their hashes can be told apart from the current ones.
+type Salt struct {
+	Version string
+	Secret  string
+}
+
+// labelHash hashes the values of anonymized labels. The hash is written to the
+// label itself if suffix is empty, and to the label named after the anonymized
+// label and suffix otherwise.
+type labelHash struct {
+	suffix string
+	hash   func(value string) string
+}
+
 type AnonymizeMetrics struct {
-	salt     string
+	hashes   []labelHash
 	global   map[string]struct{}
 	byMetric map[string]map[string]struct{}
 }
@@ -20,6 +51,73 @@ type AnonymizeMetrics struct {
 // must also be stable over the same time period. The salt should not be shared with the remote
 // agent. This type is not thread-safe.
 func NewMetricsAnonymizer(salt string, labels []string, metricsLabels map[string][]string) *AnonymizeMetrics {
+	hash := func(value string) string { return secureValueHash(salt, value) }
+	return newAnonymizer([]labelHash{{hash: hash}}, labels, metricsLabels)
+}
+
+// NewHMACAnonymizer hashes label values like NewMetricsAnonymizer, but with an
+// HMAC-SHA256 keyed by the given salt, keeping the given number of bytes of
+// the hash. To rotate the salt without breaking the continuity of anonymized
+// labels, the previous salts can be kept for a while: the values hashed with a
+// previous salt are added as labels named after the anonymized label and the
+// version of the salt, so that the old and new hashes can be correlated. These
+// labels replace the labels of the same name of the metrics, and must not be
+// anonymized labels themselves.
+func NewHMACAnonymizer(salt string, previous []Salt, length int, labels []string, metricsLabels map[string][]string) (*AnonymizeMetrics, error) {
+	if length < minHashLength || length > maxHashLength {
+		return nil, fmt.Errorf("hash length must be between %d and %d bytes", minHashLength, maxHashLength)
+	}
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("salt must not be empty")
+	}
+	hashes := []labelHash{{hash: hmacValueHash(salt, length)}}
+	versions := make(map[string]struct{}, len(previous))
+	for _, prev := range previous {
+		if !saltVersionRe.MatchString(prev.Version) {
+			return nil, fmt.Errorf("version %q of previous salt must consist of letters, digits and underscores", prev.Version)
+		}
+		if _, ok := versions[prev.Version]; ok {
+			return nil, fmt.Errorf("salt version %q is used more than once", prev.Version)
+		}
+		if len(prev.Secret) == 0 {
+			return nil, fmt.Errorf("salt of version %q must not be empty", prev.Version)
+		}
+		versions[prev.Version] = struct{}{}
+		hashes = append(hashes, labelHash{suffix: "_" + prev.Version, hash: hmacValueHash(prev.Secret, length)})
+	}
+	a := newAnonymizer(hashes, labels, metricsLabels)
+	if err := a.checkSuffixes(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// checkSuffixes returns an error if a label added for a previous salt would
+// be named like an anonymized label.
+func (a *AnonymizeMetrics) checkSuffixes() error {
+	anonymized := make(map[string]struct{}, len(a.global))
+	for label := range a.global {
+		anonymized[label] = struct{}{}
+	}
+	for _, set := range a.byMetric {
+		for label := range set {
+			anonymized[label] = struct{}{}
+		}
+	}
+	for label := range anonymized {
+		for _, h := range a.hashes {
+			if len(h.suffix) == 0 {
+				continue
+			}
+			if _, ok := anonymized[label+h.suffix]; ok {
+				return fmt.Errorf("label %q added for the previous salt of label %q is also anonymized", label+h.suffix, label)
+			}
+		}
+	}
+	return nil
+}
+
+func newAnonymizer(hashes []labelHash, labels []string, metricsLabels map[string][]string) *AnonymizeMetrics {
 	global := make(map[string]struct{})
 	for _, label := range labels {
 		global[label] = struct{}{}
@@ -33,7 +131,7 @@ func NewMetricsAnonymizer(salt string, labels []string, metricsLabels map[string
 		byMetric[name] = l
 	}
 	return &AnonymizeMetrics{
-		salt:     salt,
+		hashes:   hashes,
 		global:   global,
 		byMetric: byMetric,
 	}
@@ -44,18 +142,19 @@ func (a *AnonymizeMetrics) Transform(family *clientmodel.MetricFamily) (bool, er
 		return false, nil
 	}
 	if set, ok := a.byMetric[family.GetName()]; ok {
-		transformMetricLabelValues(a.salt, family.Metric, a.global, set)
+		transformMetricLabelValues(a.hashes, family.Metric, a.global, set)
 	} else {
-		transformMetricLabelValues(a.salt, family.Metric, a.global)
+		transformMetricLabelValues(a.hashes, family.Metric, a.global)
 	}
 	return true, nil
 }
 
-func transformMetricLabelValues(salt string, metrics []*clientmodel.Metric, sets ...map[string]struct{}) {
+func transformMetricLabelValues(hashes []labelHash, metrics []*clientmodel.Metric, sets ...map[string]struct{}) {
 	for _, m := range metrics {
 		if m == nil {
 			continue
 		}
+		added := make(map[string]*clientmodel.LabelPair)
 		for _, pair := range m.Label {
 			if pair.Value == nil || *pair.Value == "" {
 				continue
@@ -66,11 +165,22 @@ func transformMetricLabelValues(salt string, metrics []*clientmodel.Metric, sets
 				if !ok {
 					continue
 				}
-				v := secureValueHash(salt, pair.GetValue())
-				pair.Value = &v
+				value := pair.GetValue()
+				for _, h := range hashes {
+					v := h.hash(value)
+					if len(h.suffix) == 0 {
+						pair.Value = &v
+						continue
+					}
+					added[name+h.suffix] = &clientmodel.LabelPair{Name: proto.String(name + h.suffix), Value: &v}
+				}
 				break
 			}
 		}
+		if len(added) > 0 {
+			m.Label = appendLabels(m.Label, added)
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		}
 	}
 }
 
@@ -80,3 +190,14 @@ func secureValueHash(salt, value string) string {
 	hash := sha256.Sum256([]byte(salt + value))
 	return base64.RawURLEncoding.EncodeToString(hash[:9])
 }
+
+// hmacValueHash returns a function hashing values with an HMAC-SHA256 keyed by
+// the given secret, converting the first length bytes of the hash to a base64 string.
+func hmacValueHash(secret string, length int) func(string) string {
+	key := []byte(secret)
+	return func(value string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(value))
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:length])
+	}
+}
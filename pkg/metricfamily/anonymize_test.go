@@ -0,0 +1,122 @@
+package metricfamily
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func hmacOf(secret, value string, length int) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:length])
+}
+
+func TestAnonymizeMetrics(t *testing.T) {
+	family := func(name string) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name: proto.String(name),
+			Metric: []*clientmodel.Metric{{
+				Label: []*clientmodel.LabelPair{
+					{Name: proto.String("host"), Value: proto.String("a")},
+					{Name: proto.String("host_v1"), Value: proto.String("c")},
+					{Name: proto.String("ip"), Value: proto.String("b")},
+				},
+			}},
+		}
+	}
+	labels := func(family *clientmodel.MetricFamily) map[string]string {
+		l := make(map[string]string)
+		for _, pair := range family.Metric[0].Label {
+			l[pair.GetName()] = pair.GetValue()
+		}
+		return l
+	}
+
+	hmacAnonymizer := func(previous []Salt, length int) *AnonymizeMetrics {
+		a, err := NewHMACAnonymizer("new", previous, length, []string{"host"}, map[string][]string{"node": {"ip"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	for _, tc := range []struct {
+		name       string
+		anonymizer *AnonymizeMetrics
+		family     string
+		want       map[string]string
+	}{
+		{
+			name:       "salted sha256",
+			anonymizer: NewMetricsAnonymizer("salt", []string{"host"}, nil),
+			family:     "up",
+			want:       map[string]string{"host": secureValueHash("salt", "a"), "ip": "b", "host_v1": "c"},
+		},
+		{
+			name:       "salted sha256 per metric",
+			anonymizer: NewMetricsAnonymizer("salt", nil, map[string][]string{"node": {"ip"}}),
+			family:     "node",
+			want:       map[string]string{"host": "a", "ip": secureValueHash("salt", "b"), "host_v1": "c"},
+		},
+		{
+			name:       "hmac",
+			anonymizer: hmacAnonymizer(nil, 16),
+			family:     "up",
+			want:       map[string]string{"host": hmacOf("new", "a", 16), "ip": "b", "host_v1": "c"},
+		},
+		{
+			name:       "hmac with previous salts",
+			anonymizer: hmacAnonymizer([]Salt{{Version: "v1", Secret: "old"}}, DefaultHashLength),
+			family:     "node",
+			want: map[string]string{
+				"host":    hmacOf("new", "a", DefaultHashLength),
+				"host_v1": hmacOf("old", "a", DefaultHashLength),
+				"ip":      hmacOf("new", "b", DefaultHashLength),
+				"ip_v1":   hmacOf("old", "b", DefaultHashLength),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := family(tc.family)
+			if ok, err := tc.anonymizer.Transform(f); !ok || err != nil {
+				t.Fatalf("unexpected result %t, %v", ok, err)
+			}
+			if len(f.Metric[0].Label) != len(tc.want) {
+				t.Errorf("expected %d labels, got %v", len(tc.want), f.Metric[0].Label)
+			}
+			if got := labels(f); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected labels %v, got %v", tc.want, got)
+			}
+			for i := 1; i < len(f.Metric[0].Label); i++ {
+				if f.Metric[0].Label[i-1].GetName() > f.Metric[0].Label[i].GetName() {
+					t.Errorf("expected labels to be sorted, got %v", f.Metric[0].Label)
+				}
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name          string
+		salt          string
+		previous      []Salt
+		length        int
+		metricsLabels map[string][]string
+	}{
+		{name: "too short", salt: "s", length: 4},
+		{name: "too long", salt: "s", length: 33},
+		{name: "empty salt", length: 9},
+		{name: "invalid version", salt: "s", previous: []Salt{{Version: "v-1", Secret: "o"}}, length: 9},
+		{name: "duplicate version", salt: "s", previous: []Salt{{Version: "v1", Secret: "o"}, {Version: "v1", Secret: "p"}}, length: 9},
+		{name: "suffixed label is anonymized", salt: "s", previous: []Salt{{Version: "v1", Secret: "o"}}, length: 9, metricsLabels: map[string][]string{"node": {"host_v1"}}},
+	} {
+		if _, err := NewHMACAnonymizer(tc.salt, tc.previous, tc.length, []string{"host"}, tc.metricsLabels); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
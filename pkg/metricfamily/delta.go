@@ -0,0 +1,221 @@
+package metricfamily
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+// series is a metric along with the family it belongs to.
+type series struct {
+	family *clientmodel.MetricFamily
+	metric *clientmodel.Metric
+}
+
+// Diff returns the series of current that are not in previous or whose value
+// changed, along with a stale marker timestamped at removedMs for every series
+// of previous that is not in current, so that ApplyDelta(previous, diff) has
+// the same series as current. Series are identified by their family name and
+// labels, and their timestamps are not compared. Neither previous nor current
+// are modified, but the returned families share their metrics.
+func Diff(previous, current []*clientmodel.MetricFamily, removedMs int64) []*clientmodel.MetricFamily {
+	old := indexSeries(previous)
+
+	var diff []*clientmodel.MetricFamily
+	byName := make(map[string]*clientmodel.MetricFamily)
+	for _, family := range current {
+		if family == nil {
+			continue
+		}
+		var changed []*clientmodel.Metric
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			key := seriesKey(family.GetName(), m)
+			s, ok := old[key]
+			delete(old, key)
+			if ok && s.family.GetType() == family.GetType() && equalValues(s.metric, m) {
+				continue
+			}
+			changed = append(changed, m)
+		}
+		f := &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type, Metric: changed}
+		byName[family.GetName()] = f
+		diff = append(diff, f)
+	}
+
+	// Only the series that were not seen in current remain.
+	var keys []string
+	for key := range old {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := old[key]
+		f, ok := byName[s.family.GetName()]
+		if !ok {
+			f = &clientmodel.MetricFamily{Name: s.family.Name, Help: s.family.Help, Type: s.family.Type}
+			byName[s.family.GetName()] = f
+			diff = append(diff, f)
+		}
+		f.Metric = append(f.Metric, staleMarker(f.GetType(), s.metric.Label, removedMs))
+	}
+
+	for _, f := range diff {
+		SortMetrics(f)
+	}
+	return Pack(diff)
+}
+
+// ApplyDelta returns the series of base updated with the series of delta, as
+// returned by Diff. Series of delta replace the series of base with the same
+// family name and labels, and series with a stale marker are removed. The
+// timestamps of the series of base that are not in delta are moved forward to
+// timestampMs, since they were still current when delta was computed. Neither
+// base nor delta are modified.
+func ApplyDelta(base, delta []*clientmodel.MetricFamily, timestampMs int64) []*clientmodel.MetricFamily {
+	updates := indexSeries(delta)
+	deltaFamilies := make(map[string]*clientmodel.MetricFamily)
+	for _, family := range delta {
+		if family != nil {
+			deltaFamilies[family.GetName()] = family
+		}
+	}
+
+	var result []*clientmodel.MetricFamily
+	byName := make(map[string]*clientmodel.MetricFamily)
+	for _, family := range base {
+		if family == nil {
+			continue
+		}
+		f := &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+		if d, ok := deltaFamilies[family.GetName()]; ok {
+			f.Help, f.Type = d.Help, d.Type
+		}
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			key := seriesKey(family.GetName(), m)
+			if s, ok := updates[key]; ok {
+				delete(updates, key)
+				if !isStale(s.metric) {
+					f.Metric = append(f.Metric, s.metric)
+				}
+				continue
+			}
+			if m.GetTimestampMs() < timestampMs {
+				refreshed := *m
+				refreshed.TimestampMs = proto.Int64(timestampMs)
+				m = &refreshed
+			}
+			f.Metric = append(f.Metric, m)
+		}
+		byName[family.GetName()] = f
+		result = append(result, f)
+	}
+
+	// Add the series that are not in base, in the order of delta.
+	for _, family := range delta {
+		if family == nil {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m == nil || isStale(m) {
+				continue
+			}
+			if _, ok := updates[seriesKey(family.GetName(), m)]; !ok {
+				continue
+			}
+			f, ok := byName[family.GetName()]
+			if !ok {
+				f = &clientmodel.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				byName[family.GetName()] = f
+				result = append(result, f)
+			}
+			f.Metric = append(f.Metric, m)
+		}
+	}
+	return Pack(result)
+}
+
+// indexSeries returns the series of the given families by key.
+func indexSeries(families []*clientmodel.MetricFamily) map[string]series {
+	index := make(map[string]series)
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		for _, m := range family.Metric {
+			if m != nil {
+				index[seriesKey(family.GetName(), m)] = series{family: family, metric: m}
+			}
+		}
+	}
+	return index
+}
+
+// seriesKey identifies a series by its family name and labels, regardless of
+// the order of the labels.
+func seriesKey(name string, m *clientmodel.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, pair := range m.Label {
+		if pair != nil {
+			pairs = append(pairs, pair.GetName()+"\xff"+pair.GetValue())
+		}
+	}
+	sort.Strings(pairs)
+	return name + "\xfe" + strings.Join(pairs, "\xfe")
+}
+
+// equalValues returns true if the given metrics have the same values,
+// regardless of their labels and timestamps.
+func equalValues(a, b *clientmodel.Metric) bool {
+	x, y := *a, *b
+	x.Label, y.Label = nil, nil
+	x.TimestampMs, y.TimestampMs = nil, nil
+	return proto.Equal(&x, &y)
+}
+
+// staleMarker returns a metric of the given type and labels marking the series
+// as removed, with the same stale NaN value Prometheus uses.
+func staleMarker(typ clientmodel.MetricType, labels []*clientmodel.LabelPair, timestampMs int64) *clientmodel.Metric {
+	stale := proto.Float64(math.Float64frombits(value.StaleNaN))
+	m := &clientmodel.Metric{Label: labels, TimestampMs: proto.Int64(timestampMs)}
+	switch typ {
+	case clientmodel.MetricType_COUNTER:
+		m.Counter = &clientmodel.Counter{Value: stale}
+	case clientmodel.MetricType_GAUGE:
+		m.Gauge = &clientmodel.Gauge{Value: stale}
+	case clientmodel.MetricType_HISTOGRAM:
+		m.Histogram = &clientmodel.Histogram{SampleCount: proto.Uint64(0), SampleSum: stale}
+	case clientmodel.MetricType_SUMMARY:
+		m.Summary = &clientmodel.Summary{SampleCount: proto.Uint64(0), SampleSum: stale}
+	default:
+		m.Untyped = &clientmodel.Untyped{Value: stale}
+	}
+	return m
+}
+
+// isStale returns true if the metric is a stale marker.
+func isStale(m *clientmodel.Metric) bool {
+	switch {
+	case m.Counter != nil:
+		return value.IsStaleNaN(m.Counter.GetValue())
+	case m.Gauge != nil:
+		return value.IsStaleNaN(m.Gauge.GetValue())
+	case m.Untyped != nil:
+		return value.IsStaleNaN(m.Untyped.GetValue())
+	case m.Histogram != nil:
+		return len(m.Histogram.Bucket) == 0 && value.IsStaleNaN(m.Histogram.GetSampleSum())
+	case m.Summary != nil:
+		return len(m.Summary.Quantile) == 0 && value.IsStaleNaN(m.Summary.GetSampleSum())
+	default:
+		return false
+	}
+}
@@ -0,0 +1,105 @@
+package metricfamily
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestDiffAndApplyDelta(t *testing.T) {
+	gauge := func(v float64, ts int64, pairs ...string) *clientmodel.Metric {
+		m := &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: proto.Float64(v)}, TimestampMs: proto.Int64(ts)}
+		for i := 0; i < len(pairs); i += 2 {
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: proto.String(pairs[i]), Value: proto.String(pairs[i+1])})
+		}
+		return m
+	}
+	family := func(name string, metrics ...*clientmodel.Metric) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{Name: proto.String(name), Type: clientmodel.MetricType_GAUGE.Enum(), Metric: metrics}
+	}
+	histogram := func(count uint64, ts int64) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name: proto.String("latency"),
+			Type: clientmodel.MetricType_HISTOGRAM.Enum(),
+			Metric: []*clientmodel.Metric{{
+				Histogram: &clientmodel.Histogram{
+					SampleCount: proto.Uint64(count),
+					SampleSum:   proto.Float64(1),
+					Bucket:      []*clientmodel.Bucket{{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(count)}},
+				},
+				TimestampMs: proto.Int64(ts),
+			}},
+		}
+	}
+
+	previous := []*clientmodel.MetricFamily{
+		family("up", gauge(1, 1, "job", "a"), gauge(1, 1, "job", "b"), gauge(1, 1, "job", "c")),
+		family("removed", gauge(1, 1)),
+		histogram(2, 1),
+		family("unchanged", gauge(1, 1, "a", "1", "b", "2")),
+	}
+	current := []*clientmodel.MetricFamily{
+		family("up", gauge(1, 2, "job", "a"), gauge(0, 2, "job", "b"), gauge(1, 2, "job", "d")),
+		histogram(3, 2),
+		family("unchanged", gauge(1, 2, "b", "2", "a", "1")),
+		family("added", gauge(1, 2)),
+	}
+
+	diff := Diff(previous, current, 3)
+	names := make(map[string]int)
+	stale := 0
+	for _, f := range diff {
+		names[f.GetName()] = len(f.Metric)
+		for _, m := range f.Metric {
+			if isStale(m) {
+				stale++
+				if m.GetTimestampMs() != 3 {
+					t.Errorf("expected stale marker at 3, got %d", m.GetTimestampMs())
+				}
+			}
+		}
+	}
+	if len(names) != 4 || names["up"] != 3 || names["removed"] != 1 || names["latency"] != 1 || names["added"] != 1 {
+		t.Fatalf("unexpected series in diff: %v", names)
+	}
+	if stale != 2 {
+		t.Fatalf("expected stale markers for job c and removed, got %d", stale)
+	}
+	for _, f := range diff {
+		if _, err := NewErrorInvalidFederateSamples(time.Unix(0, 0)).Transform(f); err != nil {
+			t.Fatalf("expected the diff to be valid, got %v", err)
+		}
+	}
+
+	got := ApplyDelta(previous, diff, 2)
+	want := map[string]*clientmodel.Metric{}
+	for _, f := range current {
+		for _, m := range f.Metric {
+			want[seriesKey(f.GetName(), m)] = m
+		}
+	}
+	if n := MetricsCount(got); n != len(want) {
+		t.Fatalf("expected %d series, got %d: %v", len(want), n, got)
+	}
+	for _, f := range got {
+		for _, m := range f.Metric {
+			w, ok := want[seriesKey(f.GetName(), m)]
+			if !ok {
+				t.Errorf("unexpected series %s %v", f.GetName(), m)
+				continue
+			}
+			if !equalValues(m, w) || m.GetTimestampMs() != 2 {
+				t.Errorf("expected %v, got %v", w, m)
+			}
+		}
+	}
+	if previous[3].Metric[0].GetTimestampMs() != 1 {
+		t.Errorf("expected base to be unmodified")
+	}
+
+	if diff := Diff(current, current, 3); len(diff) != 0 {
+		t.Errorf("expected an empty diff, got %v", diff)
+	}
+}
@@ -171,6 +171,16 @@ func TestElide(t *testing.T) {
 				hasLabels(false, "elide"),
 			},
 		},
+		{
+			name:   "nil metric",
+			family: family(nil, metricWithLabels("elide")),
+			elide:  NewElide("elide"),
+			checks: []checkFunc{
+				isOK(true),
+				hasErr(nil),
+				hasMetricCount(2),
+			},
+		},
 		{
 			name: "multiple retains, multiple elides",
 			family: family(
@@ -0,0 +1,218 @@
+package metricfamily
+
+import (
+	"fmt"
+	"sort"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// Reasons for which series are dropped or changed by a transformer.
+const (
+	ReasonNotMatched = "not_matched"
+	ReasonInvalid    = "invalid"
+	ReasonExpired    = "expired"
+	ReasonFiltered   = "filtered"
+	ReasonRenamed    = "renamed"
+	ReasonAnonymized = "anonymized"
+	ReasonScrubbed   = "scrubbed"
+	ReasonLabelled   = "labelled"
+	ReasonAggregated = "aggregated"
+)
+
+// FamilyExplanation describes what a transformer did to a single metric family.
+type FamilyExplanation struct {
+	// Name is the name of the family before it was transformed.
+	Name string
+	// Renamed is the name of the family after it was transformed, if it changed.
+	Renamed string
+	// Series is the number of series before the family was transformed.
+	Series int
+	// Kept is the number of series remaining after the family was transformed.
+	Kept int
+	// Dropped counts the dropped series by reason.
+	Dropped map[string]int
+	// Anonymized lists the labels whose values were anonymized.
+	Anonymized []string
+	// Scrubbed lists the labels whose values were partially or fully redacted.
+	Scrubbed []string
+	// Labelled lists the labels that were added, removed or whose values were overwritten.
+	Labelled []string
+}
+
+// Explanation describes what a transformer did to a set of metric families.
+type Explanation struct {
+	Families []*FamilyExplanation
+}
+
+// Explain transforms the given families like Filter, running each transformer that
+// makes up t separately in order to record why series are dropped or changed.
+// Families that are dropped entirely are set to nil.
+func Explain(families []*clientmodel.MetricFamily, t Transformer) (*Explanation, error) {
+	stages := flatten(t)
+	e := &Explanation{}
+	for i, family := range families {
+		if family == nil {
+			continue
+		}
+		fe := &FamilyExplanation{
+			Name:    family.GetName(),
+			Series:  countMetrics(family),
+			Dropped: make(map[string]int),
+		}
+		if fe.Series == 0 {
+			continue
+		}
+		e.Families = append(e.Families, fe)
+
+		anonymized, scrubbed, labelled := make(map[string]struct{}), make(map[string]struct{}), make(map[string]struct{})
+		for _, stage := range stages {
+			reason := reasonFor(stage)
+			before := labelsByMetric(family)
+			ok, err := stage.Transform(family)
+			if err != nil {
+				return nil, fmt.Errorf("unable to transform family %s: %v", fe.Name, err)
+			}
+			if !ok {
+				if len(before) > 0 {
+					fe.Dropped[reason] += len(before)
+				}
+				families[i] = nil
+				break
+			}
+			after := labelsByMetric(family)
+			if reason == ReasonAggregated {
+				// Aggregation replaces the series, so only count how many were merged.
+				if n := len(before) - len(after); n > 0 {
+					fe.Dropped[reason] += n
+				}
+				continue
+			}
+			for m, labels := range before {
+				changed, ok := after[m]
+				if !ok {
+					fe.Dropped[reason]++
+					continue
+				}
+				for name, value := range changed {
+					if old, ok := labels[name]; ok && old == value {
+						continue
+					}
+					switch reason {
+					case ReasonAnonymized:
+						anonymized[name] = struct{}{}
+					case ReasonScrubbed:
+						scrubbed[name] = struct{}{}
+					default:
+						labelled[name] = struct{}{}
+					}
+				}
+				for name := range labels {
+					if _, ok := changed[name]; !ok {
+						labelled[name] = struct{}{}
+					}
+				}
+			}
+		}
+
+		if families[i] != nil {
+			fe.Kept = countMetrics(family)
+			if name := family.GetName(); name != fe.Name {
+				fe.Renamed = name
+			}
+		}
+		fe.Anonymized = sortedKeys(anonymized)
+		fe.Scrubbed = sortedKeys(scrubbed)
+		fe.Labelled = sortedKeys(labelled)
+	}
+	return e, nil
+}
+
+// flatten returns the individual transformers that make up t, in the order
+// in which they are applied.
+func flatten(t Transformer) []Transformer {
+	var m MultiTransformer
+	switch v := t.(type) {
+	case MultiTransformer:
+		m = v
+	case *MultiTransformer:
+		m = *v
+	case nil:
+		return nil
+	default:
+		return []Transformer{t}
+	}
+	var stages []Transformer
+	for _, f := range m.builderFuncs {
+		stages = append(stages, flatten(f())...)
+	}
+	for _, t := range m.transformers {
+		stages = append(stages, flatten(t)...)
+	}
+	return stages
+}
+
+// reasonFor returns the reason recorded for series dropped or changed by t.
+func reasonFor(t Transformer) string {
+	switch t.(type) {
+	case whitelist:
+		return ReasonNotMatched
+	case *dropInvalidFederateSamples, *errorInvalidFederateSamples:
+		return ReasonInvalid
+	case *dropExpiredSamples:
+		return ReasonExpired
+	case RenameMetrics, *RenameMetrics:
+		return ReasonRenamed
+	case *AnonymizeMetrics:
+		return ReasonAnonymized
+	case *ScrubLabels:
+		return ReasonScrubbed
+	case *label:
+		return ReasonLabelled
+	case *aggregate:
+		return ReasonAggregated
+	default:
+		return ReasonFiltered
+	}
+}
+
+func countMetrics(family *clientmodel.MetricFamily) int {
+	count := 0
+	for _, m := range family.Metric {
+		if m != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// labelsByMetric returns a copy of the labels of every metric in the family.
+func labelsByMetric(family *clientmodel.MetricFamily) map[*clientmodel.Metric]map[string]string {
+	result := make(map[*clientmodel.Metric]map[string]string, len(family.Metric))
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		labels := make(map[string]string, len(m.Label))
+		for _, pair := range m.Label {
+			if pair == nil {
+				continue
+			}
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		result[m] = labels
+	}
+	return result
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	if len(set) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,105 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func gaugeWithLabels(name string, timestamp int64, labels ...map[string]string) *clientmodel.MetricFamily {
+	family := &clientmodel.MetricFamily{Name: &name, Type: clientmodel.MetricType_GAUGE.Enum()}
+	for _, set := range labels {
+		value, ts := float64(1), timestamp
+		m := &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: &value}, TimestampMs: &ts}
+		for k, v := range set {
+			k, v := k, v
+			m.Label = append(m.Label, &clientmodel.LabelPair{Name: &k, Value: &v})
+		}
+		family.Metric = append(family.Metric, m)
+	}
+	return family
+}
+
+func TestExplain(t *testing.T) {
+	now := time.Unix(1000, 0)
+	fresh, stale := now.Unix()*1000, now.Add(-48*time.Hour).Unix()*1000
+
+	whitelister, err := NewWhitelist([]string{`{__name__="up"}`, `{__name__="ALERTS"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var common MultiTransformer
+	common.With(RenameMetrics{Names: map[string]string{"ALERTS": "alerts"}})
+	common.WithFunc(func() Transformer {
+		return NewDropInvalidFederateSamples(now.Add(-24 * time.Hour))
+	})
+	common.With(TransformerFunc(PackMetrics))
+
+	var chain MultiTransformer
+	chain.With(whitelister)
+	chain.With(common)
+	chain.With(NewMetricsAnonymizer("salt", []string{"instance"}, nil))
+	scrubber, err := NewScrubLabels(DefaultScrubPlaceholder, map[string]ScrubRule{"alertname": {Allow: []string{"Watchdog"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.With(scrubber)
+	chain.With(NewLabel(map[string]string{"cluster": "a"}, nil))
+
+	families := []*clientmodel.MetricFamily{
+		gaugeWithLabels("up", fresh, map[string]string{"instance": "a"}, map[string]string{"instance": "b"}),
+		gaugeWithLabels("ALERTS", fresh, map[string]string{"alertname": "a"}, map[string]string{"alertname": "b"}),
+		gaugeWithLabels("up", stale, map[string]string{"instance": "c"}),
+		gaugeWithLabels("other", fresh, map[string]string{}),
+	}
+	// Add an invalid series to an otherwise valid family.
+	families[0].Metric = append(families[0].Metric, gaugeWithLabels("up", stale, map[string]string{}).Metric...)
+
+	e, err := Explain(families, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*FamilyExplanation{
+		{
+			Name:       "up",
+			Series:     3,
+			Kept:       2,
+			Dropped:    map[string]int{ReasonInvalid: 1},
+			Anonymized: []string{"instance"},
+			Labelled:   []string{"cluster"},
+		},
+		{
+			Name:     "ALERTS",
+			Renamed:  "alerts",
+			Series:   2,
+			Kept:     1,
+			Dropped:  map[string]int{ReasonScrubbed: 1},
+			Scrubbed: []string{"alertname"},
+			Labelled: []string{"cluster"},
+		},
+		{
+			Name:    "up",
+			Series:  1,
+			Dropped: map[string]int{ReasonInvalid: 1},
+		},
+		{
+			Name:    "other",
+			Series:  1,
+			Dropped: map[string]int{ReasonNotMatched: 1},
+		},
+	}
+	if !reflect.DeepEqual(e.Families, want) {
+		for i := range e.Families {
+			t.Logf("got %+v", e.Families[i])
+		}
+		t.Fatalf("unexpected explanation")
+	}
+
+	if families[0] == nil || families[1] == nil || families[2] != nil || families[3] != nil {
+		t.Fatalf("expected only the first two families to be kept, got %v", families)
+	}
+}
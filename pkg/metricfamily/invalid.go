@@ -61,6 +61,9 @@ func (t *errorInvalidFederateSamples) Transform(family *clientmodel.MetricFamily
 			if m.Counter == nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil {
 				return false, fmt.Errorf("metric type %s must have counter field set", t)
 			}
+			if err := validateCounter(m.Counter); err != nil {
+				return false, err
+			}
 		case clientmodel.MetricType_GAUGE:
 			if m.Counter != nil || m.Gauge == nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil {
 				return false, fmt.Errorf("metric type %s must have gauge field set", t)
@@ -69,6 +72,9 @@ func (t *errorInvalidFederateSamples) Transform(family *clientmodel.MetricFamily
 			if m.Counter != nil || m.Gauge != nil || m.Histogram == nil || m.Summary != nil || m.Untyped != nil {
 				return false, fmt.Errorf("metric type %s must have histogram field set", t)
 			}
+			if err := validateHistogram(m.Histogram); err != nil {
+				return false, err
+			}
 		case clientmodel.MetricType_SUMMARY:
 			if m.Counter != nil || m.Gauge != nil || m.Histogram != nil || m.Summary == nil || m.Untyped != nil {
 				return false, fmt.Errorf("metric type %s must have summary field set", t)
@@ -137,7 +143,7 @@ func (t *dropInvalidFederateSamples) Transform(family *clientmodel.MetricFamily)
 		}
 		switch t := *family.Type; t {
 		case clientmodel.MetricType_COUNTER:
-			if m.Counter == nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil {
+			if m.Counter == nil || m.Gauge != nil || m.Histogram != nil || m.Summary != nil || m.Untyped != nil || validateCounter(m.Counter) != nil {
 				family.Metric[i] = nil
 			}
 		case clientmodel.MetricType_GAUGE:
@@ -145,7 +151,7 @@ func (t *dropInvalidFederateSamples) Transform(family *clientmodel.MetricFamily)
 				family.Metric[i] = nil
 			}
 		case clientmodel.MetricType_HISTOGRAM:
-			if m.Counter != nil || m.Gauge != nil || m.Histogram == nil || m.Summary != nil || m.Untyped != nil {
+			if m.Counter != nil || m.Gauge != nil || m.Histogram == nil || m.Summary != nil || m.Untyped != nil || validateHistogram(m.Histogram) != nil {
 				family.Metric[i] = nil
 			}
 		case clientmodel.MetricType_SUMMARY:
@@ -0,0 +1,197 @@
+package metricfamily
+
+import (
+	"fmt"
+	"math"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// The vendored client model predates native histograms and exemplars. Their
+// fields are kept as unrecognized fields of the classic messages, so they survive
+// decoding, storage, forwarding and protobuf encoding unchanged. The messages
+// below mirror the fields of the upstream client model, so they can be validated.
+
+const (
+	// maxNativeHistogramBuckets is the maximum number of positive and negative
+	// buckets of a native histogram.
+	maxNativeHistogramBuckets = 512
+	// maxNativeHistogramSpans is the maximum number of positive and negative
+	// spans of a native histogram.
+	maxNativeHistogramSpans = 128
+	// maxExemplarLabelRunes is the maximum length of the labels of an exemplar,
+	// as in OpenMetrics.
+	maxExemplarLabelRunes = 128
+)
+
+type nativeHistogram struct {
+	Schema           *int32        `protobuf:"zigzag32,5,opt,name=schema"`
+	ZeroThreshold    *float64      `protobuf:"fixed64,6,opt,name=zero_threshold"`
+	ZeroCount        *uint64       `protobuf:"varint,7,opt,name=zero_count"`
+	ZeroCountFloat   *float64      `protobuf:"fixed64,8,opt,name=zero_count_float"`
+	NegativeSpan     []*bucketSpan `protobuf:"bytes,9,rep,name=negative_span"`
+	NegativeDelta    []int64       `protobuf:"zigzag64,10,rep,name=negative_delta"`
+	NegativeCount    []float64     `protobuf:"fixed64,11,rep,name=negative_count"`
+	PositiveSpan     []*bucketSpan `protobuf:"bytes,12,rep,name=positive_span"`
+	PositiveDelta    []int64       `protobuf:"zigzag64,13,rep,name=positive_delta"`
+	PositiveCount    []float64     `protobuf:"fixed64,14,rep,name=positive_count"`
+	Exemplars        []*exemplar   `protobuf:"bytes,16,rep,name=exemplars"`
+	XXX_unrecognized []byte
+}
+
+func (m *nativeHistogram) Reset()         { *m = nativeHistogram{} }
+func (m *nativeHistogram) String() string { return proto.CompactTextString(m) }
+func (*nativeHistogram) ProtoMessage()    {}
+
+type bucketSpan struct {
+	Offset           *int32  `protobuf:"zigzag32,1,opt,name=offset"`
+	Length           *uint32 `protobuf:"varint,2,opt,name=length"`
+	XXX_unrecognized []byte
+}
+
+func (m *bucketSpan) Reset()         { *m = bucketSpan{} }
+func (m *bucketSpan) String() string { return proto.CompactTextString(m) }
+func (*bucketSpan) ProtoMessage()    {}
+
+type exemplar struct {
+	Label            []*clientmodel.LabelPair `protobuf:"bytes,1,rep,name=label"`
+	Value            *float64                 `protobuf:"fixed64,2,opt,name=value"`
+	XXX_unrecognized []byte
+}
+
+func (m *exemplar) Reset()         { *m = exemplar{} }
+func (m *exemplar) String() string { return proto.CompactTextString(m) }
+func (*exemplar) ProtoMessage()    {}
+
+// counterExtension holds the exemplar of a counter.
+type counterExtension struct {
+	Exemplar         *exemplar `protobuf:"bytes,2,opt,name=exemplar"`
+	XXX_unrecognized []byte
+}
+
+func (m *counterExtension) Reset()         { *m = counterExtension{} }
+func (m *counterExtension) String() string { return proto.CompactTextString(m) }
+func (*counterExtension) ProtoMessage()    {}
+
+// bucketExtension holds the exemplar of a classic histogram bucket.
+type bucketExtension struct {
+	Exemplar         *exemplar `protobuf:"bytes,3,opt,name=exemplar"`
+	XXX_unrecognized []byte
+}
+
+func (m *bucketExtension) Reset()         { *m = bucketExtension{} }
+func (m *bucketExtension) String() string { return proto.CompactTextString(m) }
+func (*bucketExtension) ProtoMessage()    {}
+
+// validateCounter checks the exemplar of a counter, if any.
+func validateCounter(c *clientmodel.Counter) error {
+	if len(c.XXX_unrecognized) == 0 {
+		return nil
+	}
+	var ext counterExtension
+	if err := proto.Unmarshal(c.XXX_unrecognized, &ext); err != nil {
+		return fmt.Errorf("invalid counter: %v", err)
+	}
+	return validateExemplar(ext.Exemplar)
+}
+
+// validateHistogram checks the exemplars of a histogram, and the spans and
+// buckets of a native histogram, if any.
+func validateHistogram(h *clientmodel.Histogram) error {
+	for _, b := range h.Bucket {
+		if b == nil || len(b.XXX_unrecognized) == 0 {
+			continue
+		}
+		var ext bucketExtension
+		if err := proto.Unmarshal(b.XXX_unrecognized, &ext); err != nil {
+			return fmt.Errorf("invalid histogram bucket: %v", err)
+		}
+		if err := validateExemplar(ext.Exemplar); err != nil {
+			return err
+		}
+	}
+	if len(h.XXX_unrecognized) == 0 {
+		return nil
+	}
+
+	var nh nativeHistogram
+	if err := proto.Unmarshal(h.XXX_unrecognized, &nh); err != nil {
+		return fmt.Errorf("invalid native histogram: %v", err)
+	}
+	if schema := nh.Schema; schema != nil && (*schema < -4 || *schema > 8) {
+		return fmt.Errorf("native histogram schema %d must be between -4 and 8", *schema)
+	}
+	if t := nh.ZeroThreshold; t != nil && !(*t >= 0) {
+		return fmt.Errorf("native histogram zero threshold must not be negative")
+	}
+	if len(nh.NegativeSpan)+len(nh.PositiveSpan) > maxNativeHistogramSpans {
+		return fmt.Errorf("native histogram cannot have more than %d spans", maxNativeHistogramSpans)
+	}
+	negative, err := validateSpans(nh.NegativeSpan, len(nh.NegativeDelta), len(nh.NegativeCount))
+	if err != nil {
+		return fmt.Errorf("negative spans of native histogram: %v", err)
+	}
+	positive, err := validateSpans(nh.PositiveSpan, len(nh.PositiveDelta), len(nh.PositiveCount))
+	if err != nil {
+		return fmt.Errorf("positive spans of native histogram: %v", err)
+	}
+	if negative+positive > maxNativeHistogramBuckets {
+		return fmt.Errorf("native histogram cannot have more than %d buckets", maxNativeHistogramBuckets)
+	}
+	for _, e := range nh.Exemplars {
+		if err := validateExemplar(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSpans checks that the given spans describe either the given number of
+// deltas or of counts, and returns the number of buckets they describe.
+func validateSpans(spans []*bucketSpan, deltas, counts int) (int, error) {
+	var buckets int
+	for i, span := range spans {
+		if span == nil {
+			return 0, fmt.Errorf("span %d is empty", i)
+		}
+		if i > 0 && span.Offset != nil && *span.Offset < 0 {
+			return 0, fmt.Errorf("offset of span %d must not be negative", i)
+		}
+		if span.Length == nil {
+			continue
+		}
+		if *span.Length > maxNativeHistogramBuckets {
+			return 0, fmt.Errorf("span %d cannot be longer than %d buckets", i, maxNativeHistogramBuckets)
+		}
+		buckets += int(*span.Length)
+	}
+	if deltas > 0 && counts > 0 {
+		return 0, fmt.Errorf("buckets cannot have both integer and float counts")
+	}
+	if deltas+counts != buckets {
+		return 0, fmt.Errorf("spans describe %d buckets but %d counts are given", buckets, deltas+counts)
+	}
+	return buckets, nil
+}
+
+func validateExemplar(e *exemplar) error {
+	if e == nil {
+		return nil
+	}
+	var runes int
+	for _, label := range e.Label {
+		if label == nil {
+			return fmt.Errorf("exemplar labels must not be empty")
+		}
+		runes += utf8.RuneCountInString(label.GetName()) + utf8.RuneCountInString(label.GetValue())
+	}
+	if runes > maxExemplarLabelRunes {
+		return fmt.Errorf("exemplar labels cannot be longer than %d characters", maxExemplarLabelRunes)
+	}
+	if e.Value != nil && math.IsInf(*e.Value, 0) {
+		return fmt.Errorf("exemplar value must be finite")
+	}
+	return nil
+}
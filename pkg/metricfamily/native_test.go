@@ -0,0 +1,149 @@
+package metricfamily
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func mustMarshal(t *testing.T, m proto.Message) []byte {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func span(offset int32, length uint32) *bucketSpan {
+	return &bucketSpan{Offset: &offset, Length: &length}
+}
+
+func TestValidateNative(t *testing.T) {
+	longLabel := &clientmodel.LabelPair{Name: proto.String("trace_id"), Value: proto.String(strings.Repeat("a", 121))}
+	traceLabel := &clientmodel.LabelPair{Name: proto.String("trace_id"), Value: proto.String("abc")}
+
+	for _, tc := range []struct {
+		name    string
+		typ     clientmodel.MetricType
+		metric  *clientmodel.Metric
+		wantErr string
+	}{
+		{
+			name: "native histogram",
+			typ:  clientmodel.MetricType_HISTOGRAM,
+			metric: &clientmodel.Metric{Histogram: &clientmodel.Histogram{
+				SampleCount: proto.Uint64(3),
+				XXX_unrecognized: mustMarshal(t, &nativeHistogram{
+					Schema:        proto.Int32(3),
+					ZeroThreshold: proto.Float64(0.001),
+					PositiveSpan:  []*bucketSpan{span(-2, 2), span(3, 1)},
+					PositiveDelta: []int64{1, 0, -1},
+					Exemplars:     []*exemplar{{Label: []*clientmodel.LabelPair{traceLabel}, Value: proto.Float64(1)}},
+				}),
+			}},
+		},
+		{
+			name: "invalid schema",
+			typ:  clientmodel.MetricType_HISTOGRAM,
+			metric: &clientmodel.Metric{Histogram: &clientmodel.Histogram{
+				XXX_unrecognized: mustMarshal(t, &nativeHistogram{Schema: proto.Int32(9)}),
+			}},
+			wantErr: "schema 9",
+		},
+		{
+			name: "spans not matching buckets",
+			typ:  clientmodel.MetricType_HISTOGRAM,
+			metric: &clientmodel.Metric{Histogram: &clientmodel.Histogram{
+				XXX_unrecognized: mustMarshal(t, &nativeHistogram{
+					NegativeSpan:  []*bucketSpan{span(0, 3)},
+					NegativeCount: []float64{1, 2},
+				}),
+			}},
+			wantErr: "spans describe 3 buckets but 2 counts are given",
+		},
+		{
+			name: "too many buckets",
+			typ:  clientmodel.MetricType_HISTOGRAM,
+			metric: &clientmodel.Metric{Histogram: &clientmodel.Histogram{
+				XXX_unrecognized: mustMarshal(t, &nativeHistogram{
+					PositiveSpan:  []*bucketSpan{span(0, maxNativeHistogramBuckets+1)},
+					PositiveDelta: make([]int64, maxNativeHistogramBuckets+1),
+				}),
+			}},
+			wantErr: "cannot be longer than",
+		},
+		{
+			name: "negative offset",
+			typ:  clientmodel.MetricType_HISTOGRAM,
+			metric: &clientmodel.Metric{Histogram: &clientmodel.Histogram{
+				XXX_unrecognized: mustMarshal(t, &nativeHistogram{
+					PositiveSpan:  []*bucketSpan{span(0, 1), span(-1, 1)},
+					PositiveDelta: []int64{1, 1},
+				}),
+			}},
+			wantErr: "offset of span 1 must not be negative",
+		},
+		{
+			name: "bucket exemplar too long",
+			typ:  clientmodel.MetricType_HISTOGRAM,
+			metric: &clientmodel.Metric{Histogram: &clientmodel.Histogram{
+				Bucket: []*clientmodel.Bucket{{
+					UpperBound:       proto.Float64(1),
+					CumulativeCount:  proto.Uint64(1),
+					XXX_unrecognized: mustMarshal(t, &bucketExtension{Exemplar: &exemplar{Label: []*clientmodel.LabelPair{longLabel}}}),
+				}},
+			}},
+			wantErr: "exemplar labels cannot be longer than 128 characters",
+		},
+		{
+			name: "counter exemplar",
+			typ:  clientmodel.MetricType_COUNTER,
+			metric: &clientmodel.Metric{Counter: &clientmodel.Counter{
+				Value:            proto.Float64(1),
+				XXX_unrecognized: mustMarshal(t, &counterExtension{Exemplar: &exemplar{Label: []*clientmodel.LabelPair{traceLabel}}}),
+			}},
+		},
+		{
+			name: "corrupt native histogram",
+			typ:  clientmodel.MetricType_HISTOGRAM,
+			metric: &clientmodel.Metric{Histogram: &clientmodel.Histogram{
+				XXX_unrecognized: []byte{0x62, 0x01, 0xff},
+			}},
+			wantErr: "invalid native histogram",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			tc.metric.TimestampMs = proto.Int64(now.UnixNano() / int64(time.Millisecond))
+			family := &clientmodel.MetricFamily{Name: proto.String("test"), Type: tc.typ.Enum(), Metric: []*clientmodel.Metric{tc.metric}}
+
+			// The native fields must survive encoding.
+			data := mustMarshal(t, family)
+			decoded := &clientmodel.MetricFamily{}
+			if err := proto.Unmarshal(data, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(family, decoded) {
+				t.Fatalf("expected %v to survive encoding, got %v", family, decoded)
+			}
+
+			_, err := NewErrorInvalidFederateSamples(now.Add(-time.Hour)).Transform(decoded)
+			if len(tc.wantErr) == 0 && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(tc.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+
+			if _, err := NewDropInvalidFederateSamples(now.Add(-time.Hour)).Transform(decoded); err != nil {
+				t.Fatal(err)
+			}
+			if dropped := decoded.Metric[0] == nil; dropped != (len(tc.wantErr) > 0) {
+				t.Errorf("expected metric to be dropped: %t, got %t", len(tc.wantErr) > 0, dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package metricfamily
+
+import (
+	"fmt"
+	"regexp"
+
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+// DefaultScrubPlaceholder replaces redacted parts of label values and label
+// values that are not allowed.
+const DefaultScrubPlaceholder = "<redacted>"
+
+// ScrubRule describes how the values of a label are scrubbed.
+type ScrubRule struct {
+	// Redact lists patterns whose matches in the value are replaced by the placeholder.
+	Redact []string
+	// Allow lists the values that are kept after redaction. If it is not empty,
+	// any other value is replaced by the placeholder.
+	Allow []string
+}
+
+type scrubRule struct {
+	redact []*regexp.Regexp
+	allow  map[string]struct{}
+}
+
+// ScrubLabels redacts label values that may contain sensitive data, for labels
+// whose values are mostly safe and so must not be anonymized as a whole.
+type ScrubLabels struct {
+	placeholder string
+	rules       map[string]scrubRule
+}
+
+// NewScrubLabels returns a transformer applying the rule of every label name to
+// the values of that label. Parts of a value matching a redaction pattern are
+// replaced by the placeholder first; then, if the rule allows a set of values,
+// values outside of that set are replaced by the placeholder.
+func NewScrubLabels(placeholder string, rules map[string]ScrubRule) (*ScrubLabels, error) {
+	s := &ScrubLabels{
+		placeholder: placeholder,
+		rules:       make(map[string]scrubRule, len(rules)),
+	}
+	for label, rule := range rules {
+		var r scrubRule
+		for _, pattern := range rule.Redact {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redaction pattern for label %s: %v", label, err)
+			}
+			r.redact = append(r.redact, re)
+		}
+		if len(rule.Allow) > 0 {
+			r.allow = make(map[string]struct{}, len(rule.Allow))
+			for _, value := range rule.Allow {
+				r.allow[value] = struct{}{}
+			}
+		}
+		s.rules[label] = r
+	}
+	return s, nil
+}
+
+// Transform scrubs the label values of the series of the family. Series that
+// end up with the same labels as another series are dropped, keeping the
+// series that were not scrubbed and the first of those that were, since their
+// values cannot be merged in general.
+func (s *ScrubLabels) Transform(family *clientmodel.MetricFamily) (bool, error) {
+	if family == nil {
+		return false, nil
+	}
+	scrubbed := make([]bool, len(family.Metric))
+	anyScrubbed := false
+	for i, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		for _, pair := range m.Label {
+			if pair.Value == nil || *pair.Value == "" {
+				continue
+			}
+			rule, ok := s.rules[pair.GetName()]
+			if !ok {
+				continue
+			}
+			v := s.scrub(rule, pair.GetValue())
+			if v != pair.GetValue() {
+				scrubbed[i], anyScrubbed = true, true
+			}
+			pair.Value = &v
+		}
+	}
+	if !anyScrubbed {
+		return true, nil
+	}
+
+	seen := make(map[string]struct{}, len(family.Metric))
+	for i, m := range family.Metric {
+		if m != nil && !scrubbed[i] {
+			seen[seriesKey("", m)] = struct{}{}
+		}
+	}
+	dropped := false
+	for i, m := range family.Metric {
+		if !scrubbed[i] {
+			continue
+		}
+		key := seriesKey("", m)
+		if _, ok := seen[key]; ok {
+			family.Metric[i] = nil
+			dropped = true
+			continue
+		}
+		seen[key] = struct{}{}
+	}
+	if dropped {
+		return PackMetrics(family)
+	}
+	return true, nil
+}
+
+// scrub returns the given value scrubbed according to the given rule.
+func (s *ScrubLabels) scrub(rule scrubRule, value string) string {
+	for _, re := range rule.redact {
+		value = re.ReplaceAllLiteralString(value, s.placeholder)
+	}
+	if rule.allow != nil {
+		if _, ok := rule.allow[value]; !ok {
+			return s.placeholder
+		}
+	}
+	return value
+}
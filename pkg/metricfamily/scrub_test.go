@@ -0,0 +1,80 @@
+package metricfamily
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+)
+
+func TestScrubLabels(t *testing.T) {
+	s, err := NewScrubLabels("x", map[string]ScrubRule{
+		"message":  {Redact: []string{`[a-z0-9.]+@[a-z0-9.]+`, `\d+\.\d+\.\d+\.\d+`}},
+		"reason":   {Allow: []string{"OOMKilled", "Error"}},
+		"instance": {Redact: []string{`^[^:]+`}, Allow: []string{"x:9100", "x:9090"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		label, value, want string
+	}{
+		{label: "message", value: "mail to bob@example.com failed", want: "mail to x failed"},
+		{label: "message", value: "dial 10.0.0.1:443 and 10.0.0.2:443", want: "dial x:443 and x:443"},
+		{label: "message", value: "safe", want: "safe"},
+		{label: "reason", value: "OOMKilled", want: "OOMKilled"},
+		{label: "reason", value: "customer-db crashed", want: "x"},
+		{label: "instance", value: "node-1.customer.com:9100", want: "x:9100"},
+		{label: "instance", value: "node-1.customer.com:1234", want: "x"},
+		{label: "other", value: "bob@example.com", want: "bob@example.com"},
+		{label: "reason", value: "", want: ""},
+	} {
+		family := &clientmodel.MetricFamily{
+			Name: proto.String("test"),
+			Metric: []*clientmodel.Metric{{
+				Label: []*clientmodel.LabelPair{{Name: proto.String(tc.label), Value: proto.String(tc.value)}},
+			}},
+		}
+		if ok, err := s.Transform(family); !ok || err != nil {
+			t.Fatalf("unexpected result %t, %v", ok, err)
+		}
+		if got := family.Metric[0].Label[0].GetValue(); got != tc.want {
+			t.Errorf("%s=%q: expected %q, got %q", tc.label, tc.value, tc.want, got)
+		}
+	}
+
+	if _, err := NewScrubLabels("x", map[string]ScrubRule{"a": {Redact: []string{"("}}}); err == nil {
+		t.Error("expected invalid pattern to fail")
+	}
+}
+
+func TestScrubLabelsCollisions(t *testing.T) {
+	s, err := NewScrubLabels(DefaultScrubPlaceholder, map[string]ScrubRule{"reason": {Allow: []string{"Error"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	family := gaugeWithLabels("test", 1,
+		map[string]string{"reason": "customer-db crashed"},
+		map[string]string{"reason": "Error"},
+		map[string]string{"reason": "customer-api crashed"},
+		map[string]string{"reason": "Error", "pod": "a"},
+	)
+
+	if ok, err := s.Transform(family); !ok || err != nil {
+		t.Fatalf("unexpected result %t, %v", ok, err)
+	}
+	var got []string
+	for _, m := range family.Metric {
+		got = append(got, seriesKey("", m))
+	}
+	want := []string{
+		seriesKey("", gaugeWithLabels("test", 1, map[string]string{"reason": DefaultScrubPlaceholder}).Metric[0]),
+		seriesKey("", gaugeWithLabels("test", 1, map[string]string{"reason": "Error"}).Metric[0]),
+		seriesKey("", gaugeWithLabels("test", 1, map[string]string{"reason": "Error", "pod": "a"}).Metric[0]),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected series %q, got %q", want, got)
+	}
+}
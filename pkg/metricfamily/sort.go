@@ -49,7 +49,7 @@ func MergeSortedWithTimestamps(families []*clientmodel.MetricFamily) []*clientmo
 			continue
 		}
 		if dst.GetName() != src.GetName() {
-			dst = nil
+			dst = src
 			continue
 		}
 
@@ -102,6 +102,7 @@ func TestMergeSort(t *testing.T) {
 		{name: "merge", args: []*clientmodel.MetricFamily{family("A", 1), family("A", 2)}, want: []*clientmodel.MetricFamily{family("A", 1, 2)}},
 		{name: "reverse merge", args: []*clientmodel.MetricFamily{family("A", 2), family("A", 1)}, want: []*clientmodel.MetricFamily{family("A", 1, 2)}},
 		{name: "differ", args: []*clientmodel.MetricFamily{family("A", 2), family("B", 1)}, want: []*clientmodel.MetricFamily{family("A", 2), family("B", 1)}},
+		{name: "merge after differ", args: []*clientmodel.MetricFamily{family("A", 2), family("B", 1), family("B", 3)}, want: []*clientmodel.MetricFamily{family("A", 2), family("B", 1, 3)}},
 		{name: "zip merge", args: []*clientmodel.MetricFamily{family("A", 2, 4, 6), family("A", 1, 3, 5)}, want: []*clientmodel.MetricFamily{family("A", 1, 2, 3, 4, 5, 6)}},
 		{name: "zip merge - dst longer", args: []*clientmodel.MetricFamily{family("A", 2, 4, 6), family("A", 3)}, want: []*clientmodel.MetricFamily{family("A", 2, 3, 4, 6)}},
 		{name: "zip merge - src longer", args: []*clientmodel.MetricFamily{family("A", 4), family("A", 1, 3, 5)}, want: []*clientmodel.MetricFamily{family("A", 1, 3, 4, 5)}},
@@ -14,6 +14,20 @@ type whitelist [][]*labels.Matcher
 // Each given rule is transformed into a matchset. Matchsets are OR-ed.
 // Individual matchers within a matchset are AND-ed, as in PromQL.
 func NewWhitelist(rules []string) (Transformer, error) {
+	selector, err := NewSelector(rules)
+	if err != nil {
+		return nil, err
+	}
+	return whitelist(selector), nil
+}
+
+// Selector matches metrics against rules in the same way as the whitelist,
+// without modifying them.
+type Selector [][]*labels.Matcher
+
+// NewSelector returns a Selector matching the metrics that match at least one
+// of the given rules.
+func NewSelector(rules []string) (Selector, error) {
 	var ms [][]*labels.Matcher
 	for i := range rules {
 		matchers, err := promql.ParseMetricSelector(rules[i])
@@ -22,7 +36,17 @@ func NewWhitelist(rules []string) (Transformer, error) {
 		}
 		ms = append(ms, matchers)
 	}
-	return whitelist(ms), nil
+	return Selector(ms), nil
+}
+
+// Matches returns true if the given metric of the named family matches at least one rule.
+func (s Selector) Matches(name string, metric *clientmodel.Metric) bool {
+	for _, matchset := range s {
+		if match(name, metric, matchset...) {
+			return true
+		}
+	}
+	return false
 }
 
 // Transform implements the Transformer interface.
@@ -33,11 +57,9 @@ Metric:
 		if m == nil {
 			continue
 		}
-		for _, matchset := range t {
-			if match(family.GetName(), m, matchset...) {
-				ok = true
-				continue Metric
-			}
+		if Selector(t).Matches(family.GetName(), m) {
+			ok = true
+			continue Metric
 		}
 		family.Metric[i] = nil
 	}
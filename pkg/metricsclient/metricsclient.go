@@ -3,22 +3,29 @@ package metricsclient
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/golang/snappy"
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
 
+	telemeterhttp "github.com/openshift/telemeter/pkg/http"
+	"github.com/openshift/telemeter/pkg/logging"
 	"github.com/openshift/telemeter/pkg/reader"
+	"github.com/openshift/telemeter/pkg/tracing"
 )
 
 var (
@@ -38,15 +45,53 @@ func init() {
 	)
 }
 
+// Headers of numbered uploads. An upload with a base sequence number only holds
+// the series that changed since the upload with that sequence number, as
+// computed by metricfamily.Diff, along with the timestamp of the unchanged
+// series in milliseconds. The server responds with 409 Conflict if it did not
+// store the base upload, in which case the series must be uploaded in full.
+const (
+	SequenceHeader     = "Telemeter-Sequence"
+	BaseSequenceHeader = "Telemeter-Base-Sequence"
+	TimestampHeader    = "Telemeter-Timestamp"
+)
+
+// StatusError is returned when a server responds with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is the delay requested by the server via the Retry-After header.
+	RetryAfter time.Duration
+
+	msg string
+}
+
+func (e *StatusError) Error() string { return e.msg }
+
+// HTTPStatusCode returns the status code of the response.
+func (e *StatusError) HTTPStatusCode() int { return e.StatusCode }
+
+// RetryAfterDuration returns the delay requested by the server.
+func (e *StatusError) RetryAfterDuration() time.Duration { return e.RetryAfter }
+
+func newStatusError(resp *http.Response, format string, args ...interface{}) error {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: telemeterhttp.RetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		msg:        fmt.Sprintf(format, args...),
+	}
+}
+
 type Client struct {
+	logger      log.Logger
 	client      *http.Client
 	maxBytes    int64
 	timeout     time.Duration
 	metricsName string
 }
 
-func New(client *http.Client, maxBytes int64, timeout time.Duration, metricsName string) *Client {
+func New(logger log.Logger, client *http.Client, maxBytes int64, timeout time.Duration, metricsName string) *Client {
 	return &Client{
+		logger:      logging.OrNop(logger),
 		client:      client,
 		maxBytes:    maxBytes,
 		timeout:     timeout,
@@ -61,8 +106,10 @@ func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmode
 	req.Header.Set("Accept", strings.Join([]string{string(expfmt.FmtProtoDelim), string(expfmt.FmtText)}, " , "))
 
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	req = req.WithContext(ctx)
 	defer cancel()
+	span, ctx := tracing.StartSpan(ctx, "metricsclient.retrieve")
+	tracing.InjectHTTP(ctx, req.Header)
+	req = req.WithContext(ctx)
 
 	families := make([]*clientmodel.MetricFamily, 0, 100)
 	err := withCancel(ctx, c.client, req, func(resp *http.Response) error {
@@ -71,16 +118,16 @@ func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmode
 			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "200").Inc()
 		case http.StatusUnauthorized:
 			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "401").Inc()
-			return fmt.Errorf("Prometheus server requires authentication: %s", resp.Request.URL)
+			return newStatusError(resp, "Prometheus server requires authentication: %s", resp.Request.URL)
 		case http.StatusForbidden:
 			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "403").Inc()
-			return fmt.Errorf("Prometheus server forbidden: %s", resp.Request.URL)
+			return newStatusError(resp, "Prometheus server forbidden: %s", resp.Request.URL)
 		case http.StatusBadRequest:
 			gaugeRequestRetrieve.WithLabelValues(c.metricsName, "400").Inc()
-			return fmt.Errorf("bad request: %s", resp.Request.URL)
+			return newStatusError(resp, "bad request: %s", resp.Request.URL)
 		default:
 			gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
-			return fmt.Errorf("Prometheus server reported unexpected error code: %d", resp.StatusCode)
+			return newStatusError(resp, "Prometheus server reported unexpected error code: %d", resp.StatusCode)
 		}
 
 		// read the response into memory
@@ -100,12 +147,87 @@ func (c *Client) Retrieve(ctx context.Context, req *http.Request) ([]*clientmode
 
 		return nil
 	})
+	tracing.Finish(span, err)
 	if err != nil {
 		return nil, err
 	}
 	return families, nil
 }
 
+// queryResponse is the response of the Prometheus /api/v1/query endpoint.
+type queryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType model.ValueType `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// Query evaluates an instant query against the Prometheus query API. The request
+// URL must point to the /api/v1/query endpoint and include the query. Scalar
+// results are returned as a vector with a single sample without labels.
+func (c *Client) Query(ctx context.Context, req *http.Request) (model.Vector, error) {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	span, ctx := tracing.StartSpan(ctx, "metricsclient.query")
+	tracing.InjectHTTP(ctx, req.Header)
+	req = req.WithContext(ctx)
+
+	var vector model.Vector
+	err := withCancel(ctx, c.client, req, func(resp *http.Response) error {
+		gaugeRequestRetrieve.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
+
+		var result queryResponse
+		r := &reader.LimitedReader{R: resp.Body, N: c.maxBytes}
+		decodeErr := json.NewDecoder(r).Decode(&result)
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusUnauthorized:
+			return newStatusError(resp, "Prometheus server requires authentication: %s", resp.Request.URL)
+		case http.StatusForbidden:
+			return newStatusError(resp, "Prometheus server forbidden: %s", resp.Request.URL)
+		default:
+			if decodeErr == nil && len(result.Error) > 0 {
+				return newStatusError(resp, "Prometheus server rejected query: %s: %s", result.ErrorType, result.Error)
+			}
+			return newStatusError(resp, "Prometheus server reported unexpected error code: %d", resp.StatusCode)
+		}
+		if decodeErr != nil {
+			return fmt.Errorf("unable to decode query response: %v", decodeErr)
+		}
+		if result.Status != "success" {
+			return fmt.Errorf("query failed: %s: %s", result.ErrorType, result.Error)
+		}
+
+		switch result.Data.ResultType {
+		case model.ValVector:
+			return json.Unmarshal(result.Data.Result, &vector)
+		case model.ValScalar:
+			var scalar model.Scalar
+			if err := json.Unmarshal(result.Data.Result, &scalar); err != nil {
+				return err
+			}
+			vector = model.Vector{{Metric: model.Metric{}, Value: scalar.Value, Timestamp: scalar.Timestamp}}
+			return nil
+		default:
+			return fmt.Errorf("query returned a %s, only instant vectors and scalars are supported", result.Data.ResultType)
+		}
+	})
+	tracing.Finish(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
+
 func (c *Client) Send(ctx context.Context, req *http.Request, families []*clientmodel.MetricFamily) error {
 	buf := &bytes.Buffer{}
 	if err := Write(buf, families); err != nil {
@@ -120,13 +242,16 @@ func (c *Client) Send(ctx context.Context, req *http.Request, families []*client
 	req.Body = ioutil.NopCloser(buf)
 
 	ctx, cancel := context.WithTimeout(ctx, c.timeout)
-	req = req.WithContext(ctx)
 	defer cancel()
+	span, ctx := tracing.StartSpan(ctx, "metricsclient.send")
+	span.SetAttributes(attribute.Int("bytes", buf.Len()))
+	tracing.InjectHTTP(ctx, req.Header)
+	req = req.WithContext(ctx)
 
-	return withCancel(ctx, c.client, req, func(resp *http.Response) error {
+	err := withCancel(ctx, c.client, req, func(resp *http.Response) error {
 		defer func() {
 			if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
-				log.Printf("error copying body: %v", err)
+				level.Error(c.logger).Log("msg", "unable to read response body", "err", err)
 			}
 			resp.Body.Close()
 		}()
@@ -136,24 +261,26 @@ func (c *Client) Send(ctx context.Context, req *http.Request, families []*client
 			gaugeRequestSend.WithLabelValues(c.metricsName, "200").Inc()
 		case http.StatusUnauthorized:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "401").Inc()
-			return fmt.Errorf("gateway server requires authentication: %s", resp.Request.URL)
+			return newStatusError(resp, "gateway server requires authentication: %s", resp.Request.URL)
 		case http.StatusForbidden:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "403").Inc()
-			return fmt.Errorf("gateway server forbidden: %s", resp.Request.URL)
+			return newStatusError(resp, "gateway server forbidden: %s", resp.Request.URL)
 		case http.StatusBadRequest:
 			gaugeRequestSend.WithLabelValues(c.metricsName, "400").Inc()
-			return fmt.Errorf("gateway server bad request: %s", resp.Request.URL)
+			return newStatusError(resp, "gateway server bad request: %s", resp.Request.URL)
 		default:
 			gaugeRequestSend.WithLabelValues(c.metricsName, strconv.Itoa(resp.StatusCode)).Inc()
 			body, _ := ioutil.ReadAll(resp.Body)
 			if len(body) > 1024 {
 				body = body[:1024]
 			}
-			return fmt.Errorf("gateway server reported unexpected error code: %d: %s", resp.StatusCode, string(body))
+			return newStatusError(resp, "gateway server reported unexpected error code: %d: %s", resp.StatusCode, string(body))
 		}
 
 		return nil
 	})
+	tracing.Finish(span, err)
+	return err
 }
 
 func Read(r io.Reader) ([]*clientmodel.MetricFamily, error) {
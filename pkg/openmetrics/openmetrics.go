@@ -0,0 +1,224 @@
+// Package openmetrics encodes and decodes metric families in the OpenMetrics
+// text format, which the vendored expfmt package does not support.
+package openmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	// ContentType is the media type of the OpenMetrics text format.
+	ContentType = "application/openmetrics-text"
+
+	// FmtOpenMetrics is the Content-Type of the OpenMetrics text format.
+	FmtOpenMetrics expfmt.Format = ContentType + "; version=1.0.0; charset=utf-8"
+)
+
+var (
+	escaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	typeNames = map[clientmodel.MetricType]string{
+		clientmodel.MetricType_COUNTER:   "counter",
+		clientmodel.MetricType_GAUGE:     "gauge",
+		clientmodel.MetricType_SUMMARY:   "summary",
+		clientmodel.MetricType_UNTYPED:   "unknown",
+		clientmodel.MetricType_HISTOGRAM: "histogram",
+	}
+)
+
+// Negotiate returns FmtOpenMetrics if the Accept header of a request prefers it
+// over the other formats, and the format negotiated by expfmt otherwise.
+func Negotiate(h http.Header) expfmt.Format {
+	var openMetrics, other float64
+	for _, accept := range strings.Split(h.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if mediaType == ContentType {
+			openMetrics = math.Max(openMetrics, q)
+		} else {
+			other = math.Max(other, q)
+		}
+	}
+	if openMetrics > 0 && openMetrics >= other {
+		return FmtOpenMetrics
+	}
+	return expfmt.Negotiate(h)
+}
+
+// ResponseFormat returns FmtOpenMetrics if the Content-Type header of a request
+// or response is the OpenMetrics text format, and the format determined by
+// expfmt otherwise.
+func ResponseFormat(h http.Header) expfmt.Format {
+	if mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil && mediaType == ContentType {
+		return FmtOpenMetrics
+	}
+	return expfmt.ResponseFormat(h)
+}
+
+// NewEncoder returns an encoder for the given format. Unlike the other formats,
+// the OpenMetrics text format must be terminated by calling WriteEOF once all
+// families have been encoded.
+func NewEncoder(w io.Writer, format expfmt.Format) expfmt.Encoder {
+	if format != FmtOpenMetrics {
+		return expfmt.NewEncoder(w, format)
+	}
+	return encoder{w: w}
+}
+
+// WriteEOF terminates an exposition in the OpenMetrics text format.
+func WriteEOF(w io.Writer) error {
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+type encoder struct {
+	w io.Writer
+}
+
+func (e encoder) Encode(family *clientmodel.MetricFamily) error {
+	w := bufio.NewWriter(e.w)
+	if err := writeFamily(w, family); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeFamily writes the given family in the OpenMetrics text format.
+// Counters are exposed without their _total suffix in the metadata and
+// with it in the samples, as the format requires.
+func writeFamily(w *bufio.Writer, family *clientmodel.MetricFamily) error {
+	name := family.GetName()
+	if len(name) == 0 {
+		return fmt.Errorf("metric family has no name")
+	}
+	if len(family.Metric) == 0 {
+		return fmt.Errorf("metric family %s has no metrics", name)
+	}
+	typ, ok := typeNames[family.GetType()]
+	if !ok {
+		return fmt.Errorf("metric family %s has unsupported type %s", name, family.GetType())
+	}
+	if family.GetType() == clientmodel.MetricType_COUNTER {
+		name = strings.TrimSuffix(name, "_total")
+	}
+
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	if family.Help != nil {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escaper.Replace(family.GetHelp()))
+	}
+
+	for _, m := range family.Metric {
+		if m == nil {
+			continue
+		}
+		switch family.GetType() {
+		case clientmodel.MetricType_COUNTER:
+			if m.Counter == nil {
+				return fmt.Errorf("expected counter in metric %s %s", name, m)
+			}
+			writeSample(w, name+"_total", m, "", "", m.Counter.GetValue())
+		case clientmodel.MetricType_GAUGE:
+			if m.Gauge == nil {
+				return fmt.Errorf("expected gauge in metric %s %s", name, m)
+			}
+			writeSample(w, name, m, "", "", m.Gauge.GetValue())
+		case clientmodel.MetricType_UNTYPED:
+			if m.Untyped == nil {
+				return fmt.Errorf("expected untyped in metric %s %s", name, m)
+			}
+			writeSample(w, name, m, "", "", m.Untyped.GetValue())
+		case clientmodel.MetricType_SUMMARY:
+			if m.Summary == nil {
+				return fmt.Errorf("expected summary in metric %s %s", name, m)
+			}
+			for _, q := range m.Summary.Quantile {
+				writeSample(w, name, m, "quantile", formatFloat(q.GetQuantile()), q.GetValue())
+			}
+			writeSample(w, name+"_sum", m, "", "", m.Summary.GetSampleSum())
+			writeSample(w, name+"_count", m, "", "", float64(m.Summary.GetSampleCount()))
+		case clientmodel.MetricType_HISTOGRAM:
+			if m.Histogram == nil {
+				return fmt.Errorf("expected histogram in metric %s %s", name, m)
+			}
+			// The +Inf bucket is mandatory in OpenMetrics.
+			buckets := append([]*clientmodel.Bucket(nil), m.Histogram.Bucket...)
+			sort.Slice(buckets, func(i, j int) bool { return buckets[i].GetUpperBound() < buckets[j].GetUpperBound() })
+			if n := len(buckets); n == 0 || !math.IsInf(buckets[n-1].GetUpperBound(), 1) {
+				count := m.Histogram.GetSampleCount()
+				buckets = append(buckets, &clientmodel.Bucket{UpperBound: floatPtr(math.Inf(1)), CumulativeCount: &count})
+			}
+			for _, b := range buckets {
+				writeSample(w, name+"_bucket", m, "le", formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+			}
+			writeSample(w, name+"_sum", m, "", "", m.Histogram.GetSampleSum())
+			writeSample(w, name+"_count", m, "", "", float64(m.Histogram.GetSampleCount()))
+		}
+	}
+	return nil
+}
+
+// writeSample writes a sample line with the labels of the given metric,
+// an optional additional label, and the timestamp of the metric in seconds.
+func writeSample(w *bufio.Writer, name string, m *clientmodel.Metric, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(m.Label) > 0 || len(extraName) > 0 {
+		w.WriteByte('{')
+		sep := ""
+		for _, l := range m.Label {
+			if l == nil {
+				continue
+			}
+			fmt.Fprintf(w, `%s%s="%s"`, sep, l.GetName(), escaper.Replace(l.GetValue()))
+			sep = ","
+		}
+		if len(extraName) > 0 {
+			fmt.Fprintf(w, `%s%s="%s"`, sep, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	if m.TimestampMs != nil {
+		w.WriteByte(' ')
+		w.WriteString(formatTimestamp(m.GetTimestampMs()))
+	}
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// formatTimestamp formats a timestamp in milliseconds as seconds.
+func formatTimestamp(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
+
+func floatPtr(f float64) *float64 { return &f }
@@ -0,0 +1,171 @@
+package openmetrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "counter with created and exemplar",
+			input: `# TYPE requests counter
+# HELP requests Requests with "quotes" and \\ backslash.
+requests_total{code="200",path="/a # b"} 10 1520879607.789 # {trace_id="abc"} 1 1520879607.7
+requests_created{code="200",path="/a # b"} 1520000000
+# EOF
+`,
+			want: `# HELP requests_total Requests with "quotes" and \\ backslash.
+# TYPE requests_total counter
+requests_total{code="200",path="/a # b"} 10 1520879607789
+`,
+		},
+		{
+			name: "histogram, unknown and info",
+			input: `# TYPE latency histogram
+latency_bucket{le="1.0"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 3
+latency_count 2
+latency_created 1520000000
+# TYPE other unknown
+other 1
+# TYPE build info
+build_info{version="1"} 1
+# EOF
+`,
+			want: `# TYPE build_info untyped
+build_info{version="1"} 1
+# TYPE latency histogram
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 3
+latency_count 2
+# TYPE other untyped
+other 1
+`,
+		},
+		{
+			name:    "missing EOF",
+			input:   "# TYPE up gauge\nup 1\n",
+			wantErr: "missing # EOF",
+		},
+		{
+			name:    "content after EOF",
+			input:   "# TYPE up gauge\n# EOF\nup 1\n",
+			wantErr: "unexpected content after # EOF",
+		},
+		{
+			name:    "invalid timestamp",
+			input:   "up 1 abc\n# EOF\n",
+			wantErr: `invalid timestamp "abc"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			families, err := Parse(strings.NewReader(tc.input))
+			if len(tc.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			for _, family := range families {
+				if _, err := expfmt.MetricFamilyToText(buf, family); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var parser expfmt.TextParser
+	byName, err := parser.TextToMetricFamilies(strings.NewReader(`# HELP requests_total Total "requests".
+# TYPE requests_total counter
+requests_total{code="200"} 10 1520879607789
+requests_total{code="500"} 1 1520879607000
+# TYPE temperature gauge
+temperature -1.5
+# TYPE latency histogram
+latency_bucket{le="0.5"} 1
+latency_sum 0.25
+latency_count 3
+# TYPE rpc summary
+rpc{quantile="0.5"} 0.1
+rpc_sum 1
+rpc_count 4
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := NewEncoder(buf, FmtOpenMetrics)
+	for _, name := range []string{"latency", "requests_total", "rpc", "temperature"} {
+		if err := encoder.Encode(byName[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteEOF(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "# TYPE requests counter\n") || !strings.Contains(buf.String(), `latency_bucket{le="+Inf"} 3`) {
+		t.Errorf("unexpected encoding:\n%s", buf)
+	}
+
+	decoder := NewDecoder(buf, FmtOpenMetrics)
+	for _, name := range []string{"latency", "requests_total", "rpc", "temperature"} {
+		family := &clientmodel.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			t.Fatal(err)
+		}
+		want := byName[name]
+		if name == "latency" {
+			// The +Inf bucket is added when encoding.
+			want.Metric[0].Histogram.Bucket = append(want.Metric[0].Histogram.Bucket, &clientmodel.Bucket{
+				UpperBound:      proto.Float64(math.Inf(1)),
+				CumulativeCount: proto.Uint64(3),
+			})
+		}
+		if !proto.Equal(family, want) {
+			t.Errorf("expected %s to round trip, got %v", want, family)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   expfmt.Format
+	}{
+		{accept: "", want: expfmt.FmtText},
+		{accept: "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", want: FmtOpenMetrics},
+		{accept: "application/openmetrics-text;q=0.3,text/plain;version=0.0.4", want: expfmt.FmtText},
+		{accept: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited", want: expfmt.FmtProtoDelim},
+	} {
+		h := http.Header{}
+		h.Set("Accept", tc.accept)
+		if got := Negotiate(h); got != tc.want {
+			t.Errorf("%q: expected %s, got %s", tc.accept, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package openmetrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// helpEscaper escapes help in the classic text format, which does not escape double quotes.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// NewDecoder returns a decoder for the given format.
+func NewDecoder(r io.Reader, format expfmt.Format) expfmt.Decoder {
+	if format != FmtOpenMetrics {
+		return expfmt.NewDecoder(r, format)
+	}
+	return &decoder{r: r}
+}
+
+type decoder struct {
+	r        io.Reader
+	families []*clientmodel.MetricFamily
+	err      error
+	parsed   bool
+}
+
+// Decode reads the whole input on the first call and returns the parsed
+// families one by one, sorted by name.
+func (d *decoder) Decode(v *clientmodel.MetricFamily) error {
+	if !d.parsed {
+		d.parsed = true
+		d.families, d.err = Parse(d.r)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.families) == 0 {
+		return io.EOF
+	}
+	*v = *d.families[0]
+	d.families = d.families[1:]
+	return nil
+}
+
+// Parse reads metric families in the OpenMetrics text format, sorted by name.
+// The input must be terminated by "# EOF".
+//
+// Information that has no equivalent in the metric families is dropped: the
+// _created samples of counters, summaries and histograms, exemplars and units.
+// Info, stateset and gaugehistogram families become untyped families, one per
+// sample name.
+func Parse(r io.Reader) ([]*clientmodel.MetricFamily, error) {
+	text, err := toText(r)
+	if err != nil {
+		return nil, err
+	}
+	var parser expfmt.TextParser
+	byName, err := parser.TextToMetricFamilies(bytes.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	families := make([]*clientmodel.MetricFamily, 0, len(byName))
+	for _, family := range byName {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, nil
+}
+
+// toText rewrites the OpenMetrics text format into the classic Prometheus text format.
+func toText(r io.Reader) ([]byte, error) {
+	var (
+		out     bytes.Buffer
+		name    string // name of the current family
+		typ     string // type of the current family
+		help    string // help of the current family
+		pending bool   // whether the metadata of the current family is not written yet
+		eof     bool
+	)
+	// flush writes the metadata of the current family, once its type is known.
+	// Counters are named with their _total suffix in the classic format.
+	flush := func() {
+		if !pending {
+			return
+		}
+		pending = false
+		classicName := name
+		if typ == "counter" {
+			classicName += "_total"
+		}
+		if len(help) > 0 {
+			fmt.Fprintf(&out, "# HELP %s %s\n", classicName, helpEscaper.Replace(help))
+		}
+		switch typ {
+		case "counter", "gauge", "summary", "histogram":
+			fmt.Fprintf(&out, "# TYPE %s %s\n", classicName, typ)
+		case "unknown":
+			fmt.Fprintf(&out, "# TYPE %s untyped\n", classicName)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if eof {
+			return nil, fmt.Errorf("line %d: unexpected content after # EOF", n)
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		if len(line) == 0 {
+			return nil, fmt.Errorf("line %d: empty lines are not allowed", n)
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 || fields[0] != "#" {
+				return nil, fmt.Errorf("line %d: invalid metadata %q", n, line)
+			}
+			if fields[2] != name {
+				flush()
+				name, typ, help = fields[2], "", ""
+			}
+			pending = true
+			switch fields[1] {
+			case "TYPE":
+				if len(fields) != 4 {
+					return nil, fmt.Errorf("line %d: invalid TYPE %q", n, line)
+				}
+				switch typ = fields[3]; typ {
+				case "counter", "gauge", "summary", "histogram", "unknown":
+				case "info", "stateset", "gaugehistogram":
+					// Not representable, the samples become untyped.
+				default:
+					return nil, fmt.Errorf("line %d: unknown type %q", n, typ)
+				}
+			case "HELP":
+				if len(fields) == 4 {
+					help = unescape(fields[3])
+				}
+			case "UNIT":
+			default:
+				return nil, fmt.Errorf("line %d: invalid metadata %q", n, line)
+			}
+			continue
+		}
+
+		flush()
+		sample, err := convertSample(line, name, typ)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if len(sample) > 0 {
+			out.WriteString(sample)
+			out.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !eof {
+		return nil, fmt.Errorf("missing # EOF")
+	}
+	flush()
+	return out.Bytes(), nil
+}
+
+// unescape resolves the escape sequences of OpenMetrics metadata.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// convertSample rewrites a sample line of the given family into the classic
+// text format, dropping exemplars and converting the timestamp from seconds to
+// milliseconds. It returns an empty line for samples that are dropped.
+func convertSample(line, family, typ string) (string, error) {
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return "", fmt.Errorf("invalid sample %q", line)
+	}
+	name := line[:end]
+	if line[end] == '{' {
+		i, err := labelsEnd(line, end)
+		if err != nil {
+			return "", err
+		}
+		end = i
+	}
+	switch typ {
+	case "counter", "summary", "histogram":
+		if name == family+"_created" {
+			return "", nil
+		}
+	}
+
+	rest := line[end:]
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 1:
+		return line[:end] + " " + fields[0], nil
+	case 2:
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return "", fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		ms := int64(math.Round(seconds * 1000))
+		return line[:end] + " " + fields[0] + " " + strconv.FormatInt(ms, 10), nil
+	default:
+		return "", fmt.Errorf("invalid sample %q", line)
+	}
+}
+
+// labelsEnd returns the index after the closing brace of the label set
+// starting at the given index, skipping quoted label values.
+func labelsEnd(line string, start int) (int, error) {
+	quoted := false
+	for i := start + 1; i < len(line); i++ {
+		switch c := line[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '}':
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated label set in %q", line)
+}
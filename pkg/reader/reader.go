@@ -3,6 +3,7 @@ package reader
 import (
 	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 type limitReadCloser struct {
@@ -48,3 +49,21 @@ func (l *LimitedReader) Read(p []byte) (n int, err error) {
 	l.N -= int64(n)
 	return
 }
+
+// CountingReader reads from R and counts the bytes read.
+// The count can be read concurrently with reading.
+type CountingReader struct {
+	R io.Reader // underlying reader
+	n int64
+}
+
+func (c *CountingReader) Read(p []byte) (n int, err error) {
+	n, err = c.R.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return
+}
+
+// Count returns the number of bytes read so far.
+func (c *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
@@ -1,16 +1,23 @@
 package memstore
 
 import (
+	"container/heap"
 	"context"
+	"errors"
+	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/golang/protobuf/proto"
 	"github.com/openshift/telemeter/pkg/store"
 	"github.com/prometheus/client_golang/prometheus"
 	clientmodel "github.com/prometheus/client_model/go"
 
+	"github.com/openshift/telemeter/pkg/logging"
 	"github.com/openshift/telemeter/pkg/metricfamily"
 )
 
@@ -34,6 +41,26 @@ var (
 		Name: "telemeter_samples_total",
 		Help: "Tracks the number of samples processed by this server.",
 	})
+
+	series = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_series",
+		Help: "Tracks the current amount of stored series.",
+	})
+
+	storedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "telemeter_stored_bytes",
+		Help: "Tracks the current size of the stored families in bytes.",
+	})
+
+	evictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_evictions_total",
+		Help: "Tracks the number of partitions evicted to make room for writes, by eviction policy.",
+	}, []string{"policy"})
+
+	storeFullTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telemeter_store_full_total",
+		Help: "Tracks the number of writes rejected because the store was full.",
+	})
 )
 
 func init() {
@@ -41,23 +68,125 @@ func init() {
 	prometheus.MustRegister(partitions)
 	prometheus.MustRegister(cleanupsTotal)
 	prometheus.MustRegister(samplesTotal)
+	prometheus.MustRegister(series)
+	prometheus.MustRegister(storedBytes)
+	prometheus.MustRegister(evictionsTotal)
+	prometheus.MustRegister(storeFullTotal)
+}
+
+// ErrStoreFull is returned when a write does not fit within the limits of the
+// store and no partition could be evicted to make room for it.
+var ErrStoreFull = errors.New("store is full")
+
+// Limits bounds the contents of the store. Zero means no limit.
+type Limits struct {
+	Partitions int64
+	Series     int64
+	Bytes      int64
+}
+
+// EvictionPolicy selects the partitions to evict when a write does not fit
+// within the limits of the store.
+type EvictionPolicy string
+
+const (
+	// EvictNone rejects writes that do not fit with ErrStoreFull.
+	EvictNone EvictionPolicy = "none"
+	// EvictOldest evicts the partitions with the oldest samples first.
+	EvictOldest EvictionPolicy = "oldest"
+	// EvictLRU evicts the least recently written partitions first.
+	EvictLRU EvictionPolicy = "lru"
+)
+
+// ParseEvictionPolicy returns the eviction policy with the given name.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch policy := EvictionPolicy(name); policy {
+	case EvictNone, EvictOldest, EvictLRU:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown eviction policy %q, must be one of none, oldest or lru", name)
+	}
 }
 
 type clusterMetricSlice struct {
-	newest   int64
-	families []*clientmodel.MetricFamily
+	partitionKey string
+	// index is the position of the slice in the eviction queue.
+	index     int
+	newest    int64
+	oldest    int64
+	cache     *store.EncodingCache
+	lastWrite time.Time
+	sequence  uint64
+	series    int64
+	bytes     int64
+	families  []*clientmodel.MetricFamily
+}
+
+// evictionQueue is a heap of the stored partitions, ordered by the eviction
+// policy so that the partition to evict first is at its root.
+type evictionQueue struct {
+	policy EvictionPolicy
+	slices []*clusterMetricSlice
+}
+
+func (q *evictionQueue) Len() int { return len(q.slices) }
+
+func (q *evictionQueue) Less(i, j int) bool {
+	if q.policy == EvictOldest {
+		return q.slices[i].newest < q.slices[j].newest
+	}
+	return q.slices[i].lastWrite.Before(q.slices[j].lastWrite)
+}
+
+func (q *evictionQueue) Swap(i, j int) {
+	q.slices[i], q.slices[j] = q.slices[j], q.slices[i]
+	q.slices[i].index = i
+	q.slices[j].index = j
+}
+
+func (q *evictionQueue) Push(x interface{}) {
+	slice := x.(*clusterMetricSlice)
+	slice.index = len(q.slices)
+	q.slices = append(q.slices, slice)
+}
+
+func (q *evictionQueue) Pop() interface{} {
+	n := len(q.slices) - 1
+	slice := q.slices[n]
+	q.slices[n] = nil
+	q.slices = q.slices[:n]
+	return slice
 }
 
 type memoryStore struct {
-	ttl   time.Duration
-	mu    sync.RWMutex
-	store map[string]*clusterMetricSlice
+	logger log.Logger
+	ttl    time.Duration
+	limits Limits
+	policy EvictionPolicy
+
+	mu     sync.RWMutex // protects fields below
+	store  map[string]*clusterMetricSlice
+	queue  evictionQueue
+	series int64
+	bytes  int64
 }
 
 func New(ttl time.Duration) *memoryStore {
+	return NewLimited(nil, ttl, Limits{}, EvictNone)
+}
+
+// NewLimited returns a store holding at most the given number of partitions,
+// series and bytes. Writes that would exceed a limit evict other partitions
+// according to the given policy or, if none can be evicted, are rejected
+// with ErrStoreFull.
+func NewLimited(logger log.Logger, ttl time.Duration, limits Limits, policy EvictionPolicy) *memoryStore {
 	return &memoryStore{
-		ttl:   ttl,
-		store: make(map[string]*clusterMetricSlice),
+		logger: log.With(logging.OrNop(logger), "component", "memstore"),
+		ttl:    ttl,
+		limits: limits,
+		policy: policy,
+		store:  make(map[string]*clusterMetricSlice),
+		queue:  evictionQueue{policy: policy},
 	}
 }
 
@@ -88,13 +217,64 @@ func (s *memoryStore) cleanup(now time.Time) {
 		ttlTimestampMs := now.Add(-s.ttl).UnixNano() / int64(time.Millisecond)
 
 		if slice.newest < ttlTimestampMs {
-			families.WithLabelValues(partitionKey).Set(0)
-			delete(s.store, partitionKey)
+			level.Debug(s.logger).Log("msg", "removing expired partition", "partition", partitionKey)
+			s.remove(partitionKey)
 		}
 	}
 
 	cleanupsTotal.Inc()
+	s.updateGauges()
+}
+
+// remove deletes the given partition from the store.
+// The caller must hold the lock.
+func (s *memoryStore) remove(partitionKey string) {
+	slice, ok := s.store[partitionKey]
+	if !ok {
+		return
+	}
+	families.DeleteLabelValues(partitionKey)
+	s.series -= slice.series
+	s.bytes -= slice.bytes
+	heap.Remove(&s.queue, slice.index)
+	delete(s.store, partitionKey)
+}
+
+// updateGauges reports the current size of the store.
+// The caller must hold the lock.
+func (s *memoryStore) updateGauges() {
 	partitions.Set(float64(len(s.store)))
+	series.Set(float64(s.series))
+	storedBytes.Set(float64(s.bytes))
+}
+
+// fits returns true if the store stays within its limits after adding the
+// given number of partitions, series and bytes.
+// The caller must hold the lock.
+func (s *memoryStore) fits(partitions, series, bytes int64) bool {
+	return (s.limits.Partitions <= 0 || int64(len(s.store))+partitions <= s.limits.Partitions) &&
+		(s.limits.Series <= 0 || s.series+series <= s.limits.Series) &&
+		(s.limits.Bytes <= 0 || s.bytes+bytes <= s.limits.Bytes)
+}
+
+// victim returns the partition to evict first according to the eviction policy,
+// other than the given partition, or false if there is none.
+// The caller must hold the lock.
+func (s *memoryStore) victim(except string) (string, bool) {
+	q := s.queue.slices
+	switch {
+	case len(q) == 0:
+		return "", false
+	case q[0].partitionKey != except:
+		return q[0].partitionKey, true
+	case len(q) == 1:
+		return "", false
+	case len(q) == 2 || s.queue.Less(1, 2):
+		// The next partition to evict is one of the children of the root.
+		return q[1].partitionKey, true
+	default:
+		return q[2].partitionKey, true
+	}
 }
 
 func (s *memoryStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
@@ -123,35 +303,183 @@ func (s *memoryStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]
 	return result, nil
 }
 
+// StreamMetrics calls fn for every partition with samples newer than minTimestampMs,
+// without copying the families. The partitions are collected under a read lock
+// that is released before fn is called, so slow readers do not block writes.
+// This is safe because a write replaces the families and the cache of its
+// partition rather than modifying them.
+func (s *memoryStore) StreamMetrics(ctx context.Context, minTimestampMs int64, fn func(*store.StreamedPartition) error) error {
+	s.mu.RLock()
+	partitions := make([]*store.StreamedPartition, 0, len(s.store))
+	for partitionKey, slice := range s.store {
+		if slice.newest < minTimestampMs {
+			continue
+		}
+		partitions = append(partitions, &store.StreamedPartition{
+			PartitionKey:      partitionKey,
+			Families:          slice.families,
+			OldestTimestampMs: slice.oldest,
+			Cache:             slice.cache,
+		})
+	}
+	s.mu.RUnlock()
+
+	for _, p := range partitions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListPartitions returns a summary of every stored partition, sorted by key.
+func (s *memoryStore) ListPartitions(ctx context.Context) ([]*store.PartitionInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	infos := make([]*store.PartitionInfo, 0, len(s.store))
+	for partitionKey, slice := range s.store {
+		info := store.Summarize(partitionKey, slice.families)
+		info.LastWrite = slice.lastWrite
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].PartitionKey < infos[j].PartitionKey })
+	return infos, nil
+}
+
+// GetPartition returns a copy of the metrics of the given partition, or nil if it is not stored.
+func (s *memoryStore) GetPartition(ctx context.Context, partitionKey string) (*store.PartitionedMetrics, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	slice, ok := s.store[partitionKey]
+	if !ok {
+		return nil, nil
+	}
+	families := make([]*clientmodel.MetricFamily, 0, len(slice.families))
+	for i := range slice.families {
+		families = append(families, proto.Clone(slice.families[i]).(*clientmodel.MetricFamily))
+	}
+	return &store.PartitionedMetrics{
+		PartitionKey: partitionKey,
+		Families:     families,
+	}, nil
+}
+
+// DeletePartition removes the given partition and returns true if it was stored.
+func (s *memoryStore) DeletePartition(ctx context.Context, partitionKey string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store[partitionKey]; !ok {
+		return false, nil
+	}
+	s.remove(partitionKey)
+	s.updateGauges()
+	return true, nil
+}
+
+// WriteMetrics replaces the metrics of the partition. Delta writes are applied
+// to the stored metrics instead, if they were last written by the base of the
+// delta, and fail with store.ErrSequenceMismatch otherwise.
 func (s *memoryStore) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
-	if p == nil || len(p.Families) == 0 {
+	if p == nil || len(p.Families) == 0 && p.Delta == nil {
 		return nil
 	}
 
+	return s.writeMetrics(p, time.Now())
+}
+
+// size returns the number of series and the size in bytes of the given families.
+func size(families []*clientmodel.MetricFamily) (series, bytes int64) {
+	for _, family := range families {
+		if family != nil {
+			bytes += int64(proto.Size(family))
+		}
+	}
+	return int64(metricfamily.MetricsCount(families)), bytes
+}
+
+func (s *memoryStore) writeMetrics(p *store.PartitionedMetrics, now time.Time) error {
+	stored := p.Families
+	var writeSeries, writeBytes int64
+	if p.Delta == nil {
+		writeSeries, writeBytes = size(stored)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	m, ok := s.store[p.PartitionKey]
+	if p.Delta != nil {
+		if !ok || m.sequence == 0 || m.sequence != p.Delta.BaseSequence {
+			return store.ErrSequenceMismatch
+		}
+		stored = metricfamily.ApplyDelta(m.families, p.Families, p.Delta.TimestampMs)
+		writeSeries, writeBytes = size(stored)
+	}
+
+	// A write replaces the previous families of its partition, so only the
+	// difference counts against the limits.
+	// A write that would not fit even on its own is rejected without
+	// evicting anything. A single partition always fits a partition limit.
+	if s.limits.Series > 0 && writeSeries > s.limits.Series || s.limits.Bytes > 0 && writeBytes > s.limits.Bytes {
+		storeFullTotal.Inc()
+		return ErrStoreFull
+	}
+	var newPartitions, newSeries, newBytes int64 = 1, writeSeries, writeBytes
+	if ok {
+		newPartitions, newSeries, newBytes = 0, writeSeries-m.series, writeBytes-m.bytes
+	}
+	for !s.fits(newPartitions, newSeries, newBytes) {
+		victim, found := s.victim(p.PartitionKey)
+		if s.policy == EvictNone || !found {
+			storeFullTotal.Inc()
+			return ErrStoreFull
+		}
+		level.Debug(s.logger).Log("msg", "evicting partition", "partition", victim, "policy", s.policy, "for", p.PartitionKey)
+		s.remove(victim)
+		evictionsTotal.WithLabelValues(string(s.policy)).Inc()
+	}
 
 	if !ok {
-		m = &clusterMetricSlice{}
+		m = &clusterMetricSlice{partitionKey: p.PartitionKey}
 		s.store[p.PartitionKey] = m
 	}
+	s.series += newSeries
+	s.bytes += newBytes
+	m.series = writeSeries
+	m.bytes = writeBytes
+	m.lastWrite = now
+	m.sequence = p.Sequence
 
 	m.newest = math.MinInt64
-	for i := range p.Families {
-		for j := range p.Families[i].Metric {
-			cur := p.Families[i].Metric[j].GetTimestampMs()
+	m.oldest = math.MaxInt64
+	for i := range stored {
+		for j := range stored[i].Metric {
+			cur := stored[i].Metric[j].GetTimestampMs()
 			if cur > m.newest {
 				m.newest = cur
 			}
+			if cur < m.oldest {
+				m.oldest = cur
+			}
 		}
 	}
 
-	m.families = p.Families
+	m.families = stored
+	m.cache = &store.EncodingCache{}
+	if ok {
+		heap.Fix(&s.queue, m.index)
+	} else {
+		heap.Push(&s.queue, m)
+	}
 
-	partitions.Set(float64(len(s.store)))
-	families.WithLabelValues(p.PartitionKey).Set(float64(len(p.Families)))
+	s.updateGauges()
+	families.WithLabelValues(p.PartitionKey).Set(float64(len(stored)))
 	samplesTotal.Add(float64(metricfamily.MetricsCount(p.Families)))
 
 	return nil
@@ -4,12 +4,12 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
-	"reflect"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/openshift/telemeter/pkg/store"
 	dto "github.com/prometheus/client_model/go"
@@ -56,6 +56,20 @@ func TestCleanup(t *testing.T) {
 		}
 	}
 
+	// The families gauge of removed partitions must be deleted, so that
+	// partitions are not exported forever.
+	familyGauges := func(want int) checkFunc {
+		return func(_ []*store.PartitionedMetrics, _ *memoryStore) error {
+			ch := make(chan prometheus.Metric, 10)
+			families.Collect(ch)
+			close(ch)
+			if got := len(ch); got != want {
+				return fmt.Errorf("want %d families gauges, got %d", want, got)
+			}
+			return nil
+		}
+	}
+
 	data := []*store.PartitionedMetrics{
 		partitionedMetrics{
 			partitionKey: "p1",
@@ -84,6 +98,7 @@ func TestCleanup(t *testing.T) {
 			check: checks(
 				metricCountIs(200), // 10 families * 10 values * 2 partitions
 				storedPartitions("p1", "p2"),
+				familyGauges(2),
 			),
 		},
 		{
@@ -93,6 +108,7 @@ func TestCleanup(t *testing.T) {
 			check: checks(
 				metricCountIs(100), // 10 families * 10 values * 1 partitions
 				storedPartitions("p2"),
+				familyGauges(1),
 			),
 		},
 		{
@@ -101,6 +117,7 @@ func TestCleanup(t *testing.T) {
 			now: time.Time{}.Add(81 * time.Minute),
 			check: checks(
 				metricCountIs(0), // all cleaned up
+				familyGauges(0),
 			),
 		},
 	} {
@@ -145,7 +162,15 @@ func TestReadWriteMetrics(t *testing.T) {
 
 	deepEquals := func(want []*store.PartitionedMetrics) checkFunc {
 		return func(got []*store.PartitionedMetrics, _ error) error {
-			if !reflect.DeepEqual(want, got) {
+			// Compare families with proto.Equal, since encoding them caches their size.
+			equal := len(want) == len(got)
+			for i := 0; equal && i < len(want); i++ {
+				equal = want[i].PartitionKey == got[i].PartitionKey && len(want[i].Families) == len(got[i].Families)
+				for j := 0; equal && j < len(want[i].Families); j++ {
+					equal = proto.Equal(want[i].Families[j], got[i].Families[j])
+				}
+			}
+			if !equal {
 				return fmt.Errorf("want written metrics to be %v, got %v", want, got)
 
 			}
@@ -254,6 +279,255 @@ func TestReadWriteMetrics(t *testing.T) {
 	}
 }
 
+func TestLimits(t *testing.T) {
+	type write struct {
+		partitionKey string
+		start        time.Time
+		// values is the number of series written, 2 if zero.
+		values      int
+		expectedErr error
+	}
+
+	for _, tc := range []struct {
+		name               string
+		limits             Limits
+		policy             EvictionPolicy
+		writes             []write
+		expectedPartitions []string
+		// expectedSeries is 2 per expected partition if zero.
+		expectedSeries int64
+	}{
+		{
+			name:   "writes beyond the limits are rejected",
+			limits: Limits{Series: 4},
+			policy: EvictNone,
+			writes: []write{
+				{partitionKey: "p1"},
+				{partitionKey: "p2"},
+				{partitionKey: "p3", expectedErr: ErrStoreFull},
+				{partitionKey: "p1"},
+			},
+			expectedPartitions: []string{"p1", "p2"},
+		},
+		{
+			name:   "partition with the oldest samples is evicted",
+			limits: Limits{Series: 4},
+			policy: EvictOldest,
+			writes: []write{
+				{partitionKey: "p1"},
+				{partitionKey: "p2", start: time.Time{}.Add(time.Hour)},
+				{partitionKey: "p1"},
+				{partitionKey: "p3"},
+			},
+			expectedPartitions: []string{"p2", "p3"},
+		},
+		{
+			name:   "least recently written partition is evicted",
+			limits: Limits{Series: 4},
+			policy: EvictLRU,
+			writes: []write{
+				{partitionKey: "p1"},
+				{partitionKey: "p2", start: time.Time{}.Add(time.Hour)},
+				{partitionKey: "p1"},
+				{partitionKey: "p3"},
+			},
+			expectedPartitions: []string{"p1", "p3"},
+		},
+		{
+			name:   "partitions are limited",
+			limits: Limits{Partitions: 1},
+			policy: EvictLRU,
+			writes: []write{
+				{partitionKey: "p1"},
+				{partitionKey: "p2"},
+			},
+			expectedPartitions: []string{"p2"},
+		},
+		{
+			name:   "write larger than the limits is rejected",
+			limits: Limits{Bytes: 10},
+			policy: EvictLRU,
+			writes: []write{
+				{partitionKey: "p1", expectedErr: ErrStoreFull},
+			},
+		},
+		{
+			name:   "write larger than the limits does not evict other partitions",
+			limits: Limits{Series: 4},
+			policy: EvictLRU,
+			writes: []write{
+				{partitionKey: "p1"},
+				{partitionKey: "p2"},
+				{partitionKey: "p3", values: 5, expectedErr: ErrStoreFull},
+			},
+			expectedPartitions: []string{"p1", "p2"},
+		},
+		{
+			name:   "partition being written is not evicted",
+			limits: Limits{Series: 4},
+			policy: EvictLRU,
+			writes: []write{
+				{partitionKey: "p1"},
+				{partitionKey: "p2"},
+				{partitionKey: "p3", values: 3},
+			},
+			expectedPartitions: []string{"p3"},
+			expectedSeries:     3,
+		},
+		{
+			name:   "growing partition evicts the next partition",
+			limits: Limits{Series: 5},
+			policy: EvictLRU,
+			writes: []write{
+				{partitionKey: "p1"},
+				{partitionKey: "p2"},
+				{partitionKey: "p1", values: 3},
+				{partitionKey: "p3"},
+				{partitionKey: "p1", values: 4},
+			},
+			expectedPartitions: []string{"p1"},
+			expectedSeries:     4,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewLimited(nil, time.Hour, tc.limits, tc.policy)
+			now := time.Time{}.Add(time.Hour)
+
+			for _, w := range tc.writes {
+				now = now.Add(time.Second)
+				values := w.values
+				if values == 0 {
+					values = 2
+				}
+				p := partitionedMetrics{partitionKey: w.partitionKey, start: w.start, span: time.Minute, families: 1, values: values}.build()
+				if err := s.writeMetrics(p, now); err != w.expectedErr {
+					t.Fatalf("write of %s: want error %v, got %v", w.partitionKey, w.expectedErr, err)
+				}
+			}
+
+			if len(s.store) != len(tc.expectedPartitions) {
+				t.Errorf("want partitions %v, got %d partitions", tc.expectedPartitions, len(s.store))
+			}
+			for _, p := range tc.expectedPartitions {
+				if _, ok := s.store[p]; !ok {
+					t.Errorf("want store to have partition %q, but it doesn't", p)
+				}
+			}
+			want := tc.expectedSeries
+			if want == 0 {
+				want = int64(2 * len(tc.expectedPartitions))
+			}
+			if s.series != want {
+				t.Errorf("want %d series in store, got %d", want, s.series)
+			}
+		})
+	}
+}
+
+func TestDeltaWrites(t *testing.T) {
+	up := func(ts int64, values ...float64) []*dto.MetricFamily {
+		f := &dto.MetricFamily{Name: proto.String("up"), Type: dto.MetricType_GAUGE.Enum()}
+		for i, v := range values {
+			f.Metric = append(f.Metric, &dto.Metric{
+				Label:       []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(strconv.Itoa(i))}},
+				Gauge:       &dto.Gauge{Value: proto.Float64(v)},
+				TimestampMs: proto.Int64(ts),
+			})
+		}
+		return []*dto.MetricFamily{f}
+	}
+	s := New(time.Hour)
+	now := time.Time{}.Add(time.Hour)
+
+	for _, w := range []struct {
+		name        string
+		p           *store.PartitionedMetrics
+		expectedErr error
+	}{
+		{
+			name:        "delta of an unknown partition is rejected",
+			p:           &store.PartitionedMetrics{PartitionKey: "a", Sequence: 1, Delta: &store.Delta{BaseSequence: 1}},
+			expectedErr: store.ErrSequenceMismatch,
+		},
+		{
+			name: "full write",
+			p:    &store.PartitionedMetrics{PartitionKey: "a", Sequence: 1, Families: up(1000, 1, 1)},
+		},
+		{
+			name:        "delta of another write is rejected",
+			p:           &store.PartitionedMetrics{PartitionKey: "a", Sequence: 3, Families: up(2000, 0), Delta: &store.Delta{BaseSequence: 2, TimestampMs: 2000}},
+			expectedErr: store.ErrSequenceMismatch,
+		},
+		{
+			name: "delta write",
+			p:    &store.PartitionedMetrics{PartitionKey: "a", Sequence: 2, Families: up(2000, 0), Delta: &store.Delta{BaseSequence: 1, TimestampMs: 2000}},
+		},
+	} {
+		if err := s.writeMetrics(w.p, now); err != w.expectedErr {
+			t.Fatalf("%s: want error %v, got %v", w.name, w.expectedErr, err)
+		}
+	}
+
+	slice := s.store["a"]
+	if slice.sequence != 2 || slice.series != 2 || slice.oldest != 2000 {
+		t.Fatalf("want sequence 2 with 2 series refreshed to 2000, got %d with %d series since %d", slice.sequence, slice.series, slice.oldest)
+	}
+	want := make(map[string]*dto.Metric)
+	for _, m := range up(2000, 0, 1)[0].Metric {
+		want[m.Label[0].GetValue()] = m
+	}
+	for _, m := range slice.families[0].Metric {
+		if w := want[m.Label[0].GetValue()]; !proto.Equal(m, w) {
+			t.Errorf("want %v, got %v", w, m)
+		}
+	}
+
+	if err := s.writeMetrics(&store.PartitionedMetrics{PartitionKey: "a", Families: up(3000, 1)}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeMetrics(&store.PartitionedMetrics{PartitionKey: "a", Sequence: 3, Delta: &store.Delta{BaseSequence: 2}}, now); err != store.ErrSequenceMismatch {
+		t.Fatalf("want deltas after an unnumbered write to be rejected, got %v", err)
+	}
+}
+
+// TestStreamMetricsDoesNotBlockWrites tests that partitions can be written while
+// they are streamed, and that the streamed families are not affected by the write.
+func TestStreamMetricsDoesNotBlockWrites(t *testing.T) {
+	s := New(time.Hour)
+	now := time.Now()
+	write := func(ts time.Time) error {
+		return s.writeMetrics(partitionedMetrics{partitionKey: "a", start: ts, span: time.Second, families: 1, values: 2}.build(), now)
+	}
+	if err := write(now); err != nil {
+		t.Fatal(err)
+	}
+
+	var streamed int
+	err := s.StreamMetrics(context.Background(), 0, func(p *store.StreamedPartition) error {
+		streamed++
+		done := make(chan error, 1)
+		go func() { done <- write(now.Add(time.Minute)) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-time.After(time.Second):
+			return fmt.Errorf("write blocked while streaming")
+		}
+		if ts := p.Families[0].Metric[0].GetTimestampMs(); ts != now.UnixNano()/int64(time.Millisecond) {
+			return fmt.Errorf("want streamed families to be unchanged, got timestamp %d", ts)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed != 1 {
+		t.Fatalf("want 1 streamed partition, got %d", streamed)
+	}
+}
+
 type partitionedMetrics struct {
 	partitionKey     string
 	start            time.Time
@@ -0,0 +1,542 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/logging"
+	"github.com/openshift/telemeter/pkg/metricfamily"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+var (
+	rejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "telemeter_quota_rejections_total",
+		Help: "Tracks the number of uploads rejected because a quota was exceeded.",
+	}, []string{"scope"})
+)
+
+func init() {
+	prometheus.MustRegister(rejectionsTotal)
+}
+
+// Scopes to which quotas apply.
+const (
+	ScopeAccount   = "account"
+	ScopePartition = "partition"
+)
+
+// buckets is the number of buckets the window of a quota is divided into.
+// Usage expires one bucket at a time, so the window slides in steps of
+// window/buckets.
+const buckets = 24
+
+// Limits bounds the number of samples and bytes stored over the window of a quota.
+// Zero means no limit.
+type Limits struct {
+	Samples int64 `json:"samples"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// ExceededError is returned when a write would exceed a quota.
+type ExceededError struct {
+	Scope string
+	// RetryAfter is the time until enough usage has expired for a write to be accepted again.
+	RetryAfter time.Duration
+
+	msg string
+}
+
+func (e *ExceededError) Error() string {
+	if len(e.msg) == 0 {
+		return fmt.Sprintf("%s quota exceeded", e.Scope)
+	}
+	return e.msg
+}
+
+// RetryAfterDuration returns the time until the oldest usage expires.
+func (e *ExceededError) RetryAfterDuration() time.Duration { return e.RetryAfter }
+
+// Usage is the number of samples and bytes stored within the window of a quota.
+type Usage struct {
+	Samples int64 `json:"samples"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type bucket struct {
+	Start   int64 `json:"start"`
+	Samples int64 `json:"samples"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// counter tracks the usage of one account or partition in buckets, oldest first.
+type counter struct {
+	Buckets []bucket `json:"buckets"`
+}
+
+type state struct {
+	Accounts   map[string]*counter `json:"accounts"`
+	Partitions map[string]*counter `json:"partitions"`
+	// Gossiped is the usage of the writes accepted by this store, by account
+	// and partition key, as gossiped to the other members of a cluster.
+	Gossiped map[string]*counter `json:"gossiped,omitempty"`
+	// Observed is the usage gossiped by the other members of a cluster, by
+	// member, account and partition key, as counted in Accounts and Partitions.
+	Observed map[string]*counter `json:"observed,omitempty"`
+}
+
+// Gossiper shares the usage of the writes accepted by a store with the other
+// members of a cluster. The usage is the total of the bucket starting at the
+// given time, so a newer usage for the same bucket replaces an older one.
+type Gossiper interface {
+	GossipUsage(account, partitionKey string, samples, size int64, at time.Time)
+}
+
+// usageKey identifies the usage of an account and partition key, as gossiped
+// by a member.
+func usageKey(parts ...string) string {
+	return strings.Join(parts, "\x00")
+}
+
+type qstore struct {
+	logger    log.Logger
+	window    time.Duration
+	step      time.Duration
+	account   Limits
+	partition Limits
+	path      string
+	next      store.Store
+	gossiper  Gossiper
+
+	mu    sync.Mutex // protects fields below
+	state state
+}
+
+// New returns a store that wraps next and limits the number of samples and bytes
+// written to it per account and per partition key over a sliding window.
+// The account is the ID of the client authorized for the write; writes without
+// a client in their context are only limited per partition key.
+// The size of a write is the size of its families in the protobuf encoding,
+// before compression.
+// If path is not empty, usage is loaded from and persisted to that file,
+// so that it survives restarts.
+func New(logger log.Logger, window time.Duration, account, partition Limits, path string, next store.Store) (*qstore, error) {
+	step := window / buckets
+	if step < time.Second {
+		step = time.Second
+	}
+	s := &qstore{
+		logger:    log.With(logging.OrNop(logger), "component", "quota"),
+		window:    window,
+		step:      step,
+		account:   account,
+		partition: partition,
+		path:      path,
+		next:      next,
+		state: state{
+			Accounts:   make(map[string]*counter),
+			Partitions: make(map[string]*counter),
+			Gossiped:   make(map[string]*counter),
+			Observed:   make(map[string]*counter),
+		},
+	}
+	if len(path) == 0 {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read quota state: %v", err)
+	}
+	var loaded state
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("unable to parse quota state: %v", err)
+	}
+	for k, c := range loaded.Accounts {
+		s.state.Accounts[k] = c
+	}
+	for k, c := range loaded.Partitions {
+		s.state.Partitions[k] = c
+	}
+	for k, c := range loaded.Gossiped {
+		s.state.Gossiped[k] = c
+	}
+	for k, c := range loaded.Observed {
+		s.state.Observed[k] = c
+	}
+	s.expire(time.Now())
+	return s, nil
+}
+
+// GossipUsage shares the usage of every write accepted by this store through the
+// given gossiper. Along with ObserveUsage on the receiving end, this enforces
+// the quotas cluster-wide rather than per member, regardless of the member a
+// write enters on. It must be called before any write.
+func (s *qstore) GossipUsage(g Gossiper) {
+	s.gossiper = g
+}
+
+// ObserveUsage records the usage of the writes that were accepted by another
+// member of the cluster, so that it counts against the quotas of this store.
+// The usage is the total of the member for the bucket containing at, so only
+// the part of it that was not observed before is counted. Usage outside of the
+// window is ignored.
+func (s *qstore) ObserveUsage(member, account, partitionKey string, samples, size int64, at time.Time) {
+	if !at.After(time.Now().Add(-s.window)) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	observed := s.counter(s.state.Observed, usageKey(member, account, partitionKey)).total(at, s.step)
+	samples, size = samples-observed.Samples, size-observed.Bytes
+	if samples < 0 {
+		samples = 0
+	}
+	if size < 0 {
+		size = 0
+	}
+	if samples == 0 && size == 0 {
+		return
+	}
+	s.counter(s.state.Observed, usageKey(member, account, partitionKey)).add(at, s.step, samples, size)
+
+	if len(account) > 0 {
+		s.counter(s.state.Accounts, account).add(at, s.step, samples, size)
+	}
+	s.counter(s.state.Partitions, partitionKey).add(at, s.step, samples, size)
+}
+
+// StartPersister starts a goroutine, expiring old usage and persisting the
+// current usage at regular intervals specified by "interval".
+// The usage is persisted a last time when the given context is done.
+func (s *qstore) StartPersister(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s.expire(time.Now())
+				if err := s.persist(); err != nil {
+					level.Error(s.logger).Log("msg", "unable to persist quota usage", "err", err)
+				}
+			case <-ctx.Done():
+				ticker.Stop()
+				if err := s.persist(); err != nil {
+					level.Error(s.logger).Log("msg", "unable to persist quota usage", "err", err)
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (s *qstore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
+	return s.next.ReadMetrics(ctx, minTimestampMs)
+}
+
+func (s *qstore) StreamMetrics(ctx context.Context, minTimestampMs int64, fn func(*store.StreamedPartition) error) error {
+	return store.Stream(ctx, s.next, minTimestampMs, fn)
+}
+
+func (s *qstore) ListPartitions(ctx context.Context) ([]*store.PartitionInfo, error) {
+	return store.ListPartitions(ctx, s.next)
+}
+
+func (s *qstore) GetPartition(ctx context.Context, partitionKey string) (*store.PartitionedMetrics, error) {
+	return store.GetPartition(ctx, s.next, partitionKey)
+}
+
+func (s *qstore) DeletePartition(ctx context.Context, partitionKey string) (bool, error) {
+	return store.DeletePartition(ctx, s.next, partitionKey)
+}
+
+func (s *qstore) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
+	return s.writeMetrics(ctx, p, time.Now())
+}
+
+func (s *qstore) writeMetrics(ctx context.Context, p *store.PartitionedMetrics, now time.Time) error {
+	if p == nil {
+		return s.next.WriteMetrics(ctx, p)
+	}
+
+	var account string
+	if client, ok := authorize.FromContext(ctx); ok {
+		account = client.ID
+	}
+	samples := int64(metricfamily.MetricsCount(p.Families))
+	var size int64
+	for _, family := range p.Families {
+		if family != nil {
+			size += int64(proto.Size(family))
+		}
+	}
+
+	if err := s.reserve(account, p.PartitionKey, samples, size, now); err != nil {
+		return err
+	}
+	if err := s.next.WriteMetrics(ctx, p); err != nil {
+		// Only successful writes count against the quota.
+		s.release(account, p.PartitionKey, samples, size, now)
+		return err
+	}
+	if s.gossiper != nil {
+		s.gossip(account, p.PartitionKey, samples, size, now)
+	}
+	return nil
+}
+
+// gossip adds an accepted write to the usage of this store and gossips the
+// resulting total of its bucket.
+func (s *qstore) gossip(account, partitionKey string, samples, size int64, now time.Time) {
+	s.mu.Lock()
+	c := s.counter(s.state.Gossiped, usageKey(account, partitionKey))
+	c.add(now, s.step, samples, size)
+	total := c.total(now, s.step)
+	s.mu.Unlock()
+
+	s.gossiper.GossipUsage(account, partitionKey, total.Samples, total.Bytes, time.Unix(total.Start, 0))
+}
+
+// reserve checks that a write of the given size fits within the quotas of the
+// account and the partition and, if so, adds it to their usage.
+func (s *qstore) reserve(account, partitionKey string, samples, size int64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ac *counter
+	if len(account) > 0 {
+		ac = s.counter(s.state.Accounts, account)
+		ac.expire(now, s.window)
+		if err := s.check(ScopeAccount, ac, s.account, samples, size, now); err != nil {
+			return err
+		}
+	}
+	pc := s.counter(s.state.Partitions, partitionKey)
+	pc.expire(now, s.window)
+	if err := s.check(ScopePartition, pc, s.partition, samples, size, now); err != nil {
+		return err
+	}
+
+	if ac != nil {
+		ac.add(now, s.step, samples, size)
+	}
+	pc.add(now, s.step, samples, size)
+	return nil
+}
+
+// release removes a previously reserved write from the usage.
+func (s *qstore) release(account, partitionKey string, samples, size int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(account) > 0 {
+		s.counter(s.state.Accounts, account).add(now, s.step, -samples, -size)
+	}
+	s.counter(s.state.Partitions, partitionKey).add(now, s.step, -samples, -size)
+}
+
+// check returns an error if adding the given write to c would exceed the limits.
+// Expired buckets must have been removed from c.
+// The caller must hold the lock.
+func (s *qstore) check(scope string, c *counter, limits Limits, samples, size int64, now time.Time) error {
+	usage := c.usage(now, s.window)
+	var limit int64
+	var unit string
+	switch {
+	case limits.Samples > 0 && usage.Samples+samples > limits.Samples:
+		limit, unit = limits.Samples, "samples"
+	case limits.Bytes > 0 && usage.Bytes+size > limits.Bytes:
+		limit, unit = limits.Bytes, "bytes"
+	default:
+		return nil
+	}
+
+	rejectionsTotal.WithLabelValues(scope).Inc()
+	retryAfter := s.step
+	if len(c.Buckets) > 0 {
+		if d := time.Unix(c.Buckets[0].Start, 0).Add(s.window).Sub(now); d > 0 {
+			retryAfter = d
+		}
+	}
+	return &ExceededError{
+		Scope:      scope,
+		RetryAfter: retryAfter,
+		msg:        fmt.Sprintf("%s quota of %d %s per %s exceeded", scope, limit, unit, s.window),
+	}
+}
+
+// counter returns the counter for key, creating it if needed.
+// The caller must hold the lock.
+func (s *qstore) counter(counters map[string]*counter, key string) *counter {
+	c, ok := counters[key]
+	if !ok {
+		c = &counter{}
+		counters[key] = c
+	}
+	return c
+}
+
+// expire removes the usage that is outside of the window, and the counters
+// without any remaining usage.
+func (s *qstore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, counters := range []map[string]*counter{s.state.Accounts, s.state.Partitions, s.state.Gossiped, s.state.Observed} {
+		for key, c := range counters {
+			c.expire(now, s.window)
+			if len(c.Buckets) == 0 {
+				delete(counters, key)
+			}
+		}
+	}
+}
+
+// persist atomically writes the current usage to the state file.
+func (s *qstore) persist() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	data, err := json.Marshal(s.state)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// ServeHTTP reports the current usage and limits as JSON. The account and
+// partition query parameters restrict the report to a single account or partition.
+func (s *qstore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := struct {
+		Window     string            `json:"window"`
+		Limits     map[string]Limits `json:"limits"`
+		Accounts   map[string]Usage  `json:"accounts"`
+		Partitions map[string]Usage  `json:"partitions"`
+	}{
+		Window:     s.window.String(),
+		Limits:     map[string]Limits{ScopeAccount: s.account, ScopePartition: s.partition},
+		Accounts:   make(map[string]Usage),
+		Partitions: make(map[string]Usage),
+	}
+
+	now := time.Now()
+	account, partition := req.URL.Query().Get("account"), req.URL.Query().Get("partition")
+	s.mu.Lock()
+	for key, c := range s.state.Accounts {
+		if len(partition) == 0 && (len(account) == 0 || key == account) {
+			report.Accounts[key] = c.usage(now, s.window)
+		}
+	}
+	for key, c := range s.state.Partitions {
+		if len(account) == 0 && (len(partition) == 0 || key == partition) {
+			report.Partitions[key] = c.usage(now, s.window)
+		}
+	}
+	s.mu.Unlock()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		level.Error(s.logger).Log("msg", "unable to write quota usage", "err", err)
+	}
+}
+
+// usage returns the sum of the buckets within the window ending at now.
+func (c *counter) usage(now time.Time, window time.Duration) Usage {
+	min := now.Add(-window).Unix()
+	var u Usage
+	for _, b := range c.Buckets {
+		if b.Start <= min {
+			continue
+		}
+		u.Samples += b.Samples
+		u.Bytes += b.Bytes
+	}
+	return u
+}
+
+// add records usage in the bucket containing at, keeping the buckets ordered.
+// Usage is usually recorded now, but usage gossiped by other members may be
+// slightly older.
+func (c *counter) add(at time.Time, step time.Duration, samples, size int64) {
+	start := at.Truncate(step).Unix()
+	i := len(c.Buckets)
+	for i > 0 && c.Buckets[i-1].Start > start {
+		i--
+	}
+	if i > 0 && c.Buckets[i-1].Start == start {
+		c.Buckets[i-1].Samples += samples
+		c.Buckets[i-1].Bytes += size
+		return
+	}
+	c.Buckets = append(c.Buckets, bucket{})
+	copy(c.Buckets[i+1:], c.Buckets[i:])
+	c.Buckets[i] = bucket{Start: start, Samples: samples, Bytes: size}
+}
+
+// total returns the bucket containing at, or an empty one if there is none.
+func (c *counter) total(at time.Time, step time.Duration) bucket {
+	start := at.Truncate(step).Unix()
+	for _, b := range c.Buckets {
+		if b.Start == start {
+			return b
+		}
+	}
+	return bucket{Start: start}
+}
+
+// expire removes the buckets outside of the window ending at now.
+func (c *counter) expire(now time.Time, window time.Duration) {
+	min := now.Add(-window).Unix()
+	i := 0
+	for i < len(c.Buckets) && c.Buckets[i].Start <= min {
+		i++
+	}
+	c.Buckets = c.Buckets[i:]
+}
@@ -0,0 +1,242 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+type testStore struct {
+	err error
+}
+
+func (s *testStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
+	return nil, nil
+}
+
+func (s *testStore) WriteMetrics(context.Context, *store.PartitionedMetrics) error {
+	return s.err
+}
+
+func metrics(partitionKey string, samples int) *store.PartitionedMetrics {
+	name := "test"
+	family := &clientmodel.MetricFamily{Name: &name, Type: clientmodel.MetricType_GAUGE.Enum()}
+	for i := 0; i < samples; i++ {
+		value := float64(i)
+		family.Metric = append(family.Metric, &clientmodel.Metric{Gauge: &clientmodel.Gauge{Value: &value}})
+	}
+	return &store.PartitionedMetrics{PartitionKey: partitionKey, Families: []*clientmodel.MetricFamily{family}}
+}
+
+func withAccount(account string) context.Context {
+	return authorize.WithClient(context.Background(), &authorize.Client{ID: account})
+}
+
+func TestWriteMetrics(t *testing.T) {
+	next := &testStore{}
+	s, err := New(nil, time.Hour, Limits{Samples: 10}, Limits{Samples: 6}, "", next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0).Add(24 * time.Hour)
+
+	for _, tc := range []struct {
+		name          string
+		advance       time.Duration
+		ctx           context.Context
+		metrics       *store.PartitionedMetrics
+		next          error
+		expectedScope string
+		expectedErr   error
+	}{
+		{
+			name:    "write of nil metric is silently dropped",
+			ctx:     withAccount("a"),
+			metrics: nil,
+		},
+		{
+			name:    "write within quota succeeds",
+			ctx:     withAccount("a"),
+			metrics: metrics("1", 5),
+		},
+		{
+			name:          "write exceeding partition quota fails",
+			ctx:           withAccount("a"),
+			metrics:       metrics("1", 2),
+			expectedScope: ScopePartition,
+		},
+		{
+			name:    "write for another partition of the account succeeds",
+			advance: time.Minute,
+			ctx:     withAccount("a"),
+			metrics: metrics("2", 5),
+		},
+		{
+			name:          "write exceeding account quota fails",
+			ctx:           withAccount("a"),
+			metrics:       metrics("3", 1),
+			expectedScope: ScopeAccount,
+		},
+		{
+			name:    "write without account is only limited per partition",
+			ctx:     context.Background(),
+			metrics: metrics("3", 6),
+		},
+		{
+			name:        "failed write does not count against the quota",
+			ctx:         withAccount("b"),
+			metrics:     metrics("4", 6),
+			next:        errors.New("failed"),
+			expectedErr: errors.New("failed"),
+		},
+		{
+			name:    "write after failed write succeeds",
+			ctx:     withAccount("b"),
+			metrics: metrics("4", 6),
+		},
+		{
+			name:    "write after usage slid out of the window succeeds",
+			advance: time.Hour,
+			ctx:     withAccount("a"),
+			metrics: metrics("1", 6),
+		},
+		{
+			name:          "usage within the window still counts",
+			ctx:           withAccount("a"),
+			metrics:       metrics("2", 6),
+			expectedScope: ScopeAccount,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+			next.err = tc.next
+
+			err := s.writeMetrics(tc.ctx, tc.metrics, now)
+			if qerr, ok := err.(*ExceededError); ok {
+				if qerr.Scope != tc.expectedScope {
+					t.Errorf("expected scope %q, got %q", tc.expectedScope, qerr.Scope)
+				}
+				if qerr.RetryAfter <= 0 || qerr.RetryAfter > time.Hour {
+					t.Errorf("unexpected retry after %s", qerr.RetryAfter)
+				}
+				return
+			}
+			if len(tc.expectedScope) > 0 {
+				t.Fatalf("expected quota of %s to be exceeded, got %v", tc.expectedScope, err)
+			}
+			if (err == nil) != (tc.expectedErr == nil) {
+				t.Errorf("expected err %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	now := time.Now()
+	s, err := New(nil, time.Hour, Limits{Bytes: 1024}, Limits{}, path, &testStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeMetrics(withAccount("a"), metrics("1", 3), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = New(nil, time.Hour, Limits{Bytes: 1024}, Limits{}, path, &testStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/quota?account=a", nil))
+
+	var report struct {
+		Accounts   map[string]Usage
+		Partitions map[string]Usage
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("unable to parse usage %q: %v", rec.Body.String(), err)
+	}
+	if u := report.Accounts["a"]; u.Samples != 3 || u.Bytes == 0 {
+		t.Errorf("expected usage of account a to be restored, got %+v", report.Accounts)
+	}
+	if len(report.Partitions) != 0 {
+		t.Errorf("expected only the usage of account a, got %+v", report.Partitions)
+	}
+}
+
+type testGossiper struct {
+	to *qstore
+}
+
+func (g *testGossiper) GossipUsage(account, partitionKey string, samples, size int64, at time.Time) {
+	// Gossip may be delivered more than once.
+	g.to.ObserveUsage("local", account, partitionKey, samples, size, at)
+	g.to.ObserveUsage("local", account, partitionKey, samples, size, at)
+}
+
+func TestGossipUsage(t *testing.T) {
+	local, err := New(nil, time.Hour, Limits{Samples: 10}, Limits{Samples: 6}, "", &testStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := New(nil, time.Hour, Limits{Samples: 10}, Limits{Samples: 6}, "", &testStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.GossipUsage(&testGossiper{to: remote})
+
+	now := time.Now()
+	if err := local.writeMetrics(withAccount("a"), metrics("1", 2), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.writeMetrics(withAccount("a"), metrics("1", 3), now); err != nil {
+		t.Fatal(err)
+	}
+	if u := remote.state.Partitions["1"].usage(now, time.Hour); u.Samples != 5 {
+		t.Fatalf("expected the gossiped usage to be counted once, got %d samples", u.Samples)
+	}
+	// A failed write is not gossiped.
+	local.next = &testStore{err: errors.New("failed")}
+	if err := local.writeMetrics(withAccount("a"), metrics("2", 5), now); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	if err := remote.writeMetrics(withAccount("a"), metrics("1", 2), now); err == nil {
+		t.Fatal("expected the partition quota to include the gossiped usage")
+	}
+	if err := remote.writeMetrics(withAccount("a"), metrics("2", 6), now); err == nil {
+		t.Fatal("expected the account quota to include the gossiped usage")
+	}
+	if err := remote.writeMetrics(withAccount("a"), metrics("2", 5), now); err != nil {
+		t.Fatalf("expected the write to fit the account quota, got %v", err)
+	}
+
+	// Usage gossiped late is recorded in order, and usage outside of the window is ignored.
+	remote.ObserveUsage("other", "b", "3", 1, 1, now.Add(-30*time.Minute))
+	remote.ObserveUsage("other", "b", "3", 1, 1, now.Add(-2*time.Hour))
+	c := remote.state.Accounts["b"]
+	remote.ObserveUsage("other", "b", "3", 2, 1, now.Add(-45*time.Minute))
+	if len(c.Buckets) != 2 || c.Buckets[0].Samples != 2 || c.Buckets[1].Samples != 1 {
+		t.Fatalf("expected the buckets in order, got %+v", c.Buckets)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/openshift/telemeter/pkg/store"
-	"golang.org/x/time/rate"
 )
 
 var ErrWriteLimitReached = errors.New("write limit reached")
@@ -16,8 +15,9 @@ type lstore struct {
 	limit time.Duration
 	next  store.Store
 
-	mu    sync.RWMutex // protects fields below
-	store map[string]*rate.Limiter
+	mu     sync.Mutex // protects fields below
+	store  map[string]time.Time
+	lastGC time.Time
 }
 
 // New returns a store that wraps next and limits writes to it.
@@ -26,7 +26,7 @@ func New(limit time.Duration, next store.Store) *lstore {
 	return &lstore{
 		limit: limit,
 		next:  next,
-		store: make(map[string]*rate.Limiter),
+		store: make(map[string]time.Time),
 	}
 }
 
@@ -34,6 +34,22 @@ func (s *lstore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*stor
 	return s.next.ReadMetrics(ctx, minTimestampMs)
 }
 
+func (s *lstore) StreamMetrics(ctx context.Context, minTimestampMs int64, fn func(*store.StreamedPartition) error) error {
+	return store.Stream(ctx, s.next, minTimestampMs, fn)
+}
+
+func (s *lstore) ListPartitions(ctx context.Context) ([]*store.PartitionInfo, error) {
+	return store.ListPartitions(ctx, s.next)
+}
+
+func (s *lstore) GetPartition(ctx context.Context, partitionKey string) (*store.PartitionedMetrics, error) {
+	return store.GetPartition(ctx, s.next, partitionKey)
+}
+
+func (s *lstore) DeletePartition(ctx context.Context, partitionKey string) (bool, error) {
+	return store.DeletePartition(ctx, s.next, partitionKey)
+}
+
 func (s *lstore) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
 	return s.writeMetrics(ctx, p, time.Now())
 }
@@ -43,22 +59,76 @@ func (s *lstore) writeMetrics(ctx context.Context, p *store.PartitionedMetrics,
 		return nil
 	}
 
-	if limiter := s.limiter(p.PartitionKey); !limiter.AllowN(now, 1) {
+	last, ok := s.allow(p.PartitionKey, now)
+	if !ok {
 		return ErrWriteLimitReached
 	}
 
-	return s.next.WriteMetrics(ctx, p)
+	err := s.next.WriteMetrics(ctx, p)
+	if err == store.ErrSequenceMismatch {
+		// The client is expected to write the partition in full right away,
+		// so a rejected delta does not count against the limit.
+		s.restore(p.PartitionKey, now, last)
+	}
+	return err
 }
 
-func (s *lstore) limiter(partitionKey string) *rate.Limiter {
+// ObserveWrite records a write for the given partition key that was accepted
+// elsewhere, such as by another member of the cluster, so that it counts against
+// the limit of this store. Observing the same write more than once has no effect.
+func (s *lstore) ObserveWrite(partitionKey string, at time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	limiter, ok := s.store[partitionKey]
-	if !ok {
-		limiter = rate.NewLimiter(rate.Every(s.limit), 1)
-		s.store[partitionKey] = limiter
+	if last, ok := s.store[partitionKey]; !ok || at.After(last) {
+		s.store[partitionKey] = at
+	}
+}
+
+// allow records a write for the given partition key and returns true
+// if the last write was at least the limit ago, along with the time of
+// the last write, if any.
+func (s *lstore) allow(partitionKey string, now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gc(now)
+
+	last, ok := s.store[partitionKey]
+	if ok && now.Sub(last) < s.limit {
+		return last, false
+	}
+	s.store[partitionKey] = now
+	return last, true
+}
+
+// restore reverts the write recorded at now for the given partition key to
+// the given last write, unless another write was recorded since.
+func (s *lstore) restore(partitionKey string, now, last time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.store[partitionKey].Equal(now) {
+		return
+	}
+	if last.IsZero() {
+		delete(s.store, partitionKey)
+		return
 	}
+	s.store[partitionKey] = last
+}
 
-	return limiter
+// gc removes the partition keys whose last write is older than the limit,
+// at most once per limit interval.
+// The caller must hold the lock.
+func (s *lstore) gc(now time.Time) {
+	if now.Sub(s.lastGC) < s.limit {
+		return
+	}
+	s.lastGC = now
+	for partitionKey, last := range s.store {
+		if now.Sub(last) >= s.limit {
+			delete(s.store, partitionKey)
+		}
+	}
 }
@@ -14,7 +14,10 @@ func (s *testStore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*s
 	return nil, nil
 }
 
-func (s *testStore) WriteMetrics(context.Context, *store.PartitionedMetrics) error {
+func (s *testStore) WriteMetrics(_ context.Context, p *store.PartitionedMetrics) error {
+	if p.Delta != nil {
+		return store.ErrSequenceMismatch
+	}
 	return nil
 }
 
@@ -28,6 +31,7 @@ func TestWriteMetrics(t *testing.T) {
 	for _, tc := range []struct {
 		name        string
 		advance     time.Duration
+		observe     string
 		expectedErr error
 		metrics     *store.PartitionedMetrics
 	}{
@@ -79,9 +83,43 @@ func TestWriteMetrics(t *testing.T) {
 			metrics:     &store.PartitionedMetrics{PartitionKey: "b"},
 			expectedErr: nil,
 		},
+		{
+			name:        "write after a write observed elsewhere fails",
+			advance:     time.Minute,
+			observe:     "a",
+			metrics:     &store.PartitionedMetrics{PartitionKey: "a"},
+			expectedErr: ErrWriteLimitReached,
+		},
+		{
+			name:        "write a minute after a write observed elsewhere succeeds",
+			advance:     time.Minute,
+			metrics:     &store.PartitionedMetrics{PartitionKey: "a"},
+			expectedErr: nil,
+		},
+		{
+			name:        "rejected delta write fails",
+			advance:     time.Minute,
+			metrics:     &store.PartitionedMetrics{PartitionKey: "a", Delta: &store.Delta{BaseSequence: 1}},
+			expectedErr: store.ErrSequenceMismatch,
+		},
+		{
+			name:        "write right after a rejected delta write succeeds",
+			advance:     time.Second,
+			metrics:     &store.PartitionedMetrics{PartitionKey: "a"},
+			expectedErr: nil,
+		},
+		{
+			name:        "write after 1 second fails again",
+			advance:     time.Second,
+			metrics:     &store.PartitionedMetrics{PartitionKey: "a"},
+			expectedErr: ErrWriteLimitReached,
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			now = now.Add(tc.advance)
+			if len(tc.observe) > 0 {
+				s.ObserveWrite(tc.observe, now.Add(-time.Second))
+			}
 
 			if got := s.writeMetrics(ctx, tc.metrics, now); got != tc.expectedErr {
 				t.Errorf("expected err %v, got %v", tc.expectedErr, got)
@@ -89,3 +127,23 @@ func TestWriteMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestGC(t *testing.T) {
+	s := New(time.Minute, &testStore{})
+	now := time.Time{}.Add(time.Hour)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.writeMetrics(context.Background(), &store.PartitionedMetrics{PartitionKey: key}, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.ObserveWrite("a", now.Add(30*time.Second))
+
+	now = now.Add(time.Minute)
+	if err := s.writeMetrics(context.Background(), &store.PartitionedMetrics{PartitionKey: "d"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.store["b"]; ok || len(s.store) != 2 {
+		t.Errorf("expected only the limiters of a and d to remain, got %v", s.store)
+	}
+}
@@ -0,0 +1,229 @@
+// Package staleness detects partitions that stopped uploading at their usual
+// cadence while their metrics are still stored, and serves synthetic series
+// for them alongside the stored metrics.
+package staleness
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+)
+
+const (
+	// LastSeenName is the name of the series holding the time of the last
+	// write of a silent partition, in seconds since the epoch.
+	LastSeenName = "telemeter_cluster_last_seen_timestamp"
+	// SilentName is the name of the series marking a silent partition.
+	SilentName = "telemeter_cluster_silent"
+
+	// minIntervals is the number of intervals between writes that must be
+	// observed before a partition is considered to upload regularly.
+	minIntervals = 2
+)
+
+// Config describes after how many missed intervals a partition is silent.
+type Config struct {
+	// MissedIntervals is the number of expected intervals without a write
+	// after which a partition is silent. Zero disables detection.
+	MissedIntervals int
+	// AccountMissedIntervals overrides MissedIntervals for the partitions
+	// written by the given accounts.
+	AccountMissedIntervals map[string]int
+	// TTL is how long the wrapped store keeps a partition after its last
+	// write. Partitions that were not written for longer are forgotten. Zero
+	// keeps them until they are deleted.
+	TTL time.Duration
+}
+
+// missedIntervals returns the number of missed intervals after which the
+// partitions of the given account are silent.
+func (c Config) missedIntervals(account string) int {
+	if n, ok := c.AccountMissedIntervals[account]; ok {
+		return n
+	}
+	return c.MissedIntervals
+}
+
+// partition tracks the cadence of the writes of a partition.
+type partition struct {
+	account   string
+	lastWrite time.Time
+	// interval is the moving average of the intervals between writes.
+	interval  time.Duration
+	intervals int
+}
+
+type sstore struct {
+	label  string
+	config Config
+	next   store.Store
+	nowFn  func() time.Time
+
+	mu         sync.Mutex // protects fields below
+	partitions map[string]*partition
+}
+
+// New returns a store that wraps next and learns the interval between the
+// writes of every partition. Partitions that are still stored by next but
+// missed the configured number of intervals are streamed with a synthetic
+// partition holding the LastSeenName and SilentName series, labeled with the
+// partition key under the given label.
+//
+// The account of a write is the ID of the client authorized for it.
+func New(label string, config Config, next store.Store) *sstore {
+	return &sstore{
+		label:      label,
+		config:     config,
+		next:       next,
+		nowFn:      time.Now,
+		partitions: make(map[string]*partition),
+	}
+}
+
+func (s *sstore) WriteMetrics(ctx context.Context, p *store.PartitionedMetrics) error {
+	if err := s.next.WriteMetrics(ctx, p); err != nil || p == nil {
+		return err
+	}
+	var account string
+	if client, ok := authorize.FromContext(ctx); ok {
+		account = client.ID
+	}
+	s.observe(p.PartitionKey, account, s.nowFn())
+	return nil
+}
+
+// observe records a write of the given partition by the given account.
+func (s *sstore) observe(partitionKey, account string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.partitions[partitionKey]
+	if !ok {
+		s.partitions[partitionKey] = &partition{account: account, lastWrite: now}
+		return
+	}
+	if len(account) > 0 {
+		t.account = account
+	}
+	d := now.Sub(t.lastWrite)
+	t.lastWrite = now
+	if d <= 0 {
+		return
+	}
+	if t.intervals == 0 {
+		t.interval = d
+	} else {
+		t.interval += (d - t.interval) / 4
+	}
+	t.intervals++
+}
+
+// silent returns the synthetic partitions of the partitions read from next
+// that missed their configured number of intervals, and forgets the partitions
+// that expired. Only the partitions that were read are served as silent, so
+// that partitions next no longer stores are not, without listing them.
+func (s *sstore) silent(read map[string]struct{}) []*store.PartitionedMetrics {
+	now := s.nowFn()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var silent []*store.PartitionedMetrics
+	for partitionKey, t := range s.partitions {
+		if s.config.TTL > 0 && now.Sub(t.lastWrite) > s.config.TTL {
+			delete(s.partitions, partitionKey)
+			continue
+		}
+		if _, ok := read[partitionKey]; !ok {
+			continue
+		}
+		missed := s.config.missedIntervals(t.account)
+		if missed <= 0 || t.intervals < minIntervals || now.Sub(t.lastWrite) <= time.Duration(missed)*t.interval {
+			continue
+		}
+		silent = append(silent, &store.PartitionedMetrics{
+			PartitionKey: partitionKey,
+			Families:     s.families(partitionKey, t.lastWrite, now),
+		})
+	}
+	return silent
+}
+
+// families returns the synthetic series of a silent partition.
+func (s *sstore) families(partitionKey string, lastWrite, now time.Time) []*clientmodel.MetricFamily {
+	timestampMs := now.UnixNano() / int64(time.Millisecond)
+	gauge := func(name, help string, value float64) *clientmodel.MetricFamily {
+		return &clientmodel.MetricFamily{
+			Name: proto.String(name),
+			Help: proto.String(help),
+			Type: clientmodel.MetricType_GAUGE.Enum(),
+			Metric: []*clientmodel.Metric{{
+				Label:       []*clientmodel.LabelPair{{Name: proto.String(s.label), Value: proto.String(partitionKey)}},
+				Gauge:       &clientmodel.Gauge{Value: proto.Float64(value)},
+				TimestampMs: proto.Int64(timestampMs),
+			}},
+		}
+	}
+	return []*clientmodel.MetricFamily{
+		gauge(LastSeenName, "The time of the last upload of a cluster that stopped uploading, in seconds since the epoch.", float64(lastWrite.UnixNano())/1e9),
+		gauge(SilentName, "Whether a cluster stopped uploading at its usual interval.", 1),
+	}
+}
+
+func (s *sstore) ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*store.PartitionedMetrics, error) {
+	ps, err := s.next.ReadMetrics(ctx, minTimestampMs)
+	if err != nil {
+		return nil, err
+	}
+	read := make(map[string]struct{}, len(ps))
+	for _, p := range ps {
+		read[p.PartitionKey] = struct{}{}
+	}
+	return append(ps, s.silent(read)...), nil
+}
+
+func (s *sstore) StreamMetrics(ctx context.Context, minTimestampMs int64, fn func(*store.StreamedPartition) error) error {
+	read := make(map[string]struct{})
+	err := store.Stream(ctx, s.next, minTimestampMs, func(p *store.StreamedPartition) error {
+		read[p.PartitionKey] = struct{}{}
+		return fn(p)
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range s.silent(read) {
+		timestampMs := p.Families[0].Metric[0].GetTimestampMs()
+		if err := fn(&store.StreamedPartition{
+			PartitionKey:      p.PartitionKey,
+			Families:          p.Families,
+			OldestTimestampMs: timestampMs,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sstore) ListPartitions(ctx context.Context) ([]*store.PartitionInfo, error) {
+	return store.ListPartitions(ctx, s.next)
+}
+
+func (s *sstore) GetPartition(ctx context.Context, partitionKey string) (*store.PartitionedMetrics, error) {
+	return store.GetPartition(ctx, s.next, partitionKey)
+}
+
+func (s *sstore) DeletePartition(ctx context.Context, partitionKey string) (bool, error) {
+	deleted, err := store.DeletePartition(ctx, s.next, partitionKey)
+	if err == nil {
+		s.mu.Lock()
+		delete(s.partitions, partitionKey)
+		s.mu.Unlock()
+	}
+	return deleted, err
+}
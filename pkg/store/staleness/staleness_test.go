@@ -0,0 +1,93 @@
+package staleness
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	clientmodel "github.com/prometheus/client_model/go"
+
+	"github.com/openshift/telemeter/pkg/authorize"
+	"github.com/openshift/telemeter/pkg/store"
+	"github.com/openshift/telemeter/pkg/store/memstore"
+)
+
+func TestSilent(t *testing.T) {
+	families := []*clientmodel.MetricFamily{{
+		Name:   proto.String("up"),
+		Type:   clientmodel.MetricType_GAUGE.Enum(),
+		Metric: []*clientmodel.Metric{{Gauge: &clientmodel.Gauge{Value: proto.Float64(1)}, TimestampMs: proto.Int64(1)}},
+	}}
+	now := time.Unix(1000, 0)
+	ms := memstore.New(time.Hour)
+	s := New("_id", Config{MissedIntervals: 3, AccountMissedIntervals: map[string]int{"patient": 10}, TTL: time.Hour}, ms)
+	s.nowFn = func() time.Time { return now }
+
+	write := func(partitionKey, account string) {
+		ctx := authorize.WithClient(context.Background(), &authorize.Client{ID: account})
+		if err := s.WriteMetrics(ctx, &store.PartitionedMetrics{PartitionKey: partitionKey, Families: families}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	silent := func() map[string]float64 {
+		lastSeen := make(map[string]float64)
+		err := s.StreamMetrics(context.Background(), 0, func(p *store.StreamedPartition) error {
+			for _, family := range p.Families {
+				if family.GetName() == LastSeenName {
+					lastSeen[p.PartitionKey] = family.Metric[0].GetGauge().GetValue()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lastSeen
+	}
+
+	// Every partition uploads three times, a minute apart.
+	for i := 0; i < 3; i++ {
+		write("regular", "a")
+		write("patient", "patient")
+		write("deleted", "a")
+		now = now.Add(time.Minute)
+	}
+	write("new", "a")
+	if got := silent(); len(got) != 0 {
+		t.Fatalf("expected no silent partitions, got %v", got)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if _, err := s.DeletePartition(context.Background(), "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	got := silent()
+	if len(got) != 1 || got["regular"] != 1120 {
+		t.Fatalf("expected only partition regular to be silent since 1120, got %v", got)
+	}
+
+	write("regular", "a")
+	if got := silent(); len(got) != 0 {
+		t.Fatalf("expected no silent partitions after an upload, got %v", got)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if got := silent(); len(got) != 2 {
+		t.Fatalf("expected partitions regular and patient to be silent, got %v", got)
+	}
+
+	// Partitions the wrapped store no longer holds are not served as silent.
+	if _, err := store.DeletePartition(context.Background(), ms, "patient"); err != nil {
+		t.Fatal(err)
+	}
+	if got := silent(); len(got) != 1 || got["regular"] == 0 {
+		t.Fatalf("expected only partition regular to be silent, got %v", got)
+	}
+
+	now = now.Add(time.Hour)
+	silent()
+	if n := len(s.partitions); n != 0 {
+		t.Errorf("expected expired partitions to be forgotten, got %d", n)
+	}
+}
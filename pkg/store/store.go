@@ -2,6 +2,12 @@ package store
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
 
 	clientmodel "github.com/prometheus/client_model/go"
 )
@@ -9,9 +15,216 @@ import (
 type PartitionedMetrics struct {
 	PartitionKey string
 	Families     []*clientmodel.MetricFamily
+	// Sequence is the sequence number of the upload the families were sent
+	// in, or zero if the uploads of the partition are not numbered.
+	Sequence uint64
+	// Delta is set if Families only holds the series that changed since a
+	// previous write of the partition.
+	Delta *Delta
 }
 
+// Delta describes a write that only holds the series that changed since the
+// write with the sequence number BaseSequence, as computed by metricfamily.Diff.
+type Delta struct {
+	BaseSequence uint64
+	// TimestampMs is the timestamp of the series that did not change.
+	TimestampMs int64
+}
+
+// ErrSequenceMismatch is returned for delta writes that do not apply to the
+// stored metrics of their partition. The partition must be written in full.
+var ErrSequenceMismatch = errors.New("the stored metrics of the partition do not match the base of the delta")
+
 type Store interface {
 	ReadMetrics(ctx context.Context, minTimestampMs int64) ([]*PartitionedMetrics, error)
 	WriteMetrics(context.Context, *PartitionedMetrics) error
 }
+
+// Streamer is implemented by stores that can pass their metrics to a function
+// without copying them.
+type Streamer interface {
+	// StreamMetrics calls fn for every partition with samples newer than minTimestampMs.
+	// The partition is only valid during the call and must not be modified.
+	StreamMetrics(ctx context.Context, minTimestampMs int64, fn func(*StreamedPartition) error) error
+}
+
+// StreamedPartition is a read-only view of the metrics of a partition.
+type StreamedPartition struct {
+	PartitionKey string
+	Families     []*clientmodel.MetricFamily
+	// OldestTimestampMs is the oldest timestamp of the samples in Families,
+	// or math.MinInt64 if it is unknown.
+	OldestTimestampMs int64
+	// Cache holds encodings of Families until the partition is written again.
+	// It is nil if the store does not cache encodings.
+	Cache *EncodingCache
+}
+
+// Stream calls fn for every partition of s with samples newer than minTimestampMs.
+// If s is not a Streamer, the partitions are read with ReadMetrics.
+func Stream(ctx context.Context, s Store, minTimestampMs int64, fn func(*StreamedPartition) error) error {
+	if streamer, ok := s.(Streamer); ok {
+		return streamer.StreamMetrics(ctx, minTimestampMs, fn)
+	}
+
+	ps, err := s.ReadMetrics(ctx, minTimestampMs)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if err := fn(&StreamedPartition{
+			PartitionKey:      p.PartitionKey,
+			Families:          p.Families,
+			OldestTimestampMs: math.MinInt64,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrNotSupported is returned for operations that a store does not implement.
+var ErrNotSupported = errors.New("not supported by the store")
+
+// NotOwnerError is returned when a partition is not stored locally and the
+// member of the cluster it belongs to could not be asked for it.
+type NotOwnerError struct {
+	PartitionKey string
+	Owner        string
+	Err          error
+}
+
+func (e *NotOwnerError) Error() string {
+	return fmt.Sprintf("partition %s is not stored on this member and could not be fetched from %s: %v", e.PartitionKey, e.Owner, e.Err)
+}
+
+// PartitionInfo summarizes a stored partition.
+type PartitionInfo struct {
+	PartitionKey string `json:"partitionKey"`
+	// LastWrite is the time the partition was last written, or zero if it is unknown.
+	LastWrite         time.Time `json:"lastWrite,omitempty"`
+	NewestTimestampMs int64     `json:"newestTimestampMs"`
+	Families          int       `json:"families"`
+	Series            int       `json:"series"`
+	// Owner is the name of the cluster member the partition belongs to, if any.
+	Owner string `json:"owner,omitempty"`
+}
+
+// Lister is implemented by stores that can list their partitions and read a
+// single partition.
+type Lister interface {
+	// ListPartitions returns a summary of every stored partition, sorted by key.
+	ListPartitions(ctx context.Context) ([]*PartitionInfo, error)
+	// GetPartition returns a copy of the metrics of the given partition,
+	// or nil if it is not stored.
+	GetPartition(ctx context.Context, partitionKey string) (*PartitionedMetrics, error)
+}
+
+// Deleter is implemented by stores that can delete a partition.
+type Deleter interface {
+	// DeletePartition removes the given partition and returns true if it was stored.
+	DeletePartition(ctx context.Context, partitionKey string) (bool, error)
+}
+
+// ListPartitions returns a summary of every partition of s, sorted by key.
+// If s is not a Lister, the partitions are read with ReadMetrics.
+func ListPartitions(ctx context.Context, s Store) ([]*PartitionInfo, error) {
+	if lister, ok := s.(Lister); ok {
+		return lister.ListPartitions(ctx)
+	}
+
+	ps, err := s.ReadMetrics(ctx, math.MinInt64)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*PartitionInfo, 0, len(ps))
+	for _, p := range ps {
+		infos = append(infos, Summarize(p.PartitionKey, p.Families))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].PartitionKey < infos[j].PartitionKey })
+	return infos, nil
+}
+
+// GetPartition returns the metrics of the given partition of s, or nil if it is
+// not stored. If s is not a Lister, the partitions are read with ReadMetrics.
+func GetPartition(ctx context.Context, s Store, partitionKey string) (*PartitionedMetrics, error) {
+	if lister, ok := s.(Lister); ok {
+		return lister.GetPartition(ctx, partitionKey)
+	}
+
+	ps, err := s.ReadMetrics(ctx, math.MinInt64)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ps {
+		if p.PartitionKey == partitionKey {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeletePartition removes the given partition from s and returns true if it was
+// stored. It returns ErrNotSupported if s is not a Deleter.
+func DeletePartition(ctx context.Context, s Store, partitionKey string) (bool, error) {
+	if deleter, ok := s.(Deleter); ok {
+		return deleter.DeletePartition(ctx, partitionKey)
+	}
+	return false, ErrNotSupported
+}
+
+// Summarize returns the summary of a partition holding the given families,
+// without its last write time.
+func Summarize(partitionKey string, families []*clientmodel.MetricFamily) *PartitionInfo {
+	info := &PartitionInfo{
+		PartitionKey:      partitionKey,
+		NewestTimestampMs: math.MinInt64,
+	}
+	for _, family := range families {
+		if family == nil {
+			continue
+		}
+		info.Families++
+		for _, m := range family.Metric {
+			if m == nil {
+				continue
+			}
+			info.Series++
+			if t := m.GetTimestampMs(); t > info.NewestTimestampMs {
+				info.NewestTimestampMs = t
+			}
+		}
+	}
+	return info
+}
+
+// EncodingCache holds encodings of the metrics of a partition by key, such as
+// the exposition format. It is safe for concurrent use, and a nil cache holds nothing.
+type EncodingCache struct {
+	mu        sync.Mutex
+	encodings map[string][]byte
+}
+
+// Get returns the encoding stored for key.
+func (c *EncodingCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.encodings[key]
+	return data, ok
+}
+
+// Set stores the encoding for key. The data must not be modified afterwards.
+func (c *EncodingCache) Set(key string, data []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.encodings == nil {
+		c.encodings = make(map[string][]byte)
+	}
+	c.encodings[key] = data
+}
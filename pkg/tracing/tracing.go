@@ -0,0 +1,163 @@
+// Package tracing traces uploads across the client, the servers and the members
+// of a cluster with OpenTelemetry. Spans are reported to the global tracer
+// provider, which discards them until an exporter is registered with Register.
+// The trace context is propagated in the W3C Trace Context format.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/openshift/telemeter/pkg/logging"
+)
+
+// instrumentation is the name of the tracer creating the spans of this package.
+const instrumentation = "github.com/openshift/telemeter/pkg/tracing"
+
+// defaultPath is the path the OTLP/HTTP protocol reports traces to.
+const defaultPath = "/v1/traces"
+
+// shutdownTimeout bounds the time to export the remaining spans on shutdown.
+const shutdownTimeout = 5 * time.Second
+
+// propagator carries the trace context across processes, regardless of
+// whether an exporter is registered.
+var propagator = propagation.TraceContext{}
+
+// Register sets the global tracer provider to one exporting the spans of the
+// given service over OTLP/HTTP to the collector at endpoint, such as
+// http://localhost:4318. The path defaults to /v1/traces. The given ratio of
+// traces, between 0 and 1, is sampled, unless the caller of a service decided
+// otherwise. The returned closer exports the spans not exported yet.
+func Register(logger log.Logger, service, endpoint string, ratio float64) (io.Closer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("the tracing endpoint %q must be an absolute URL", endpoint)
+	}
+	if len(u.Path) == 0 {
+		u.Path = defaultPath
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("the sample ratio must be between 0 and 1, got %v", ratio)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	logger = log.With(logging.OrNop(logger), "component", "tracing")
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		level.Error(logger).Log("msg", "unable to export traces", "err", err)
+	}))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return closerFunc(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	}), nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// StartSpan starts a span with the given operation name, as a child of the span
+// of ctx if there is one, and returns a context holding the new span.
+func StartSpan(ctx context.Context, operation string) (trace.Span, context.Context) {
+	ctx, span := tracer().Start(ctx, operation)
+	return span, ctx
+}
+
+// Finish ends the span, marking it as failed if err is not nil.
+func Finish(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectHTTP adds the trace context of ctx, if any, to the given headers.
+func InjectHTTP(ctx context.Context, h http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// Inject returns the trace context of ctx as a map, for transports other
+// than HTTP. It returns nil if ctx has no span.
+func Inject(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract starts a span with the given operation name as a child of the trace
+// context returned by Inject, or in a new trace if there is none. The returned
+// context holds the new span.
+func Extract(ctx context.Context, operation string, carrier map[string]string) (trace.Span, context.Context) {
+	if len(carrier) > 0 {
+		ctx = propagator.Extract(ctx, propagation.MapCarrier(carrier))
+	}
+	ctx, span := tracer().Start(ctx, operation, trace.WithSpanKind(trace.SpanKindConsumer))
+	return span, ctx
+}
+
+// Handler traces every request to next in a span with the given operation name,
+// continuing the trace of the client if its headers carry one.
+func Handler(operation string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer().Start(ctx, operation,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.URLPath(req.URL.Path),
+			),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, req.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// statusWriter records the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	// client
+	span, ctx := StartSpan(context.Background(), "send")
+	req := httptest.NewRequest("POST", "/upload", nil)
+	InjectHTTP(ctx, req.Header)
+	Finish(span, nil)
+	if len(req.Header.Get("traceparent")) == 0 {
+		t.Fatalf("expected the trace context in the W3C format, got %v", req.Header)
+	}
+
+	// server, forwarding to another member
+	var carrier map[string]string
+	handler := Handler("upload", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		span, ctx := StartSpan(req.Context(), "forward")
+		carrier = Inject(ctx)
+		Finish(span, errors.New("unable to forward"))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// other member
+	span, _ = Extract(context.Background(), "store", carrier)
+	Finish(span, nil)
+
+	ended := recorder.Ended()
+	if len(ended) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(ended))
+	}
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range ended {
+		spans[s.Name()] = s
+	}
+	for operation, parent := range map[string]string{"upload": "send", "forward": "upload", "store": "forward"} {
+		s, p := spans[operation], spans[parent]
+		if s == nil || p == nil {
+			t.Fatalf("expected the %s and %s spans, got %v", operation, parent, spans)
+		}
+		if s.SpanContext().TraceID() != spans["send"].SpanContext().TraceID() {
+			t.Errorf("expected span %s to be part of the trace", operation)
+		}
+		if s.Parent().SpanID() != p.SpanContext().SpanID() {
+			t.Errorf("expected span %s to follow span %s", operation, parent)
+		}
+	}
+	var code int64
+	for _, attr := range spans["upload"].Attributes() {
+		if attr.Key == semconv.HTTPResponseStatusCodeKey {
+			code = attr.Value.AsInt64()
+		}
+	}
+	if code != http.StatusTooManyRequests {
+		t.Errorf("expected the status code to be recorded, got %d", code)
+	}
+	if spans["forward"].Status().Code != codes.Error {
+		t.Errorf("expected the failed span to be marked as such")
+	}
+
+	// Without a span there is nothing to propagate.
+	if carrier := Inject(context.Background()); carrier != nil {
+		t.Errorf("expected no span context, got %v", carrier)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	if _, err := Register(nil, "test", "collector:4318", 1); err == nil {
+		t.Errorf("expected an error for a relative endpoint")
+	}
+	if _, err := Register(nil, "test", "http://collector:4318", 2); err == nil {
+		t.Errorf("expected an error for a ratio above 1")
+	}
+
+	type export struct {
+		path, contentType string
+	}
+	exported := make(chan export, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case exported <- export{path: req.URL.Path, contentType: req.Header.Get("Content-Type")}:
+		default:
+		}
+	}))
+	defer collector.Close()
+
+	closer, err := Register(nil, "test", collector.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span, _ := StartSpan(context.Background(), "test")
+	Finish(span, nil)
+	// Closing the provider exports the remaining spans.
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-exported:
+		if e.path != "/v1/traces" || e.contentType != "application/x-protobuf" {
+			t.Errorf("expected spans exported over OTLP/HTTP, got %+v", e)
+		}
+	default:
+		t.Fatalf("expected the span to be exported to the collector")
+	}
+}